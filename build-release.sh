@@ -16,9 +16,25 @@ if hash upx 2>/dev/null; then
 fi
 
 VERSION=`date -u +%Y%m%d`
-LDFLAGS="-X main.VERSION=$VERSION -s -w"
+LDFLAGS="-X github.com/xtaci/kcptun/generic.VERSION=$VERSION -s -w"
 GCFLAGS=""
 
+# build builds the combined binary for $1, GOOS and GOARCH in the rest,
+# and links it as the client_ and server_ binaries of the releases before,
+# or copies it for windows, whose archive tools don't all keep hard links
+build() {
+	out=$1
+	shift
+	env CGO_ENABLED=0 "$@" go build -ldflags "$LDFLAGS" -gcflags "$GCFLAGS" -o kcptun_$out github.com/xtaci/kcptun
+	if $UPX; then upx -9 kcptun_$out;fi
+	link="ln -f"
+	if [[ "$out" == windows_* ]]; then
+		link="cp -f"
+	fi
+	$link kcptun_$out client_$out
+	$link kcptun_$out server_$out
+}
+
 OSES=(linux darwin windows freebsd)
 ARCHS=(amd64 386)
 for os in ${OSES[@]}; do
@@ -28,10 +44,8 @@ for os in ${OSES[@]}; do
 		then
 			suffix=".exe"
 		fi
-		env CGO_ENABLED=0 GOOS=$os GOARCH=$arch go build -ldflags "$LDFLAGS" -gcflags "$GCFLAGS" -o client_${os}_${arch}${suffix} github.com/xtaci/kcptun/client
-		env CGO_ENABLED=0 GOOS=$os GOARCH=$arch go build -ldflags "$LDFLAGS" -gcflags "$GCFLAGS" -o server_${os}_${arch}${suffix} github.com/xtaci/kcptun/server
-		if $UPX; then upx -9 client_${os}_${arch}${suffix} server_${os}_${arch}${suffix};fi
-		tar -zcf kcptun-${os}-${arch}-$VERSION.tar.gz client_${os}_${arch}${suffix} server_${os}_${arch}${suffix}
+		build ${os}_${arch}${suffix} GOOS=$os GOARCH=$arch
+		tar -zcf kcptun-${os}-${arch}-$VERSION.tar.gz kcptun_${os}_${arch}${suffix} client_${os}_${arch}${suffix} server_${os}_${arch}${suffix}
 		$sum kcptun-${os}-${arch}-$VERSION.tar.gz
 	done
 done
@@ -39,21 +53,16 @@ done
 # ARM
 ARMS=(5 6 7)
 for v in ${ARMS[@]}; do
-	env CGO_ENABLED=0 GOOS=linux GOARCH=arm GOARM=$v go build -ldflags "$LDFLAGS" -gcflags "$GCFLAGS" -o client_linux_arm$v  github.com/xtaci/kcptun/client
-	env CGO_ENABLED=0 GOOS=linux GOARCH=arm GOARM=$v go build -ldflags "$LDFLAGS" -gcflags "$GCFLAGS" -o server_linux_arm$v  github.com/xtaci/kcptun/server
+	build linux_arm$v GOOS=linux GOARCH=arm GOARM=$v
 done
-if $UPX; then upx -9 client_linux_arm* server_linux_arm*;fi
-tar -zcf kcptun-linux-arm-$VERSION.tar.gz client_linux_arm* server_linux_arm*
+tar -zcf kcptun-linux-arm-$VERSION.tar.gz kcptun_linux_arm* client_linux_arm* server_linux_arm*
 $sum kcptun-linux-arm-$VERSION.tar.gz
 
 #MIPS32LE
-env CGO_ENABLED=0 GOOS=linux GOARCH=mipsle go build -ldflags "$LDFLAGS" -gcflags "$GCFLAGS" -o client_linux_mipsle github.com/xtaci/kcptun/client
-env CGO_ENABLED=0 GOOS=linux GOARCH=mipsle go build -ldflags "$LDFLAGS" -gcflags "$GCFLAGS" -o server_linux_mipsle github.com/xtaci/kcptun/server
-env CGO_ENABLED=0 GOOS=linux GOARCH=mips go build -ldflags "$LDFLAGS" -gcflags "$GCFLAGS" -o client_linux_mips github.com/xtaci/kcptun/client
-env CGO_ENABLED=0 GOOS=linux GOARCH=mips go build -ldflags "$LDFLAGS" -gcflags "$GCFLAGS" -o server_linux_mips github.com/xtaci/kcptun/server
-
-if $UPX; then upx -9 client_linux_mips* server_linux_mips*;fi
-tar -zcf kcptun-linux-mipsle-$VERSION.tar.gz client_linux_mipsle server_linux_mipsle
-tar -zcf kcptun-linux-mips-$VERSION.tar.gz client_linux_mips server_linux_mips
+build linux_mipsle GOOS=linux GOARCH=mipsle
+build linux_mips GOOS=linux GOARCH=mips
+
+tar -zcf kcptun-linux-mipsle-$VERSION.tar.gz kcptun_linux_mipsle client_linux_mipsle server_linux_mipsle
+tar -zcf kcptun-linux-mips-$VERSION.tar.gz kcptun_linux_mips client_linux_mips server_linux_mips
 $sum kcptun-linux-mipsle-$VERSION.tar.gz
 $sum kcptun-linux-mips-$VERSION.tar.gz
@@ -0,0 +1,36 @@
+package client
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// serverBusyBackoff is how long after a server refused a session as busy,
+// being at its --maxsessions, the client refuses the local connections
+// needing a new session at once, rather than holding them until one comes
+// up, and waits before asking the server again
+const serverBusyBackoff = 5 * time.Second
+
+// busyUntil is when the backoff of the last busy refusal ends, in unix
+// nanoseconds
+var busyUntil int64
+
+// markBusy starts the backoff of a busy refusal
+func markBusy() {
+	atomic.StoreInt64(&busyUntil, time.Now().Add(serverBusyBackoff).UnixNano())
+}
+
+// isBusy reports whether the server refused a session as busy lately
+func isBusy() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&busyUntil)
+}
+
+// refuseBusy resets p1, so the application fails at once with "connection
+// reset" as on a refused stream
+func refuseBusy(p1 net.Conn) {
+	if conn, ok := p1.(*net.TCPConn); ok {
+		conn.SetLinger(0)
+	}
+	p1.Close()
+}
@@ -0,0 +1,328 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+	"github.com/xtaci/kcptun/generic"
+	"github.com/xtaci/smux"
+)
+
+var checkCommand = cli.Command{
+	Name:  "check",
+	Usage: "validate the configuration and print the effective settings, no socket is opened",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Value:  "",
+			Usage:  "json config file to check, same as the global -c",
+			EnvVar: "KCPTUN_CHECK_CONFIG",
+		},
+		cli.IntFlag{
+			Name:   "rtt",
+			Value:  200,
+			Usage:  "expected round trip time to the server in ms, used to size the windows",
+			EnvVar: "KCPTUN_CHECK_RTT",
+		},
+		cli.IntFlag{
+			Name:   "bandwidth",
+			Value:  50,
+			Usage:  "expected downlink bandwidth in Mbit/s, used to size the windows",
+			EnvVar: "KCPTUN_CHECK_BANDWIDTH",
+		},
+		cli.BoolFlag{
+			Name:   "json",
+			Usage:  "print the effective settings and the findings as one JSON object",
+			EnvVar: "KCPTUN_CHECK_JSON",
+		},
+	},
+	Action: check,
+}
+
+func check(c *cli.Context) error {
+	if path := c.String("config"); path != "" {
+		c.Parent().Set("c", path)
+	}
+	config := loadConfig(c.Parent())
+	rtt := time.Duration(c.Int("rtt")) * time.Millisecond
+
+	var r generic.Report
+	r.CheckAddr("localaddr", config.LocalAddr)
+	if config.Stdio && config.Transport == "quic" {
+		r.Errorf("stdio: not supported over quic")
+	}
+	if kind := generic.TunnelKind(config.Tun, config.Tap); kind != "" {
+		switch {
+		case config.Tun != "" && config.Tap != "":
+			r.Errorf("tun, tap: pick one")
+		case config.Stdio:
+			r.Errorf("%v: can't relay stdio at the same time", kind)
+		case config.Transport == "quic":
+			r.Errorf("%v: not supported over quic", kind)
+		case config.NoHello:
+			r.Errorf("%v: needs the hello exchange, drop nohello", kind)
+		}
+	}
+	if config.StreamComp && config.NoHello {
+		r.Errorf("streamcomp: needs the hello exchange, drop nohello")
+	}
+	switch {
+	case config.Telemetry < 0:
+		r.Errorf("telemetry: must not be negative")
+	case config.Telemetry > 0 && config.NoHello:
+		r.Errorf("telemetry: needs the hello exchange, drop nohello")
+	case config.Telemetry > 0 && config.Transport == "quic":
+		r.Warnf("telemetry: not available over quic")
+	}
+	if _, err := generic.ParseFrameFilter(config.TapFilter); err != nil {
+		r.Errorf("%v", err)
+	} else if config.TapFilter != "" && config.Tap == "" {
+		r.Warnf("tapfilter: only applies with tap")
+	}
+	if config.TCPKeepAlive < 0 || config.TCPLinger < -1 {
+		r.Errorf("tcp-keepalive, tcp-linger: out of range")
+	}
+	if config.Interactive != "" {
+		r.CheckAddr("interactive", config.Interactive)
+		if config.Transport == "quic" {
+			r.Warnf("interactive: quic streams are independent already, the address is ignored")
+		}
+	}
+	servers := splitRemotes(config.RemoteAddr)
+	if len(servers) == 0 {
+		r.CheckAddr("remoteaddr", config.RemoteAddr)
+	}
+	for _, server := range servers {
+		if server == "auto" && len(servers) > 1 {
+			r.Errorf("remoteaddr: auto, to find the servers on the local network, goes alone")
+		} else if isSRVName(server) && len(servers) > 1 {
+			r.Errorf("remoteaddr: %v, a domain to look up the SRV records of, goes alone", server)
+		} else if server != "auto" && !isSRVName(server) {
+			r.CheckAddr("remoteaddr", server)
+		}
+	}
+	if len(servers) > 1 && config.Peer != "" {
+		r.Errorf("remoteaddr: a list of servers doesn't go with peer, which needs a single introducer")
+	}
+	if (len(servers) > 1 || len(servers) == 1 && (isSRVName(servers[0]) || servers[0] == "auto")) && config.SelectInterval < 0 {
+		r.Errorf("selectinterval: %v is negative", config.SelectInterval)
+	}
+	if config.State != "" && config.NoHello && len(servers) < 2 {
+		r.Warnf("state: nothing to keep without the hello and a single server")
+	}
+	switch config.Transport {
+	case "udp", "tcp", "faketcp", "quic", "icmp", "auto":
+	case "dns":
+		if config.DNSDomain == "" {
+			r.Errorf("transport: dns requires dnsdomain")
+		} else if mtu := generic.DNSUpstreamMTU(config.DNSDomain); mtu < 100 {
+			r.Errorf("dnsdomain: %q leaves %v bytes per query, too few", config.DNSDomain, mtu)
+		}
+	case "ws":
+		if config.WSURL == "" {
+			r.Errorf("transport: ws requires wsurl")
+		}
+	default:
+		r.Errorf("transport: unknown transport %q", config.Transport)
+	}
+	if config.Resolver != "" && !strings.HasPrefix(config.Resolver, "https://") {
+		host, _, err := net.SplitHostPort(config.Resolver)
+		if err != nil {
+			host = config.Resolver
+		}
+		if net.ParseIP(host) == nil {
+			r.Errorf("resolver: %q is neither an IP address nor a https:// url", config.Resolver)
+		}
+	}
+	if config.Bind != "" && net.ParseIP(config.Bind) == nil {
+		r.Errorf("bind: %q is not an IP address", config.Bind)
+	}
+	if config.Interface != "" {
+		if _, err := net.InterfaceByName(config.Interface); err != nil {
+			r.Warnf("interface: %v", err)
+		}
+	}
+	if config.PortRange != "" {
+		if _, _, err := generic.ParsePortRange(config.PortRange); err != nil {
+			r.Errorf("port-range: %v", err)
+		}
+		if config.HopInterval < 10 {
+			r.Errorf("hop-interval: %v seconds is too short for clock skew, 10 at least", config.HopInterval)
+		}
+		if config.Transport != "udp" || config.Multipath != "" {
+			r.Errorf("port-range: hopping only works with plain udp transport")
+		}
+	}
+	if config.Peer != "" && (config.Transport != "udp" || config.Multipath != "" || config.PortRange != "") {
+		r.Errorf("peer: rendezvous only works with plain udp transport")
+	}
+	if config.STUN != "" {
+		for _, server := range strings.Split(config.STUN, ",") {
+			r.CheckAddr("stun", strings.TrimSpace(server))
+		}
+	}
+	if config.Multipath != "" {
+		if config.Transport != "udp" {
+			r.Errorf("multipath: only bonds udp paths, not transport %v", config.Transport)
+		}
+		for _, local := range strings.Split(config.Multipath, ",") {
+			if net.ParseIP(strings.TrimSpace(local)) == nil {
+				r.Errorf("multipath: %q is not an IP address", local)
+			}
+		}
+	}
+	r.CheckCrypt(config.Key, config.Crypt)
+	if err := generic.CheckPaddingMode(config.Padding); err != nil {
+		r.Errorf("%v", err)
+	}
+	if config.Seed != 0 {
+		r.Warnf("seed: the padding, chaff and record sizes are predictable, for debugging only")
+	}
+	if _, max, err := generic.ParseRecords(config.Records); err != nil {
+		r.Errorf("%v", err)
+	} else if max > config.MTU {
+		r.Warnf("records: %v bytes don't fit a packet of mtu %v, records are cut in several", max, config.MTU)
+	}
+	if _, err := generic.NewObfuscator(config.Obfs, config.Key); err != nil {
+		r.Errorf("%v", err)
+	} else if config.Obfs != "" && config.Obfs != "none" && config.Transport != "udp" && config.Transport != "auto" {
+		r.Errorf("obfs: only applies to udp, not transport %v", config.Transport)
+	}
+	if config.Chaff < 0 {
+		r.Errorf("chaff: interval must not be negative")
+	}
+	if config.OTLP != "" && !strings.HasPrefix(config.OTLP, "http://") && !strings.HasPrefix(config.OTLP, "https://") {
+		r.Errorf("otlp: %v is not an http(s) url", config.OTLP)
+	}
+	if err := generic.CheckWebhook(config.Webhook); err != nil {
+		r.Errorf("%v", err)
+	}
+	if config.WebhookLoss < 0 || config.WebhookLoss > 100 {
+		r.Errorf("webhookloss: %v out of range 0-100", config.WebhookLoss)
+	}
+	if config.Admin != "" {
+		r.CheckAddr("admin", config.Admin)
+		r.CheckLoopback("admin", config.Admin)
+	}
+	if config.Statsd != "" {
+		r.CheckAddr("statsd", strings.TrimPrefix(config.Statsd, "graphite://"))
+		if config.StatsdPeriod <= 0 {
+			r.Errorf("statsdperiod: must be positive")
+		}
+	}
+	if config.HandshakeTimeout <= 0 {
+		r.Errorf("handshaketimeout: must be positive")
+	}
+	switch {
+	case config.StreamTimeout < 0:
+		r.Errorf("streamtimeout: must not be negative")
+	case config.StreamTimeout > 0 && config.NoHello:
+		r.Errorf("streamtimeout: needs the hello exchange, drop nohello")
+	}
+	if config.Migrate && config.NoHello {
+		r.Errorf("migrate: needs the hello exchange, drop nohello")
+	}
+	if config.Checksum && config.NoHello {
+		r.Errorf("checksum: needs the hello exchange, drop nohello")
+	}
+	if config.PQ && config.Handshake != generic.HandshakeNoiseIK && config.Handshake != generic.HandshakeNoiseXK {
+		r.Errorf("pq: requires handshake noise-ik or noise-xk")
+	}
+	if config.Pin != "" && config.Handshake == generic.HandshakeNone {
+		r.Errorf("pin: requires a handshake proving the server key, tls, noise-ik or noise-xk")
+	}
+	if err := generic.CheckHandshake(config.Handshake); err != nil {
+		r.Errorf("%v", err)
+	} else if config.Handshake != generic.HandshakeNone {
+		if config.Transport == "quic" {
+			r.Warnf("handshake: quic runs its own TLS, %v is ignored", config.Handshake)
+		}
+		if _, err := newKeyExchange(&config); err != nil {
+			r.Errorf("%v", err)
+		}
+		if config.TLSName != "" && config.TLSCA == "" {
+			r.Warnf("tlsname: only checked with tlsca")
+		}
+	}
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		r.Errorf("tlscert, tlskey: must be set together")
+	} else if config.TLSCert != "" && config.Handshake != generic.HandshakeTLS {
+		r.Warnf("tlscert: only presented with handshake tls")
+	}
+	if config.KCPKeepAlive < 0 || config.DeadPeer < 0 {
+		r.Errorf("kcpkeepalive, deadpeer: must not be negative")
+	}
+	if config.DeadPeer > 0 && (config.KCPKeepAlive == 0 || config.DeadPeer < 2*config.KCPKeepAlive) {
+		r.Warnf("deadpeer: %v seconds without kcpkeepalive pings at most every %v seconds may drop idle sessions", config.DeadPeer, config.DeadPeer/2)
+	}
+	r.CheckMode(config.Mode)
+	r.CheckMTU(config.MTU)
+	if config.SndWnd <= 0 {
+		r.Errorf("sndwnd: window must be positive")
+	}
+	bandwidth := c.Int("bandwidth")
+	if config.DownBW > 0 && !c.IsSet("bandwidth") {
+		bandwidth = config.DownBW
+	}
+	r.CheckWindow("rcvwnd", config.RcvWnd, config.MTU, rtt, bandwidth)
+	switch {
+	case config.UpBW < 0 || config.DownBW < 0:
+		r.Errorf("upbw, downbw: must not be negative")
+	case (config.UpBW > 0 || config.DownBW > 0) && config.NoHello:
+		r.Warnf("upbw, downbw: without the hello exchange only upbw paces this end, the server isn't told")
+	}
+	if err := generic.CheckSchedule(config.Schedule); err != nil {
+		r.Errorf("%v", err)
+	}
+	r.CheckFEC(config.DataShard, config.ParityShard)
+	r.CheckDSCP(config.DSCP)
+	if err := generic.CheckDF(config.DF); err != nil {
+		r.Errorf("%v", err)
+	}
+	if config.TTL < 0 || config.TTL > 255 {
+		r.Errorf("ttl: %v out of range 1-255", config.TTL)
+	}
+	if config.FWMark < 0 {
+		r.Errorf("fwmark: must not be negative")
+	}
+	r.CheckSockBuf(config.SockBuf, config.RcvWnd, config.MTU)
+	if config.Conn < 1 {
+		r.Errorf("conn: at least one connection is required")
+	}
+	if config.AutoExpire < 0 {
+		r.Errorf("autoexpire: must not be negative")
+	}
+	if config.Warm < 0 {
+		r.Errorf("warm: must not be negative")
+	} else if config.Warm > 0 && (config.Stdio || generic.TunnelKind(config.Tun, config.Tap) != "") {
+		r.Warnf("warm: unused with a single session, stdio, tun or tap")
+	}
+
+	if err := smux.VerifyConfig(generic.NewSmuxConfig(config.SockBuf, config.KeepAlive, config.KeepAliveTimeout, config.SmuxFrame)); err != nil {
+		r.Errorf("smux: %v", err)
+	}
+
+	// print the effective configuration without leaking the key
+	config.Key = "********"
+	if config.NoiseKey != "" {
+		config.NoiseKey = "********"
+	}
+	if c.Bool("json") {
+		checkError(generic.PrintJSON(os.Stdout, r.Result(config)))
+	} else {
+		out, err := json.MarshalIndent(config, "", "    ")
+		checkError(err)
+		fmt.Println(string(out))
+		r.Print(os.Stdout)
+	}
+
+	if len(r.Errors) > 0 {
+		return cli.NewExitError("configuration check failed", generic.ExitConfig)
+	}
+	return nil
+}
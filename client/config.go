@@ -1,38 +1,110 @@
-package main
+package client
 
 import (
 	"encoding/json"
 	"os"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/generic"
 )
 
 // Config for client
 type Config struct {
-	LocalAddr    string `json:"localaddr"`
-	RemoteAddr   string `json:"remoteaddr"`
-	Key          string `json:"key"`
-	Crypt        string `json:"crypt"`
-	Mode         string `json:"mode"`
-	Conn         int    `json:"conn"`
-	AutoExpire   int    `json:"autoexpire"`
-	ScavengeTTL  int    `json:"scavengettl"`
-	MTU          int    `json:"mtu"`
-	SndWnd       int    `json:"sndwnd"`
-	RcvWnd       int    `json:"rcvwnd"`
-	DataShard    int    `json:"datashard"`
-	ParityShard  int    `json:"parityshard"`
-	DSCP         int    `json:"dscp"`
-	NoComp       bool   `json:"nocomp"`
-	AckNodelay   bool   `json:"acknodelay"`
-	NoDelay      int    `json:"nodelay"`
-	Interval     int    `json:"interval"`
-	Resend       int    `json:"resend"`
-	NoCongestion int    `json:"nc"`
-	SockBuf      int    `json:"sockbuf"`
-	KeepAlive    int    `json:"keepalive"`
-	Log          string `json:"log"`
-	SnmpLog      string `json:"snmplog"`
-	SnmpPeriod   int    `json:"snmpperiod"`
-	Quiet        bool   `json:"quiet"`
+	LocalAddr        string `json:"localaddr"`
+	Interactive      string `json:"interactive"`
+	Stdio            bool   `json:"stdio"`
+	Tun              string `json:"tun"`
+	Tap              string `json:"tap"`
+	TapFilter        string `json:"tapfilter"`
+	RemoteAddr       string `json:"remoteaddr"`
+	Peer             string `json:"peer"`
+	STUN             string `json:"stun"`
+	Transport        string `json:"transport"`
+	WSURL            string `json:"wsurl"`
+	DNSDomain        string `json:"dnsdomain"`
+	Key              string `json:"key"`
+	Crypt            string `json:"crypt"`
+	Mode             string `json:"mode"`
+	Conn             int    `json:"conn"`
+	AutoExpire       int    `json:"autoexpire"`
+	Warm             int    `json:"warm"`
+	ScavengeTTL      int    `json:"scavengettl"`
+	MTU              int    `json:"mtu"`
+	SndWnd           int    `json:"sndwnd"`
+	RcvWnd           int    `json:"rcvwnd"`
+	UpBW             int    `json:"upbw"`
+	DownBW           int    `json:"downbw"`
+	DataShard        int    `json:"datashard"`
+	ParityShard      int    `json:"parityshard"`
+	DSCP             int    `json:"dscp"`
+	DF               string `json:"df"`
+	TTL              int    `json:"ttl"`
+	FWMark           int    `json:"fwmark"`
+	NoComp           bool   `json:"nocomp"`
+	StreamComp       bool   `json:"streamcomp"`
+	Telemetry        int    `json:"telemetry"`
+	AckNodelay       bool   `json:"acknodelay"`
+	NoDelay          int    `json:"nodelay"`
+	Interval         int    `json:"interval"`
+	Resend           int    `json:"resend"`
+	NoCongestion     int    `json:"nc"`
+	SockBuf          int    `json:"sockbuf"`
+	KeepAlive        int    `json:"keepalive"`
+	KeepAliveTimeout int    `json:"keepalivetimeout"`
+	Handshake        string `json:"handshake"`
+	PQ               bool   `json:"pq"`
+	TLSCA            string `json:"tlsca"`
+	TLSName          string `json:"tlsname"`
+	Pin              string `json:"pin"`
+	TLSCert          string `json:"tlscert"`
+	TLSKey           string `json:"tlskey"`
+	NoiseKey         string `json:"noisekey"`
+	NoiseServer      string `json:"noiseserver"`
+	HandshakeTimeout int    `json:"handshaketimeout"`
+	StreamTimeout    int    `json:"streamtimeout"`
+	Migrate          bool   `json:"migrate"`
+	Checksum         bool   `json:"checksum"`
+	TCPNoDelay       bool   `json:"tcp-nodelay"`
+	TCPKeepAlive     int    `json:"tcp-keepalive"`
+	TCPLinger        int    `json:"tcp-linger"`
+	SmuxFrame        int    `json:"smuxframe"`
+	Log              string `json:"log"`
+	SnmpLog          string `json:"snmplog"`
+	SnmpPeriod       int    `json:"snmpperiod"`
+	Statsd           string `json:"statsd"`
+	StatsdPeriod     int    `json:"statsdperiod"`
+	StatsdPrefix     string `json:"statsdprefix"`
+	Admin            string `json:"admin"`
+	Quiet            bool   `json:"quiet"`
+	PreferIPv6       bool   `json:"prefer-ipv6"`
+	ResolvePeriod    int    `json:"resolveperiod"`
+	SelectInterval   int    `json:"selectinterval"`
+	State            string `json:"state"`
+	Resolver         string `json:"resolver"`
+	Bind             string `json:"bind"`
+	Interface        string `json:"interface"`
+	Multipath        string `json:"multipath"`
+	MPDup            bool   `json:"mpdup"`
+	PortRange        string `json:"port-range"`
+	HopInterval      int    `json:"hop-interval"`
+	Padding          string `json:"padding"`
+	Records          string `json:"records"`
+	Obfs             string `json:"obfs"`
+	Chaff            int    `json:"chaff"`
+	NoHello          bool   `json:"nohello"`
+	KCPKeepAlive     int    `json:"kcpkeepalive"`
+	DeadPeer         int    `json:"deadpeer"`
+	Pcap             string `json:"pcap"`
+	OTLP             string `json:"otlp"`
+	Webhook          string `json:"webhook"`
+	WebhookLoss      int    `json:"webhookloss"`
+	PcapPlain        bool   `json:"pcapplain"`
+	Impair           string `json:"impair"`
+	Seed             int64  `json:"seed"`
+	RecordTraffic    string `json:"recordtraffic"`
+
+	// Schedule caps the bandwidth by time of day, json file only
+	Schedule []generic.BandwidthProfile `json:"schedule"`
 }
 
 func parseJSONConfig(config *Config, path string) error {
@@ -44,3 +116,16 @@ func parseJSONConfig(config *Config, path string) error {
 
 	return json.NewDecoder(file).Decode(config)
 }
+
+// reloadSchedule reads the schedule of the json file again, for SIGHUP
+func reloadSchedule() error {
+	var config Config
+	if err := parseJSONConfig(&config, configFile); err != nil {
+		return errors.Wrap(err, "schedule")
+	}
+	if err := generic.CheckSchedule(config.Schedule); err != nil {
+		return err
+	}
+	schedule.Set(config.Schedule)
+	return nil
+}
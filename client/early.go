@@ -0,0 +1,99 @@
+package client
+
+import (
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A session resuming with a token doesn't wait for the server's answer to
+// its hello, so the first bytes of its streams, their early data, go out
+// along with the handshake, and a short connection like a DNS query over
+// TCP or an HTTP request gets its answer a round trip sooner. Until the
+// answer arrives, a stream keeps what it sent, up to earlyMax, and holds
+// back the rest. Should the server refuse the token, e.g. after a restart,
+// the stream opens again over a full hello and sends its early data again,
+// instead of resetting the local connection.
+const earlyMax = 16 * 1024
+
+// resumption is the server's answer to a hello with a token, pending until
+// done is closed
+type resumption struct {
+	done chan struct{}
+	err  error
+}
+
+func newResumption() *resumption {
+	return &resumption{done: make(chan struct{})}
+}
+
+// answer records the outcome of the hello, nil once the server accepted it
+func (r *resumption) answer(err error) {
+	r.err = err
+	close(r.done)
+}
+
+// pending returns r while the server hasn't accepted the hello, nil after
+// and for a nil r
+func (r *resumption) pending() *resumption {
+	if r == nil {
+		return nil
+	}
+	select {
+	case <-r.done:
+		if r.err == nil {
+			return nil
+		}
+	default:
+	}
+	return r
+}
+
+// sendEarly copies what p1 sends to stream until r is answered, at most
+// earlyMax bytes, and returns them with the answer, or an error after
+// timeout without one
+func sendEarly(p1 net.Conn, stream io.Writer, r *resumption, timeout time.Duration) ([]byte, error) {
+	expire := time.Now().Add(timeout)
+	// the answer interrupts the read waiting for more
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-r.done:
+		case <-time.After(timeout):
+		case <-stop:
+			return
+		}
+		p1.SetReadDeadline(time.Now())
+	}()
+
+	var early []byte
+	buf := make([]byte, earlyMax)
+	for len(early) < earlyMax {
+		n, err := p1.Read(buf[:earlyMax-len(early)])
+		if n > 0 {
+			early = append(early, buf[:n]...)
+			if _, err := stream.Write(buf[:n]); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			// timeouts are the answer, the other errors show again on
+			// the next read
+			break
+		}
+	}
+	close(stop)
+	<-stopped
+	p1.SetReadDeadline(time.Time{})
+
+	select {
+	case <-r.done:
+		return early, r.err
+	case <-time.After(time.Until(expire)):
+		return early, errors.New("early data: no answer to the hello")
+	}
+}
@@ -0,0 +1,70 @@
+package client
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/generic"
+)
+
+// newKeyExchange prepares the key exchange of config. Without --noisekey
+// the client's noise key is random, good for the life of the process. With
+// --tlsca the TLS server name defaults to the host of the remote address.
+func newKeyExchange(config *Config) (*generic.KeyExchange, error) {
+	kx := &generic.KeyExchange{Mode: config.Handshake, Timeout: time.Duration(config.HandshakeTimeout) * time.Second, PQ: config.PQ}
+	pins, err := generic.ParsePins(config.Pin)
+	if err != nil {
+		return nil, err
+	}
+	switch config.Handshake {
+	case generic.HandshakeTLS:
+		serverName := config.TLSName
+		if serverName == "" {
+			serverName, _, _ = net.SplitHostPort(config.RemoteAddr)
+		}
+		pass := generic.DeriveKey(config.Key)
+		if kx.TLS, err = generic.NewHandshakeClientTLS(serverName, config.TLSCA, pass, pins); err != nil {
+			return nil, err
+		}
+		if config.TLSCert != "" {
+			cert, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+			if err != nil {
+				return nil, errors.Wrap(err, "handshake")
+			}
+			kx.TLS.Certificates = []tls.Certificate{cert}
+		}
+	case generic.HandshakeNoiseIK, generic.HandshakeNoiseXK:
+		if kx.Peer, err = generic.ParseNoisePublic(config.NoiseServer); err != nil {
+			return nil, err
+		}
+		// the handshake proves possession of the server key, which must be
+		// the pinned one
+		if len(pins) > 0 {
+			if err := generic.CheckPin(generic.KeyPin(kx.Peer), pins); err != nil {
+				return nil, err
+			}
+		}
+		if config.NoiseKey == "" {
+			kx.Noise, err = generic.GenerateNoiseKey()
+		} else {
+			kx.Noise, err = generic.ParseNoiseKey(config.NoiseKey)
+		}
+	}
+	return kx, err
+}
+
+// logPublic logs the client's noise public key or certificate pin, for the
+// server's list
+func logPublic(kx *generic.KeyExchange) {
+	if kx.Noise != nil {
+		log.Println("noise public key:", kx.Noise.PublicString())
+	}
+	if kx.TLS != nil && len(kx.TLS.Certificates) > 0 {
+		if pin, err := generic.TLSPin(kx.TLS); err == nil {
+			log.Println("tls certificate pin:", pin)
+		}
+	}
+}
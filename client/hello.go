@@ -0,0 +1,145 @@
+package client
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go"
+	"github.com/xtaci/kcptun/generic"
+	"github.com/xtaci/smux"
+)
+
+// helloState carries what the server said in the last hello over to new
+// sessions: the parameters it pushed, the resumption token with the secret
+// of the key exchange it resumes, and whether it answers telemetry,
+// acknowledges, migrates and checksums streams
+type helloState struct {
+	key   []byte     // stamps the hellos
+	state *stateFile // keeps all that across restarts, nil without --state
+
+	mu        sync.Mutex
+	pushed    *generic.Params
+	token     []byte
+	secret    []byte // see generic.ResumptionSecret
+	telemetry bool
+	streamAck bool
+	migrate   bool
+	checksum  bool
+}
+
+// features are the optional parts of the protocol a session runs with
+type features struct {
+	telemetry bool        // the session opens with a control stream
+	streamAck bool        // the server answers every stream with a StreamStatus
+	resumed   *resumption // the answer to a hello with a token, nil after a full hello
+	migrate   bool        // streams move over to the next session, see generic.MigrateStream
+	checksum  bool        // stream data carries CRCs, see generic.ChecksumStream
+}
+
+// session is a smux session to the server, with the features it runs with
+type session struct {
+	*smux.Session
+	features
+}
+
+// apply overrides config with the parameters pushed so far
+func (s *helloState) apply(config *Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pushed != nil {
+		applyPush(config, s.pushed)
+	}
+}
+
+// take returns the token to resume the next session with and its secret,
+// nil without, the server taking a token once
+func (s *helloState) take() (token, secret []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, secret = s.token, s.secret
+	s.token, s.secret = nil, nil
+	return
+}
+
+// update records the server's answer over a session keyed with secret, and
+// applies newly pushed parameters to kcpconn, set up with sessConfig
+func (s *helloState) update(hello *generic.Hello, secret []byte, kcpconn *kcp.UDPSession, sessConfig Config) {
+	s.mu.Lock()
+	s.token, s.secret = hello.Token, secret
+	s.telemetry = hello.Telemetry
+	s.streamAck = hello.StreamAck
+	s.migrate = hello.Migrate
+	s.checksum = hello.Checksum
+	changed := hello.Push != nil && (s.pushed == nil || *hello.Push != *s.pushed)
+	if changed {
+		s.pushed = hello.Push
+	}
+	pushed := s.pushed
+	s.mu.Unlock()
+	s.state.update(func(state *clientState) {
+		state.Pushed = pushed
+		state.Token, state.Secret = hello.Token, secret
+		state.Telemetry, state.StreamAck, state.Migrate = hello.Telemetry, hello.StreamAck, hello.Migrate
+		state.Checksum = hello.Checksum
+	})
+	if changed {
+		log.Printf("server pushed: %+v", *hello.Push)
+		applyPush(&sessConfig, hello.Push)
+		tuneSession(kcpconn, &sessConfig)
+	}
+	if (sessConfig.UpBW > 0 || sessConfig.DownBW > 0) && hello.Recv != nil {
+		// send with the window the server receives with
+		kcpconn.SetWindowSize(hello.Recv.RcvWnd, sessConfig.RcvWnd)
+	}
+}
+
+// handshake runs the hello exchange over conn, returned by the key
+// exchange of a new session kcpconn set up with sessConfig, interactive for
+// the interactive streams' session. Holding a token, taken with take, it
+// spends it and doesn't wait for the answer, and asks for telemetry and
+// stream acks only if the server answered them before. The returned conn
+// replaces conn, along with the features the session runs with.
+func (s *helloState) handshake(conn net.Conn, token []byte, kcpconn *kcp.UDPSession, config, sessConfig *Config, interactive bool) (_ net.Conn, _ features, err error) {
+	local := newHello(config)
+	local.Interactive = interactive
+	local.Token = token
+	s.mu.Lock()
+	local.Telemetry = config.Telemetry > 0 && (token == nil || s.telemetry)
+	local.StreamAck = token == nil || s.streamAck
+	local.Migrate = config.Migrate && (token == nil || s.migrate)
+	local.Checksum = config.Checksum && (token == nil || s.checksum)
+	s.mu.Unlock()
+	generic.StampHello(local, s.key)
+	// the next token resumes the keys of this session
+	secret := generic.ResumptionSecret(conn)
+
+	if local.Token == nil {
+		hello, err := generic.ClientHello(conn, local, s.key, time.Duration(config.HandshakeTimeout)*time.Second)
+		if err != nil {
+			return nil, features{}, err
+		}
+		s.update(hello, secret, kcpconn, *sessConfig)
+		// servers predating telemetry, stream acks, migration or checksums
+		// ignore them
+		return conn, features{
+			telemetry: local.Telemetry && hello.Telemetry,
+			streamAck: local.StreamAck && hello.StreamAck,
+			migrate:   local.Migrate && hello.Migrate,
+			checksum:  local.Checksum && hello.Checksum,
+		}, nil
+	}
+
+	resumed := *sessConfig
+	r := newResumption()
+	conn, err = generic.ResumeHello(conn, local, s.key, func(hello *generic.Hello, err error) {
+		defer r.answer(err)
+		if err != nil {
+			log.Println("resume:", err)
+			return
+		}
+		s.update(hello, secret, kcpconn, resumed)
+	})
+	return conn, features{telemetry: local.Telemetry, streamAck: local.StreamAck, resumed: r, migrate: local.Migrate, checksum: local.Checksum}, err
+}
@@ -1,447 +1,1446 @@
-package main
+package client
 
 import (
-	"crypto/sha1"
-	"encoding/csv"
 	"fmt"
 	"io"
 	"log"
-	"math/rand"
 	"net"
 	"os"
+	"strings"
 	"time"
 
-	"golang.org/x/crypto/pbkdf2"
-
-	"github.com/golang/snappy"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	kcp "github.com/xtaci/kcp-go"
+	"github.com/xtaci/kcptun/generic"
 	"github.com/xtaci/smux"
-
-	"path/filepath"
 )
 
+// rendezvousTimeout bounds the wait for the introducer's answer to a lookup
+const rendezvousTimeout = 10 * time.Second
+
+// stats tracks the sessions and streams for the SIGUSR1 snapshot
+var stats = generic.NewStats()
+
+// tracer exports the spans of sessions and streams with --otlp
+var tracer *generic.Tracer
+
+// traffic records the streams with --recordtraffic, nil without
+var traffic *generic.TrafficRecorder
+
+// webhook posts the events of the client with --webhook, nil without
+var webhook *generic.Webhook
+
+// schedule paces all sessions by time of day with the schedule of the json
+// file, nil without. configFile is re-read for it on SIGHUP.
 var (
-	// VERSION is injected by buildflags
-	VERSION = "SELFBUILD"
-	// SALT is use for pbkdf2 key expansion
-	SALT = "kcp-go"
+	schedule   *generic.Schedule
+	configFile string
 )
 
-type compStream struct {
-	conn net.Conn
-	w    *snappy.Writer
-	r    *snappy.Reader
+// handleClient tunnels p1 over a stream of sess. A stream whose early data
+// the server refused starts over on a session from redial, if not nil.
+func handleClient(sess *session, p1 io.ReadWriteCloser, config *Config, qos *generic.QoS, interactive bool, redial func() *session) {
+	if !config.Quiet {
+		log.Println("stream opened")
+		defer log.Println("stream closed")
+	}
+
+	span := tracer.Start("stream", nil)
+	span.SetAttr("interactive", interactive)
+	defer span.End()
+	defer p1.Close()
+	stream, counted, err := openStream(sess, p1, config, span)
+	if err != nil {
+		span.SetError(err)
+		return
+	}
+	defer func() {
+		counted.Close()
+		in, out := generic.StreamBytes(counted)
+		span.SetAttr("bytes.in", in)
+		span.SetAttr("bytes.out", out)
+	}()
+
+	conn, ok := p1.(net.Conn)
+	if r := sess.resumed.pending(); r != nil && ok && redial != nil {
+		early, err := sendEarly(conn, stream, r, time.Duration(config.HandshakeTimeout)*time.Second)
+		if err != nil {
+			log.Println("early data:", err, "sending", len(early), "bytes again over a full hello")
+			counted.Close()
+			sess = redial()
+			defer sess.Close()
+			if stream, counted, err = openStream(sess, p1, config, span); err != nil {
+				span.SetError(err)
+				return
+			}
+			if _, err := stream.Write(early); err != nil {
+				span.SetError(err)
+				return
+			}
+		}
+	}
+	generic.Pipe(p1, qos.Wrap(traffic.Track(stream), interactive))
 }
 
-func (c *compStream) Read(p []byte) (n int, err error) {
-	return c.r.Read(p)
+// openStream opens a stream on sess for p1, framed the way the session
+// runs them, along with the raw stream counted in the stats
+func openStream(sess *session, p1 io.ReadWriteCloser, config *Config, span *generic.Span) (stream, counted io.ReadWriteCloser, err error) {
+	p2, err := sess.OpenStream()
+	if err != nil {
+		return nil, nil, err
+	}
+	span.SetAttr("stream.id", p2.ID())
+	counted = stats.TrackStream(sess.Session, p2)
+	stream = counted
+	if sess.migrate {
+		if stream, err = migrations.open(sess, counted); err != nil {
+			counted.Close()
+			return nil, nil, err
+		}
+	}
+	if sess.streamAck {
+		// the server's answer goes ahead of the frames. Local connections
+		// it refuses are reset, so the application fails at once.
+		stream = generic.NewAckedStream(stream, p2, time.Duration(config.StreamTimeout)*time.Second, func(err error) {
+			log.Println(err)
+			span.SetError(err)
+			if conn, ok := p1.(*net.TCPConn); ok {
+				conn.SetLinger(0)
+			}
+		})
+	}
+	// sessions past the hello frame their streams for half close
+	if !config.NoHello {
+		stream = generic.NewHalfCloseStream(stream)
+		if config.StreamComp {
+			stream = generic.NewStreamComp(stream)
+		}
+	}
+	if sess.checksum {
+		// a corrupted stream resets the local connection rather than
+		// ending it as if complete
+		stream = generic.NewChecksumStream(stream, func(err error) {
+			log.Println(err)
+			span.SetError(err)
+			if conn, ok := p1.(*net.TCPConn); ok {
+				conn.SetLinger(0)
+			}
+		})
+	}
+	return stream, counted, nil
 }
 
-func (c *compStream) Write(p []byte) (n int, err error) {
-	n, err = c.w.Write(p)
-	err = c.w.Flush()
-	return n, err
+// webhookUnreachable are the failed attempts in a row after which the
+// webhook hears the server is unreachable, about as many seconds
+const webhookUnreachable = 30
+
+// watchSession posts the session to remote to the webhook as established,
+// then as lost once closed
+func watchSession(session *smux.Session, remote string) {
+	fields := map[string]interface{}{"remote": remote}
+	webhook.Post("session_established", "session with "+remote, fields)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if session.IsClosed() {
+			webhook.Post("session_lost", "session with "+remote+" closed", fields)
+			return
+		}
+	}
 }
 
-func (c *compStream) Close() error {
-	return c.conn.Close()
+func checkError(err error) {
+	generic.Exit(generic.ExitError, err)
 }
 
-func newCompStream(conn net.Conn) *compStream {
-	c := new(compStream)
-	c.conn = conn
-	c.w = snappy.NewBufferedWriter(conn)
-	c.r = snappy.NewReader(conn)
-	return c
+// loadConfig builds the client configuration from the command line,
+// the optional json file and the selected mode profile
+func loadConfig(c *cli.Context) Config {
+	// run by shadowsocks, the flags come from SS_PLUGIN_OPTIONS too
+	plugin, err := generic.ParsePluginEnv()
+	generic.Exit(generic.ExitConfig, err)
+	generic.Exit(generic.ExitConfig, plugin.Apply(c))
+
+	config := Config{}
+	config.LocalAddr = c.String("localaddr")
+	config.Interactive = c.String("interactive")
+	config.Stdio = c.Bool("stdio")
+	config.Tun = c.String("tun")
+	config.Tap = c.String("tap")
+	config.TapFilter = c.String("tapfilter")
+	config.RemoteAddr = c.String("remoteaddr")
+	config.Peer = c.String("peer")
+	config.STUN = c.String("stun")
+	config.Key = c.String("key")
+	config.Crypt = c.String("crypt")
+	config.Mode = c.String("mode")
+	config.Conn = c.Int("conn")
+	config.AutoExpire = c.Int("autoexpire")
+	config.Warm = c.Int("warm")
+	config.ScavengeTTL = c.Int("scavengettl")
+	config.MTU = c.Int("mtu")
+	config.SndWnd = c.Int("sndwnd")
+	config.RcvWnd = c.Int("rcvwnd")
+	config.UpBW = c.Int("upbw")
+	config.DownBW = c.Int("downbw")
+	config.DataShard = c.Int("datashard")
+	config.ParityShard = c.Int("parityshard")
+	config.DSCP = c.Int("dscp")
+	config.DF = c.String("df")
+	config.TTL = c.Int("ttl")
+	config.FWMark = c.Int("fwmark")
+	config.NoComp = c.Bool("nocomp")
+	config.StreamComp = c.Bool("streamcomp")
+	config.Telemetry = c.Int("telemetry")
+	config.AckNodelay = c.Bool("acknodelay")
+	config.NoDelay = c.Int("nodelay")
+	config.Interval = c.Int("interval")
+	config.Resend = c.Int("resend")
+	config.NoCongestion = c.Int("nc")
+	config.SockBuf = c.Int("sockbuf")
+	config.KeepAlive = c.Int("keepalive")
+	config.KeepAliveTimeout = c.Int("keepalivetimeout")
+	config.Handshake = c.String("handshake")
+	config.PQ = c.Bool("pq")
+	config.TLSCA = c.String("tlsca")
+	config.TLSName = c.String("tlsname")
+	config.Pin = c.String("pin")
+	config.TLSCert = c.String("tlscert")
+	config.TLSKey = c.String("tlskey")
+	config.NoiseKey = c.String("noisekey")
+	config.NoiseServer = c.String("noiseserver")
+	config.HandshakeTimeout = c.Int("handshaketimeout")
+	config.StreamTimeout = c.Int("streamtimeout")
+	config.Migrate = c.Bool("migrate")
+	config.Checksum = c.Bool("checksum")
+	config.TCPNoDelay = c.BoolT("tcp-nodelay")
+	config.TCPKeepAlive = c.Int("tcp-keepalive")
+	config.TCPLinger = c.Int("tcp-linger")
+	config.SmuxFrame = c.Int("smuxframe")
+	config.Log = c.String("log")
+	config.SnmpLog = c.String("snmplog")
+	config.SnmpPeriod = c.Int("snmpperiod")
+	config.Statsd = c.String("statsd")
+	config.StatsdPeriod = c.Int("statsdperiod")
+	config.StatsdPrefix = c.String("statsdprefix")
+	config.Admin = c.String("admin")
+	config.Quiet = c.Bool("quiet")
+	config.Transport = c.String("transport")
+	config.WSURL = c.String("wsurl")
+	config.DNSDomain = c.String("dnsdomain")
+	config.PreferIPv6 = c.Bool("prefer-ipv6")
+	config.ResolvePeriod = c.Int("resolveperiod")
+	config.SelectInterval = c.Int("selectinterval")
+	config.State = c.String("state")
+	config.Resolver = c.String("resolver")
+	config.Bind = c.String("bind")
+	config.Interface = c.String("interface")
+	config.Multipath = c.String("multipath")
+	config.PortRange = c.String("port-range")
+	config.Padding = c.String("padding")
+	config.Records = c.String("records")
+	config.Obfs = c.String("obfs")
+	config.Chaff = c.Int("chaff")
+	config.NoHello = c.Bool("nohello")
+	config.KCPKeepAlive = c.Int("kcpkeepalive")
+	config.DeadPeer = c.Int("deadpeer")
+	config.HopInterval = c.Int("hop-interval")
+	config.MPDup = c.Bool("mpdup")
+	config.Pcap = c.String("pcap")
+	config.OTLP = c.String("otlp")
+	config.Webhook = c.String("webhook")
+	config.WebhookLoss = c.Int("webhookloss")
+	config.PcapPlain = c.Bool("pcapplain")
+	config.Impair = c.String("impair")
+	config.Seed = c.Int64("seed")
+	config.RecordTraffic = c.String("recordtraffic")
+
+	if c.String("c") != "" {
+		err := parseJSONConfig(&config, c.String("c"))
+		generic.Exit(generic.ExitConfig, err)
+	}
+	if plugin != nil {
+		// between ss-local and ss-server's plugin
+		config.LocalAddr, config.RemoteAddr = plugin.Local(), plugin.Remote()
+	}
+	if config.StreamComp {
+		// the streams compress on their own
+		config.NoComp = true
+	}
+
+	if nodelay, interval, resend, nc, ok := generic.ModeProfile(config.Mode); ok {
+		config.NoDelay, config.Interval, config.Resend, config.NoCongestion = nodelay, interval, resend, nc
+	}
+	if config.Mode == "auto" && config.Telemetry == 0 {
+		// sessions move on their link reports
+		config.Telemetry = 10
+	}
+	return config
 }
 
-func handleClient(sess *smux.Session, p1 io.ReadWriteCloser, quiet bool) {
-	if !quiet {
-		log.Println("stream opened")
-		defer log.Println("stream closed")
+// newHello describes config for the hello exchange
+func newHello(config *Config) *generic.Hello {
+	hello := &generic.Hello{
+		Version:     generic.ProtocolVersion,
+		Crypt:       config.Crypt,
+		DataShard:   config.DataShard,
+		ParityShard: config.ParityShard,
+		NoComp:      config.NoComp,
+		StreamComp:  config.StreamComp,
+		PQ:          config.PQ,
+		Tunnel:      generic.TunnelKind(config.Tun, config.Tap),
 	}
+	if config.UpBW > 0 || config.DownBW > 0 {
+		hello.Recv = &generic.RecvParams{RcvWnd: config.RcvWnd, Rate: config.DownBW}
+	}
+	return hello
+}
 
-	defer p1.Close()
-	p2, err := sess.OpenStream()
+// dial creates a KCP session to the server over the configured transport
+// with all parameters applied, wrap decorates the packet conn if not nil
+func dial(config *Config, block kcp.BlockCrypt, wrap func(net.PacketConn) net.PacketConn) (*kcp.UDPSession, error) {
+	var pconn net.PacketConn
+	raddr := config.RemoteAddr
+	switch config.Transport {
+	case "tcp":
+		carrier, err := generic.DialTCPCarrier(config.RemoteAddr)
+		if err != nil {
+			return nil, err
+		}
+		pconn, raddr = carrier, carrier.RemoteAddr().String()
+	case "faketcp":
+		carrier, err := generic.DialFakeTCP(config.RemoteAddr)
+		if err != nil {
+			return nil, err
+		}
+		pconn, raddr = carrier, carrier.RemoteAddr().String()
+	case "icmp":
+		carrier, err := generic.DialICMP(config.RemoteAddr)
+		if err != nil {
+			return nil, err
+		}
+		pconn, raddr = carrier, carrier.RemoteAddr().String()
+	case "ws":
+		carrier, err := generic.DialWebSocket(config.WSURL)
+		if err != nil {
+			return nil, err
+		}
+		pconn, raddr = carrier, carrier.RemoteAddr().String()
+	case "dns":
+		carrier, err := generic.DialDNS(config.RemoteAddr, config.DNSDomain)
+		if err != nil {
+			return nil, err
+		}
+		pconn, raddr = carrier, carrier.RemoteAddr().String()
+	default:
+		if config.Multipath != "" {
+			conn, err := dialMultipath(config)
+			if err != nil {
+				return nil, err
+			}
+			pconn = conn
+			break
+		}
+		// rendezvous and port hopping talk to other addresses than
+		// remoteaddr, the sockets of the others are connected to it
+		connect := config.Peer == "" && config.PortRange == ""
+		conn, err := dialUDP(config, connect)
+		if err != nil {
+			return nil, err
+		}
+		pconn = conn
+		if connect {
+			pconn = generic.NewConnectedConn(conn)
+		}
+		if config.Peer != "" {
+			introducer, err := net.ResolveUDPAddr("udp", config.RemoteAddr)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			peer, err := generic.Rendezvous(conn, config.Key, introducer, config.Peer, rendezvousTimeout)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			log.Println("rendezvous: peer", config.Peer, "at", peer)
+			pconn, raddr = generic.NewRendezvousConn(conn, config.Key, false), peer.String()
+		}
+		if config.PortRange != "" {
+			hopconn, err := dialHop(conn, config)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			pconn = hopconn
+		}
+		pconn = generic.ReadAhead(pconn)
+		obfs, err := generic.NewObfuscator(config.Obfs, config.Key)
+		if err != nil {
+			pconn.Close()
+			return nil, err
+		}
+		if obfs != nil {
+			pconn = generic.NewObfsConn(pconn, obfs)
+		}
+	}
+
+	if wrap != nil {
+		pconn = wrap(pconn)
+	}
+	if config.Padding != "" && config.Padding != "none" {
+		pconn = generic.NewPadConn(pconn, config.Key, config.Padding, config.MTU, false)
+	}
+	var heartbeat *generic.HeartbeatConn
+	var fingerprint *generic.FingerprintConn
+	udpaddr, resolveErr := net.ResolveUDPAddr("udp", raddr)
+	if !config.NoHello && resolveErr == nil {
+		fingerprint = generic.NewFingerprintConn(pconn, config.Key, newHello(config), udpaddr)
+		pconn = fingerprint
+	}
+	if config.Chaff > 0 || config.KCPKeepAlive > 0 || config.DeadPeer > 0 {
+		if resolveErr != nil {
+			pconn.Close()
+			return nil, resolveErr
+		}
+		if config.Chaff > 0 {
+			pconn = generic.NewChaffConn(pconn, config.Key, time.Duration(config.Chaff)*time.Second, udpaddr)
+		}
+		if config.KCPKeepAlive > 0 || config.DeadPeer > 0 {
+			heartbeat = generic.NewHeartbeatConn(pconn, config.Key, udpaddr,
+				time.Duration(config.KCPKeepAlive)*time.Second, time.Duration(config.DeadPeer)*time.Second)
+			pconn = heartbeat
+		}
+	}
+	pconn = stats.TimePackets(pconn)
+	kcpconn, err := kcp.NewConn(raddr, block, config.DataShard, config.ParityShard, pconn)
 	if err != nil {
-		return
+		pconn.Close()
+		return nil, err
+	}
+	if heartbeat != nil {
+		// closing the session lets the next connection replace it
+		heartbeat.OnDead(func() {
+			log.Println("dead peer:", raddr, "silent for", config.DeadPeer, "seconds")
+			kcpconn.Close()
+		})
+		// the session's round trip estimate, once tracked
+		heartbeat.OnRTT(func(rtt time.Duration) {
+			generic.SessionRTT(kcpconn).Add(rtt)
+		})
+	}
+	if fingerprint != nil {
+		// retrying won't help
+		fingerprint.OnMismatch(func(err error) {
+			generic.Exit(generic.ExitConfig, errors.Wrap(err, raddr))
+		})
+	}
+	kcpconn.SetStreamMode(true)
+	kcpconn.SetWriteDelay(true)
+	tuneSession(kcpconn, config)
+	kcpconn.SetACKNoDelay(config.AckNodelay)
+	return kcpconn, nil
+}
+
+// tuneSession applies the parameters a server may push to kcpconn
+func tuneSession(kcpconn *kcp.UDPSession, config *Config) {
+	kcpconn.SetNoDelay(config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
+	kcpconn.SetWindowSize(config.SndWnd, config.RcvWnd)
+	mtu := config.MTU
+	if config.Transport == "dns" && mtu > generic.DNSUpstreamMTU(config.DNSDomain) {
+		mtu = generic.DNSUpstreamMTU(config.DNSDomain)
 	}
-	defer p2.Close()
+	kcpconn.SetMtu(mtu - packetOverhead(config))
+}
 
-	// start tunnel
-	p1die := make(chan struct{})
-	go func() { io.Copy(p1, p2); close(p1die) }()
+// packetOverhead returns the bytes the layers below KCP add to every packet
+func packetOverhead(config *Config) int {
+	var overhead int
+	switch config.Transport {
+	case "tcp", "faketcp", "icmp", "ws", "dns":
+	default:
+		if config.Multipath != "" {
+			overhead += generic.MultipathOverhead
+		}
+		if obfs, _ := generic.NewObfuscator(config.Obfs, config.Key); obfs != nil {
+			overhead += obfs.Overhead()
+		}
+	}
+	if config.Padding != "" && config.Padding != "none" {
+		overhead += generic.PaddingOverhead
+	}
+	return overhead
+}
 
-	p2die := make(chan struct{})
-	go func() { io.Copy(p2, p1); close(p2die) }()
+// applyPush overrides the parameters of config pushed by the server
+func applyPush(config *Config, push *generic.Params) {
+	config.MTU = push.MTU
+	config.SndWnd, config.RcvWnd = push.SndWnd, push.RcvWnd
+	config.NoDelay, config.Interval, config.Resend, config.NoCongestion = push.NoDelay, push.Interval, push.Resend, push.NoCongestion
+}
 
-	// wait for tunnel termination
-	select {
-	case <-p1die:
-	case <-p2die:
+// dialUDP creates the UDP socket of a session to config.RemoteAddr with the
+// socket options applied, connected to it with connect
+func dialUDP(config *Config, connect bool) (*net.UDPConn, error) {
+	udpaddr, err := net.ResolveUDPAddr("udp", config.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	network := "udp4"
+	if udpaddr.IP.To4() == nil {
+		network = "udp"
 	}
+	var laddr *net.UDPAddr
+	if config.Bind != "" {
+		if laddr, err = net.ResolveUDPAddr("udp", net.JoinHostPort(config.Bind, "0")); err != nil {
+			return nil, err
+		}
+	}
+	var raddr *net.UDPAddr
+	if connect {
+		raddr = udpaddr
+	}
+	conn, err := listenUDP(network, laddr, raddr, config)
+	if err != nil {
+		return nil, err
+	}
+	if config.Interface != "" {
+		if err := generic.BindToDevice(conn, config.Interface); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "BindToDevice")
+		}
+	}
+	if config.FWMark != 0 {
+		if err := generic.SetMark(conn, config.FWMark); err != nil {
+			conn.Close()
+			return nil, errors.Wrap(err, "SetMark")
+		}
+	}
+	return conn, nil
 }
 
-func checkError(err error) {
+// listenUDP creates a UDP socket on laddr with the socket options applied,
+// connected to raddr unless nil
+func listenUDP(network string, laddr, raddr *net.UDPAddr, config *Config) (*net.UDPConn, error) {
+	var conn *net.UDPConn
+	var err error
+	if raddr != nil {
+		conn, err = net.DialUDP(network, laddr, raddr)
+	} else {
+		conn, err = net.ListenUDP(network, laddr)
+	}
 	if err != nil {
-		log.Printf("%+v\n", err)
-		os.Exit(-1)
+		return nil, err
+	}
+
+	if err := generic.SetDSCP(conn, config.DSCP); err != nil {
+		log.Println("SetDSCP:", err)
+	}
+	if err := generic.SetDF(conn, config.DF); err != nil {
+		log.Println("SetDF:", err)
+	}
+	if err := generic.SetTTL(conn, config.TTL); err != nil {
+		log.Println("SetTTL:", err)
+	}
+	if raddr == nil {
+		// a connected socket's session ends on the ICMP errors it gets
+		if err := generic.TuneUDP(conn); err != nil {
+			log.Println("TuneUDP:", err)
+		}
+	}
+	if err := conn.SetReadBuffer(config.SockBuf); err != nil {
+		log.Println("SetReadBuffer:", err)
+	}
+	if err := conn.SetWriteBuffer(config.SockBuf); err != nil {
+		log.Println("SetWriteBuffer:", err)
 	}
+	return conn, nil
 }
 
-func main() {
-	rand.Seed(int64(time.Now().Nanosecond()))
-	if VERSION == "SELFBUILD" {
-		// add more log flags for debugging
-		log.SetFlags(log.LstdFlags | log.Lshortfile)
+// dialHop hops the UDP traffic of conn over config.PortRange in lockstep
+// with the server
+func dialHop(conn *net.UDPConn, config *Config) (*generic.HopConn, error) {
+	lo, hi, err := generic.ParsePortRange(config.PortRange)
+	if err != nil {
+		return nil, err
+	}
+	udpaddr, err := net.ResolveUDPAddr("udp", config.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	interval := time.Duration(config.HopInterval) * time.Second
+	return generic.NewHopConn(conn, udpaddr, []byte(config.Key), lo, hi, interval), nil
+}
+
+// dialMultipath bonds one UDP socket per local address in config.Multipath
+func dialMultipath(config *Config) (*generic.MultipathConn, error) {
+	udpaddr, err := net.ResolveUDPAddr("udp", config.RemoteAddr)
+	if err != nil {
+		return nil, err
 	}
+	var conns []*net.UDPConn
+	for _, local := range strings.Split(config.Multipath, ",") {
+		laddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(strings.TrimSpace(local), "0"))
+		if err == nil {
+			var conn *net.UDPConn
+			if conn, err = listenUDP("udp", laddr, nil, config); err == nil {
+				conns = append(conns, conn)
+				continue
+			}
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+		return nil, errors.Wrap(err, "multipath")
+	}
+	return generic.NewMultipathConn(conns, udpaddr, config.MPDup)
+}
+
+// NewApp returns the command line of the client, run by "kcptun client"
+func NewApp() *cli.App {
 	myApp := cli.NewApp()
 	myApp.Name = "kcptun"
+	myApp.HelpName = "kcptun client"
 	myApp.Usage = "client(with SMUX)"
-	myApp.Version = VERSION
+	myApp.Version = generic.VERSION
 	myApp.Flags = []cli.Flag{
 		cli.StringFlag{
-			Name:  "localaddr,l",
-			Value: ":12948",
-			Usage: "local listen address",
+			Name:   "localaddr,l",
+			Value:  ":12948",
+			Usage:  "local listen address, or unix:/path/to.sock for a unix socket",
+			EnvVar: "KCPTUN_LOCALADDR",
+		},
+		cli.BoolFlag{
+			Name:   "stdio",
+			Usage:  "relay a single stream between stdin/stdout and the tunnel instead of listening, e.g. as an OpenSSH ProxyCommand",
+			EnvVar: "KCPTUN_STDIO",
 		},
 		cli.StringFlag{
-			Name:  "remoteaddr, r",
-			Value: "vps:29900",
-			Usage: "kcp server address",
+			Name:   "tun",
+			Value:  "",
+			Usage:  "relay IP packets of this TUN interface, like tun0, instead of listening, the server needs --tun too",
+			EnvVar: "KCPTUN_TUN",
 		},
 		cli.StringFlag{
-			Name:   "key",
-			Value:  "it's a secrect",
-			Usage:  "pre-shared secret between client and server",
-			EnvVar: "KCPTUN_KEY",
+			Name:   "tap",
+			Value:  "",
+			Usage:  "bridge Ethernet frames of this TAP interface, like tap0, instead of listening, the server needs --tap too",
+			EnvVar: "KCPTUN_TAP",
 		},
+		generic.TapFilterFlag,
 		cli.StringFlag{
-			Name:  "crypt",
-			Value: "aes",
-			Usage: "aes, aes-128, aes-192, salsa20, blowfish, twofish, cast5, 3des, tea, xtea, xor, sm4, none",
+			Name:   "interactive",
+			Value:  "",
+			Usage:  "local listen address for interactive streams, like SSH, served ahead of the bulk streams of localaddr",
+			EnvVar: "KCPTUN_INTERACTIVE",
 		},
 		cli.StringFlag{
-			Name:  "mode",
-			Value: "fast",
-			Usage: "profiles: fast3, fast2, fast, normal, manual",
+			Name:   "remoteaddr, r",
+			Value:  "vps:29900",
+			Usage:  "kcp server address, or the introducer's with --peer, several separated by commas to use the one answering the fastest, or a domain without a port to use the servers of its _kcptun._udp SRV records, or auto for those announced with mdns on the local network",
+			EnvVar: "KCPTUN_REMOTEADDR",
 		},
-		cli.IntFlag{
-			Name:  "conn",
-			Value: 1,
-			Usage: "set num of UDP connections to server",
+		cli.StringFlag{
+			Name:   "peer",
+			Value:  "",
+			Usage:  "connect directly to the server registered as this peer id with the introducer at remoteaddr, through NAT",
+			EnvVar: "KCPTUN_PEER",
+		},
+		cli.StringFlag{
+			Name:   "stun",
+			Value:  "",
+			Usage:  "STUN servers to discover the public address and NAT kind with, like stun.l.google.com:19302,stun.cloudflare.com:3478",
+			EnvVar: "KCPTUN_STUN",
 		},
+		generic.KeyFlag,
+		generic.CryptFlag,
+		generic.ModeFlag,
 		cli.IntFlag{
-			Name:  "autoexpire",
-			Value: 0,
-			Usage: "set auto expiration time(in seconds) for a single UDP connection, 0 to disable",
+			Name:   "conn",
+			Value:  1,
+			Usage:  "set num of UDP connections to server",
+			EnvVar: "KCPTUN_CONN",
 		},
 		cli.IntFlag{
-			Name:  "scavengettl",
-			Value: 600,
-			Usage: "set how long an expired connection can live(in sec), -1 to disable",
+			Name:   "autoexpire",
+			Value:  0,
+			Usage:  "set auto expiration time(in seconds) for a single UDP connection, 0 to disable",
+			EnvVar: "KCPTUN_AUTOEXPIRE",
 		},
 		cli.IntFlag{
-			Name:  "mtu",
-			Value: 1350,
-			Usage: "set maximum transmission unit for UDP packets",
+			Name:   "warm",
+			Value:  0,
+			Usage:  "spare sessions kept established to replace expired or broken ones without a stall",
+			EnvVar: "KCPTUN_WARM",
 		},
 		cli.IntFlag{
-			Name:  "sndwnd",
-			Value: 128,
-			Usage: "set send window size(num of packets)",
+			Name:   "scavengettl",
+			Value:  600,
+			Usage:  "set how long an expired connection can live(in sec), -1 to disable",
+			EnvVar: "KCPTUN_SCAVENGETTL",
 		},
+		generic.MTUFlag,
 		cli.IntFlag{
-			Name:  "rcvwnd",
-			Value: 512,
-			Usage: "set receive window size(num of packets)",
+			Name:   "sndwnd",
+			Value:  128,
+			Usage:  "set send window size(num of packets)",
+			EnvVar: "KCPTUN_SNDWND",
 		},
 		cli.IntFlag{
-			Name:  "datashard,ds",
-			Value: 10,
-			Usage: "set reed-solomon erasure coding - datashard",
+			Name:   "rcvwnd",
+			Value:  512,
+			Usage:  "set receive window size(num of packets)",
+			EnvVar: "KCPTUN_RCVWND",
 		},
 		cli.IntFlag{
-			Name:  "parityshard,ps",
-			Value: 3,
-			Usage: "set reed-solomon erasure coding - parityshard",
+			Name:   "upbw",
+			Value:  0,
+			Usage:  "uplink bandwidth in Mbit/s to pace the sending to, and with downbw, send with the server's receive window, 0 for unknown",
+			EnvVar: "KCPTUN_UPBW",
 		},
 		cli.IntFlag{
-			Name:  "dscp",
-			Value: 0,
-			Usage: "set DSCP(6bit)",
+			Name:   "downbw",
+			Value:  0,
+			Usage:  "downlink bandwidth in Mbit/s for the server to pace its sending to, and with upbw, have it send with this end's receive window, 0 for unknown",
+			EnvVar: "KCPTUN_DOWNBW",
 		},
-		cli.BoolFlag{
-			Name:  "nocomp",
-			Usage: "disable compression",
+		generic.DataShardFlag,
+		generic.ParityShardFlag,
+		generic.DSCPFlag,
+		generic.DFFlag,
+		generic.TTLFlag,
+		generic.FWMarkFlag,
+		generic.NoCompFlag,
+		generic.StreamCompFlag,
+		generic.AckNodelayFlag,
+		generic.NoDelayFlag,
+		generic.IntervalFlag,
+		generic.ResendFlag,
+		generic.NoCongestionFlag,
+		generic.SockBufFlag,
+		generic.KeepAliveFlag,
+		generic.KeepAliveTimeoutFlag,
+		cli.StringFlag{
+			Name:   "handshake",
+			Value:  "none",
+			Usage:  "key exchange starting every session: none(pre-shared key only), tls(TLS 1.3, verifying the server with --tlsca, or by the key), noise-ik, noise-xk(Noise with --noiseserver), must match the server",
+			EnvVar: "KCPTUN_HANDSHAKE",
+		},
+		cli.StringFlag{
+			Name:   "tlsca",
+			Value:  "",
+			Usage:  "CA certificates file verifying the server's certificate with --handshake tls",
+			EnvVar: "KCPTUN_TLSCA",
+		},
+		cli.StringFlag{
+			Name:   "tlsname",
+			Value:  "",
+			Usage:  "server name expected in the certificate with --tlsca, the host of --remoteaddr by default",
+			EnvVar: "KCPTUN_TLSNAME",
+		},
+		cli.StringFlag{
+			Name:   "tlscert",
+			Value:  "",
+			Usage:  "certificate file identifying the client to the server with --handshake tls",
+			EnvVar: "KCPTUN_TLSCERT",
+		},
+		generic.TLSKeyFlag,
+		cli.StringFlag{
+			Name:   "pin",
+			Value:  "",
+			Usage:  "comma separated sha256/... pins of the server's public key, refusing sessions with another key, logged by the server at startup",
+			EnvVar: "KCPTUN_PIN",
+		},
+		cli.StringFlag{
+			Name:   "noisekey",
+			Value:  "",
+			Usage:  "the client's noise private key in base64, from genkey --noise, a random one by default",
+			EnvVar: "KCPTUN_NOISEKEY",
+		},
+		cli.StringFlag{
+			Name:   "noiseserver",
+			Value:  "",
+			Usage:  "the server's noise public key in base64",
+			EnvVar: "KCPTUN_NOISESERVER",
 		},
 		cli.BoolFlag{
-			Name:   "acknodelay",
-			Usage:  "flush ack immediately when a packet is received",
-			Hidden: true,
+			Name:   "pq",
+			Usage:  "require a hybrid X25519+Kyber768 key exchange in the noise handshake, against future quantum computers",
+			EnvVar: "KCPTUN_PQ",
 		},
 		cli.IntFlag{
-			Name:   "nodelay",
-			Value:  0,
-			Hidden: true,
+			Name:   "handshaketimeout",
+			Value:  10,
+			Usage:  "seconds to wait for the server's answer to the hello",
+			EnvVar: "KCPTUN_HANDSHAKETIMEOUT",
 		},
 		cli.IntFlag{
-			Name:   "interval",
-			Value:  50,
-			Hidden: true,
+			Name:   "streamtimeout",
+			Value:  0,
+			Usage:  "seconds to wait for the server to connect a stream to the target before resetting the local connection, 0 to wait as long as the server tries",
+			EnvVar: "KCPTUN_STREAMTIMEOUT",
+		},
+		cli.BoolFlag{
+			Name:   "migrate",
+			Usage:  "move the streams of a dead session over to the next one instead of resetting them, at the cost of buffering up to 1MB per stream and direction",
+			EnvVar: "KCPTUN_MIGRATE",
+		},
+		cli.BoolFlag{
+			Name:   "checksum",
+			Usage:  "check the data of every stream end to end with a CRC, failing streams corrupted on the way, e.g. by a router's bad memory",
+			EnvVar: "KCPTUN_CHECKSUM",
+		},
+		cli.BoolTFlag{
+			Name:   "tcp-nodelay",
+			Usage:  "disable Nagle's algorithm on the local TCP connections, --tcp-nodelay=false to enable it",
+			EnvVar: "KCPTUN_TCP_NODELAY",
 		},
 		cli.IntFlag{
-			Name:   "resend",
+			Name:   "tcp-keepalive",
 			Value:  0,
-			Hidden: true,
+			Usage:  "seconds between TCP keepalive probes on the local connections, 0 for the system default",
+			EnvVar: "KCPTUN_TCP_KEEPALIVE",
 		},
 		cli.IntFlag{
-			Name:   "nc",
-			Value:  0,
-			Hidden: true,
+			Name:   "tcp-linger",
+			Value:  -1,
+			Usage:  "SO_LINGER seconds of the local connections, 0 to reset on close, -1 for the system default",
+			EnvVar: "KCPTUN_TCP_LINGER",
+		},
+		generic.SmuxFrameFlag,
+		generic.SnmpLogFlag,
+		generic.SnmpPeriodFlag,
+		generic.StatsdFlag,
+		generic.StatsdPeriodFlag,
+		cli.StringFlag{
+			Name:   "statsdprefix",
+			Value:  "kcptun.client",
+			Usage:  "prefix of the statsd metric names",
+			EnvVar: "KCPTUN_STATSDPREFIX",
+		},
+		generic.AdminFlag,
+		generic.LogFlag,
+		generic.QuietFlag,
+		cli.StringFlag{
+			Name:   "transport",
+			Value:  "udp",
+			Usage:  "udp, tcp, ws, faketcp(raw TCP segments, needs CAP_NET_RAW), quic(QUIC in place of KCP, for comparison), icmp(ICMP echo, needs CAP_NET_RAW), dns(DNS queries through the resolver at remoteaddr, last resort), auto(udp, falling back to tcp then ws when the server doesn't answer)",
+			EnvVar: "KCPTUN_TRANSPORT",
+		},
+		cli.StringFlag{
+			Name:   "wsurl",
+			Value:  "",
+			Usage:  "websocket endpoint of the server for transport ws, like wss://example.com/",
+			EnvVar: "KCPTUN_WSURL",
+		},
+		cli.StringFlag{
+			Name:   "dnsdomain",
+			Value:  "",
+			Usage:  "domain delegated to the server for transport dns, like t.example.com",
+			EnvVar: "KCPTUN_DNSDOMAIN",
+		},
+		cli.BoolFlag{
+			Name:   "prefer-ipv6",
+			Usage:  "try the server's IPv6 addresses first when racing its addresses, IPv4 goes first by default",
+			EnvVar: "KCPTUN_PREFER_IPV6",
 		},
 		cli.IntFlag{
-			Name:   "sockbuf",
-			Value:  4194304, // socket buffer size in bytes
-			Hidden: true,
+			Name:   "resolveperiod",
+			Value:  300,
+			Usage:  "re-resolve a hostname remoteaddr every this many seconds and move the sessions when it changes, 0 to disable",
+			EnvVar: "KCPTUN_RESOLVEPERIOD",
 		},
 		cli.IntFlag{
-			Name:   "keepalive",
-			Value:  10, // nat keepalive interval in seconds
-			Hidden: true,
+			Name:   "selectinterval",
+			Value:  60,
+			Usage:  "ping the servers of a remoteaddr list every this many seconds and move new sessions to the fastest, 0 to keep the first choice",
+			EnvVar: "KCPTUN_SELECTINTERVAL",
 		},
 		cli.StringFlag{
-			Name:  "snmplog",
-			Value: "",
-			Usage: "collect snmp to file, aware of timeformat in golang, like: ./snmp-20060102.log",
+			Name:   "state",
+			Value:  "",
+			Usage:  "keep the resumption token, pushed parameters and server picked in this file, for a restart to start with them",
+			EnvVar: "KCPTUN_STATE",
+		},
+		cli.StringFlag{
+			Name:   "resolver",
+			Value:  "",
+			Usage:  "resolve remoteaddr with this DNS server, like 1.1.1.1:53, or DNS-over-HTTPS url, like https://1.1.1.1/dns-query, instead of the system resolver",
+			EnvVar: "KCPTUN_RESOLVER",
+		},
+		cli.StringFlag{
+			Name:   "bind",
+			Value:  "",
+			Usage:  "send the UDP traffic from this local address, to pick an uplink on multihomed hosts",
+			EnvVar: "KCPTUN_BIND",
+		},
+		cli.StringFlag{
+			Name:   "interface",
+			Value:  "",
+			Usage:  "send the UDP traffic out of this interface whatever the default route, like eth1, linux only",
+			EnvVar: "KCPTUN_INTERFACE",
+		},
+		cli.StringFlag{
+			Name:   "multipath",
+			Value:  "",
+			Usage:  "bond the UDP paths from these local addresses, like 192.168.1.2,10.64.0.2 for DSL and LTE uplinks",
+			EnvVar: "KCPTUN_MULTIPATH",
+		},
+		cli.BoolFlag{
+			Name:   "mpdup",
+			Usage:  "duplicate every packet on all healthy paths instead of striping, for reliability over bandwidth",
+			EnvVar: "KCPTUN_MPDUP",
+		},
+		cli.StringFlag{
+			Name:   "port-range",
+			Value:  "",
+			Usage:  "hop over the server ports in this range, like 20000-30000, the server must hop with the same range and key",
+			EnvVar: "KCPTUN_PORT_RANGE",
 		},
 		cli.IntFlag{
-			Name:  "snmpperiod",
-			Value: 60,
-			Usage: "snmp collect period, in seconds",
+			Name:   "hop-interval",
+			Value:  60,
+			Usage:  "seconds between port hops, must match the server",
+			EnvVar: "KCPTUN_HOP_INTERVAL",
 		},
 		cli.StringFlag{
-			Name:  "log",
-			Value: "",
-			Usage: "specify a log file to output, default goes to stderr",
+			Name:   "padding",
+			Value:  "none",
+			Usage:  "pad packets against size fingerprinting: none, random(random sizes within mtu), bucket(multiples of 128 bytes), the server must enable padding too",
+			EnvVar: "KCPTUN_PADDING",
+		},
+		generic.RecordsFlag,
+		cli.StringFlag{
+			Name:   "obfs",
+			Value:  "none",
+			Usage:  "disguise the UDP packets: none, scramble(keyed header scrambling), dtls(DTLS 1.2 records), must match the server",
+			EnvVar: "KCPTUN_OBFS",
+		},
+		cli.IntFlag{
+			Name:   "chaff",
+			Value:  0,
+			Usage:  "send bursts of dummy packets about every N seconds while idle, 0 to disable, the server must enable chaff too",
+			EnvVar: "KCPTUN_CHAFF",
+		},
+		cli.IntFlag{
+			Name:   "kcpkeepalive",
+			Value:  0,
+			Usage:  "seconds of silence before pinging the server below KCP, independent of the smux keepalive, 0 to disable",
+			EnvVar: "KCPTUN_KCPKEEPALIVE",
+		},
+		cli.IntFlag{
+			Name:   "telemetry",
+			Value:  0,
+			Usage:  "seconds between link reports exchanged with the server on a control stream, for its loss and rtt in stats and top, 0 to disable",
+			EnvVar: "KCPTUN_TELEMETRY",
+		},
+		cli.IntFlag{
+			Name:   "deadpeer",
+			Value:  0,
+			Usage:  "seconds of silence before the server is considered dead and the session replaced, 0 to disable",
+			EnvVar: "KCPTUN_DEADPEER",
 		},
 		cli.BoolFlag{
-			Name:  "quiet",
-			Usage: "to suppress the 'stream open/close' messages",
+			Name:   "nohello",
+			Usage:  "skip the version and parameter check when connecting, for servers predating it",
+			EnvVar: "KCPTUN_NOHELLO",
+		},
+		generic.OTLPFlag,
+		cli.StringFlag{
+			Name:   "webhook",
+			Value:  "",
+			Usage:  "POST JSON events to this URL: session_established, session_lost, server_unreachable, loss, loss_recovered",
+			EnvVar: "KCPTUN_WEBHOOK",
 		},
+		generic.WebhookLossFlag,
+		generic.PcapFlag,
+		generic.PcapPlainFlag,
+		generic.ImpairFlag,
+		generic.SeedFlag,
 		cli.StringFlag{
-			Name:  "c",
-			Value: "", // when the value is not empty, the config path must exists
-			Usage: "config from json file, which will override the command from shell",
+			Name:   "recordtraffic",
+			Value:  "",
+			Usage:  "debug: record the timing and sizes of the streams, without their data, to a trace file for the replay command",
+			EnvVar: "KCPTUN_RECORDTRAFFIC",
 		},
+		generic.ConfigFlag,
+	}
+	myApp.Commands = []cli.Command{
+		pingCommand,
+		checkCommand,
+		selftestCommand,
+		replayCommand,
+		generic.GenKeyCommand,
+		generic.TopCommand,
 	}
 	myApp.Action = func(c *cli.Context) error {
-		config := Config{}
-		config.LocalAddr = c.String("localaddr")
-		config.RemoteAddr = c.String("remoteaddr")
-		config.Key = c.String("key")
-		config.Crypt = c.String("crypt")
-		config.Mode = c.String("mode")
-		config.Conn = c.Int("conn")
-		config.AutoExpire = c.Int("autoexpire")
-		config.ScavengeTTL = c.Int("scavengettl")
-		config.MTU = c.Int("mtu")
-		config.SndWnd = c.Int("sndwnd")
-		config.RcvWnd = c.Int("rcvwnd")
-		config.DataShard = c.Int("datashard")
-		config.ParityShard = c.Int("parityshard")
-		config.DSCP = c.Int("dscp")
-		config.NoComp = c.Bool("nocomp")
-		config.AckNodelay = c.Bool("acknodelay")
-		config.NoDelay = c.Int("nodelay")
-		config.Interval = c.Int("interval")
-		config.Resend = c.Int("resend")
-		config.NoCongestion = c.Int("nc")
-		config.SockBuf = c.Int("sockbuf")
-		config.KeepAlive = c.Int("keepalive")
-		config.Log = c.String("log")
-		config.SnmpLog = c.String("snmplog")
-		config.SnmpPeriod = c.Int("snmpperiod")
-		config.Quiet = c.Bool("quiet")
-
-		if c.String("c") != "" {
-			err := parseJSONConfig(&config, c.String("c"))
-			checkError(err)
-		}
+		watchSignals()
+		config := loadConfig(c)
 
 		// log redirect
 		if config.Log != "" {
 			f, err := os.OpenFile(config.Log, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-			checkError(err)
+			if err != nil {
+				return generic.Fatal(generic.ExitBind, err)
+			}
 			defer f.Close()
 			log.SetOutput(f)
 		}
 
-		switch config.Mode {
-		case "normal":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 0, 40, 2, 1
-		case "fast":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 0, 30, 2, 1
-		case "fast2":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 1, 20, 2, 1
-		case "fast3":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 1, 10, 2, 1
+		log.Println("version:", generic.VERSION)
+		if config.Key == generic.DefaultKey {
+			log.Println("WARNING: running with the public default key, generate one with 'genkey'")
+		}
+		if err := generic.TuneTimers(); err != nil {
+			log.Println("TuneTimers:", err)
+		}
+		// stdio and tun modes relay without a local port
+		var listener net.Listener
+		var err error
+		if !config.Stdio && generic.TunnelKind(config.Tun, config.Tap) == "" {
+			listener, err = generic.ListenStream(config.LocalAddr)
+			if err != nil {
+				return generic.Fatal(generic.ExitBind, err)
+			}
+			log.Println("listening on:", listener.Addr())
 		}
 
-		log.Println("version:", VERSION)
-		addr, err := net.ResolveTCPAddr("tcp", config.LocalAddr)
-		checkError(err)
-		listener, err := net.ListenTCP("tcp", addr)
-		checkError(err)
-
-		pass := pbkdf2.Key([]byte(config.Key), []byte(SALT), 4096, 32, sha1.New)
 		var block kcp.BlockCrypt
-		switch config.Crypt {
-		case "sm4":
-			block, _ = kcp.NewSM4BlockCrypt(pass[:16])
-		case "tea":
-			block, _ = kcp.NewTEABlockCrypt(pass[:16])
-		case "xor":
-			block, _ = kcp.NewSimpleXORBlockCrypt(pass)
-		case "none":
-			block, _ = kcp.NewNoneBlockCrypt(pass)
-		case "aes-128":
-			block, _ = kcp.NewAESBlockCrypt(pass[:16])
-		case "aes-192":
-			block, _ = kcp.NewAESBlockCrypt(pass[:24])
-		case "blowfish":
-			block, _ = kcp.NewBlowfishBlockCrypt(pass)
-		case "twofish":
-			block, _ = kcp.NewTwofishBlockCrypt(pass)
-		case "cast5":
-			block, _ = kcp.NewCast5BlockCrypt(pass[:16])
-		case "3des":
-			block, _ = kcp.NewTripleDESBlockCrypt(pass[:24])
-		case "xtea":
-			block, _ = kcp.NewXTEABlockCrypt(pass[:16])
-		case "salsa20":
-			block, _ = kcp.NewSalsa20BlockCrypt(pass)
-		default:
-			config.Crypt = "aes"
-			block, _ = kcp.NewAESBlockCrypt(pass)
-		}
-
-		log.Println("listening on:", listener.Addr())
+		block, config.Crypt = generic.NewBlockCrypt(config.Key, config.Crypt)
+
+		log.Println("stdio:", config.Stdio)
+		log.Println("tun:", config.Tun, "tap:", config.Tap, "tapfilter:", config.TapFilter)
+		log.Println("interactive:", config.Interactive)
 		log.Println("encryption:", config.Crypt)
 		log.Println("nodelay parameters:", config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
 		log.Println("remote address:", config.RemoteAddr)
+		log.Println("peer:", config.Peer)
+		log.Println("stun:", config.STUN)
+		log.Println("transport:", config.Transport, "wsurl:", config.WSURL, "dnsdomain:", config.DNSDomain)
 		log.Println("sndwnd:", config.SndWnd, "rcvwnd:", config.RcvWnd)
-		log.Println("compression:", !config.NoComp)
+		log.Println("upbw:", config.UpBW, "downbw:", config.DownBW)
+		log.Println("compression:", !config.NoComp, "streamcomp:", config.StreamComp)
+		log.Println("telemetry:", config.Telemetry)
 		log.Println("mtu:", config.MTU)
 		log.Println("datashard:", config.DataShard, "parityshard:", config.ParityShard)
 		log.Println("acknodelay:", config.AckNodelay)
-		log.Println("dscp:", config.DSCP)
+		log.Println("dscp:", config.DSCP, "df:", config.DF, "ttl:", config.TTL)
+		if err := generic.CheckDF(config.DF); err != nil {
+			return generic.Fatal(generic.ExitConfig, err)
+		}
 		log.Println("sockbuf:", config.SockBuf)
-		log.Println("keepalive:", config.KeepAlive)
+		log.Println("keepalive:", config.KeepAlive, "keepalivetimeout:", config.KeepAliveTimeout)
+		log.Println("handshake:", config.Handshake, "pq:", config.PQ, "tlsca:", config.TLSCA, "tlsname:", config.TLSName, "noiseserver:", config.NoiseServer, "pin:", config.Pin)
+		log.Println("handshaketimeout:", config.HandshakeTimeout, "streamtimeout:", config.StreamTimeout, "migrate:", config.Migrate, "checksum:", config.Checksum)
+		log.Println("smuxframe:", config.SmuxFrame)
+		log.Println("tcp-nodelay:", config.TCPNoDelay, "tcp-keepalive:", config.TCPKeepAlive, "tcp-linger:", config.TCPLinger)
 		log.Println("conn:", config.Conn)
-		log.Println("autoexpire:", config.AutoExpire)
+		log.Println("autoexpire:", config.AutoExpire, "warm:", config.Warm)
 		log.Println("scavengettl:", config.ScavengeTTL)
 		log.Println("snmplog:", config.SnmpLog)
 		log.Println("snmpperiod:", config.SnmpPeriod)
+		log.Println("statsd:", config.Statsd, "statsdperiod:", config.StatsdPeriod, "statsdprefix:", config.StatsdPrefix)
+		log.Println("admin:", config.Admin)
 		log.Println("quiet:", config.Quiet)
+		log.Println("prefer-ipv6:", config.PreferIPv6)
+		log.Println("resolveperiod:", config.ResolvePeriod, "resolver:", config.Resolver, "selectinterval:", config.SelectInterval)
+		log.Println("state:", config.State)
+		log.Println("bind:", config.Bind, "interface:", config.Interface, "fwmark:", config.FWMark)
+		log.Println("multipath:", config.Multipath, "mpdup:", config.MPDup)
+		log.Println("port-range:", config.PortRange, "hop-interval:", config.HopInterval)
+		log.Println("padding:", config.Padding)
+		if err := generic.CheckPaddingMode(config.Padding); err != nil {
+			return generic.Fatal(generic.ExitConfig, err)
+		}
+		log.Println("records:", config.Records)
+		if _, _, err := generic.ParseRecords(config.Records); err != nil {
+			return generic.Fatal(generic.ExitConfig, err)
+		}
+		log.Println("obfs:", config.Obfs)
+		log.Println("chaff:", config.Chaff)
+		log.Println("nohello:", config.NoHello)
+		log.Println("kcpkeepalive:", config.KCPKeepAlive, "deadpeer:", config.DeadPeer)
+		log.Println("pcap:", config.Pcap, "pcapplain:", config.PcapPlain)
+		log.Println("impair:", config.Impair, "seed:", config.Seed)
+		if config.Seed != 0 {
+			generic.SetSeed(config.Seed)
+		}
+		log.Println("recordtraffic:", config.RecordTraffic)
+		if config.RecordTraffic != "" {
+			if traffic, err = generic.NewTrafficRecorder(config.RecordTraffic); err != nil {
+				return generic.Fatal(generic.ExitBind, err)
+			}
+		}
+		log.Println("otlp:", config.OTLP)
+		tracer = generic.NewTracer(config.OTLP, "kcptun-client")
+		log.Println("webhook:", config.Webhook, "webhookloss:", config.WebhookLoss)
+		if err := generic.CheckWebhook(config.Webhook); err != nil {
+			return generic.Fatal(generic.ExitConfig, err)
+		}
+		webhook = generic.NewWebhook(config.Webhook, "kcptun-client")
+		webhook.WatchLoss(float64(config.WebhookLoss))
+		log.Println("schedule:", len(config.Schedule), "profiles")
+		if err := generic.CheckSchedule(config.Schedule); err != nil {
+			return generic.Fatal(generic.ExitConfig, err)
+		}
+		if configFile = c.String("c"); len(config.Schedule) > 0 {
+			schedule = generic.NewSchedule(config.Schedule)
+		}
+
+		// what the client learned before its restart
+		var state *stateFile
+		if config.State != "" {
+			state = openState(config.State, config.RemoteAddr)
+		}
+
+		// of several servers, start with the fastest, or the first one of
+		// the SRV records answering
+		var selector *serverSelector
+		servers, ordered := splitRemotes(config.RemoteAddr), false
+		if len(servers) == 1 && servers[0] == "auto" {
+			servers = browseServers()
+			config.RemoteAddr = servers[0]
+		}
+		if len(servers) == 1 && isSRVName(servers[0]) {
+			servers, ordered = lookupServers(config.Resolver, servers[0]), true
+			config.RemoteAddr = servers[0]
+		}
+		if len(servers) > 1 {
+			if config.Peer != "" {
+				return generic.Fatal(generic.ExitConfig, errors.New("remoteaddr: a list of servers doesn't go with --peer"))
+			}
+			selector = newServerSelector(servers, ordered, &config, block, state)
+			config.RemoteAddr = selector.pick()
+		}
+
+		remoteName := config.RemoteAddr
+		if config.Transport == "udp" || config.Transport == "auto" {
+			if addr, err := raceRemote(&config, block); err == nil {
+				config.RemoteAddr = addr
+			} else {
+				log.Println(err)
+			}
+		}
+		if config.Transport == "auto" {
+			config.Transport = selectTransport(&config, block)
+		}
 
-		smuxConfig := smux.DefaultConfig()
-		smuxConfig.MaxReceiveBuffer = config.SockBuf
-		smuxConfig.KeepAliveInterval = time.Duration(config.KeepAlive) * time.Second
+		// other transports resolve the name on every dial, unless the
+		// system resolver is bypassed
+		if config.Resolver != "" && config.Transport != "udp" && config.Transport != "ws" {
+			if addr, err := resolveRemote(&config); err == nil {
+				config.RemoteAddr = addr
+			} else {
+				log.Println("resolver:", err)
+			}
+		}
+		resolver := newRemoteResolver(remoteName, config.RemoteAddr)
+		if selector != nil && config.SelectInterval > 0 {
+			go selector.loop(time.Duration(config.SelectInterval)*time.Second, remoteName, resolver)
+		} else if config.Transport == "udp" && config.ResolvePeriod > 0 {
+			go resolver.loop(time.Duration(config.ResolvePeriod)*time.Second, &config, block)
+		}
+		if config.Transport == "faketcp" {
+			log.Println(generic.FakeTCPNote(0, config.RemoteAddr))
+		}
+		if config.Transport == "quic" {
+			if config.Stdio || generic.TunnelKind(config.Tun, config.Tap) != "" {
+				return cli.NewExitError("stdio, tun, tap: not supported over quic", 1)
+			}
+			// QUIC brings its own congestion control, mux and crypto
+			return runQUIC(listener, &config)
+		}
 
-		createConn := func() (*smux.Session, error) {
-			kcpconn, err := kcp.DialWithOptions(config.RemoteAddr, block, config.DataShard, config.ParityShard)
+		// packet capturing for debugging
+		var pcap *generic.PcapWriter
+		if config.Pcap != "" {
+			pcap, err = generic.NewPcapWriter(config.Pcap)
 			if err != nil {
-				return nil, errors.Wrap(err, "createConn()")
+				return generic.Fatal(generic.ExitBind, err)
 			}
-			kcpconn.SetStreamMode(true)
-			kcpconn.SetWriteDelay(true)
-			kcpconn.SetNoDelay(config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
-			kcpconn.SetWindowSize(config.SndWnd, config.RcvWnd)
-			kcpconn.SetMtu(config.MTU)
-			kcpconn.SetACKNoDelay(config.AckNodelay)
+			defer pcap.Close()
+		}
 
-			if err := kcpconn.SetDSCP(config.DSCP); err != nil {
-				log.Println("SetDSCP:", err)
+		// simulated link faults for testing
+		var impairment *generic.Impairment
+		if config.Impair != "" {
+			impairment, err = generic.ParseImpairment(config.Impair)
+			if err != nil {
+				return generic.Fatal(generic.ExitConfig, err)
 			}
-			if err := kcpconn.SetReadBuffer(config.SockBuf); err != nil {
-				log.Println("SetReadBuffer:", err)
+		}
+
+		// wrap decorates the UDP socket of every new session
+		wrap := func(conn net.PacketConn) net.PacketConn {
+			if pcap != nil {
+				var plain kcp.BlockCrypt
+				if config.PcapPlain {
+					plain = block
+				}
+				conn = generic.NewPcapConn(conn, pcap, plain)
 			}
-			if err := kcpconn.SetWriteBuffer(config.SockBuf); err != nil {
-				log.Println("SetWriteBuffer:", err)
+			if impairment != nil {
+				conn = generic.NewImpairConn(conn, impairment)
+			}
+			return conn
+		}
+
+		smuxConfig := generic.NewSmuxConfig(config.SockBuf, config.KeepAlive, config.KeepAliveTimeout, config.SmuxFrame)
+
+		// pushed parameters and resumption token of the last hello
+		hellos := &helloState{key: generic.DeriveKey(config.Key), state: state}
+		state.restore(hellos)
+
+		kx, err := newKeyExchange(&config)
+		if err != nil {
+			return generic.Fatal(generic.ExitConfig, err)
+		}
+		logPublic(kx)
+
+		createConn := func(interactive bool) (*session, error) {
+			sessConfig := config
+			sessConfig.RemoteAddr, _ = resolver.get()
+			hellos.apply(&sessConfig)
+			span := tracer.Start("handshake", nil)
+			span.SetAttr("net.peer.addr", sessConfig.RemoteAddr)
+			span.SetAttr("interactive", interactive)
+			defer span.End()
+			kcpconn, err := dial(&sessConfig, block, wrap)
+			if err != nil {
+				span.SetError(err)
+				return nil, errors.Wrap(err, "createConn()")
+			}
+			var conn net.Conn = kcpconn
+			if min, max, _ := generic.ParseRecords(config.Records); min > 0 {
+				// each record goes out as it's written
+				kcpconn.SetWriteDelay(false)
+				conn = generic.NewRecordConn(kcpconn, min, max)
+			}
+			var feats features
+			token, secret := hellos.take()
+			if token != nil && secret != nil && kx.Mode != generic.HandshakeNone {
+				// the keys of the session the token was issued in
+				conn, err = generic.ResumeClient(conn, token, secret)
+			} else {
+				conn, err = kx.Run(conn)
+			}
+			if err != nil {
+				span.SetError(err)
+				kcpconn.Close()
+				return nil, errors.Wrap(err, "createConn()")
+			}
+			if !config.NoHello {
+				if conn, feats, err = hellos.handshake(conn, token, kcpconn, &config, &sessConfig, interactive); err != nil {
+					span.SetError(err)
+					kcpconn.Close()
+					return nil, errors.Wrap(err, "createConn()")
+				}
+			}
+			if config.UpBW > 0 {
+				conn = generic.NewRateLimitedConn(conn, nil, generic.NewRateLimiter(config.UpBW*1000*1000/8))
+			}
+			if schedule != nil {
+				conn = generic.NewRateLimitedConn(conn, schedule.Down, schedule.Up)
 			}
 
 			// stream multiplex
-			var session *smux.Session
+			var mux *smux.Session
 			if config.NoComp {
-				session, err = smux.Client(kcpconn, smuxConfig)
+				mux, err = smux.Client(conn, smuxConfig)
 			} else {
-				session, err = smux.Client(newCompStream(kcpconn), smuxConfig)
+				mux, err = smux.Client(generic.NewCompStream(conn), smuxConfig)
 			}
 			if err != nil {
 				return nil, errors.Wrap(err, "createConn()")
 			}
 			log.Println("connection:", kcpconn.LocalAddr(), "->", kcpconn.RemoteAddr())
-			return session, nil
+			stats.AddSession(kcpconn, mux)
+			if webhook != nil {
+				go watchSession(mux, kcpconn.RemoteAddr().String())
+			}
+			if feats.telemetry {
+				// the server takes the first stream for the control stream
+				control, err := mux.OpenStream()
+				if err != nil {
+					mux.Close()
+					return nil, errors.Wrap(err, "createConn()")
+				}
+				t := generic.NewTelemetry(mux, control, kcpconn, time.Duration(config.Telemetry)*time.Second)
+				if config.Mode == "auto" {
+					t.AutoMode()
+				}
+			}
+			return &session{mux, feats}, nil
 		}
 
-		// wait until a connection is ready
-		waitConn := func() *smux.Session {
-			for {
-				if session, err := createConn(); err == nil {
+		// wait until a connection is ready, or with busyFails give up with
+		// nil once the server refuses it as busy
+		dialConn := func(interactive, busyFails bool) *session {
+			for failures := 0; ; failures++ {
+				if session, err := createConn(interactive); err == nil {
 					return session
+				} else if generic.IsAuthFailed(err) {
+					// retrying won't help
+					generic.Exit(generic.ExitAuthFailed, err)
+				} else if generic.IsServerBusy(err) {
+					markBusy()
+					log.Println("re-connecting:", err, "refusing new connections for", serverBusyBackoff)
+					if busyFails {
+						return nil
+					}
+					time.Sleep(serverBusyBackoff)
 				} else {
 					log.Println("re-connecting:", err)
+					if failures == webhookUnreachable {
+						webhook.Post("server_unreachable", fmt.Sprintf("no session with %v after %v attempts: %v", config.RemoteAddr, failures+1, err),
+							map[string]interface{}{"remote": config.RemoteAddr, "error": err.Error()})
+					}
 					time.Sleep(time.Second)
 				}
 			}
 		}
+		waitConn := func(interactive bool) *session { return dialConn(interactive, false) }
+		// while the server is busy, nil without asking it again
+		dialConnUnlessBusy := func(interactive bool) *session {
+			if isBusy() {
+				return nil
+			}
+			return dialConn(interactive, true)
+		}
+
+		if config.Migrate {
+			migrations = newMigrator(func() *session { return waitConn(false) }, time.Duration(config.HandshakeTimeout)*time.Second)
+		}
+
+		if config.Stdio {
+			session := waitConn(false)
+			defer session.Close()
+			handleClient(session, stdioConn{}, &config, nil, false, nil)
+			return nil
+		}
+		if generic.TunnelKind(config.Tun, config.Tap) != "" {
+			return runTun(&config, waitConn)
+		}
 
 		numconn := uint16(config.Conn)
 		muxes := make([]struct {
-			session *smux.Session
+			session *session
 			ttl     time.Time
+			gen     uint32
 		}, numconn)
 
 		for k := range muxes {
-			muxes[k].session = waitConn()
+			muxes[k].gen = resolver.generation()
+			muxes[k].session = waitConn(false)
 			muxes[k].ttl = time.Now().Add(time.Duration(config.AutoExpire) * time.Second)
 		}
 
-		chScavenger := make(chan *smux.Session, 128)
+		// spare sessions replacing the expired and broken ones
+		var warm *warmPool
+		if config.Warm > 0 {
+			warm = newWarmPool(config.Warm, func() (*session, error) { return createConn(false) }, resolver.generation)
+		}
+
+		chScavenger := make(chan *session, 128)
 		go scavenger(chScavenger, config.ScavengeTTL)
-		go snmpLogger(config.SnmpLog, config.SnmpPeriod)
+		go generic.SnmpLogger(config.SnmpLog, config.SnmpPeriod, "PublicAddr", publicAddr)
+		if config.Statsd != "" {
+			go generic.StatsdSink(config.Statsd, config.StatsdPrefix, time.Duration(config.StatsdPeriod)*time.Second, stats)
+		}
+		if config.Admin != "" {
+			admin, err := generic.ListenStream(config.Admin)
+			if err != nil {
+				return generic.Fatal(generic.ExitBind, err)
+			}
+			go generic.ServeAdmin(admin, stats)
+		}
+		if config.STUN != "" {
+			go discoverNAT(config.STUN)
+		}
+		tcpOptions := generic.NewTCPOptions(config.TCPNoDelay, config.TCPKeepAlive, config.TCPLinger)
+
+		// interactive streams get a session of their own, and bulk streams
+		// yield to them
+		var qos *generic.QoS
+		if config.Interactive != "" {
+			qos = generic.NewQoS()
+			ilistener, err := generic.ListenStream(config.Interactive)
+			if err != nil {
+				return generic.Fatal(generic.ExitBind, err)
+			}
+			log.Println("interactive listening on:", ilistener.Addr())
+			go func() {
+				redial := func() *session { return waitConn(true) }
+				session := waitConn(true)
+				for {
+					p1, err := ilistener.Accept()
+					generic.Exit(generic.ExitTransport, err)
+					if err := tcpOptions.Apply(p1); err != nil {
+						log.Println("tcp options:", err)
+					}
+					if session.IsClosed() {
+						if s := dialConnUnlessBusy(true); s != nil {
+							session = s
+						} else {
+							refuseBusy(p1)
+							continue
+						}
+					}
+					go handleClient(session, p1, &config, qos, true, redial)
+				}
+			}()
+		}
+
+		// streams whose early data the server refused get a session of
+		// their own
+		redial := func() *session { return waitConn(false) }
 		rr := uint16(0)
 		for {
-			p1, err := listener.AcceptTCP()
+			p1, err := listener.Accept()
 			if err != nil {
-				log.Fatalln(err)
+				return generic.Fatal(generic.ExitTransport, err)
+			}
+			if err := tcpOptions.Apply(p1); err != nil {
+				log.Println("tcp options:", err)
 			}
-			checkError(err)
 			idx := rr % numconn
 
-			// do auto expiration && reconnection
-			if muxes[idx].session.IsClosed() || (config.AutoExpire > 0 && time.Now().After(muxes[idx].ttl)) {
-				chScavenger <- muxes[idx].session
-				muxes[idx].session = waitConn()
-				muxes[idx].ttl = time.Now().Add(time.Duration(config.AutoExpire) * time.Second)
+			// do auto expiration && reconnection, also after the server moved.
+			// While the server is busy, an open session is kept past its
+			// expiration and the connections needing a new one are reset.
+			if muxes[idx].session.IsClosed() || (config.AutoExpire > 0 && time.Now().After(muxes[idx].ttl)) ||
+				muxes[idx].gen != resolver.generation() {
+				session := warm.get()
+				if session == nil {
+					session = dialConnUnlessBusy(false)
+				}
+				switch {
+				case session != nil:
+					chScavenger <- muxes[idx].session
+					muxes[idx].session = session
+					muxes[idx].gen = resolver.generation()
+					muxes[idx].ttl = time.Now().Add(time.Duration(config.AutoExpire) * time.Second)
+				case muxes[idx].session.IsClosed():
+					refuseBusy(p1)
+					rr++
+					continue
+				}
 			}
 
-			go handleClient(muxes[idx].session, p1, config.Quiet)
+			go handleClient(muxes[idx].session, p1, &config, qos, false, redial)
 			rr++
 		}
 	}
-	myApp.Run(os.Args)
+	return myApp
 }
 
 type scavengeSession struct {
-	session *smux.Session
+	session *session
 	ts      time.Time
 }
 
-func scavenger(ch chan *smux.Session, ttl int) {
+func scavenger(ch chan *session, ttl int) {
 	ticker := time.NewTicker(time.Second)
 	defer ticker.Stop()
 	var sessionList []scavengeSession
@@ -454,7 +1453,7 @@ func scavenger(ch chan *smux.Session, ttl int) {
 			var newList []scavengeSession
 			for k := range sessionList {
 				s := sessionList[k]
-				if s.session.NumStreams() == 0 || s.session.IsClosed() {
+				if generic.UserStreams(s.session.Session) == 0 || s.session.IsClosed() {
 					log.Println("session normally closed")
 					s.session.Close()
 				} else if ttl >= 0 && time.Since(s.ts) >= time.Duration(ttl)*time.Second {
@@ -468,37 +1467,3 @@ func scavenger(ch chan *smux.Session, ttl int) {
 		}
 	}
 }
-
-func snmpLogger(path string, interval int) {
-	if path == "" || interval == 0 {
-		return
-	}
-	ticker := time.NewTicker(time.Duration(interval) * time.Second)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ticker.C:
-			// split path into dirname and filename
-			logdir, logfile := filepath.Split(path)
-			// only format logfile
-			f, err := os.OpenFile(logdir+time.Now().Format(logfile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			w := csv.NewWriter(f)
-			// write header in empty file
-			if stat, err := f.Stat(); err == nil && stat.Size() == 0 {
-				if err := w.Write(append([]string{"Unix"}, kcp.DefaultSnmp.Header()...)); err != nil {
-					log.Println(err)
-				}
-			}
-			if err := w.Write(append([]string{fmt.Sprint(time.Now().Unix())}, kcp.DefaultSnmp.ToSlice()...)); err != nil {
-				log.Println(err)
-			}
-			kcp.DefaultSnmp.Reset()
-			w.Flush()
-			f.Close()
-		}
-	}
-}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/generic"
+)
+
+// migrations moves the streams of dead sessions over, with --migrate
+var migrations *migrator
+
+// migrator hands the streams of a dead session over to a session of its
+// own, shared by all of them, so that they don't wait for the next local
+// connection to replace it
+type migrator struct {
+	connect func() *session
+	timeout time.Duration // for the server's answer
+
+	mu      sync.Mutex
+	session *session
+}
+
+func newMigrator(connect func() *session, timeout time.Duration) *migrator {
+	return &migrator{connect: connect, timeout: timeout}
+}
+
+// open runs raw, a new stream of sess, as a new logical stream. Its id is
+// random from crypto/rand, whatever --seed, as it's all it takes to move
+// the stream over.
+func (m *migrator) open(sess *session, raw io.ReadWriteCloser) (*generic.MigrateStream, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint64(b[:])
+	if err := generic.WriteMigrateHeader(raw, false, id, 0); err != nil {
+		return nil, err
+	}
+	return generic.NewMigrateStream(id, raw, func() bool { return !sess.IsClosed() }, m.dial), nil
+}
+
+// dial opens a stream moving the logical stream id over, implementing
+// generic.MigrateDialer
+func (m *migrator) dial(id, received uint64) (io.ReadWriteCloser, func() bool, uint64, error) {
+	m.mu.Lock()
+	if m.session == nil || m.session.IsClosed() {
+		m.session = m.connect()
+	}
+	sess := m.session
+	m.mu.Unlock()
+	if !sess.migrate {
+		return nil, nil, 0, errors.New("migrate: the server no longer migrates streams")
+	}
+
+	p2, err := sess.OpenStream()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	raw := stats.TrackStream(sess.Session, p2)
+	if err := generic.WriteMigrateHeader(raw, true, id, received); err != nil {
+		raw.Close()
+		return nil, nil, 0, err
+	}
+	p2.SetReadDeadline(time.Now().Add(m.timeout))
+	peerReceived, err := generic.ReadMigrateReply(raw)
+	p2.SetReadDeadline(time.Time{})
+	if err != nil {
+		raw.Close()
+		return nil, nil, 0, err
+	}
+	return raw, func() bool { return !sess.IsClosed() }, peerReceived, nil
+}
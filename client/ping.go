@@ -0,0 +1,410 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/urfave/cli"
+	kcp "github.com/xtaci/kcp-go"
+	"github.com/xtaci/kcptun/generic"
+)
+
+// interval between two probes
+const pingPeriod = 200 * time.Millisecond
+
+// smux v1 NOP frame: ver(1), cmdNOP(3), length(0), sid(0). It is accepted
+// and ignored by the server's mux, so it exercises crypto and KCP only.
+var smuxNOP = []byte{1, 3, 0, 0, 0, 0, 0, 0}
+
+var pingCommand = cli.Command{
+	Name:      "ping",
+	Usage:     "probe a kcptun server, reporting handshake time, rtt, jitter and loss",
+	ArgsUsage: "[server:port]",
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:   "count,n",
+			Value:  10,
+			Usage:  "number of probes to send",
+			EnvVar: "KCPTUN_PING_COUNT",
+		},
+		cli.IntFlag{
+			Name:   "timeout",
+			Value:  3,
+			Usage:  "how long to wait for replies after the last probe, in seconds",
+			EnvVar: "KCPTUN_PING_TIMEOUT",
+		},
+		cli.BoolFlag{
+			Name:   "json",
+			Usage:  "print the results as one JSON object",
+			EnvVar: "KCPTUN_PING_JSON",
+		},
+	},
+	Action: ping,
+}
+
+// echoStats collects the plaintext probe round trips
+type echoStats struct {
+	sent    int
+	rtts    []time.Duration
+	refused bool
+}
+
+func (s *echoStats) loss() float64 {
+	if s.sent == 0 {
+		return 0
+	}
+	return 1 - float64(len(s.rtts))/float64(s.sent)
+}
+
+// summary returns min/avg/max rtt and the mean deviation between
+// consecutive samples as jitter
+func (s *echoStats) summary() (min, avg, max, jitter time.Duration) {
+	if len(s.rtts) == 0 {
+		return
+	}
+	min = s.rtts[0]
+	var sum, dev time.Duration
+	for k, rtt := range s.rtts {
+		sum += rtt
+		if rtt < min {
+			min = rtt
+		}
+		if rtt > max {
+			max = rtt
+		}
+		if k > 0 {
+			d := rtt - s.rtts[k-1]
+			if d < 0 {
+				d = -d
+			}
+			dev += d
+		}
+	}
+	avg = sum / time.Duration(len(s.rtts))
+	if len(s.rtts) > 1 {
+		jitter = dev / time.Duration(len(s.rtts)-1)
+	}
+	return
+}
+
+// kcpStats collects the result of the authenticated KCP probe
+type kcpStats struct {
+	ok        bool  // the server answered
+	authErr   error // of the key exchange
+	helloErr  error // of the hello exchange
+	handshake time.Duration
+	srtt      time.Duration
+	rttvar    time.Duration
+	outSegs   uint64
+	retrans   uint64
+}
+
+// established reports whether the session got through the key and hello
+// exchanges
+func (s *kcpStats) established() bool {
+	return s.ok && s.authErr == nil && s.helloErr == nil
+}
+
+func (s *kcpStats) loss() float64 {
+	if s.outSegs == 0 {
+		return 0
+	}
+	return float64(s.retrans) / float64(s.outSegs)
+}
+
+// pingResult is the --json output of ping, times in milliseconds
+type pingResult struct {
+	Server      string `json:"server"`
+	Crypt       string `json:"crypt"`
+	DataShard   int    `json:"datashard"`
+	ParityShard int    `json:"parityshard"`
+	Compression bool   `json:"compression"`
+	Echo        struct {
+		Sent     int     `json:"sent"`
+		Received int     `json:"received"`
+		Loss     float64 `json:"loss"`
+		RTTMin   float64 `json:"rtt_min,omitempty"`
+		RTTAvg   float64 `json:"rtt_avg,omitempty"`
+		RTTMax   float64 `json:"rtt_max,omitempty"`
+		Jitter   float64 `json:"jitter,omitempty"`
+		Refused  bool    `json:"refused"`
+	} `json:"echo"`
+	KCP struct {
+		OK         bool    `json:"ok"`
+		AuthError  string  `json:"auth_error,omitempty"`
+		HelloError string  `json:"hello_error,omitempty"`
+		Handshake  float64 `json:"handshake,omitempty"`
+		SRTT       float64 `json:"srtt,omitempty"`
+		RTTVar     float64 `json:"rttvar,omitempty"`
+		OutSegs    uint64  `json:"out_segs"`
+		Retrans    uint64  `json:"retrans_segs"`
+		Loss       float64 `json:"loss"`
+	} `json:"kcp"`
+	Diagnosis string `json:"diagnosis"`
+}
+
+// ms converts d to fractional milliseconds
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// pingJSON gathers the results of ping
+func pingJSON(config *Config, echo *echoStats, tun *kcpStats) *pingResult {
+	res := &pingResult{
+		Server:      config.RemoteAddr,
+		Crypt:       config.Crypt,
+		DataShard:   config.DataShard,
+		ParityShard: config.ParityShard,
+		Compression: !config.NoComp,
+		Diagnosis:   diagnose(echo, tun),
+	}
+	res.Echo.Sent = echo.sent
+	res.Echo.Received = len(echo.rtts)
+	res.Echo.Loss = echo.loss()
+	res.Echo.Refused = echo.refused
+	if len(echo.rtts) > 0 {
+		min, avg, max, jitter := echo.summary()
+		res.Echo.RTTMin, res.Echo.RTTAvg, res.Echo.RTTMax, res.Echo.Jitter = ms(min), ms(avg), ms(max), ms(jitter)
+	}
+	res.KCP.OK = tun.established()
+	if tun.authErr != nil {
+		res.KCP.AuthError = tun.authErr.Error()
+	}
+	if tun.helloErr != nil {
+		res.KCP.HelloError = tun.helloErr.Error()
+	}
+	if tun.established() {
+		res.KCP.Handshake, res.KCP.SRTT, res.KCP.RTTVar = ms(tun.handshake), ms(tun.srtt), ms(tun.rttvar)
+		res.KCP.OutSegs, res.KCP.Retrans, res.KCP.Loss = tun.outSegs, tun.retrans, tun.loss()
+	}
+	return res
+}
+
+func ping(c *cli.Context) error {
+	config := loadConfig(c.Parent())
+	if c.Args().Present() {
+		config.RemoteAddr = c.Args().First()
+	}
+	count := c.Int("count")
+	timeout := time.Duration(c.Int("timeout")) * time.Second
+	var block kcp.BlockCrypt
+	block, config.Crypt = generic.NewBlockCrypt(config.Key, config.Crypt)
+
+	if c.Bool("json") {
+		echo, err := probeEcho(config.RemoteAddr, count, timeout)
+		checkError(err)
+		tun, err := probeKCP(&config, block, count, timeout)
+		checkError(err)
+		checkError(generic.PrintJSON(os.Stdout, pingJSON(&config, echo, tun)))
+		return nil
+	}
+
+	fmt.Printf("PING %v, crypt: %v, datashard: %v, parityshard: %v, compression: %v\n",
+		config.RemoteAddr, config.Crypt, config.DataShard, config.ParityShard, !config.NoComp)
+
+	echo, err := probeEcho(config.RemoteAddr, count, timeout)
+	checkError(err)
+	if len(echo.rtts) > 0 {
+		min, avg, max, jitter := echo.summary()
+		fmt.Printf("udp echo: %v/%v received, %.1f%% loss, rtt min/avg/max = %v/%v/%v, jitter %v\n",
+			len(echo.rtts), echo.sent, echo.loss()*100, min, avg, max, jitter)
+	} else {
+		fmt.Printf("udp echo: 0/%v received\n", echo.sent)
+	}
+
+	tun, err := probeKCP(&config, block, count, timeout)
+	checkError(err)
+	switch {
+	case tun.authErr != nil:
+		fmt.Println("kcp: key exchange failed:", tun.authErr)
+	case tun.helloErr != nil:
+		fmt.Println("kcp: hello failed:", tun.helloErr)
+	case tun.ok:
+		fmt.Printf("kcp: handshake %v, srtt %v, rttvar %v, %v/%v segments retransmitted (%.1f%%)\n",
+			tun.handshake, tun.srtt, tun.rttvar, tun.retrans, tun.outSegs, tun.loss()*100)
+	default:
+		fmt.Printf("kcp: no authenticated reply within %v\n", timeout)
+	}
+
+	fmt.Println("diagnosis:", diagnose(echo, tun))
+	return nil
+}
+
+// probeEcho sends count plaintext probes to raddr, which are echoed back by
+// servers running with --echoprobe
+func probeEcho(raddr string, count int, timeout time.Duration) (*echoStats, error) {
+	addr, err := net.ResolveUDPAddr("udp", raddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	stats := new(echoStats)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 1500)
+		seen := make(map[uint32]bool)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				// a connected socket surfaces ICMP port unreachable
+				stats.refused = strings.Contains(err.Error(), "refused")
+				return
+			}
+			seq, sent, ok := generic.ParseProbe(buf[:n])
+			if !ok || int(seq) >= count || seen[seq] {
+				continue
+			}
+			seen[seq] = true
+			stats.rtts = append(stats.rtts, time.Since(sent))
+		}
+	}()
+
+	for i := 0; i < count; i++ {
+		conn.Write(generic.NewProbe(uint32(i), time.Now()))
+		stats.sent++
+		time.Sleep(pingPeriod)
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	<-done
+	return stats, nil
+}
+
+// replyCounter counts the packets a session receives, whatever they carry
+type replyCounter struct {
+	net.PacketConn
+	in uint64
+}
+
+func (c *replyCounter) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err == nil {
+		atomic.AddUint64(&c.in, 1)
+	}
+	return n, addr, err
+}
+
+// probeKCP opens a KCP session as the tunnel does, through the key
+// exchange and the hello, timing both as the handshake, and sends count
+// smux NOPs over it. Each probe is timed until the next packet of the
+// session in, the acknowledgement, kcp-go keeping its own estimate to
+// itself. The segments count process wide, the probe's session being the
+// only one.
+func probeKCP(config *Config, block kcp.BlockCrypt, count int, timeout time.Duration) (*kcpStats, error) {
+	kx, err := newKeyExchange(config)
+	if err != nil {
+		return nil, err
+	}
+	replies := new(replyCounter)
+	before := kcp.DefaultSnmp.Copy()
+	start := time.Now()
+	kcpconn, err := dial(config, block, func(conn net.PacketConn) net.PacketConn {
+		replies.PacketConn = conn
+		return replies
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer kcpconn.Close()
+
+	stats := new(kcpStats)
+	conn, err := kx.Run(kcpconn)
+	if err != nil {
+		stats.ok, stats.authErr = atomic.LoadUint64(&replies.in) > 0, err
+		return stats, nil
+	}
+	if !config.NoHello {
+		key := generic.DeriveKey(config.Key)
+		local := newHello(config)
+		generic.StampHello(local, key)
+		if _, err := generic.ClientHello(conn, local, key, time.Duration(config.HandshakeTimeout)*time.Second); err != nil {
+			stats.ok, stats.helloErr = atomic.LoadUint64(&replies.in) > 0, err
+			return stats, nil
+		}
+	}
+	if atomic.LoadUint64(&replies.in) > 0 {
+		stats.ok = true
+		stats.handshake = time.Since(start)
+	}
+
+	var w io.Writer = conn
+	if !config.NoComp {
+		w = generic.NewCompStream(conn)
+	}
+	var rtt generic.RTT
+	var pending time.Time // of the probe awaiting a packet in
+	var seen uint64       // packets in when it was sent
+	first := time.Now()
+	deadline := first.Add(time.Duration(count)*pingPeriod + timeout)
+	sent := 0
+	for time.Now().Before(deadline) {
+		if sent < count && time.Since(first) >= time.Duration(sent)*pingPeriod {
+			if pending.IsZero() {
+				pending, seen = time.Now(), atomic.LoadUint64(&replies.in)
+			}
+			if _, err := w.Write(smuxNOP); err != nil {
+				return nil, err
+			}
+			sent++
+		}
+		in := atomic.LoadUint64(&replies.in)
+		if !stats.ok && in > 0 {
+			// without a hello, the first acknowledgement ends the handshake
+			stats.ok = true
+			stats.handshake = time.Since(start)
+		}
+		if !pending.IsZero() && in > seen {
+			rtt.Add(time.Since(pending))
+			pending = time.Time{}
+		}
+		if stats.ok && sent == count {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !stats.ok {
+		return stats, nil
+	}
+
+	// let the remaining probes be acknowledged
+	time.Sleep(pingPeriod)
+	snmp := kcp.DefaultSnmp.Copy()
+	stats.srtt, stats.rttvar, _ = rtt.Get()
+	stats.outSegs = snmp.OutSegs - before.OutSegs
+	stats.retrans = snmp.RetransSegs - before.RetransSegs
+	return stats, nil
+}
+
+func diagnose(echo *echoStats, tun *kcpStats) string {
+	switch {
+	case !tun.ok && echo.refused:
+		return "port closed, nothing is listening on the server address"
+	case !tun.ok && len(echo.rtts) > 0:
+		return "UDP is reachable but KCP got no authenticated reply, check key, crypt, datashard and parityshard against the server"
+	case !tun.ok:
+		return "no reply at all, UDP is blocked on the path or the server is down (or the key mismatches on a server without --echoprobe)"
+	case tun.authErr != nil:
+		return "the server answered but the key exchange failed, check handshake and its keys, certificates and pins against the server"
+	case generic.IsServerBusy(tun.helloErr):
+		return "the server is up but busy, past its maxsessions or max-memory"
+	case generic.IsAuthFailed(tun.helloErr):
+		return "the server answered but the hello failed authentication, check key against the server"
+	case tun.helloErr != nil:
+		return "the server answered but the hello failed, check crypt, datashard, parityshard and compression against the server"
+	case len(echo.rtts) > 0 && echo.loss() > 0.1, tun.loss() > 0.1:
+		return "high loss on the path, consider raising parityshard or a faster mode"
+	case len(echo.rtts) == 0:
+		return "ok (server doesn't answer plaintext probes, run it with --echoprobe for per-packet rtt)"
+	}
+	return "ok"
+}
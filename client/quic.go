@@ -0,0 +1,86 @@
+package client
+
+import (
+	"log"
+	"net"
+	"time"
+
+	quic "github.com/lucas-clemente/quic-go"
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/generic"
+)
+
+// runQUIC serves the local listener over QUIC sessions in place of KCP and
+// smux, keeping the round robin over config.Conn sessions
+func runQUIC(listener net.Listener, config *Config) error {
+	pass := generic.DeriveKey(config.Key)
+	tlsConfig := generic.NewQUICClientTLS(pass)
+	quicConfig := generic.NewQUICConfig(config.SockBuf, config.KeepAlive)
+	token := generic.QUICAuthToken(pass)
+
+	createConn := func() (quic.Session, error) {
+		sess, err := quic.DialAddr(config.RemoteAddr, tlsConfig, quicConfig)
+		if err != nil {
+			return nil, errors.Wrap(err, "createConn()")
+		}
+		log.Println("connection:", sess.LocalAddr(), "->", sess.RemoteAddr())
+		return sess, nil
+	}
+
+	waitConn := func() quic.Session {
+		for {
+			if sess, err := createConn(); err == nil {
+				return sess
+			} else {
+				log.Println("re-connecting:", err)
+				time.Sleep(time.Second)
+			}
+		}
+	}
+
+	numconn := uint16(config.Conn)
+	sessions := make([]quic.Session, numconn)
+	for k := range sessions {
+		sessions[k] = waitConn()
+	}
+
+	tcpOptions := generic.NewTCPOptions(config.TCPNoDelay, config.TCPKeepAlive, config.TCPLinger)
+	rr := uint16(0)
+	for {
+		p1, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		if err := tcpOptions.Apply(p1); err != nil {
+			log.Println("tcp options:", err)
+		}
+		idx := rr % numconn
+
+		select {
+		case <-sessions[idx].Context().Done():
+			sessions[idx] = waitConn()
+		default:
+		}
+
+		go handleQUICClient(sessions[idx], token, p1, config.Quiet)
+		rr++
+	}
+}
+
+func handleQUICClient(sess quic.Session, token []byte, p1 net.Conn, quiet bool) {
+	if !quiet {
+		log.Println("stream opened")
+		defer log.Println("stream closed")
+	}
+
+	defer p1.Close()
+	p2, err := sess.OpenStreamSync()
+	if err != nil {
+		return
+	}
+	defer p2.Close()
+	if _, err := p2.Write(token); err != nil {
+		return
+	}
+	generic.Pipe(p1, p2)
+}
@@ -0,0 +1,383 @@
+package client
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	kcp "github.com/xtaci/kcp-go"
+	"github.com/xtaci/kcptun/generic"
+	"github.com/xtaci/smux"
+)
+
+var replayCommand = cli.Command{
+	Name:  "replay",
+	Usage: "replay a trace of --recordtraffic through an in-process server over loopback, with the parameters given and the faults of --impair",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "trace",
+			Usage:  "trace file written with --recordtraffic",
+			EnvVar: "KCPTUN_REPLAY_TRACE",
+		},
+		cli.IntFlag{
+			Name:   "timeout",
+			Value:  60,
+			Usage:  "fail if the replay runs this much past the trace, in seconds",
+			EnvVar: "KCPTUN_REPLAY_TIMEOUT",
+		},
+		cli.BoolFlag{
+			Name:   "json",
+			Usage:  "print the result as one JSON object",
+			EnvVar: "KCPTUN_REPLAY_JSON",
+		},
+	},
+	Action: replay,
+}
+
+// replayResult is the --json output of replay
+type replayResult struct {
+	Trace       string               `json:"trace"`
+	Crypt       string               `json:"crypt"`
+	Mode        string               `json:"mode"`
+	Compression bool                 `json:"compression"`
+	DataShard   int                  `json:"datashard"`
+	ParityShard int                  `json:"parityshard"`
+	SndWnd      int                  `json:"sndwnd"`
+	RcvWnd      int                  `json:"rcvwnd"`
+	Impair      string               `json:"impair,omitempty"`
+	Streams     int                  `json:"streams"`
+	BytesUp     int64                `json:"bytes_up"`
+	BytesDown   int64                `json:"bytes_down"`
+	Pass        bool                 `json:"pass"`
+	Error       string               `json:"error,omitempty"`
+	Recorded    float64              `json:"recorded_ms"`
+	Elapsed     float64              `json:"elapsed_ms,omitempty"`
+	Lateness    *generic.Percentiles `json:"lateness,omitempty"`
+}
+
+// replayStream is the schedule of a stream of the trace, in offsets from
+// the start of the replay
+type replayStream struct {
+	id    uint32
+	open  time.Duration
+	up    []generic.TrafficEvent
+	down  []generic.TrafficEvent
+	total int64 // bytes down
+}
+
+// replaySchedule groups the events of a trace by stream, in order of
+// opening, and returns the length of the trace
+func replaySchedule(events []generic.TrafficEvent) ([]*replayStream, time.Duration) {
+	byID := make(map[uint32]*replayStream)
+	var streams []*replayStream
+	var length time.Duration
+	for _, e := range events {
+		at := time.Duration(e.T) * time.Microsecond
+		if at > length {
+			length = at
+		}
+		s := byID[e.Stream]
+		if s == nil {
+			// a stream cut off at the start of the trace opens with its
+			// first event
+			s = &replayStream{id: e.Stream, open: at}
+			byID[e.Stream] = s
+			streams = append(streams, s)
+		}
+		switch e.Op {
+		case generic.TrafficUp:
+			s.up = append(s.up, e)
+		case generic.TrafficDown:
+			s.down = append(s.down, e)
+			s.total += int64(e.N)
+		}
+	}
+	sort.SliceStable(streams, func(i, j int) bool { return streams[i].open < streams[j].open })
+	return streams, length
+}
+
+// replay runs the streams of a trace with the timing and sizes recorded,
+// the server sending the data down on schedule whatever came up, and
+// measures how late the data arrives at the client
+func replay(c *cli.Context) error {
+	config := loadConfig(c.Parent())
+	if c.String("trace") == "" {
+		return generic.Fatal(generic.ExitConfig, errors.New("replay: --trace is required"))
+	}
+	events, err := generic.ReadTrafficTrace(c.String("trace"))
+	if err != nil {
+		return generic.Fatal(generic.ExitConfig, err)
+	}
+	streams, length := replaySchedule(events)
+	var wrap func(net.PacketConn) net.PacketConn
+	if config.Impair != "" {
+		imp, err := generic.ParseImpairment(config.Impair)
+		if err != nil {
+			return generic.Fatal(generic.ExitConfig, err)
+		}
+		wrap = func(conn net.PacketConn) net.PacketConn { return generic.NewImpairConn(conn, imp) }
+	}
+	var block kcp.BlockCrypt
+	block, config.Crypt = generic.NewBlockCrypt(config.Key, config.Crypt)
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	checkError(err)
+	lis, err := kcp.ServeConn(block, config.DataShard, config.ParityShard, conn)
+	checkError(err)
+	defer lis.Close()
+
+	asJSON := c.Bool("json")
+	res := &replayResult{
+		Trace:       c.String("trace"),
+		Crypt:       config.Crypt,
+		Mode:        config.Mode,
+		Compression: !config.NoComp,
+		DataShard:   config.DataShard,
+		ParityShard: config.ParityShard,
+		SndWnd:      config.SndWnd,
+		RcvWnd:      config.RcvWnd,
+		Impair:      config.Impair,
+		Streams:     len(streams),
+		Recorded:    ms(length),
+	}
+	for _, s := range streams {
+		for _, e := range s.up {
+			res.BytesUp += int64(e.N)
+		}
+		res.BytesDown += s.total
+	}
+	if !asJSON {
+		fmt.Printf("replay: %v, %v streams, %v bytes up, %v bytes down over %v\n", res.Trace, res.Streams, res.BytesUp, res.BytesDown, length)
+		fmt.Printf("crypt: %v, mode: %v, compression: %v, datashard: %v, parityshard: %v, sndwnd: %v, rcvwnd: %v, impair: %q\n",
+			config.Crypt, config.Mode, !config.NoComp, config.DataShard, config.ParityShard, config.SndWnd, config.RcvWnd, config.Impair)
+	}
+
+	config.RemoteAddr = conn.LocalAddr().String()
+	var lateness generic.Histogram
+	start := time.Now()
+	go replayServer(lis, &config, streams, start)
+	done := make(chan error, 1)
+	go func() { done <- replayClient(&config, block, wrap, streams, start, &lateness) }()
+
+	select {
+	case err = <-done:
+	case <-time.After(length + time.Duration(c.Int("timeout"))*time.Second):
+		err = errors.New("timeout")
+	}
+	if err != nil {
+		if asJSON {
+			res.Error = err.Error()
+			checkError(generic.PrintJSON(os.Stdout, res))
+		} else {
+			fmt.Println("FAIL:", err)
+		}
+		return cli.NewExitError("replay failed", 1)
+	}
+
+	elapsed := time.Since(start)
+	res.Pass = true
+	res.Elapsed = ms(elapsed)
+	res.Lateness = lateness.Percentiles()
+	if asJSON {
+		checkError(generic.PrintJSON(os.Stdout, res))
+		return nil
+	}
+	fmt.Printf("PASS: replayed in %v, %v as recorded\n", elapsed, length)
+	if p := res.Lateness; p != nil {
+		fmt.Printf("data down late by p50 %vms, p95 %vms, p99 %vms over %v reads\n", p.P50, p.P95, p.P99, p.Count)
+	}
+	return nil
+}
+
+// replayFiller is what the replay sends, random so that compression
+// doesn't make it vanish
+var replayFiller = func() []byte {
+	b := make([]byte, 64*1024)
+	rand.Read(b)
+	return b
+}()
+
+// replayWrite writes n bytes of filler to w
+func replayWrite(w io.Writer, n int) error {
+	for n > 0 {
+		chunk := n
+		if chunk > len(replayFiller) {
+			chunk = len(replayFiller)
+		}
+		if _, err := w.Write(replayFiller[:chunk]); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// sleepUntil sleeps until at past start
+func sleepUntil(start time.Time, at time.Duration) {
+	if d := time.Until(start.Add(at)); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// replayServer sends every stream of every session its data down as
+// scheduled, after the id of the stream, and drains the data up
+func replayServer(lis *kcp.Listener, config *Config, streams []*replayStream, start time.Time) {
+	byID := make(map[uint32]*replayStream)
+	for _, s := range streams {
+		byID[s.id] = s
+	}
+	for {
+		conn, err := lis.AcceptKCP()
+		if err != nil {
+			return
+		}
+		conn.SetStreamMode(true)
+		conn.SetWriteDelay(true)
+		conn.SetNoDelay(config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
+		conn.SetMtu(config.MTU)
+		conn.SetWindowSize(config.SndWnd, config.RcvWnd)
+		conn.SetACKNoDelay(config.AckNodelay)
+
+		var mux *smux.Session
+		if config.NoComp {
+			mux, err = smux.Server(conn, generic.NewSmuxConfig(config.SockBuf, config.KeepAlive, config.KeepAliveTimeout, config.SmuxFrame))
+		} else {
+			mux, err = smux.Server(generic.NewCompStream(conn), generic.NewSmuxConfig(config.SockBuf, config.KeepAlive, config.KeepAliveTimeout, config.SmuxFrame))
+		}
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer mux.Close()
+			for {
+				stream, err := mux.AcceptStream()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer stream.Close()
+					var id [4]byte
+					if _, err := io.ReadFull(stream, id[:]); err != nil {
+						return
+					}
+					s := byID[binary.BigEndian.Uint32(id[:])]
+					if s == nil {
+						return
+					}
+					drained := make(chan struct{})
+					go func() {
+						io.Copy(ioutil.Discard, stream)
+						close(drained)
+					}()
+					for _, e := range s.down {
+						sleepUntil(start, time.Duration(e.T)*time.Microsecond)
+						if replayWrite(stream, e.N) != nil {
+							return
+						}
+					}
+					// the client closes once it has it all
+					<-drained
+				}()
+			}
+		}()
+	}
+}
+
+// replayClient opens the streams of the trace over one session as
+// scheduled and sends their data up, counting how late the data down
+// arrives in lateness
+func replayClient(config *Config, block kcp.BlockCrypt, wrap func(net.PacketConn) net.PacketConn, streams []*replayStream, start time.Time, lateness *generic.Histogram) error {
+	kcpconn, err := dial(config, block, wrap)
+	if err != nil {
+		return err
+	}
+	var session *smux.Session
+	if config.NoComp {
+		session, err = smux.Client(kcpconn, generic.NewSmuxConfig(config.SockBuf, config.KeepAlive, config.KeepAliveTimeout, config.SmuxFrame))
+	} else {
+		session, err = smux.Client(generic.NewCompStream(kcpconn), generic.NewSmuxConfig(config.SockBuf, config.KeepAlive, config.KeepAliveTimeout, config.SmuxFrame))
+	}
+	if err != nil {
+		kcpconn.Close()
+		return err
+	}
+	defer session.Close()
+
+	var wg sync.WaitGroup
+	var failure atomic.Value
+	for _, s := range streams {
+		sleepUntil(start, s.open)
+		stream, err := session.OpenStream()
+		if err != nil {
+			return errors.Wrap(err, "open")
+		}
+		wg.Add(1)
+		go func(s *replayStream, stream *smux.Stream) {
+			defer wg.Done()
+			defer stream.Close()
+			if err := replayStreamClient(s, stream, start, lateness); err != nil {
+				failure.Store(errors.Wrapf(err, "stream %v", s.id))
+			}
+		}(s, stream)
+	}
+	wg.Wait()
+	if err, ok := failure.Load().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// replayStreamClient sends the id of s and its data up over stream on
+// schedule while it reads the data down
+func replayStreamClient(s *replayStream, stream *smux.Stream, start time.Time, lateness *generic.Histogram) error {
+	var id [4]byte
+	binary.BigEndian.PutUint32(id[:], s.id)
+	if _, err := stream.Write(id[:]); err != nil {
+		return err
+	}
+	sent := make(chan error, 1)
+	go func() {
+		for _, e := range s.up {
+			sleepUntil(start, time.Duration(e.T)*time.Microsecond)
+			if err := replayWrite(stream, e.N); err != nil {
+				sent <- err
+				return
+			}
+		}
+		sent <- nil
+	}()
+
+	buf := make([]byte, 64*1024)
+	var got, due int64
+	next := 0
+	for got < s.total {
+		n, err := stream.Read(buf)
+		if err != nil {
+			return errors.Wrap(err, "read")
+		}
+		got += int64(n)
+		// every read recorded that's complete now is as late as the
+		// schedule says
+		for next < len(s.down) && got >= due+int64(s.down[next].N) {
+			due += int64(s.down[next].N)
+			late := time.Since(start.Add(time.Duration(s.down[next].T) * time.Microsecond))
+			if late < 0 {
+				late = 0
+			}
+			lateness.Add(late)
+			next++
+		}
+	}
+	return <-sent
+}
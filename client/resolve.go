@@ -0,0 +1,86 @@
+package client
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go"
+	"github.com/xtaci/kcptun/generic"
+)
+
+// remoteResolver keeps the server address current when it's configured as
+// a hostname, e.g. behind dynamic DNS. Every change bumps the generation,
+// so sessions dialed to a stale address get replaced.
+type remoteResolver struct {
+	name string // host:port as configured
+
+	mu   sync.Mutex
+	addr string // address new sessions dial
+	gen  uint32
+}
+
+func newRemoteResolver(name, addr string) *remoteResolver {
+	return &remoteResolver{name: name, addr: addr}
+}
+
+// get returns the current address and its generation
+func (r *remoteResolver) get() (string, uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.addr, r.gen
+}
+
+// generation returns the generation of the current address
+func (r *remoteResolver) generation() uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.gen
+}
+
+// loop re-resolves the name every period, switching to a new address when
+// the current one is no longer among the name's addresses
+func (r *remoteResolver) loop(period time.Duration, config *Config, block kcp.BlockCrypt) {
+	host, _, err := net.SplitHostPort(r.name)
+	if err != nil || net.ParseIP(host) != nil {
+		return
+	}
+	for range time.Tick(period) {
+		ips, err := generic.LookupIP(config.Resolver, host)
+		if err != nil {
+			log.Println("re-resolve:", err)
+			continue
+		}
+		current, _ := r.get()
+		currentHost, _, _ := net.SplitHostPort(current)
+		found := false
+		for _, ip := range ips {
+			if ip.Equal(net.ParseIP(currentHost)) {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+
+		raceConfig := *config
+		raceConfig.RemoteAddr = r.name
+		addr, err := raceRemote(&raceConfig, block)
+		if err != nil {
+			log.Println("re-resolve:", err)
+			continue
+		}
+		r.set(addr)
+		log.Println("re-resolve:", r.name, "moved from", current, "to", addr)
+	}
+}
+
+// set moves new sessions to addr
+func (r *remoteResolver) set(addr string) {
+	r.mu.Lock()
+	r.addr = addr
+	r.gen++
+	r.mu.Unlock()
+}
@@ -0,0 +1,203 @@
+package client
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go"
+	"github.com/xtaci/kcptun/generic"
+)
+
+// With several servers in --remoteaddr, separated by commas, new sessions
+// go to the one answering a KCP ping the fastest. Every --selectinterval
+// seconds all of them are pinged again; sessions move when the current
+// server stops answering, or when another answers clearly faster, so that
+// close times don't make them flap between servers.
+//
+// A --remoteaddr of a single domain without a port lists the servers in the
+// SRV records of _kcptun._udp.domain instead. Those servers are tried in
+// the order of the records, by priority and weight, rather than by speed:
+// sessions go to the first one answering, and move back to an earlier one
+// once it answers again.
+//
+// --remoteaddr auto lists the servers announcing themselves on the local
+// network with --mdns, raced like a list.
+const (
+	selectMargin = 0.8 // a server must answer within 80% of the current one's time
+	srvRetry     = 5 * time.Second
+	mdnsBrowse   = 2 * time.Second // how long servers have to answer
+)
+
+// splitRemotes returns the servers of a --remoteaddr list
+func splitRemotes(remoteaddr string) []string {
+	var servers []string
+	for _, s := range strings.Split(remoteaddr, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			servers = append(servers, s)
+		}
+	}
+	return servers
+}
+
+// isSRVName reports whether a --remoteaddr entry is a domain to look up the
+// SRV records of
+func isSRVName(server string) bool {
+	_, _, err := net.SplitHostPort(server)
+	return err != nil && server != "" && server != "auto" && net.ParseIP(server) == nil
+}
+
+// browseServers returns the servers announced on the local network, asking
+// again until one answers
+func browseServers() []string {
+	for {
+		servers, err := generic.BrowseMDNS(mdnsBrowse)
+		if len(servers) > 0 {
+			log.Println("mdns: found", servers)
+			return servers
+		}
+		if err == nil {
+			err = errors.New("no server on the local network")
+		}
+		log.Println("mdns:", err)
+		time.Sleep(srvRetry)
+	}
+}
+
+// lookupServers returns the servers of the SRV records of name in the order
+// of their priorities and weights, retrying until the lookup succeeds
+func lookupServers(resolver, name string) []string {
+	for {
+		srvs, err := generic.LookupSRV(resolver, name)
+		var servers []string
+		for _, srv := range srvs {
+			// "." for a target says there's no service
+			if target := strings.TrimSuffix(srv.Target, "."); target != "" {
+				servers = append(servers, net.JoinHostPort(target, strconv.Itoa(int(srv.Port))))
+			}
+		}
+		if len(servers) > 0 {
+			log.Println("srv:", name, "lists", servers)
+			return servers
+		}
+		if err == nil {
+			err = errors.Errorf("no server for %v", name)
+		}
+		log.Println("srv:", err)
+		time.Sleep(srvRetry)
+	}
+}
+
+// serverSelector picks the lowest-latency server among several, or the
+// first answering when they're ordered
+type serverSelector struct {
+	servers []string
+	ordered bool // by SRV records, earlier ones take precedence
+	config  *Config
+	block   kcp.BlockCrypt
+	state   *stateFile // remembers the server picked, nil without --state
+}
+
+func newServerSelector(servers []string, ordered bool, config *Config, block kcp.BlockCrypt, state *stateFile) *serverSelector {
+	return &serverSelector{servers: servers, ordered: ordered, config: config, block: block, state: state}
+}
+
+// probe pings the servers at once and returns the round-trip times of those
+// answering
+func (s *serverSelector) probe(servers []string) map[string]time.Duration {
+	transport := s.config.Transport
+	if transport == "auto" {
+		transport = "udp"
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	rtts := make(map[string]time.Duration)
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+			probeConfig := *s.config
+			probeConfig.RemoteAddr = server
+			if rtt, ok := probeRTT(&probeConfig, s.block, transport, probeTimeout); ok {
+				mu.Lock()
+				rtts[server] = rtt
+				mu.Unlock()
+			}
+		}(server)
+	}
+	wg.Wait()
+	return rtts
+}
+
+// best returns the server of rtts answering the fastest, or the first one
+// answering when ordered, empty when none did
+func (s *serverSelector) best(rtts map[string]time.Duration) string {
+	best := ""
+	for _, server := range s.servers {
+		if _, ok := rtts[server]; ok && s.ordered {
+			return server
+		}
+		if rtt, ok := rtts[server]; ok && (best == "" || rtt < rtts[best]) {
+			best = server
+		}
+	}
+	return best
+}
+
+// pick returns the server to start with: the one of the state if it still
+// answers, without waiting for the others, or else the fastest, the first
+// one when none answers
+func (s *serverSelector) pick() string {
+	if last := s.state.server(); last != "" {
+		for _, server := range s.servers {
+			if server != last {
+				continue
+			}
+			if rtt, ok := s.probe([]string{last})[last]; ok {
+				log.Println("select: using", last, "rtt", rtt, "as last time")
+				return last
+			}
+		}
+	}
+	rtts := s.probe(s.servers)
+	best := s.best(rtts)
+	if best == "" {
+		log.Println("select: no answer from any of", s.servers, "using", s.servers[0])
+		return s.servers[0]
+	}
+	log.Println("select: using", best, "rtt", rtts[best], "of", rtts)
+	s.remember(best)
+	return best
+}
+
+// remember records server in the state
+func (s *serverSelector) remember(server string) {
+	s.state.update(func(state *clientState) { state.Server = server })
+}
+
+// loop re-evaluates the servers every period and moves the new sessions of
+// resolver to a better one
+func (s *serverSelector) loop(period time.Duration, current string, resolver *remoteResolver) {
+	for range time.Tick(period) {
+		rtts := s.probe(s.servers)
+		best := s.best(rtts)
+		if best == "" || best == current {
+			continue
+		}
+		if rtt, ok := rtts[current]; ok && !s.ordered && float64(rtts[best]) > float64(rtt)*selectMargin {
+			continue
+		}
+		if rtt, ok := rtts[current]; ok {
+			log.Println("select: moving from", current, "rtt", rtt, "to", best, "rtt", rtts[best])
+		} else {
+			log.Println("select:", current, "doesn't answer, moving to", best, "rtt", rtts[best])
+		}
+		current = best
+		resolver.set(best)
+		s.remember(best)
+	}
+}
@@ -0,0 +1,197 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	kcp "github.com/xtaci/kcp-go"
+	"github.com/xtaci/kcptun/generic"
+	"github.com/xtaci/smux"
+)
+
+var selftestCommand = cli.Command{
+	Name:  "selftest",
+	Usage: "echo data through an in-process server over loopback, exercising crypto, mux and KCP",
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:   "size",
+			Value:  16,
+			Usage:  "amount of data to echo, in MB",
+			EnvVar: "KCPTUN_SELFTEST_SIZE",
+		},
+		cli.IntFlag{
+			Name:   "timeout",
+			Value:  60,
+			Usage:  "fail if the echo doesn't complete in time, in seconds",
+			EnvVar: "KCPTUN_SELFTEST_TIMEOUT",
+		},
+		cli.BoolFlag{
+			Name:   "json",
+			Usage:  "print the result as one JSON object",
+			EnvVar: "KCPTUN_SELFTEST_JSON",
+		},
+	},
+	Action: selftest,
+}
+
+// selftestResult is the --json output of selftest
+type selftestResult struct {
+	Size        int     `json:"size_mb"`
+	Crypt       string  `json:"crypt"`
+	Mode        string  `json:"mode"`
+	Compression bool    `json:"compression"`
+	DataShard   int     `json:"datashard"`
+	ParityShard int     `json:"parityshard"`
+	Pass        bool    `json:"pass"`
+	Error       string  `json:"error,omitempty"`
+	Elapsed     float64 `json:"elapsed_ms,omitempty"`
+	Throughput  float64 `json:"mb_per_second,omitempty"` // each way
+}
+
+func selftest(c *cli.Context) error {
+	config := loadConfig(c.Parent())
+	var block kcp.BlockCrypt
+	block, config.Crypt = generic.NewBlockCrypt(config.Key, config.Crypt)
+	size := c.Int("size") << 20
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	checkError(err)
+	lis, err := kcp.ServeConn(block, config.DataShard, config.ParityShard, conn)
+	checkError(err)
+	defer lis.Close()
+	go selftestServer(lis, &config)
+
+	asJSON := c.Bool("json")
+	res := &selftestResult{
+		Size:        c.Int("size"),
+		Crypt:       config.Crypt,
+		Mode:        config.Mode,
+		Compression: !config.NoComp,
+		DataShard:   config.DataShard,
+		ParityShard: config.ParityShard,
+	}
+	if !asJSON {
+		fmt.Printf("selftest: %v MB, crypt: %v, mode: %v, compression: %v, datashard: %v, parityshard: %v\n",
+			c.Int("size"), config.Crypt, config.Mode, !config.NoComp, config.DataShard, config.ParityShard)
+	}
+
+	config.RemoteAddr = conn.LocalAddr().String()
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- selftestEcho(&config, block, size) }()
+
+	select {
+	case err = <-done:
+	case <-time.After(time.Duration(c.Int("timeout")) * time.Second):
+		err = errors.New("timeout")
+	}
+	if err != nil {
+		if asJSON {
+			res.Error = err.Error()
+			checkError(generic.PrintJSON(os.Stdout, res))
+		} else {
+			fmt.Println("FAIL:", err)
+		}
+		return cli.NewExitError("selftest failed", 1)
+	}
+
+	elapsed := time.Since(start)
+	if asJSON {
+		res.Pass = true
+		res.Elapsed = ms(elapsed)
+		res.Throughput = float64(size) / (1 << 20) / elapsed.Seconds()
+		checkError(generic.PrintJSON(os.Stdout, res))
+		return nil
+	}
+	fmt.Printf("PASS: %v MB echoed in %v, %.2f MB/s each way\n",
+		c.Int("size"), elapsed, float64(size)/(1<<20)/elapsed.Seconds())
+	return nil
+}
+
+// selftestServer echoes every stream of every session back to the client
+func selftestServer(lis *kcp.Listener, config *Config) {
+	for {
+		conn, err := lis.AcceptKCP()
+		if err != nil {
+			return
+		}
+		conn.SetStreamMode(true)
+		conn.SetWriteDelay(true)
+		conn.SetNoDelay(config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
+		conn.SetMtu(config.MTU)
+		conn.SetWindowSize(config.SndWnd, config.RcvWnd)
+		conn.SetACKNoDelay(config.AckNodelay)
+
+		var mux *smux.Session
+		if config.NoComp {
+			mux, err = smux.Server(conn, generic.NewSmuxConfig(config.SockBuf, config.KeepAlive, config.KeepAliveTimeout, config.SmuxFrame))
+		} else {
+			mux, err = smux.Server(generic.NewCompStream(conn), generic.NewSmuxConfig(config.SockBuf, config.KeepAlive, config.KeepAliveTimeout, config.SmuxFrame))
+		}
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer mux.Close()
+			for {
+				stream, err := mux.AcceptStream()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer stream.Close()
+					io.Copy(stream, stream)
+				}()
+			}
+		}()
+	}
+}
+
+// selftestEcho sends size random bytes over a new session and verifies the
+// echoed data
+func selftestEcho(config *Config, block kcp.BlockCrypt, size int) error {
+	kcpconn, err := dial(config, block, nil)
+	if err != nil {
+		return err
+	}
+	var session *smux.Session
+	if config.NoComp {
+		session, err = smux.Client(kcpconn, generic.NewSmuxConfig(config.SockBuf, config.KeepAlive, config.KeepAliveTimeout, config.SmuxFrame))
+	} else {
+		session, err = smux.Client(generic.NewCompStream(kcpconn), generic.NewSmuxConfig(config.SockBuf, config.KeepAlive, config.KeepAliveTimeout, config.SmuxFrame))
+	}
+	if err != nil {
+		kcpconn.Close()
+		return err
+	}
+	defer session.Close()
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	payload := make([]byte, size)
+	rand.Read(payload)
+	go stream.Write(payload)
+
+	h := sha1.New()
+	if _, err := io.CopyN(h, stream, int64(size)); err != nil {
+		return errors.Wrap(err, "echo")
+	}
+	want := sha1.Sum(payload)
+	if !bytes.Equal(h.Sum(nil), want[:]) {
+		return errors.New("echoed data mismatch")
+	}
+	return nil
+}
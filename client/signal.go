@@ -1,6 +1,6 @@
 // +build linux darwin freebsd
 
-package main
+package client
 
 import (
 	"log"
@@ -11,19 +11,35 @@ import (
 	kcp "github.com/xtaci/kcp-go"
 )
 
-func init() {
+// watchSignals handles the signals of the client once it runs, not as the
+// combined binary starts: the client and the server take SIGHUP apart
+func watchSignals() {
 	go sigHandler()
 }
 
 func sigHandler() {
 	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, syscall.SIGUSR1)
+	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGHUP)
 	signal.Ignore(syscall.SIGPIPE)
 
 	for {
 		switch <-ch {
 		case syscall.SIGUSR1:
 			log.Printf("KCP SNMP:%+v", kcp.DefaultSnmp.Copy())
+			log.Println("public address:", publicAddr())
+			for _, line := range stats.Dump() {
+				log.Println(line)
+			}
+		case syscall.SIGHUP:
+			if schedule == nil {
+				// nothing to reload, hang up as before
+				signal.Reset(syscall.SIGHUP)
+				syscall.Kill(os.Getpid(), syscall.SIGHUP)
+				continue
+			}
+			if err := reloadSchedule(); err != nil {
+				log.Println(err, "keeping the schedule loaded")
+			}
 		}
 	}
 }
@@ -0,0 +1,5 @@
+// +build !linux,!darwin,!freebsd
+
+package client
+
+func watchSignals() {}
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/xtaci/kcptun/generic"
+)
+
+// clientState is what --state keeps across restarts, so that a restarted
+// client resumes its first session with a token, dials with the parameters
+// the server pushed, its mtu among them, and goes straight to the server of
+// a --remoteaddr list it used last
+type clientState struct {
+	RemoteAddr string          `json:"remoteaddr"`       // as configured, a state of another one is dropped
+	Server     string          `json:"server,omitempty"` // of the list, last picked
+	Pushed     *generic.Params `json:"pushed,omitempty"`
+	Token      []byte          `json:"token,omitempty"`
+	Secret     []byte          `json:"secret,omitempty"`    // of the key exchange the token resumes
+	Telemetry  bool            `json:"telemetry,omitempty"` // the server answered these along with the token
+	StreamAck  bool            `json:"streamack,omitempty"`
+	Migrate    bool            `json:"migrate,omitempty"`
+	Checksum   bool            `json:"checksum,omitempty"`
+}
+
+// stateFile keeps the client state in --state, nil without
+type stateFile struct {
+	path string
+
+	mu    sync.Mutex
+	state clientState
+}
+
+// openState reads the state of path left by a client with the same
+// remoteaddr. The state only saves time, so a missing or broken file is
+// logged and starts afresh.
+func openState(path, remoteaddr string) *stateFile {
+	f := &stateFile{path: path, state: clientState{RemoteAddr: remoteaddr}}
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		log.Println("state:", err)
+	default:
+		var state clientState
+		if err := json.Unmarshal(data, &state); err != nil {
+			log.Println("state:", path, err)
+		} else if state.RemoteAddr == remoteaddr {
+			f.state = state
+		}
+	}
+	return f
+}
+
+// server returns the server of the list used last, empty for none
+func (f *stateFile) server() string {
+	if f == nil {
+		return ""
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.state.Server
+}
+
+// restore hands the pushed parameters and the token over to hellos
+func (f *stateFile) restore(hellos *helloState) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	hellos.mu.Lock()
+	defer hellos.mu.Unlock()
+	hellos.pushed = f.state.Pushed
+	hellos.token, hellos.secret = f.state.Token, f.state.Secret
+	hellos.telemetry = f.state.Telemetry
+	hellos.streamAck = f.state.StreamAck
+	hellos.migrate = f.state.Migrate
+	hellos.checksum = f.state.Checksum
+	if f.state.Pushed != nil || f.state.Token != nil {
+		log.Printf("state: restored pushed parameters %+v, token %v", f.state.Pushed, f.state.Token != nil)
+	}
+}
+
+// update changes the state with fn and writes it to --state
+func (f *stateFile) update(fn func(*clientState)) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fn(&f.state)
+	data, err := json.Marshal(f.state)
+	if err != nil {
+		log.Println("state:", err)
+		return
+	}
+	// replaced whole, a crash mid-write keeps the previous state
+	tmp := f.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		log.Println("state:", err)
+		return
+	}
+	if err := os.Rename(tmp, f.path); err != nil {
+		log.Println("state:", err)
+	}
+}
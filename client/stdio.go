@@ -0,0 +1,25 @@
+package client
+
+import "os"
+
+// stdioConn is a stream over stdin and stdout, relayed through the tunnel
+// when the client runs as an OpenSSH ProxyCommand or in a pipeline
+type stdioConn struct{}
+
+func (stdioConn) Read(p []byte) (n int, err error) {
+	return os.Stdin.Read(p)
+}
+
+func (stdioConn) Write(p []byte) (n int, err error) {
+	return os.Stdout.Write(p)
+}
+
+// CloseWrite passes the end of the stream on as EOF on stdout
+func (stdioConn) CloseWrite() error {
+	return os.Stdout.Close()
+}
+
+func (stdioConn) Close() error {
+	os.Stdin.Close()
+	return os.Stdout.Close()
+}
@@ -0,0 +1,43 @@
+package client
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/xtaci/kcptun/generic"
+)
+
+const (
+	// stunTimeout bounds the wait for each STUN server
+	stunTimeout = 3 * time.Second
+	// stunPeriod is how often the public address is checked again, carrier
+	// grade NATs change it under long running clients
+	stunPeriod = 10 * time.Minute
+)
+
+// natStatus holds the last *generic.STUNResult
+var natStatus atomic.Value
+
+// publicAddr returns the public address and NAT kind found last, or "-"
+func publicAddr() string {
+	if result, ok := natStatus.Load().(*generic.STUNResult); ok {
+		return result.String()
+	}
+	return "-"
+}
+
+// discoverNAT keeps the public address behind the NAT up to date, logging
+// changes
+func discoverNAT(servers string) {
+	for {
+		result, err := generic.DiscoverNAT(servers, stunTimeout)
+		if err != nil {
+			log.Println(err)
+		} else if result.String() != publicAddr() {
+			log.Println("public address:", result)
+			natStatus.Store(result)
+		}
+		time.Sleep(stunPeriod)
+	}
+}
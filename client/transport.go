@@ -0,0 +1,181 @@
+package client
+
+import (
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go"
+	"github.com/xtaci/kcptun/generic"
+)
+
+const (
+	// how long transport auto waits for the server to answer over each transport
+	probeTimeout = 5 * time.Second
+
+	// the head start of every address over the next one when racing, RFC 8305
+	attemptDelay = 250 * time.Millisecond
+)
+
+// raceRemote resolves the host of config.RemoteAddr to all its IPv4 and
+// IPv6 addresses and races probe sessions to them happy eyeballs style,
+// alternating address families starting with the preferred one. It returns
+// the first address the server answers on.
+func raceRemote(config *Config, block kcp.BlockCrypt) (string, error) {
+	host, port, err := net.SplitHostPort(config.RemoteAddr)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return config.RemoteAddr, nil
+	}
+	ips, err := generic.LookupIP(config.Resolver, host)
+	if err != nil {
+		return "", err
+	}
+
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	first, second := v4, v6
+	if config.PreferIPv6 {
+		first, second = v6, v4
+	}
+	var addrs []string
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			addrs = append(addrs, net.JoinHostPort(first[i].String(), port))
+		}
+		if i < len(second) {
+			addrs = append(addrs, net.JoinHostPort(second[i].String(), port))
+		}
+	}
+	if len(addrs) == 1 {
+		return addrs[0], nil
+	}
+
+	results := make(chan string, len(addrs))
+	done := make(chan struct{})
+	defer close(done)
+	for i, addr := range addrs {
+		go func(delay time.Duration, addr string) {
+			select {
+			case <-time.After(delay):
+			case <-done:
+				results <- ""
+				return
+			}
+			probeConfig := *config
+			probeConfig.RemoteAddr = addr
+			if probeTransport(&probeConfig, block, "udp", probeTimeout) {
+				results <- addr
+			} else {
+				results <- ""
+			}
+		}(time.Duration(i)*attemptDelay, addr)
+	}
+	for range addrs {
+		if addr := <-results; addr != "" {
+			log.Println("happy eyeballs: using", addr, "of", addrs)
+			return addr, nil
+		}
+	}
+	return "", errors.Errorf("happy eyeballs: no answer from any of %v", addrs)
+}
+
+// selectTransport resolves transport auto: UDP is kept when the server
+// answers a probe session, otherwise a TCP carrier is tried, and at last
+// the websocket carrier when one is configured
+func selectTransport(config *Config, block kcp.BlockCrypt) string {
+	if probeTransport(config, block, "udp", probeTimeout) {
+		log.Println("transport: udp probe succeeded, using udp")
+		return "udp"
+	}
+	if probeTransport(config, block, "tcp", probeTimeout) {
+		log.Println("transport: udp probe failed, downgrading to tcp", config.RemoteAddr)
+		return "tcp"
+	}
+	if config.WSURL != "" {
+		log.Println("transport: udp and tcp probes failed, falling back to websocket", config.WSURL)
+		return "ws"
+	}
+	log.Println("transport: udp and tcp probes failed and no fallback is configured, using udp")
+	return "udp"
+}
+
+// resolveRemote resolves the host of config.RemoteAddr with the configured
+// resolver, for the transports dialing a single address
+func resolveRemote(config *Config) (string, error) {
+	host, port, err := net.SplitHostPort(config.RemoteAddr)
+	if err != nil {
+		return "", err
+	}
+	ips, err := generic.LookupIP(config.Resolver, host)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
+
+// probeTransport opens a KCP session over transport, sends a smux NOP and
+// reports whether anything came back within timeout. The server stays
+// silent on key mismatch, so a reply proves the whole path works.
+func probeTransport(config *Config, block kcp.BlockCrypt, transport string, timeout time.Duration) bool {
+	_, ok := probeRTT(config, block, transport, timeout)
+	return ok
+}
+
+// probeRTT is probeTransport returning the time the first reply took
+func probeRTT(config *Config, block kcp.BlockCrypt, transport string, timeout time.Duration) (time.Duration, bool) {
+	probeConfig := *config
+	probeConfig.Transport = transport
+	replied := make(chan struct{}, 1)
+	kcpconn, err := dial(&probeConfig, block, func(conn net.PacketConn) net.PacketConn {
+		return &notifyConn{conn, replied}
+	})
+	if err != nil {
+		log.Println("transport:", err)
+		return 0, false
+	}
+	defer kcpconn.Close()
+
+	var w io.Writer = kcpconn
+	if !config.NoComp {
+		w = generic.NewCompStream(kcpconn)
+	}
+	start := time.Now()
+	if _, err := w.Write(smuxNOP); err != nil {
+		return 0, false
+	}
+
+	select {
+	case <-replied:
+		return time.Since(start), true
+	case <-time.After(timeout):
+		return 0, false
+	}
+}
+
+// notifyConn signals ch on every packet received
+type notifyConn struct {
+	net.PacketConn
+	ch chan struct{}
+}
+
+func (c *notifyConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(p)
+	if err == nil {
+		select {
+		case c.ch <- struct{}{}:
+		default:
+		}
+	}
+	return
+}
@@ -0,0 +1,42 @@
+package client
+
+import (
+	"io"
+	"log"
+
+	"github.com/xtaci/kcptun/generic"
+)
+
+// runTun relays the packets of a TUN or TAP interface over the tunnel, on a
+// new session whenever the last one fails
+func runTun(config *Config, waitConn func(bool) *session) error {
+	filter, err := generic.ParseFrameFilter(config.TapFilter)
+	if err != nil {
+		return generic.Fatal(generic.ExitConfig, err)
+	}
+	var dev io.ReadWriteCloser
+	var name string
+	var mtu int
+	if config.Tap != "" {
+		mtu = generic.TapMTU(config.MTU - packetOverhead(config))
+		dev, name, err = generic.OpenTap(config.Tap, mtu)
+	} else {
+		mtu = generic.TunMTU(config.MTU - packetOverhead(config))
+		dev, name, err = generic.OpenTun(config.Tun, mtu)
+		filter = nil
+	}
+	if err != nil {
+		return generic.Fatal(generic.ExitBind, err)
+	}
+	log.Println(generic.TunnelKind(config.Tun, config.Tap)+":", name, "mtu:", mtu)
+	relay := generic.NewPacketRelay(dev, filter)
+	for {
+		session := waitConn(false)
+		stream, err := session.OpenStream()
+		if err == nil {
+			err = relay.Serve(stream)
+		}
+		log.Println(generic.TunnelKind(config.Tun, config.Tap)+":", err)
+		session.Close()
+	}
+}
@@ -0,0 +1,87 @@
+package client
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// warmPool keeps spare sessions established ahead of need, so that replacing
+// an expired or broken session doesn't stall the connection noticing it
+// behind a dial and a handshake. A nil warmPool has no spares.
+type warmPool struct {
+	size       int
+	create     func() (*session, error)
+	generation func() uint32 // of the server address
+
+	mu     sync.Mutex
+	spares []warmSession
+}
+
+type warmSession struct {
+	session *session
+	gen     uint32
+}
+
+// newWarmPool keeps size spares made by create, for the server address of
+// generation
+func newWarmPool(size int, create func() (*session, error), generation func() uint32) *warmPool {
+	p := &warmPool{size: size, create: create, generation: generation}
+	go p.loop()
+	return p
+}
+
+// get takes a spare, nil if there is none ready
+func (p *warmPool) get() *session {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	gen := p.generation()
+	for len(p.spares) > 0 {
+		spare := p.spares[0]
+		p.spares = p.spares[1:]
+		if !spare.session.IsClosed() && spare.gen == gen {
+			return spare.session
+		}
+		spare.session.Close()
+	}
+	return nil
+}
+
+// prune drops the spares which closed, e.g. on the server's idle timeout,
+// or dialed a stale address, and returns how many are missing
+func (p *warmPool) prune() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	gen := p.generation()
+	live := p.spares[:0]
+	for _, spare := range p.spares {
+		if !spare.session.IsClosed() && spare.gen == gen {
+			live = append(live, spare)
+		} else {
+			spare.session.Close()
+		}
+	}
+	p.spares = live
+	return p.size - len(live)
+}
+
+// loop tops the pool up every second
+func (p *warmPool) loop() {
+	for {
+		for missing := p.prune(); missing > 0; missing-- {
+			gen := p.generation()
+			session, err := p.create()
+			if err != nil {
+				log.Println("warm:", err)
+				break
+			}
+			p.mu.Lock()
+			p.spares = append(p.spares, warmSession{session, gen})
+			p.mu.Unlock()
+		}
+		time.Sleep(time.Second)
+	}
+}
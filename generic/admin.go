@@ -0,0 +1,47 @@
+package generic
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The admin socket serves a Snapshot of the live sessions and streams as
+// one JSON object to every connection, then closes it. `top` polls it.
+const adminTimeout = 5 * time.Second
+
+// ServeAdmin answers the connections to lis with snapshots of stats
+func ServeAdmin(lis net.Listener, stats *Stats) {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			log.Println("admin:", err)
+			return
+		}
+		go func() {
+			defer conn.Close()
+			conn.SetWriteDeadline(time.Now().Add(adminTimeout))
+			json.NewEncoder(conn).Encode(stats.Snapshot())
+		}()
+	}
+}
+
+// ReadAdmin fetches a snapshot from the admin socket at addr, a TCP or
+// unix: address
+func ReadAdmin(addr string) (*Snapshot, error) {
+	network, address := SplitNetwork(addr)
+	conn, err := net.DialTimeout(network, address, adminTimeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "admin")
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(adminTimeout))
+	snap := new(Snapshot)
+	if err := json.NewDecoder(conn).Decode(snap); err != nil {
+		return nil, errors.Wrap(err, "admin")
+	}
+	return snap, nil
+}
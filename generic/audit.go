@@ -0,0 +1,59 @@
+package generic
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditRecord is a line of the audit log, written when a session or a
+// stream closes
+type AuditRecord struct {
+	Kind   string    `json:"kind"` // "session" or "stream"
+	Opened time.Time `json:"opened"`
+	Closed time.Time `json:"closed"`
+	Remote string    `json:"remote"`
+	// Client is the name of the client in --clients
+	Client string `json:"client,omitempty"`
+	// Conv is the KCP conversation id, tying streams to their session
+	Conv   uint32 `json:"conv"`
+	Stream uint32 `json:"stream,omitempty"`
+	// Params are the parameters the session was set up with
+	Params   map[string]interface{} `json:"params,omitempty"`
+	Target   string                 `json:"target,omitempty"`
+	BytesIn  uint64                 `json:"bytes_in"`
+	BytesOut uint64                 `json:"bytes_out"`
+	Reason   string                 `json:"reason"`
+}
+
+// AuditLog appends a JSON line per closed session and stream to a file. A
+// nil AuditLog records nothing.
+type AuditLog struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// OpenAuditLog appends to the file at path, created if missing. The file is
+// opened for append only, so it can be rotated by copy and truncate.
+func OpenAuditLog(path string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Record writes rec as a line
+func (a *AuditLog) Record(rec *AuditRecord) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.enc.Encode(rec); err != nil {
+		log.Println("auditlog:", err)
+	}
+}
@@ -0,0 +1,79 @@
+package generic
+
+import "log"
+
+// With --mode auto, a session with telemetry starts as fast, and moves
+// between the normal, fast and fast2 profiles as its link reports come in:
+// up at once when the retransmissions or the rtt jitter grow, back down
+// only after autoModeCalm reports in a row call for it, so a short burst
+// of loss doesn't make it flap.
+const autoModeCalm = 3
+
+// autoMode is a profile --mode auto moves between, calmest first
+type autoMode struct {
+	name                          string
+	nodelay, interval, resend, nc int
+}
+
+var autoModes = []autoMode{
+	{"normal", 0, 40, 2, 1},
+	{"fast", 0, 30, 2, 1},
+	{"fast2", 1, 20, 2, 1},
+}
+
+// autoModeStart is the profile of new sessions, fast
+const autoModeStart = 1
+
+// autoModeLevel returns the profile the reports of both ends call for: the
+// worse of the retransmissions each way, as lost acks cost retransmissions
+// too, and the rtt jitter seen here
+func autoModeLevel(local, peer *LinkReport) int {
+	loss := local.Loss()
+	if l := peer.Loss(); l > loss {
+		loss = l
+	}
+	jittery := local != nil && local.SRTT > 0 && local.RTTVar*2 > local.SRTT
+	switch {
+	case loss >= 5 || jittery:
+		return 2
+	case loss >= 1 || local != nil && local.RTTVar*4 > local.SRTT:
+		return 1
+	}
+	return 0
+}
+
+// AutoMode has the session of t retuned to the profile its link calls for,
+// as reports come in
+func (t *Telemetry) AutoMode() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.auto = true
+	t.level = autoModeStart
+}
+
+// retune moves the session to the profile the last reports call for, called
+// with t.mu held
+func (t *Telemetry) retune() {
+	if !t.auto || t.local == nil || t.peer == nil {
+		return
+	}
+	want := autoModeLevel(t.local, t.peer)
+	switch {
+	case want > t.level:
+		t.calm = 0
+	case want < t.level:
+		if t.calm++; t.calm < autoModeCalm {
+			return
+		}
+		t.calm = 0
+		want = t.level - 1
+	default:
+		t.calm = 0
+		return
+	}
+	from, to := autoModes[t.level], autoModes[want]
+	t.level = want
+	t.kcpconn.SetNoDelay(to.nodelay, to.interval, to.resend, to.nc)
+	log.Printf("mode: %v auto %v -> %v, retrans out %.1f%% in %.1f%% srtt %vms rttvar %vms",
+		t.kcpconn.RemoteAddr(), from.name, to.name, t.local.Loss(), t.peer.Loss(), t.local.SRTT, t.local.RTTVar)
+}
@@ -0,0 +1,41 @@
+package generic
+
+import (
+	"net"
+	"syscall"
+)
+
+// BindToDevice pins conn to the network interface iface with
+// SO_BINDTODEVICE, so its packets leave by that interface whatever the
+// routing table says. It needs CAP_NET_RAW on older kernels.
+func BindToDevice(conn *net.UDPConn, iface string) error {
+	rawconn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rawconn.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// SetMark sets the fwmark of the packets of conn with SO_MARK, for policy
+// routing rules to tell them apart. It needs CAP_NET_ADMIN.
+func SetMark(conn *net.UDPConn, mark int) error {
+	rawconn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = rawconn.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,20 @@
+// +build !linux
+
+package generic
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// BindToDevice is only supported on linux, bind to the interface's address
+// instead
+func BindToDevice(conn *net.UDPConn, iface string) error {
+	return errors.New("binding to an interface is only supported on linux, use --bind with its address")
+}
+
+// SetMark is only supported on linux
+func SetMark(conn *net.UDPConn, mark int) error {
+	return errors.New("fwmark is only supported on linux")
+}
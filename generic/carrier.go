@@ -0,0 +1,239 @@
+package generic
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Carriers transport the encrypted KCP packets over a reliable stream, such
+// as TCP or a WebSocket, for networks that drop or throttle UDP. Every packet is
+// written as a frame:
+//
+// | length(2B, big endian) | packet |
+const carrierHeaderSize = 2
+
+var errCarrierClosed = errors.New("carrier closed")
+
+// carrierAddr names a carrier connection, it's unique per connection so
+// that KCP keys its sessions correctly
+type carrierAddr string
+
+func (a carrierAddr) Network() string { return "carrier" }
+func (a carrierAddr) String() string  { return string(a) }
+
+func writeFrame(w io.Writer, p []byte) (int, error) {
+	if len(p) > 0xffff {
+		return 0, errors.New("carrier: packet too large")
+	}
+	frame := make([]byte, carrierHeaderSize+len(p))
+	binary.BigEndian.PutUint16(frame, uint16(len(p)))
+	copy(frame[carrierHeaderSize:], p)
+	if _, err := w.Write(frame); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func readFrame(r io.Reader, p []byte) (int, error) {
+	var hdr [carrierHeaderSize]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	if n > len(p) {
+		// drain and drop an oversized packet, like UDP would truncate it
+		io.CopyN(ioutil.Discard, r, int64(n))
+		return 0, errors.New("carrier: short buffer")
+	}
+	return io.ReadFull(r, p[:n])
+}
+
+// StreamPacketConn is the client side of a carrier, it presents a single
+// stream connection as a PacketConn talking to the stream's peer
+type StreamPacketConn struct {
+	conn  net.Conn
+	raddr net.Addr
+	rmu   sync.Mutex
+	wmu   sync.Mutex
+}
+
+// NewStreamPacketConn wraps an established carrier connection
+func NewStreamPacketConn(conn net.Conn) *StreamPacketConn {
+	return &StreamPacketConn{conn: conn, raddr: conn.RemoteAddr()}
+}
+
+// ReadFrom implements net.PacketConn
+func (c *StreamPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	n, err = readFrame(c.conn, p)
+	return n, c.raddr, err
+}
+
+// WriteTo implements net.PacketConn, addr is ignored
+func (c *StreamPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return writeFrame(c.conn, p)
+}
+
+// Close implements net.PacketConn
+func (c *StreamPacketConn) Close() error { return c.conn.Close() }
+
+// LocalAddr implements net.PacketConn
+func (c *StreamPacketConn) LocalAddr() net.Addr { return c.conn.LocalAddr() }
+
+// RemoteAddr returns the address of the carrier's peer
+func (c *StreamPacketConn) RemoteAddr() net.Addr { return c.raddr }
+
+// SetDeadline implements net.PacketConn
+func (c *StreamPacketConn) SetDeadline(t time.Time) error { return c.conn.SetDeadline(t) }
+
+// SetReadDeadline implements net.PacketConn
+func (c *StreamPacketConn) SetReadDeadline(t time.Time) error { return c.conn.SetReadDeadline(t) }
+
+// SetWriteDeadline implements net.PacketConn
+func (c *StreamPacketConn) SetWriteDeadline(t time.Time) error { return c.conn.SetWriteDeadline(t) }
+
+type carrierPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+type carrier struct {
+	conn net.Conn
+	wmu  sync.Mutex
+}
+
+// CarrierConn is the server side of the carriers, it merges the packets of
+// all accepted carrier connections into one PacketConn for kcp.ServeConn
+type CarrierConn struct {
+	laddr net.Addr
+	in    chan carrierPacket
+
+	mu       sync.Mutex
+	carriers map[string]*carrier
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// NewCarrierConn creates an empty CarrierConn reporting laddr as its address
+func NewCarrierConn(laddr net.Addr) *CarrierConn {
+	c := new(CarrierConn)
+	c.laddr = laddr
+	c.in = make(chan carrierPacket, 1024)
+	c.carriers = make(map[string]*carrier)
+	c.die = make(chan struct{})
+	return c
+}
+
+// Serve feeds the packets of conn into c until conn fails, name must be
+// unique among the live carriers, typically the peer's address
+func (c *CarrierConn) Serve(conn net.Conn, name string) {
+	addr := carrierAddr(name)
+	cr := &carrier{conn: conn}
+	c.mu.Lock()
+	c.carriers[name] = cr
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.carriers, name)
+		c.mu.Unlock()
+		conn.Close()
+	}()
+
+	buf := make([]byte, 65536)
+	for {
+		n, err := readFrame(conn, buf)
+		if err != nil {
+			return
+		}
+		pkt := carrierPacket{make([]byte, n), addr}
+		copy(pkt.data, buf)
+		select {
+		case c.in <- pkt:
+		case <-c.die:
+			return
+		}
+	}
+}
+
+// ReadFrom implements net.PacketConn
+func (c *CarrierConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	select {
+	case pkt := <-c.in:
+		return copy(p, pkt.data), pkt.addr, nil
+	case <-c.die:
+		return 0, nil, errCarrierClosed
+	}
+}
+
+// WriteTo implements net.PacketConn, sending p over the carrier named addr
+func (c *CarrierConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	c.mu.Lock()
+	cr, ok := c.carriers[addr.String()]
+	c.mu.Unlock()
+	if !ok {
+		return 0, errCarrierClosed
+	}
+	cr.wmu.Lock()
+	defer cr.wmu.Unlock()
+	return writeFrame(cr.conn, p)
+}
+
+// Close closes all carriers
+func (c *CarrierConn) Close() error {
+	c.dieOnce.Do(func() { close(c.die) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, cr := range c.carriers {
+		cr.conn.Close()
+	}
+	return nil
+}
+
+// LocalAddr implements net.PacketConn
+func (c *CarrierConn) LocalAddr() net.Addr { return c.laddr }
+
+// SetDeadline implements net.PacketConn, carriers have no deadlines
+func (c *CarrierConn) SetDeadline(t time.Time) error { return nil }
+
+// SetReadDeadline implements net.PacketConn
+func (c *CarrierConn) SetReadDeadline(t time.Time) error { return nil }
+
+// SetWriteDeadline implements net.PacketConn
+func (c *CarrierConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// DialTCPCarrier opens a client carrier over plain TCP to addr
+func DialTCPCarrier(addr string) (*StreamPacketConn, error) {
+	dialer := net.Dialer{Timeout: 10 * time.Second, DualStack: true}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "DialTCPCarrier")
+	}
+	return NewStreamPacketConn(conn), nil
+}
+
+// ListenTCPCarrier accepts TCP carriers on addr and feeds them into c, it
+// blocks until the listener fails
+func ListenTCPCarrier(c *CarrierConn, addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer lis.Close()
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+		go c.Serve(conn, "tcp:"+conn.RemoteAddr().String())
+	}
+}
@@ -0,0 +1,185 @@
+package generic
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Chaff keeps a flow alive while it's idle, with bursts of dummy packets at
+// random times. They defeat flow correlation on idle and bursty traffic and
+// keep NAT bindings warm. A chaff packet is random bytes and a keyed tag,
+// which the receiving ChaffConn drops:
+//
+// | random(24-248B) | tag(8B) |
+const (
+	chaffTagSize  = 8
+	chaffMinBody  = 24
+	chaffMaxBody  = 248
+	chaffMaxBurst = 3
+
+	// server side peers silent for this long get no more chaff
+	chaffPeerExpiry = 2 * time.Minute
+)
+
+type chaffPeer struct {
+	addr     net.Addr
+	lastSend time.Time
+	lastRecv time.Time
+}
+
+// ChaffConn sends chaff to its peers when nothing was sent to them for
+// about an interval, and drops the chaff received
+type ChaffConn struct {
+	net.PacketConn
+	key      []byte
+	interval time.Duration
+
+	mu    sync.Mutex
+	peers map[string]*chaffPeer
+	rng   *rand.Rand
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// NewChaffConn wraps conn with chaff every interval of idleness. On the
+// client side raddr is the server, on the server side it's nil and chaff
+// goes to the peers heard from recently.
+func NewChaffConn(conn net.PacketConn, key string, interval time.Duration, raddr net.Addr) *ChaffConn {
+	c := new(ChaffConn)
+	c.PacketConn = conn
+	c.key = []byte(key)
+	c.interval = interval
+	c.peers = make(map[string]*chaffPeer)
+	c.rng = NewRand()
+	c.die = make(chan struct{})
+	if raddr != nil {
+		now := time.Now()
+		c.peers[raddr.String()] = &chaffPeer{raddr, now, now}
+	}
+	go c.loop(raddr == nil)
+	return c
+}
+
+func (c *ChaffConn) tag(body []byte) []byte {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte("kcptun-chaff"))
+	mac.Write(body)
+	return mac.Sum(nil)[:chaffTagSize]
+}
+
+func (c *ChaffConn) isChaff(p []byte) bool {
+	if len(p) < chaffMinBody+chaffTagSize || len(p) > chaffMaxBody+chaffTagSize {
+		return false
+	}
+	body := p[:len(p)-chaffTagSize]
+	return hmac.Equal(p[len(body):], c.tag(body))
+}
+
+// ReadFrom implements net.PacketConn
+func (c *ChaffConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, addr, err = c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return
+		}
+		c.mu.Lock()
+		peer, ok := c.peers[addr.String()]
+		if !ok {
+			peer = &chaffPeer{addr: addr, lastSend: time.Now()}
+			c.peers[addr.String()] = peer
+		}
+		peer.lastRecv = time.Now()
+		c.mu.Unlock()
+		if !c.isChaff(p[:n]) {
+			return
+		}
+	}
+}
+
+// WriteTo implements net.PacketConn
+func (c *ChaffConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	c.mu.Lock()
+	if peer, ok := c.peers[addr.String()]; ok {
+		peer.lastSend = time.Now()
+	}
+	c.mu.Unlock()
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// Close implements net.PacketConn
+func (c *ChaffConn) Close() error {
+	c.dieOnce.Do(func() {
+		close(c.die)
+	})
+	return c.PacketConn.Close()
+}
+
+// jitter returns d scaled randomly into [d/2, 3d/2), c.mu must be held
+func (c *ChaffConn) jitter(d time.Duration) time.Duration {
+	return d/2 + time.Duration(c.rng.Int63n(int64(d)))
+}
+
+func (c *ChaffConn) loop(expire bool) {
+	c.mu.Lock()
+	wait := c.jitter(c.interval)
+	c.mu.Unlock()
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-c.die:
+			return
+		}
+
+		now := time.Now()
+		var idle []net.Addr
+		c.mu.Lock()
+		for key, peer := range c.peers {
+			if expire && now.Sub(peer.lastRecv) > chaffPeerExpiry {
+				delete(c.peers, key)
+				continue
+			}
+			if now.Sub(peer.lastSend) >= c.interval/2 {
+				idle = append(idle, peer.addr)
+			}
+		}
+		c.mu.Unlock()
+		for _, addr := range idle {
+			c.burst(addr)
+		}
+
+		c.mu.Lock()
+		wait = c.jitter(c.interval)
+		c.mu.Unlock()
+		timer.Reset(wait)
+	}
+}
+
+// burst sends 1 to chaffMaxBurst chaff packets of random sizes to addr, a
+// few milliseconds apart
+func (c *ChaffConn) burst(addr net.Addr) {
+	c.mu.Lock()
+	count := 1 + c.rng.Intn(chaffMaxBurst)
+	c.mu.Unlock()
+	for i := 0; i < count; i++ {
+		c.mu.Lock()
+		body := make([]byte, chaffMinBody+c.rng.Intn(chaffMaxBody-chaffMinBody+1))
+		c.rng.Read(body)
+		gap := time.Duration(c.rng.Intn(50)) * time.Millisecond
+		c.mu.Unlock()
+		if _, err := c.PacketConn.WriteTo(append(body, c.tag(body)...), addr); err != nil {
+			return
+		}
+		select {
+		case <-time.After(gap):
+		case <-c.die:
+			return
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package generic
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// DefaultKey is the key shipped as flag default, it must never be used in
+// a real deployment
+const DefaultKey = "it's a secrect"
+
+// Report collects the findings of a configuration check
+type Report struct {
+	Errors   []string
+	Warnings []string
+}
+
+// Errorf records a problem that prevents the tunnel from working
+func (r *Report) Errorf(format string, args ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+// Warnf records a setting that works but is likely not what the user wants
+func (r *Report) Warnf(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// CheckAddr verifies that addr is a valid host:port pair, or a unix socket
+// path where allowed
+func (r *Report) CheckAddr(name, addr string) {
+	if network, path := SplitNetwork(addr); network == "unix" {
+		if path == "" {
+			r.Errorf("%v: empty unix socket path", name)
+		}
+		return
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		r.Errorf("%v: %v", name, err)
+	}
+}
+
+// CheckCrypt warns about the default key and unknown ciphers, which
+// silently fall back to aes
+func (r *Report) CheckCrypt(key, crypt string) {
+	if key == DefaultKey {
+		r.Warnf("key: the default key is public, generate one with 'genkey'")
+	}
+	switch crypt {
+	case "aes", "aes-128", "aes-192", "salsa20", "blowfish", "twofish", "cast5", "3des", "tea", "xtea", "xor", "sm4":
+	case "none":
+		r.Warnf("crypt: none, packets are neither encrypted nor authenticated")
+	default:
+		r.Warnf("crypt: unknown cipher %q, falling back to aes", crypt)
+	}
+}
+
+// CheckMode warns about unknown mode profiles, which behave like manual
+func (r *Report) CheckMode(mode string) {
+	switch mode {
+	case "normal", "fast", "fast2", "fast3", "manual", "auto":
+	default:
+		r.Warnf("mode: unknown profile %q, nodelay parameters are taken as is", mode)
+	}
+}
+
+// CheckMTU verifies mtu against the protocol limits and the largest MTU of
+// the local interfaces, since bigger packets get fragmented or dropped
+func (r *Report) CheckMTU(mtu int) {
+	const ipUDPHeader = 28
+	if mtu < 64 || mtu > 65507 {
+		r.Errorf("mtu: %v out of range", mtu)
+		return
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+	maxMTU := 0
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp != 0 && ifi.Flags&net.FlagLoopback == 0 && ifi.MTU > maxMTU {
+			maxMTU = ifi.MTU
+		}
+	}
+	if maxMTU > 0 && mtu+ipUDPHeader > maxMTU {
+		r.Warnf("mtu: %v plus %v bytes of IP/UDP headers exceeds the largest interface MTU %v", mtu, ipUDPHeader, maxMTU)
+	}
+}
+
+// CheckWindow warns when a window of wnd packets caps the throughput below
+// bandwidth(in Mbit/s) at the given rtt, i.e. it's smaller than the BDP
+func (r *Report) CheckWindow(name string, wnd, mtu int, rtt time.Duration, bandwidth int) {
+	if wnd <= 0 {
+		r.Errorf("%v: window must be positive", name)
+		return
+	}
+	bdp := float64(bandwidth) * 1e6 / 8 * rtt.Seconds() / float64(mtu)
+	if float64(wnd) < bdp {
+		ceiling := float64(wnd*mtu) * 8 / rtt.Seconds() / 1e6
+		r.Warnf("%v: %v packets is below the BDP of %.0f packets for %v Mbit/s at %v rtt, throughput is capped at %.1f Mbit/s",
+			name, wnd, bdp, bandwidth, rtt, ceiling)
+	}
+}
+
+// CheckFEC verifies the reed-solomon parameters
+func (r *Report) CheckFEC(dataShard, parityShard int) {
+	switch {
+	case dataShard < 0 || parityShard < 0:
+		r.Errorf("datashard/parityshard: must not be negative")
+	case dataShard+parityShard > 255:
+		r.Errorf("datashard/parityshard: %v shards in total, at most 255 are supported", dataShard+parityShard)
+	case dataShard == 0 && parityShard > 0, dataShard > 0 && parityShard == 0:
+		r.Warnf("datashard/parityshard: %v/%v disables FEC, set both to 0 to make it explicit", dataShard, parityShard)
+	}
+}
+
+// CheckDSCP verifies dscp fits in 6 bits
+func (r *Report) CheckDSCP(dscp int) {
+	if dscp < 0 || dscp > 63 {
+		r.Errorf("dscp: %v out of range 0-63", dscp)
+	}
+}
+
+// CheckSockBuf warns when the socket buffer can't hold a full window
+func (r *Report) CheckSockBuf(sockbuf, wnd, mtu int) {
+	if sockbuf < wnd*mtu {
+		r.Warnf("sockbuf: %v bytes can't hold a window of %v packets of %v bytes", sockbuf, wnd, mtu)
+	}
+}
+
+// CheckLoopback warns when addr, of an unauthenticated service, is
+// reachable from the network
+func (r *Report) CheckLoopback(name, addr string) {
+	network, address := SplitNetwork(addr)
+	if network == "unix" {
+		return
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil || host == "localhost" {
+		return
+	}
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		r.Warnf("%v: %v is reachable from the network without authentication, prefer 127.0.0.1 or a unix socket", name, addr)
+	}
+}
+
+// Print writes the findings to w, one per line
+func (r *Report) Print(w io.Writer) {
+	for _, msg := range r.Errors {
+		fmt.Fprintln(w, "ERROR:", msg)
+	}
+	for _, msg := range r.Warnings {
+		fmt.Fprintln(w, "WARNING:", msg)
+	}
+	if len(r.Errors) == 0 && len(r.Warnings) == 0 {
+		fmt.Fprintln(w, "no problems found")
+	}
+}
+
+// CheckResult is the --json output of check
+type CheckResult struct {
+	Config   interface{} `json:"config"`
+	Errors   []string    `json:"errors"`
+	Warnings []string    `json:"warnings"`
+}
+
+// Result returns the findings along with the effective config checked
+func (r *Report) Result(config interface{}) *CheckResult {
+	res := &CheckResult{Config: config, Errors: r.Errors, Warnings: r.Warnings}
+	// empty lists rather than nulls, for scripts
+	if res.Errors == nil {
+		res.Errors = []string{}
+	}
+	if res.Warnings == nil {
+		res.Warnings = []string{}
+	}
+	return res
+}
+
+// PrintJSON writes v to w as indented JSON, the --json output of the
+// informational commands
+func PrintJSON(w io.Writer, v interface{}) error {
+	out, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(out))
+	return err
+}
@@ -0,0 +1,31 @@
+package generic
+
+import "net"
+
+// ConnectedConn hands a UDP socket connected to the server to KCP, which
+// sends with WriteTo. A connected socket has the kernel drop the packets of
+// other sources before they reach the session, and report the ICMP errors
+// of the server's address to it: a port unreachable fails the next read,
+// ending the session at once instead of after the keepalive timeout, and a
+// fragmentation needed updates the path MTU of the socket, which --df do
+// follows.
+type ConnectedConn struct {
+	*net.UDPConn
+	raddr net.Addr
+}
+
+// NewConnectedConn wraps conn, connected with net.DialUDP
+func NewConnectedConn(conn *net.UDPConn) *ConnectedConn {
+	return &ConnectedConn{UDPConn: conn, raddr: conn.RemoteAddr()}
+}
+
+// ReadFrom implements net.PacketConn, the packets all come from the server
+func (c *ConnectedConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, err := c.UDPConn.Read(p)
+	return n, c.raddr, err
+}
+
+// WriteTo implements net.PacketConn, writing to the server whatever addr
+func (c *ConnectedConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	return c.UDPConn.Write(p)
+}
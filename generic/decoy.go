@@ -0,0 +1,115 @@
+package generic
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"net"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go"
+)
+
+// kcp-go drops the packets that don't decrypt under the key without a
+// word, so a silent port hints at kcptun as much as an answer would. With
+// --decoy, the server checks the packets itself and answers the others as
+// an unrelated service would, an answer no larger than the packet:
+//
+// dns: a DNS server refusing the query, FORMERR for what doesn't parse as
+// one, nothing for what's too short to be one, as bind does
+const (
+	DecoyNone = "none"
+	DecoyDNS  = "dns"
+
+	// kcp-go's packets start with | nonce(16B) | crc32(4B) |
+	kcpNonceSize       = 16
+	kcpCryptHeaderSize = kcpNonceSize + 4
+
+	dnsHeaderSize = 12
+)
+
+// CheckDecoy validates a --decoy value
+func CheckDecoy(mode string) error {
+	switch mode {
+	case "", DecoyNone, DecoyDNS:
+		return nil
+	}
+	return errors.Errorf("decoy: unknown mode %q, must be none or dns", mode)
+}
+
+// DecoyConn passes on the packets which decrypt under the key, and answers
+// the others as a decoy service
+type DecoyConn struct {
+	net.PacketConn
+	block  kcp.BlockCrypt
+	answer func(p []byte) []byte
+	plain  []byte // scratch, ReadFrom has a single caller, the listener
+}
+
+// NewDecoyConn checks the packets read from conn against block, and
+// answers the others as mode's service does, conn as is for none
+func NewDecoyConn(conn net.PacketConn, block kcp.BlockCrypt, mode string) net.PacketConn {
+	switch mode {
+	case DecoyDNS:
+		return &DecoyConn{PacketConn: conn, block: block, answer: dnsDecoy, plain: make([]byte, 65536)}
+	}
+	return conn
+}
+
+// authentic reports whether p decrypts under the key with a valid checksum
+func (c *DecoyConn) authentic(p []byte) bool {
+	if len(p) < kcpCryptHeaderSize {
+		return false
+	}
+	plain := c.plain[:len(p)]
+	c.block.Decrypt(plain, p)
+	return crc32.ChecksumIEEE(plain[kcpCryptHeaderSize:]) == binary.LittleEndian.Uint32(plain[kcpNonceSize:])
+}
+
+// ReadFrom implements net.PacketConn, answering the packets that aren't
+// the tunnel's
+func (c *DecoyConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, addr, err = c.PacketConn.ReadFrom(p)
+		if err != nil || c.authentic(p[:n]) {
+			return
+		}
+		if reply := c.answer(p[:n]); reply != nil {
+			c.PacketConn.WriteTo(reply, addr)
+		}
+	}
+}
+
+// dnsDecoy answers p as a DNS server refusing recursion, nil for no answer
+func dnsDecoy(p []byte) []byte {
+	if len(p) < dnsHeaderSize || p[2]&0x80 != 0 {
+		// too short, or a response: dropped
+		return nil
+	}
+	qdcount := binary.BigEndian.Uint16(p[4:])
+	// the question: labels up to the root, then type and class
+	end := dnsHeaderSize
+	for end < len(p) && p[end] != 0 && p[end]&0xc0 == 0 {
+		end += 1 + int(p[end])
+	}
+	end += 1 + 4
+	rcode := byte(5) // REFUSED
+	if qdcount != 1 || end > len(p) {
+		rcode, end = 1, dnsHeaderSize // FORMERR, the header alone
+	}
+
+	reply := make([]byte, end)
+	copy(reply, p[:end])
+	// QR, the opcode and RD as asked, RA clear
+	reply[2] = 0x80 | p[2]&0x79
+	reply[3] = rcode
+	// the question only, no records
+	var qd uint16
+	if rcode == 5 {
+		qd = 1
+	}
+	binary.BigEndian.PutUint16(reply[4:], qd)
+	binary.BigEndian.PutUint16(reply[6:], 0)
+	binary.BigEndian.PutUint16(reply[8:], 0)
+	binary.BigEndian.PutUint16(reply[10:], 0)
+	return reply
+}
@@ -0,0 +1,54 @@
+package generic
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// SetDF sets the don't fragment behaviour of conn with IP_MTU_DISCOVER, and
+// IPV6_MTU_DISCOVER on IPv6 sockets: do sets DF and follows the path MTU
+// the kernel learns, dont lets routers fragment, probe sets DF but ignores
+// the learned path MTU, so bigger packets can probe it. "" leaves the
+// system default.
+func SetDF(conn *net.UDPConn, mode string) error {
+	if mode == "" {
+		return nil
+	}
+	var v4, v6 int
+	switch mode {
+	case DFDo:
+		v4, v6 = syscall.IP_PMTUDISC_DO, syscall.IPV6_PMTUDISC_DO
+	case DFDont:
+		v4, v6 = syscall.IP_PMTUDISC_DONT, syscall.IPV6_PMTUDISC_DONT
+	case DFProbe:
+		v4, v6 = syscall.IP_PMTUDISC_PROBE, syscall.IPV6_PMTUDISC_PROBE
+	default:
+		return errors.Errorf("df: unknown mode %q", mode)
+	}
+	rawconn, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	ipv6 := false
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		ipv6 = true
+	}
+	var serr error
+	err = rawconn.Control(func(fd uintptr) {
+		if ipv6 {
+			if serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, v6); serr != nil {
+				return
+			}
+			// dual-stack sockets may carry IPv4 traffic too, best effort
+			syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, v4)
+			return
+		}
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, v4)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
@@ -0,0 +1,17 @@
+// +build !linux
+
+package generic
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// SetDF is only supported on linux, "" leaves the system default elsewhere
+func SetDF(conn *net.UDPConn, mode string) error {
+	if mode == "" {
+		return nil
+	}
+	return errors.New("df: only supported on linux")
+}
@@ -0,0 +1,148 @@
+package generic
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A server dialing its targets by name asks the resolver on every stream,
+// and a slow or flaky resolver adds its delay to every one of them. The
+// DNS cache keeps the addresses for the TTL of their records, capped at the
+// cache's own TTL, which also applies when the resolver doesn't tell. Past
+// it, the addresses are still used while they're refreshed in the
+// background, for up to dnsStale, so that a resolver failing doesn't fail
+// the dials. Failures are cached too, for dnsNegative, so that a name which
+// doesn't resolve doesn't hold every stream for the resolver's timeout.
+const (
+	dnsStale    = time.Hour
+	dnsNegative = 10 * time.Second
+)
+
+// dnsEntry is the outcome of the last lookup of a host
+type dnsEntry struct {
+	ips        []net.IP
+	err        error
+	expire     time.Time
+	refreshing bool
+	done       chan struct{} // closed once the first lookup is done
+}
+
+// DNSCache resolves host names with the records cached
+type DNSCache struct {
+	resolver string
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+// NewDNSCache caches the lookups of resolver, as LookupIP takes it, for up
+// to ttl
+func NewDNSCache(resolver string, ttl time.Duration) *DNSCache {
+	return &DNSCache{resolver: resolver, ttl: ttl, entries: make(map[string]*dnsEntry)}
+}
+
+// LookupIP returns the addresses of host, from the cache when they're
+// fresh, or stale with a refresh under way; a nil cache asks resolver
+// every time
+func (c *DNSCache) LookupIP(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if c == nil {
+		return net.LookupIP(host)
+	}
+	key := strings.ToLower(host)
+	now := time.Now()
+	c.mu.Lock()
+	e := c.entries[key]
+	pending := false
+	if e != nil {
+		select {
+		case <-e.done:
+		default:
+			pending = true
+		}
+	}
+	switch {
+	case pending:
+		c.mu.Unlock()
+		<-e.done
+		c.mu.Lock()
+	case e == nil || now.After(e.expire) && (e.ips == nil || now.After(e.expire.Add(dnsStale))):
+		// new, failed or long stale, the lookups meanwhile wait for this one
+		e = &dnsEntry{done: make(chan struct{})}
+		c.entries[key] = e
+		c.mu.Unlock()
+		c.lookup(key, e)
+		close(e.done)
+		c.mu.Lock()
+	case now.After(e.expire) && !e.refreshing:
+		e.refreshing = true
+		go c.lookup(key, e)
+	}
+	ips, err := e.ips, e.err
+	c.mu.Unlock()
+	if ips == nil {
+		return nil, err
+	}
+	return ips, nil
+}
+
+// lookup resolves host into e; a failed refresh keeps the stale addresses
+func (c *DNSCache) lookup(host string, e *dnsEntry) {
+	ips, ttl, err := LookupIPTTL(c.resolver, host)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e.refreshing = false
+	if err != nil || len(ips) == 0 {
+		if err == nil {
+			err = errors.Errorf("no address for %v", host)
+		}
+		if e.ips == nil {
+			e.err = err
+			e.expire = time.Now().Add(dnsNegative)
+		}
+		return
+	}
+	if ttl <= 0 || ttl > c.ttl {
+		ttl = c.ttl
+	}
+	e.ips, e.err = ips, nil
+	e.expire = time.Now().Add(ttl)
+}
+
+// Dial connects to address on network like net.DialTimeout does, with the
+// host resolved through the cache, trying its addresses in turn
+func (c *DNSCache) Dial(network, address string, timeout time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if c == nil || err != nil || net.ParseIP(host) != nil || !strings.HasPrefix(network, "tcp") && !strings.HasPrefix(network, "udp") {
+		return net.DialTimeout(network, address, timeout)
+	}
+	ips, err := c.LookupIP(host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	deadline := time.Now().Add(timeout)
+	var lastErr error
+	for k, ip := range ips {
+		if (strings.HasSuffix(network, "4") && ip.To4() == nil) || (strings.HasSuffix(network, "6") && ip.To4() != nil) {
+			continue
+		}
+		// the addresses left share the time left
+		remaining := time.Until(deadline) / time.Duration(len(ips)-k)
+		conn, err := net.DialTimeout(network, net.JoinHostPort(ip.String(), port), remaining)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = &net.OpError{Op: "dial", Net: network, Err: errors.Errorf("no %v address for %v", network, host)}
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,568 @@
+package generic
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DNS tunnels are the last resort in captive networks where only the local
+// resolver answers. The server is the authoritative name server of a
+// domain, and the client asks the local resolver for TXT records under it.
+// Upstream packets ride in the query names, base32 encoded:
+//
+// <data labels>.<header label>.<domain>, the header being client id(2B) |
+// sequence(2B), the sequence defeating caches
+//
+// Downstream packets ride in the TXT answers. The server may only speak in
+// answers, so the client keeps polling with empty queries, quickly while
+// data flows, and the server holds each query a moment for data to send.
+const (
+	dnsTypeTXT   = 16
+	dnsTypeOPT   = 41
+	dnsHeaderLen = 12
+	dnsMaxName   = 253
+	dnsMaxLabel  = 63
+	dnsEDNSSize  = 1232
+	dnsRcodeRef  = 5
+
+	// DNSDownstreamMTU is the KCP MTU of the server's side of DNS tunnels,
+	// the answers carry more than the queries
+	DNSDownstreamMTU = 900
+
+	// queries unanswered for this long get an empty answer, well before
+	// resolvers give up on them
+	dnsHold = 200 * time.Millisecond
+	// the most queries held per client
+	dnsMaxPending = 64
+	// the most packets queued per client for lack of queries
+	dnsMaxQueue = 256
+	// clients silent for this long are forgotten
+	dnsClientTTL = 2 * time.Minute
+
+	// the client polls this often while data flows, and at the slow pace
+	// when idle
+	dnsFastPoll = 20 * time.Millisecond
+	dnsSlowPoll = 500 * time.Millisecond
+)
+
+var dnsEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// DNSUpstreamMTU returns the largest packet a query under domain carries,
+// the KCP MTU of the client's side
+func DNSUpstreamMTU(domain string) int {
+	header := len(dnsEncoding.EncodeToString(make([]byte, 4)))
+	avail := dnsMaxName - (len(strings.Trim(domain, ".")) + 1) - (header + 1)
+	// one dot every label
+	chars := avail * dnsMaxLabel / (dnsMaxLabel + 1)
+	return chars * 5 / 8
+}
+
+// dnsAddr names a client of a DNS tunnel on the server side
+type dnsAddr uint16
+
+func (a dnsAddr) Network() string { return "dns" }
+func (a dnsAddr) String() string  { return fmt.Sprintf("dns#%v", uint16(a)) }
+
+// dnsHeld is a query held by the server for data to answer with
+type dnsHeld struct {
+	id       uint16
+	question []byte // as sent, answered as is
+	edns     bool
+	addr     net.Addr // the resolver asking
+	at       time.Time
+}
+
+// dnsClient is the state of a client on the server side
+type dnsClient struct {
+	pending []*dnsHeld
+	queue   [][]byte
+	seen    time.Time
+}
+
+// DNSConn is a PacketConn over DNS queries and answers
+type DNSConn struct {
+	conn   *net.UDPConn
+	domain string // lower case, no trailing dot
+
+	// client side
+	raddr    *net.UDPAddr
+	id       uint16
+	seq      uint32
+	lastData int64 // unix nanoseconds of the last downstream data
+
+	// server side
+	mu      sync.Mutex
+	clients map[dnsAddr]*dnsClient
+
+	in      chan icmpPacket
+	die     chan struct{}
+	dieOnce sync.Once
+	readErr error
+}
+
+func newDNSConn(conn *net.UDPConn, domain string) *DNSConn {
+	c := new(DNSConn)
+	c.conn = conn
+	c.domain = strings.ToLower(strings.Trim(domain, "."))
+	c.clients = make(map[dnsAddr]*dnsClient)
+	c.in = make(chan icmpPacket, 1024)
+	c.die = make(chan struct{})
+	return c
+}
+
+// ListenDNS serves DNS tunnels under domain on the UDP address addr,
+// usually port 53 of the name server the domain is delegated to
+func ListenDNS(addr, domain string) (*DNSConn, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	c := newDNSConn(conn, domain)
+	go c.serverLoop()
+	go c.holdLoop()
+	return c, nil
+}
+
+// DialDNS opens a DNS tunnel under domain through the resolver at addr
+func DialDNS(addr, domain string) (*DNSConn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "dns")
+	}
+	conn, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	c := newDNSConn(conn, domain)
+	c.raddr = raddr
+	var id [2]byte
+	rand.Read(id[:])
+	c.id = binary.BigEndian.Uint16(id[:])
+	go c.clientLoop()
+	go c.pollLoop()
+	return c, nil
+}
+
+// query builds a TXT query carrying p
+func (c *DNSConn) query(p []byte) ([]byte, error) {
+	var hdr [4]byte
+	binary.BigEndian.PutUint16(hdr[:], c.id)
+	binary.BigEndian.PutUint16(hdr[2:], uint16(atomic.AddUint32(&c.seq, 1)))
+	data := dnsEncoding.EncodeToString(p)
+	var labels []string
+	for len(data) > 0 {
+		size := len(data)
+		if size > dnsMaxLabel {
+			size = dnsMaxLabel
+		}
+		labels = append(labels, data[:size])
+		data = data[size:]
+	}
+	labels = append(labels, dnsEncoding.EncodeToString(hdr[:]))
+	labels = append(labels, strings.Split(c.domain, ".")...)
+	if len(strings.Join(labels, ".")) > dnsMaxName {
+		return nil, errors.Errorf("dns: %v bytes don't fit a query", len(p))
+	}
+
+	msg := make([]byte, dnsHeaderLen, 512)
+	rand.Read(msg[:2])
+	msg[2] = 0x01 // recursion desired
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	binary.BigEndian.PutUint16(msg[10:], 1)
+	for _, label := range labels {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, 0, dnsTypeTXT, 0, dnsClassIN)
+	// OPT pseudo record advertising large answers
+	msg = append(msg, 0, 0, dnsTypeOPT, dnsEDNSSize>>8, dnsEDNSSize&0xff, 0, 0, 0, 0, 0, 0)
+	return msg, nil
+}
+
+// dnsParseName returns the labels of the name at off of msg, and the offset
+// past it; compressed names are followed
+func dnsParseName(msg []byte, off int) (labels []string, next int, err error) {
+	next = -1
+	for jumps := 0; jumps < 16; {
+		if off >= len(msg) {
+			return nil, 0, errors.New("dns: truncated name")
+		}
+		size := int(msg[off])
+		switch {
+		case size == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return labels, next, nil
+		case size&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return nil, 0, errors.New("dns: truncated name")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+size > len(msg) {
+				return nil, 0, errors.New("dns: truncated name")
+			}
+			labels = append(labels, string(msg[off+1:off+1+size]))
+			off += 1 + size
+		}
+	}
+	return nil, 0, errors.New("dns: name loops")
+}
+
+// dnsParseAnswer returns the TXT data of an answer to one of the client's
+// queries
+func dnsParseAnswer(msg []byte) ([]byte, error) {
+	if len(msg) < dnsHeaderLen || msg[2]&0x80 == 0 {
+		return nil, errors.New("dns: not an answer")
+	}
+	if rcode := msg[3] & 0x0f; rcode != 0 {
+		return nil, errors.Errorf("dns: rcode %v", rcode)
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	off := dnsHeaderLen
+	for i := 0; i < qdcount; i++ {
+		next, err := dnsSkipName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next + 4
+	}
+	var data []byte
+	for i := 0; i < ancount; i++ {
+		next, err := dnsSkipName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		off = next
+		if off+10 > len(msg) {
+			return nil, errors.New("dns: truncated answer")
+		}
+		typ := binary.BigEndian.Uint16(msg[off:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, errors.New("dns: truncated answer")
+		}
+		if typ == dnsTypeTXT {
+			rdata := msg[off : off+rdlen]
+			for len(rdata) > 0 {
+				size := int(rdata[0])
+				if 1+size > len(rdata) {
+					return nil, errors.New("dns: truncated TXT")
+				}
+				data = append(data, rdata[1:1+size]...)
+				rdata = rdata[1+size:]
+			}
+		}
+		off += rdlen
+	}
+	return data, nil
+}
+
+func (c *DNSConn) clientLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		data, err := dnsParseAnswer(buf[:n])
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		atomic.StoreInt64(&c.lastData, time.Now().UnixNano())
+		// more may be queued on the server
+		c.poll()
+		select {
+		case c.in <- icmpPacket{data, c.raddr}:
+		case <-c.die:
+			return
+		}
+	}
+}
+
+func (c *DNSConn) poll() {
+	if msg, err := c.query(nil); err == nil {
+		c.conn.Write(msg)
+	}
+}
+
+// pollLoop gives the server queries to answer with its data
+func (c *DNSConn) pollLoop() {
+	for {
+		interval := dnsSlowPoll
+		if time.Since(time.Unix(0, atomic.LoadInt64(&c.lastData))) < time.Second {
+			interval = dnsFastPoll
+		}
+		select {
+		case <-time.After(interval):
+		case <-c.die:
+			return
+		}
+		c.poll()
+	}
+}
+
+// parseQuery returns the client id and data of a query for the tunnel
+// domain, and the question to answer with
+func (c *DNSConn) parseQuery(msg []byte) (q *dnsHeld, client dnsAddr, data []byte, err error) {
+	if len(msg) < dnsHeaderLen || msg[2]&0x80 != 0 || binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return nil, 0, nil, errors.New("dns: not a query")
+	}
+	labels, next, err := dnsParseName(msg, dnsHeaderLen)
+	if err != nil || next+4 > len(msg) {
+		return nil, 0, nil, errors.New("dns: bad question")
+	}
+	q = &dnsHeld{
+		id:       binary.BigEndian.Uint16(msg),
+		question: msg[dnsHeaderLen : next+4],
+		edns:     binary.BigEndian.Uint16(msg[10:]) > 0,
+		at:       time.Now(),
+	}
+
+	// resolvers may randomize the case of names
+	name := strings.ToLower(strings.Join(labels, "."))
+	if !strings.HasSuffix(name, "."+c.domain) || binary.BigEndian.Uint16(msg[next:]) != dnsTypeTXT {
+		return q, 0, nil, errors.New("dns: not for the tunnel")
+	}
+	parts := strings.Split(strings.TrimSuffix(name, "."+c.domain), ".")
+	hdr, err := dnsEncoding.DecodeString(parts[len(parts)-1])
+	if err != nil || len(hdr) != 4 {
+		return q, 0, nil, errors.New("dns: bad header label")
+	}
+	if data, err = dnsEncoding.DecodeString(strings.Join(parts[:len(parts)-1], "")); err != nil {
+		return q, 0, nil, errors.New("dns: bad data labels")
+	}
+	return q, dnsAddr(binary.BigEndian.Uint16(hdr)), data, nil
+}
+
+// answer responds to q with data in a TXT record, or with rcode
+func (c *DNSConn) answer(q *dnsHeld, data []byte, rcode byte) error {
+	msg := make([]byte, dnsHeaderLen, dnsHeaderLen+len(q.question)+len(data)+64)
+	binary.BigEndian.PutUint16(msg, q.id)
+	msg[2] = 0x84 // answer, authoritative
+	msg[3] = rcode
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	msg = append(msg, q.question...)
+	if rcode == 0 {
+		binary.BigEndian.PutUint16(msg[6:], 1)
+		var rdata []byte
+		for len(data) > 0 || rdata == nil {
+			size := len(data)
+			if size > 255 {
+				size = 255
+			}
+			rdata = append(rdata, byte(size))
+			rdata = append(rdata, data[:size]...)
+			data = data[size:]
+		}
+		// the name points at the question
+		msg = append(msg, 0xc0, dnsHeaderLen, 0, dnsTypeTXT, 0, dnsClassIN, 0, 0, 0, 0)
+		msg = append(msg, byte(len(rdata)>>8), byte(len(rdata)))
+		msg = append(msg, rdata...)
+	}
+	if q.edns {
+		binary.BigEndian.PutUint16(msg[10:], 1)
+		msg = append(msg, 0, 0, dnsTypeOPT, dnsEDNSSize>>8, dnsEDNSSize&0xff, 0, 0, 0, 0, 0, 0)
+	}
+	if (q.edns && len(msg) > dnsEDNSSize) || (!q.edns && len(msg) > 512) {
+		return errors.Errorf("dns: %v byte answer too large for the resolver", len(msg))
+	}
+	_, err := c.conn.WriteTo(msg, q.addr)
+	return err
+}
+
+func (c *DNSConn) serverLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		msg := make([]byte, n)
+		copy(msg, buf[:n])
+		q, client, data, err := c.parseQuery(msg)
+		if q == nil {
+			continue
+		}
+		q.addr = addr
+		if err != nil {
+			c.answer(q, nil, dnsRcodeRef)
+			continue
+		}
+
+		c.mu.Lock()
+		cl, ok := c.clients[client]
+		if !ok {
+			cl = new(dnsClient)
+			c.clients[client] = cl
+		}
+		cl.seen = time.Now()
+		var reply []byte
+		var held *dnsHeld
+		if len(cl.queue) > 0 {
+			reply = cl.queue[0]
+			cl.queue = cl.queue[1:]
+		} else {
+			cl.pending = append(cl.pending, q)
+			if len(cl.pending) > dnsMaxPending {
+				held = cl.pending[0]
+				cl.pending = cl.pending[1:]
+			}
+			q = nil
+		}
+		c.mu.Unlock()
+		if q != nil {
+			c.answer(q, reply, 0)
+		}
+		if held != nil {
+			c.answer(held, nil, 0)
+		}
+
+		if len(data) > 0 {
+			select {
+			case c.in <- icmpPacket{data, client}:
+			case <-c.die:
+				return
+			}
+		}
+	}
+}
+
+// holdLoop answers the queries held too long, and forgets silent clients
+func (c *DNSConn) holdLoop() {
+	ticker := time.NewTicker(dnsHold / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.die:
+			return
+		}
+		var expired []*dnsHeld
+		now := time.Now()
+		c.mu.Lock()
+		for addr, cl := range c.clients {
+			for len(cl.pending) > 0 && now.Sub(cl.pending[0].at) >= dnsHold {
+				expired = append(expired, cl.pending[0])
+				cl.pending = cl.pending[1:]
+			}
+			if now.Sub(cl.seen) > dnsClientTTL {
+				delete(c.clients, addr)
+			}
+		}
+		c.mu.Unlock()
+		for _, q := range expired {
+			c.answer(q, nil, 0)
+		}
+	}
+}
+
+func (c *DNSConn) fail(err error) {
+	c.dieOnce.Do(func() {
+		c.readErr = err
+		close(c.die)
+	})
+}
+
+// ReadFrom implements net.PacketConn
+func (c *DNSConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	select {
+	case pkt := <-c.in:
+		return copy(p, pkt.data), pkt.addr, nil
+	case <-c.die:
+		return 0, nil, c.readErr
+	}
+}
+
+// WriteTo implements net.PacketConn. The client sends a query through its
+// resolver whatever addr is, the server answers a held query of the client
+// named addr, or queues p for the next one.
+func (c *DNSConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if c.raddr != nil {
+		msg, err := c.query(p)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := c.conn.Write(msg); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+
+	client, ok := addr.(dnsAddr)
+	if !ok {
+		return 0, errors.Errorf("dns: no tunnel %v", addr)
+	}
+	data := make([]byte, len(p))
+	copy(data, p)
+	c.mu.Lock()
+	cl, ok := c.clients[client]
+	var q *dnsHeld
+	if ok {
+		if len(cl.pending) > 0 {
+			q = cl.pending[0]
+			cl.pending = cl.pending[1:]
+		} else if len(cl.queue) < dnsMaxQueue {
+			cl.queue = append(cl.queue, data)
+		}
+	}
+	c.mu.Unlock()
+	if !ok {
+		return 0, errors.Errorf("dns: no tunnel %v", addr)
+	}
+	if q != nil {
+		if err := c.answer(q, data, 0); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Close implements net.PacketConn
+func (c *DNSConn) Close() error {
+	c.fail(errors.New("dns: closed"))
+	return c.conn.Close()
+}
+
+// LocalAddr implements net.PacketConn
+func (c *DNSConn) LocalAddr() net.Addr { return c.conn.LocalAddr() }
+
+// RemoteAddr returns the resolver's address on the client side, nil
+// otherwise
+func (c *DNSConn) RemoteAddr() net.Addr {
+	if c.raddr == nil {
+		return nil
+	}
+	return c.raddr
+}
+
+// SetDeadline implements net.PacketConn, tunnels have no deadlines
+func (c *DNSConn) SetDeadline(t time.Time) error { return nil }
+
+// SetReadDeadline implements net.PacketConn
+func (c *DNSConn) SetReadDeadline(t time.Time) error { return nil }
+
+// SetWriteDeadline implements net.PacketConn
+func (c *DNSConn) SetWriteDeadline(t time.Time) error { return nil }
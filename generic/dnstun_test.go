@@ -0,0 +1,126 @@
+package generic
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDNSParseName(t *testing.T) {
+	tests := []struct {
+		name   string
+		msg    string
+		off    int
+		labels []string
+		next   int
+		err    bool
+	}{
+		{"plain", "\x03www\x07example\x03com\x00", 0, []string{"www", "example", "com"}, 17, false},
+		{"root", "\x00", 0, nil, 1, false},
+		{"at offset", "\xff\xff\x03com\x00", 2, []string{"com"}, 7, false},
+		{"compressed", "\x03com\x00\x07example\xc0\x00", 5, []string{"example", "com"}, 15, false},
+		{"chained pointers", "\x03com\x00\xc0\x00\x03www\xc0\x05", 7, []string{"www", "com"}, 13, false},
+		{"pointer to itself", "\xc0\x00", 0, nil, 0, true},
+		{"pointers to each other", "\xc0\x02\xc0\x00", 0, nil, 0, true},
+		{"label then loop", "\x01a\xc0\x00", 0, nil, 0, true},
+		{"truncated label", "\x05ab", 0, nil, 0, true},
+		{"truncated pointer", "\x03com\xc0", 0, nil, 0, true},
+		{"pointer past the end", "\xc0\x10", 0, nil, 0, true},
+		{"no terminator", "\x03com", 0, nil, 0, true},
+		{"offset past the end", "\x00", 1, nil, 0, true},
+		{"empty", "", 0, nil, 0, true},
+	}
+	for _, test := range tests {
+		labels, next, err := dnsParseName([]byte(test.msg), test.off)
+		if (err != nil) != test.err {
+			t.Errorf("%v: error %v, want error %v", test.name, err, test.err)
+			continue
+		}
+		if err == nil && (!reflect.DeepEqual(labels, test.labels) || next != test.next) {
+			t.Errorf("%v: got %q and %v, want %q and %v", test.name, labels, next, test.labels, test.next)
+		}
+	}
+}
+
+// dnsTestName encodes a dotted name without compression
+func dnsTestName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(name, ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// dnsTestQuery builds a query for a TXT record of name, with no OPT record
+func dnsTestQuery(name []byte) []byte {
+	msg := []byte{0xab, 0xcd, 0x01, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	msg = append(msg, name...)
+	return append(msg, 0, dnsTypeTXT, 0, dnsClassIN)
+}
+
+func TestDNSParseQuery(t *testing.T) {
+	c := newDNSConn(nil, "T.Example.com.")
+	c.id = 0x1234
+	data, err := c.query([]byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	poll, err := c.query(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// resolvers may randomize the case of the names they forward
+	upper := append([]byte(nil), data...)
+	for i := dnsHeaderLen; i < len(upper); i++ {
+		if upper[i] >= 'a' && upper[i] <= 'z' {
+			upper[i] -= 'a' - 'A'
+		}
+	}
+	response := append([]byte(nil), data...)
+	response[2] |= 0x80
+	questions := append([]byte(nil), data...)
+	questions[5] = 2
+	typeA := dnsTestQuery(dnsTestName("aaaaaaa.t.example.com"))
+	typeA[len(typeA)-3] = 1
+	header := dnsEncoding.EncodeToString([]byte{0x12, 0x34, 0, 1})
+	// the domain after the question, pointed at
+	compressed := dnsTestQuery([]byte("\x07" + header + "\xc0\x1a"))
+	compressed = append(compressed, dnsTestName("t.example.com")...)
+
+	tests := []struct {
+		name   string
+		msg    []byte
+		held   bool // a question to answer, even if refused
+		client dnsAddr
+		data   []byte
+		err    bool
+	}{
+		{"data", data, true, 0x1234, []byte("hello"), false},
+		{"poll", poll, true, 0x1234, nil, false},
+		{"mixed case", upper, true, 0x1234, []byte("hello"), false},
+		{"compressed", compressed, true, 0x1234, nil, false},
+		{"another domain", dnsTestQuery(dnsTestName(header + ".t.example.org")), true, 0, nil, true},
+		{"the domain itself", dnsTestQuery(dnsTestName("t.example.com")), true, 0, nil, true},
+		{"not TXT", typeA, true, 0, nil, true},
+		{"short header label", dnsTestQuery(dnsTestName("aaaa.t.example.com")), true, 0, nil, true},
+		{"bad base32", dnsTestQuery(dnsTestName("11." + header + ".t.example.com")), true, 0, nil, true},
+		{"response", response, false, 0, nil, true},
+		{"two questions", questions, false, 0, nil, true},
+		{"short", data[:dnsHeaderLen-1], false, 0, nil, true},
+		{"truncated name", data[:dnsHeaderLen+10], false, 0, nil, true},
+		{"truncated question", data[:len(data)-13], false, 0, nil, true},
+		{"name loops", dnsTestQuery([]byte{0xc0, dnsHeaderLen}), false, 0, nil, true},
+	}
+	for _, test := range tests {
+		q, client, data, err := c.parseQuery(test.msg)
+		if (err != nil) != test.err || (q != nil) != test.held {
+			t.Errorf("%v: error %v and held %v, want error %v and held %v", test.name, err, q != nil, test.err, test.held)
+			continue
+		}
+		if err == nil && (client != test.client || !bytes.Equal(data, test.data)) {
+			t.Errorf("%v: got client %v and %q, want client %v and %q", test.name, client, data, test.client, test.data)
+		}
+	}
+}
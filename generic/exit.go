@@ -0,0 +1,34 @@
+package generic
+
+import (
+	"log"
+	"os"
+
+	"github.com/urfave/cli"
+)
+
+// Exit codes of the client and the server, for wrapper scripts and service
+// managers to react to the cause of a failure
+const (
+	ExitError      = 1 // anything else
+	ExitConfig     = 2 // invalid flags or configuration
+	ExitAuthFailed = 3 // the peer doesn't share the key, or doesn't prove the one expected
+	ExitBind       = 4 // a local port, device or file can't be opened
+	ExitTransport  = 5 // the tunnel failed beyond recovery
+)
+
+// Fatal logs err and returns it with the exit code, for an Action to
+// return so that its deferred cleanups run
+func Fatal(code int, err error) error {
+	log.Printf("%+v\n", err)
+	return cli.NewExitError("", code)
+}
+
+// Exit logs err and exits with code unless err is nil, on the fatal paths
+// which can't return to the Action
+func Exit(code int, err error) {
+	if err != nil {
+		log.Printf("%+v\n", err)
+		os.Exit(code)
+	}
+}
@@ -0,0 +1,365 @@
+package generic
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FakeTCP carries the KCP packets as the payload of raw TCP segments, with
+// an emulated handshake and sequence numbers, so the flow looks like TCP to
+// middleboxes policing or deprioritizing UDP. The kernel doesn't know these
+// connections and answers them with RST, which must be dropped by the
+// firewall, see FakeTCPNote.
+const (
+	tcpHeaderSize = 20
+
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpPSH = 0x08
+	tcpACK = 0x10
+
+	fakeTCPWindow     = 65535
+	fakeTCPSynRetries = 5
+	fakeTCPSynTimeout = time.Second
+)
+
+type fakeTCPPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// fakeTCPFlow is the emulated state of one connection
+type fakeTCPFlow struct {
+	raddr     *net.TCPAddr
+	lip       net.IP
+	seq       uint32 // next sequence number to send
+	ack       uint32 // next sequence number expected from the peer
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+func (f *fakeTCPFlow) establish() {
+	f.readyOnce.Do(func() { close(f.ready) })
+}
+
+// FakeTCPConn is a PacketConn over raw TCP segments, one per peer flow
+type FakeTCPConn struct {
+	conn   *net.IPConn
+	lip    net.IP
+	lport  int
+	raddr  *net.TCPAddr // the server, on the client side
+	server bool
+
+	// the client keeps a real socket on its port, so that the kernel
+	// doesn't hand the port to another connection
+	reserve net.Listener
+
+	mu    sync.Mutex
+	flows map[string]*fakeTCPFlow
+
+	in      chan fakeTCPPacket
+	die     chan struct{}
+	readErr error
+}
+
+func listenRawTCP(ip net.IP) (*net.IPConn, error) {
+	network := "ip4:tcp"
+	if ip != nil && ip.To4() == nil {
+		network = "ip6:tcp"
+	}
+	return listenRaw(network, ip)
+}
+
+func newFakeTCPConn(conn *net.IPConn, lip net.IP, lport int) *FakeTCPConn {
+	c := new(FakeTCPConn)
+	c.conn = conn
+	c.lip = lip
+	c.lport = lport
+	c.flows = make(map[string]*fakeTCPFlow)
+	c.in = make(chan fakeTCPPacket, 1024)
+	c.die = make(chan struct{})
+	go c.readLoop()
+	return c
+}
+
+// ListenFakeTCP accepts FakeTCP flows on the TCP port of addr
+func ListenFakeTCP(addr string) (*FakeTCPConn, error) {
+	laddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "faketcp")
+	}
+	if laddr.Port == 0 {
+		return nil, errors.Errorf("faketcp: %v has no port", addr)
+	}
+	conn, err := listenRawTCP(laddr.IP)
+	if err != nil {
+		return nil, err
+	}
+	c := newFakeTCPConn(conn, laddr.IP, laddr.Port)
+	c.server = true
+	return c, nil
+}
+
+// DialFakeTCP opens a FakeTCP flow to addr, completing the emulated
+// handshake before returning
+func DialFakeTCP(addr string) (*FakeTCPConn, error) {
+	raddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "faketcp")
+	}
+	reserve, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return nil, errors.Wrap(err, "faketcp")
+	}
+	conn, err := listenRawTCP(raddr.IP)
+	if err != nil {
+		reserve.Close()
+		return nil, err
+	}
+	c := newFakeTCPConn(conn, nil, reserve.Addr().(*net.TCPAddr).Port)
+	c.raddr = raddr
+	c.reserve = reserve
+	if err := c.handshake(raddr); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// FakeTCPNote returns the firewall rule dropping the kernel's RST replies
+// to the flows of a server listening on port, or of a client talking to
+// the server at raddr when raddr is set
+func FakeTCPNote(port int, raddr string) string {
+	if raddr == "" {
+		return fmt.Sprintf("faketcp: the kernel resets unknown TCP flows, drop its RSTs with: iptables -A OUTPUT -p tcp --sport %v --tcp-flags RST RST -j DROP", port)
+	}
+	host, rport, err := net.SplitHostPort(raddr)
+	if err != nil {
+		return err.Error()
+	}
+	return fmt.Sprintf("faketcp: the kernel resets unknown TCP flows, drop its RSTs with: iptables -A OUTPUT -p tcp -d %v --dport %v --tcp-flags RST RST -j DROP", host, rport)
+}
+
+// newFlow registers a flow to raddr, replacing any previous one, c.mu must
+// be held
+func (c *FakeTCPConn) newFlow(raddr *net.TCPAddr) *fakeTCPFlow {
+	flow := &fakeTCPFlow{raddr: raddr, seq: rand.Uint32(), ready: make(chan struct{})}
+	flow.lip = c.lip
+	if flow.lip == nil || flow.lip.IsUnspecified() {
+		flow.lip = localIPFor(raddr.IP)
+	}
+	c.flows[raddr.String()] = flow
+	return flow
+}
+
+// localIPFor returns the source address the kernel picks for ip
+func localIPFor(ip net.IP) net.IP {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: 9})
+	if err != nil {
+		return net.IPv4zero
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+func (c *FakeTCPConn) handshake(raddr *net.TCPAddr) error {
+	c.mu.Lock()
+	flow := c.newFlow(raddr)
+	isn := flow.seq
+	c.mu.Unlock()
+
+	for i := 0; i < fakeTCPSynRetries; i++ {
+		c.mu.Lock()
+		flow.seq = isn
+		c.mu.Unlock()
+		if err := c.send(flow, tcpSYN, nil); err != nil {
+			return err
+		}
+		select {
+		case <-flow.ready:
+			return nil
+		case <-time.After(fakeTCPSynTimeout):
+		case <-c.die:
+			return c.readErr
+		}
+	}
+	return errors.Errorf("faketcp: no SYN-ACK from %v, is the server accepting faketcp on that port?", raddr)
+}
+
+// send writes one segment to flow, advancing its sequence number
+func (c *FakeTCPConn) send(flow *fakeTCPFlow, flags byte, payload []byte) error {
+	seg := make([]byte, tcpHeaderSize+len(payload))
+	c.mu.Lock()
+	binary.BigEndian.PutUint16(seg[0:], uint16(c.lport))
+	binary.BigEndian.PutUint16(seg[2:], uint16(flow.raddr.Port))
+	binary.BigEndian.PutUint32(seg[4:], flow.seq)
+	if flags&tcpACK != 0 {
+		binary.BigEndian.PutUint32(seg[8:], flow.ack)
+	}
+	flow.seq += uint32(len(payload))
+	if flags&tcpSYN != 0 {
+		flow.seq++
+	}
+	c.mu.Unlock()
+	seg[12] = (tcpHeaderSize / 4) << 4
+	seg[13] = flags
+	binary.BigEndian.PutUint16(seg[14:], fakeTCPWindow)
+	copy(seg[tcpHeaderSize:], payload)
+	binary.BigEndian.PutUint16(seg[16:], tcpChecksum(flow.lip, flow.raddr.IP, seg))
+
+	_, err := c.conn.WriteToIP(seg, &net.IPAddr{IP: flow.raddr.IP})
+	return err
+}
+
+// tcpChecksum computes the checksum of seg including the pseudo header
+func tcpChecksum(src, dst net.IP, seg []byte) uint16 {
+	var pseudo []byte
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		pseudo = make([]byte, 12)
+		copy(pseudo[0:], src4)
+		copy(pseudo[4:], dst4)
+		pseudo[9] = 6
+		binary.BigEndian.PutUint16(pseudo[10:], uint16(len(seg)))
+	} else {
+		pseudo = make([]byte, 40)
+		copy(pseudo[0:], src.To16())
+		copy(pseudo[16:], dst.To16())
+		binary.BigEndian.PutUint32(pseudo[32:], uint32(len(seg)))
+		pseudo[39] = 6
+	}
+	return checksum(pseudo, seg)
+}
+
+func (c *FakeTCPConn) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := c.conn.ReadFromIP(buf)
+		if err != nil {
+			c.readErr = err
+			close(c.die)
+			return
+		}
+		// the raw socket sees every TCP segment of the host
+		if n < tcpHeaderSize || int(binary.BigEndian.Uint16(buf[2:])) != c.lport {
+			continue
+		}
+		off := int(buf[12]>>4) * 4
+		if off < tcpHeaderSize || off > n {
+			continue
+		}
+		raddr := &net.TCPAddr{IP: addr.IP, Port: int(binary.BigEndian.Uint16(buf))}
+		c.handleSegment(raddr, binary.BigEndian.Uint32(buf[4:]), buf[13], buf[off:n])
+	}
+}
+
+func (c *FakeTCPConn) handleSegment(raddr *net.TCPAddr, seq uint32, flags byte, payload []byte) {
+	if flags&tcpRST != 0 {
+		// stray resets from a kernel without the firewall rule
+		return
+	}
+
+	c.mu.Lock()
+	flow := c.flows[raddr.String()]
+	switch {
+	case flags&tcpSYN != 0 && flags&tcpACK == 0:
+		if !c.server {
+			c.mu.Unlock()
+			return
+		}
+		flow = c.newFlow(raddr)
+		flow.ack = seq + 1
+		c.mu.Unlock()
+		c.send(flow, tcpSYN|tcpACK, nil)
+		return
+	case flags&tcpSYN != 0:
+		if flow == nil {
+			c.mu.Unlock()
+			return
+		}
+		flow.ack = seq + 1
+		c.mu.Unlock()
+		c.send(flow, tcpACK, nil)
+		flow.establish()
+		return
+	}
+
+	if flow == nil {
+		if !c.server {
+			c.mu.Unlock()
+			return
+		}
+		// adopt flows whose handshake was lost, e.g. across a server restart
+		flow = c.newFlow(raddr)
+	}
+	flow.ack = seq + uint32(len(payload))
+	c.mu.Unlock()
+	flow.establish()
+
+	if len(payload) == 0 {
+		return
+	}
+	pkt := fakeTCPPacket{make([]byte, len(payload)), raddr}
+	copy(pkt.data, payload)
+	select {
+	case c.in <- pkt:
+	case <-c.die:
+	}
+}
+
+// ReadFrom implements net.PacketConn
+func (c *FakeTCPConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	select {
+	case pkt := <-c.in:
+		return copy(p, pkt.data), pkt.addr, nil
+	case <-c.die:
+		return 0, nil, c.readErr
+	}
+}
+
+// WriteTo implements net.PacketConn, sending p on the flow to addr
+func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	c.mu.Lock()
+	flow, ok := c.flows[addr.String()]
+	c.mu.Unlock()
+	if !ok {
+		return 0, errors.Errorf("faketcp: no flow to %v", addr)
+	}
+	if err := c.send(flow, tcpPSH|tcpACK, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close implements net.PacketConn
+func (c *FakeTCPConn) Close() error {
+	if c.reserve != nil {
+		c.reserve.Close()
+	}
+	return c.conn.Close()
+}
+
+// LocalAddr implements net.PacketConn
+func (c *FakeTCPConn) LocalAddr() net.Addr { return &net.TCPAddr{IP: c.lip, Port: c.lport} }
+
+// RemoteAddr returns the server's address on the client side, nil otherwise
+func (c *FakeTCPConn) RemoteAddr() net.Addr {
+	if c.raddr == nil {
+		return nil
+	}
+	return c.raddr
+}
+
+// SetDeadline implements net.PacketConn, flows have no deadlines
+func (c *FakeTCPConn) SetDeadline(t time.Time) error { return nil }
+
+// SetReadDeadline implements net.PacketConn
+func (c *FakeTCPConn) SetReadDeadline(t time.Time) error { return nil }
+
+// SetWriteDeadline implements net.PacketConn
+func (c *FakeTCPConn) SetWriteDeadline(t time.Time) error { return nil }
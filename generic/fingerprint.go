@@ -0,0 +1,202 @@
+package generic
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A client and a server disagreeing on -crypt or the FEC shards can't
+// exchange a single KCP packet, so their hello never gets through and the
+// client only sees its sessions stall. Fingerprints run below KCP, under
+// the key alone: the client sends the parameters of its hello, sealed, as
+// it dials, and the server answers with its own. Each end compares them as
+// the hello would, and names the mismatch in its log; the client gives up
+// at once. Replies are the same size as requests, no amplification:
+//
+// | nonce(12B) | AES-GCM sealed JSON of the parameters, space padded |
+const (
+	fingerprintNonceSize = 12
+	fingerprintPlainSize = 160
+	fingerprintSize      = fingerprintNonceSize + fingerprintPlainSize + 16
+
+	// the client resends until answered, servers predating fingerprints
+	// never answer
+	fingerprintInterval = time.Second
+	fingerprintTries    = 3
+)
+
+var (
+	fingerprintLabel = []byte("kcptun-fingerprint")
+	fingerprintPing  = []byte("kcptun-fingerprint-ping")
+	fingerprintPong  = []byte("kcptun-fingerprint-pong")
+)
+
+// ErrConfigMismatch is the cause of the errors of fingerprints the peer's
+// doesn't match
+var ErrConfigMismatch = errors.New("config mismatch")
+
+// IsConfigMismatch reports whether err is caused by ErrConfigMismatch
+func IsConfigMismatch(err error) bool {
+	return errors.Cause(err) == ErrConfigMismatch
+}
+
+// FingerprintConn sends the fingerprint of the client's parameters on the
+// client side and answers those of the clients on the server side,
+// dropping the fingerprints it receives
+type FingerprintConn struct {
+	net.PacketConn
+	aead  cipher.AEAD
+	local []byte // the sealed parameters, JSON padded
+	hello *Hello
+	raddr net.Addr
+
+	mu         sync.Mutex
+	nonce      []byte // of the last fingerprint sent
+	answered   bool
+	onMismatch func(error)
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// NewFingerprintConn wraps conn with the fingerprints of local's parameters
+// under key. On the client side raddr is the server to send them to, and
+// the function set with OnMismatch runs when the server's differ; on the
+// server side raddr is nil.
+func NewFingerprintConn(conn net.PacketConn, key string, local *Hello, raddr net.Addr) *FingerprintConn {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(fingerprintLabel)
+	block, _ := aes.NewCipher(mac.Sum(nil))
+	aead, _ := cipher.NewGCM(block)
+
+	// only what the hello checks
+	params, _ := json.Marshal(&Hello{
+		Version:     local.Version,
+		Crypt:       local.Crypt,
+		DataShard:   local.DataShard,
+		ParityShard: local.ParityShard,
+		NoComp:      local.NoComp,
+		StreamComp:  local.StreamComp,
+		Tunnel:      local.Tunnel,
+	})
+	padded := bytes.Repeat([]byte(" "), fingerprintPlainSize)
+	copy(padded, params)
+
+	c := new(FingerprintConn)
+	c.PacketConn = conn
+	c.aead = aead
+	c.local = padded
+	c.hello = local
+	c.raddr = raddr
+	c.die = make(chan struct{})
+	if raddr != nil {
+		go c.loop()
+	}
+	return c
+}
+
+// OnMismatch sets the function to run when the server's parameters differ
+func (c *FingerprintConn) OnMismatch(fn func(error)) {
+	c.mu.Lock()
+	c.onMismatch = fn
+	c.mu.Unlock()
+}
+
+// seal returns a fingerprint of kind label, in answer to the one of nonce
+// for pongs
+func (c *FingerprintConn) seal(label, nonce []byte) []byte {
+	p := make([]byte, fingerprintNonceSize, fingerprintSize)
+	rand.Read(p)
+	return c.aead.Seal(p, p, c.local, append(append([]byte{}, label...), nonce...))
+}
+
+// open returns the parameters of p if it's a fingerprint of kind label
+func (c *FingerprintConn) open(p, label, nonce []byte) (*Hello, bool) {
+	if len(p) != fingerprintSize {
+		return nil, false
+	}
+	plain, err := c.aead.Open(nil, p[:fingerprintNonceSize], p[fingerprintNonceSize:], append(append([]byte{}, label...), nonce...))
+	if err != nil {
+		return nil, false
+	}
+	peer := new(Hello)
+	if err := json.Unmarshal(plain, peer); err != nil {
+		return nil, false
+	}
+	return peer, true
+}
+
+// ReadFrom implements net.PacketConn
+func (c *FingerprintConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, addr, err = c.PacketConn.ReadFrom(p)
+		if err != nil || n != fingerprintSize {
+			return
+		}
+		if c.raddr == nil {
+			peer, ok := c.open(p[:n], fingerprintPing, nil)
+			if !ok {
+				return
+			}
+			if err := c.hello.Check(peer); err != nil {
+				log.Println("fingerprint:", addr, "config mismatch:", err)
+			}
+			c.PacketConn.WriteTo(c.seal(fingerprintPong, p[:fingerprintNonceSize]), addr)
+			continue
+		}
+
+		c.mu.Lock()
+		peer, ok := c.open(p[:n], fingerprintPong, c.nonce)
+		first := ok && !c.answered
+		c.answered = c.answered || ok
+		onMismatch := c.onMismatch
+		c.mu.Unlock()
+		if !ok {
+			return
+		}
+		if err := c.hello.Check(peer); first && err != nil && onMismatch != nil {
+			onMismatch(errors.Wrap(ErrConfigMismatch, err.Error()))
+		}
+	}
+}
+
+// Close implements net.PacketConn
+func (c *FingerprintConn) Close() error {
+	c.dieOnce.Do(func() {
+		close(c.die)
+	})
+	return c.PacketConn.Close()
+}
+
+func (c *FingerprintConn) loop() {
+	ticker := time.NewTicker(fingerprintInterval)
+	defer ticker.Stop()
+	for i := 0; i < fingerprintTries; i++ {
+		c.mu.Lock()
+		if c.answered {
+			c.mu.Unlock()
+			return
+		}
+		ping := c.seal(fingerprintPing, nil)
+		c.nonce = ping[:fingerprintNonceSize]
+		c.mu.Unlock()
+		c.PacketConn.WriteTo(ping, c.raddr)
+
+		select {
+		case <-ticker.C:
+		case <-c.die:
+			return
+		}
+	}
+}
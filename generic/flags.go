@@ -0,0 +1,236 @@
+package generic
+
+import "github.com/urfave/cli"
+
+// VERSION is injected by buildflags
+var VERSION = "SELFBUILD"
+
+// The flags the client and the server share, defined once so that the two
+// can't drift apart
+var (
+	TapFilterFlag = cli.StringFlag{
+		Name:   "tapfilter",
+		Value:  "",
+		Usage:  "frames of the TAP interface to send, like ipv4,ipv6,arp,0x88cc,nobroadcast, all if empty",
+		EnvVar: "KCPTUN_TAPFILTER",
+	}
+	KeyFlag = cli.StringFlag{
+		Name:   "key",
+		Value:  DefaultKey,
+		Usage:  "pre-shared secret between client and server, generate one with 'genkey'",
+		EnvVar: "KCPTUN_KEY",
+	}
+	CryptFlag = cli.StringFlag{
+		Name:   "crypt",
+		Value:  "aes",
+		Usage:  "aes, aes-128, aes-192, salsa20, blowfish, twofish, cast5, 3des, tea, xtea, xor, sm4, none",
+		EnvVar: "KCPTUN_CRYPT",
+	}
+	ModeFlag = cli.StringFlag{
+		Name:   "mode",
+		Value:  "fast",
+		Usage:  "profiles: fast3, fast2, fast, normal, manual, auto(between normal and fast2 as the link reports of telemetry call for)",
+		EnvVar: "KCPTUN_MODE",
+	}
+	MTUFlag = cli.IntFlag{
+		Name:   "mtu",
+		Value:  1350,
+		Usage:  "set maximum transmission unit for UDP packets",
+		EnvVar: "KCPTUN_MTU",
+	}
+	DataShardFlag = cli.IntFlag{
+		Name:   "datashard,ds",
+		Value:  10,
+		Usage:  "set reed-solomon erasure coding - datashard",
+		EnvVar: "KCPTUN_DATASHARD",
+	}
+	ParityShardFlag = cli.IntFlag{
+		Name:   "parityshard,ps",
+		Value:  3,
+		Usage:  "set reed-solomon erasure coding - parityshard",
+		EnvVar: "KCPTUN_PARITYSHARD",
+	}
+	DSCPFlag = cli.IntFlag{
+		Name:   "dscp",
+		Value:  0,
+		Usage:  "set DSCP(6bit)",
+		EnvVar: "KCPTUN_DSCP",
+	}
+	DFFlag = cli.StringFlag{
+		Name:   "df",
+		Value:  "",
+		Usage:  "don't fragment on the UDP socket (linux): do(set DF, follow the path MTU), dont(allow fragmenting), probe(set DF, ignore the path MTU), empty for the system default",
+		EnvVar: "KCPTUN_DF",
+	}
+	TTLFlag = cli.IntFlag{
+		Name:   "ttl",
+		Value:  0,
+		Usage:  "IP TTL, or hop limit, of the tunnel's packets, 0 for the system default",
+		EnvVar: "KCPTUN_TTL",
+	}
+	FWMarkFlag = cli.IntFlag{
+		Name:   "fwmark",
+		Value:  0,
+		Usage:  "fwmark of the tunnel's UDP packets for policy routing (linux, needs CAP_NET_ADMIN), 0 for none",
+		EnvVar: "KCPTUN_FWMARK",
+	}
+	NoCompFlag = cli.BoolFlag{
+		Name:   "nocomp",
+		Usage:  "disable compression",
+		EnvVar: "KCPTUN_NOCOMP",
+	}
+	StreamCompFlag = cli.BoolFlag{
+		Name:   "streamcomp",
+		Usage:  "compress per stream and direction, skipping already compressed or encrypted data, instead of the whole session",
+		EnvVar: "KCPTUN_STREAMCOMP",
+	}
+	AckNodelayFlag = cli.BoolFlag{
+		Name:   "acknodelay",
+		Usage:  "flush ack immediately when a packet is received",
+		Hidden: true,
+		EnvVar: "KCPTUN_ACKNODELAY",
+	}
+	NoDelayFlag = cli.IntFlag{
+		Name:   "nodelay",
+		Value:  0,
+		Hidden: true,
+		EnvVar: "KCPTUN_NODELAY",
+	}
+	IntervalFlag = cli.IntFlag{
+		Name:   "interval",
+		Value:  50,
+		Hidden: true,
+		EnvVar: "KCPTUN_INTERVAL",
+	}
+	ResendFlag = cli.IntFlag{
+		Name:   "resend",
+		Value:  0,
+		Hidden: true,
+		EnvVar: "KCPTUN_RESEND",
+	}
+	NoCongestionFlag = cli.IntFlag{
+		Name:   "nc",
+		Value:  0,
+		Hidden: true,
+		EnvVar: "KCPTUN_NC",
+	}
+	SockBufFlag = cli.IntFlag{
+		Name:   "sockbuf",
+		Value:  4194304,
+		Usage:  "socket buffer size in bytes, also the smux receive buffer of each session, lower it on small routers",
+		EnvVar: "KCPTUN_SOCKBUF",
+	}
+	KeepAliveFlag = cli.IntFlag{
+		Name:   "keepalive",
+		Value:  10,
+		Usage:  "seconds between smux keepalives, which also keep NAT mappings open",
+		EnvVar: "KCPTUN_KEEPALIVE",
+	}
+	KeepAliveTimeoutFlag = cli.IntFlag{
+		Name:   "keepalivetimeout",
+		Value:  30,
+		Usage:  "seconds without any data before smux closes a session, more than keepalive",
+		EnvVar: "KCPTUN_KEEPALIVETIMEOUT",
+	}
+	TLSKeyFlag = cli.StringFlag{
+		Name:   "tlskey",
+		Value:  "",
+		Usage:  "private key file of --tlscert",
+		EnvVar: "KCPTUN_TLSKEY",
+	}
+	SmuxFrameFlag = cli.IntFlag{
+		Name:   "smuxframe",
+		Value:  4096,
+		Usage:  "maximum smux frame size in bytes, up to 65535",
+		EnvVar: "KCPTUN_SMUXFRAME",
+	}
+	SnmpLogFlag = cli.StringFlag{
+		Name:   "snmplog",
+		Value:  "",
+		Usage:  "collect snmp to file, aware of timeformat in golang, like: ./snmp-20060102.log",
+		EnvVar: "KCPTUN_SNMPLOG",
+	}
+	SnmpPeriodFlag = cli.IntFlag{
+		Name:   "snmpperiod",
+		Value:  60,
+		Usage:  "snmp collect period, in seconds",
+		EnvVar: "KCPTUN_SNMPPERIOD",
+	}
+	StatsdFlag = cli.StringFlag{
+		Name:   "statsd",
+		Value:  "",
+		Usage:  "push the session, stream, byte, retransmission and rtt metrics to this statsd host:port, or graphite://host:port",
+		EnvVar: "KCPTUN_STATSD",
+	}
+	StatsdPeriodFlag = cli.IntFlag{
+		Name:   "statsdperiod",
+		Value:  10,
+		Usage:  "statsd push period, in seconds",
+		EnvVar: "KCPTUN_STATSDPERIOD",
+	}
+	AdminFlag = cli.StringFlag{
+		Name:   "admin",
+		Value:  "",
+		Usage:  "serve the live sessions and streams to 'top' on this host:port or unix:/path socket",
+		EnvVar: "KCPTUN_ADMIN",
+	}
+	LogFlag = cli.StringFlag{
+		Name:   "log",
+		Value:  "",
+		Usage:  "specify a log file to output, default goes to stderr",
+		EnvVar: "KCPTUN_LOG",
+	}
+	QuietFlag = cli.BoolFlag{
+		Name:   "quiet",
+		Usage:  "to suppress the 'stream open/close' messages",
+		EnvVar: "KCPTUN_QUIET",
+	}
+	OTLPFlag = cli.StringFlag{
+		Name:   "otlp",
+		Value:  "",
+		Usage:  "export spans of the sessions and streams to this OpenTelemetry collector, like http://localhost:4318",
+		EnvVar: "KCPTUN_OTLP",
+	}
+	WebhookLossFlag = cli.IntFlag{
+		Name:   "webhookloss",
+		Value:  10,
+		Usage:  "percent of the segments retransmitted for 30 seconds that posts a loss event, 0 for none",
+		EnvVar: "KCPTUN_WEBHOOKLOSS",
+	}
+	PcapFlag = cli.StringFlag{
+		Name:   "pcap",
+		Value:  "",
+		Usage:  "debug: capture the UDP packets to a pcap file",
+		EnvVar: "KCPTUN_PCAP",
+	}
+	PcapPlainFlag = cli.BoolFlag{
+		Name:   "pcapplain",
+		Usage:  "debug: decrypt the packets before capturing, to see the FEC and KCP headers",
+		EnvVar: "KCPTUN_PCAPPLAIN",
+	}
+	RecordsFlag = cli.StringFlag{
+		Name:   "records",
+		Value:  "",
+		Usage:  "cut the writes into records of random sizes in this range, like 64-1200, sent in packets of their own, so the sizes of the application's writes don't show",
+		EnvVar: "KCPTUN_RECORDS",
+	}
+	ImpairFlag = cli.StringFlag{
+		Name:   "impair",
+		Value:  "",
+		Usage:  "testing: inject faults into the UDP path, like loss=5,dup=1,reorder=2,delay=50ms,jitter=10ms",
+		Hidden: true,
+		EnvVar: "KCPTUN_IMPAIR",
+	}
+	SeedFlag = cli.Int64Flag{
+		Name:   "seed",
+		Value:  0,
+		Usage:  "debug: seed the random choices outside the crypto, like the faults of --impair and the padding sizes, so runs can be reproduced, 0 for random",
+		EnvVar: "KCPTUN_SEED",
+	}
+	ConfigFlag = cli.StringFlag{
+		Name:   "c",
+		Value:  "", // when the value is not empty, the config path must exists
+		Usage:  "config from json file, which will override the command from shell",
+		EnvVar: "KCPTUN_CONFIG",
+	}
+)
@@ -0,0 +1,152 @@
+package generic
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// SALT is use for pbkdf2 key expansion
+const SALT = "kcp-go"
+
+// DeriveKey expands a --key into the 32 bytes of the block ciphers and the
+// handshakes, the same on the client and the server
+func DeriveKey(key string) []byte {
+	return pbkdf2.Key([]byte(key), []byte(SALT), 4096, 32, sha1.New)
+}
+
+// GenKey returns n cryptographically random bytes, base64 encoded
+func GenKey(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf), nil
+}
+
+// GenKeyCommand prints a random key, or writes a matching client and
+// server config pair built around it
+var GenKeyCommand = cli.Command{
+	Name:  "genkey",
+	Usage: "generate a random key, optionally with a ready-to-use client and server config pair",
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:   "length",
+			Value:  32,
+			Usage:  "key length in bytes before base64 encoding",
+			EnvVar: "KCPTUN_GENKEY_LENGTH",
+		},
+		cli.BoolFlag{
+			Name:   "noise",
+			Usage:  "generate a noise key pair for --handshake noise-ik/noise-xk instead",
+			EnvVar: "KCPTUN_GENKEY_NOISE",
+		},
+		cli.StringFlag{
+			Name:   "pair",
+			Value:  "",
+			Usage:  "directory to write client.json and server.json into",
+			EnvVar: "KCPTUN_GENKEY_PAIR",
+		},
+		cli.StringFlag{
+			Name:   "server",
+			Value:  "vps:29900",
+			Usage:  "kcp server address written into the config pair",
+			EnvVar: "KCPTUN_GENKEY_SERVER",
+		},
+		cli.StringFlag{
+			Name:   "target",
+			Value:  "127.0.0.1:12948",
+			Usage:  "target address written into the config pair",
+			EnvVar: "KCPTUN_GENKEY_TARGET",
+		},
+		cli.StringFlag{
+			Name:   "local",
+			Value:  ":12948",
+			Usage:  "client listen address written into the config pair",
+			EnvVar: "KCPTUN_GENKEY_LOCAL",
+		},
+	},
+	Action: genkey,
+}
+
+func genkey(c *cli.Context) error {
+	if c.Bool("noise") {
+		key, err := GenerateNoiseKey()
+		if err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		fmt.Println("private:", key.PrivateString())
+		fmt.Println("public:", key.PublicString())
+		return nil
+	}
+	if c.Int("length") < 16 {
+		return cli.NewExitError("key length must be at least 16 bytes", 1)
+	}
+	key, err := GenKey(c.Int("length"))
+	if err != nil {
+		return cli.NewExitError(err.Error(), 1)
+	}
+
+	dir := c.String("pair")
+	if dir == "" {
+		fmt.Println(key)
+		return nil
+	}
+
+	_, port, err := net.SplitHostPort(c.String("server"))
+	if err != nil {
+		return cli.NewExitError("server: "+err.Error(), 1)
+	}
+	shared := map[string]interface{}{
+		"key":         key,
+		"crypt":       "aes",
+		"mode":        "fast",
+		"datashard":   10,
+		"parityshard": 3,
+		"nocomp":      false,
+	}
+	client := map[string]interface{}{
+		"localaddr":  c.String("local"),
+		"remoteaddr": c.String("server"),
+	}
+	server := map[string]interface{}{
+		"listen": ":" + port,
+		"target": c.String("target"),
+	}
+	for k, v := range shared {
+		client[k] = v
+		server[k] = v
+	}
+
+	for name, config := range map[string]interface{}{"client.json": client, "server.json": server} {
+		if err := writeConfig(filepath.Join(dir, name), config); err != nil {
+			return cli.NewExitError(err.Error(), 1)
+		}
+		fmt.Println("written:", filepath.Join(dir, name))
+	}
+	return nil
+}
+
+// writeConfig creates path readable by the owner only, refusing to
+// overwrite an existing config
+func writeConfig(path string, config interface{}) error {
+	out, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(out, '\n'))
+	return err
+}
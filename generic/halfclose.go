@@ -0,0 +1,131 @@
+package generic
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// smux closes both directions of a stream at once, truncating protocols
+// which shut down one direction and keep reading the other, like HTTP
+// uploads or git. Sessions which went through the hello exchange frame the
+// data of their streams, so that an empty frame can carry the shutdown of
+// one direction:
+//
+// | length(2B) | data |
+const (
+	halfCloseMaxFrame = 65535
+
+	// HalfCloseLinger is how long a half closed tunnel waits for the other
+	// direction before closing anyway
+	HalfCloseLinger = 2 * time.Minute
+)
+
+// HalfCloseStream frames the data of a stream, supporting CloseWrite
+type HalfCloseStream struct {
+	io.ReadWriteCloser
+
+	rmu    sync.Mutex
+	remain int // bytes left of the frame being read
+	eof    bool
+
+	wmu sync.Mutex
+}
+
+// NewHalfCloseStream wraps stream with framing
+func NewHalfCloseStream(stream io.ReadWriteCloser) *HalfCloseStream {
+	return &HalfCloseStream{ReadWriteCloser: stream}
+}
+
+// Read implements io.Reader, returning io.EOF once the peer closed its
+// writing direction
+func (s *HalfCloseStream) Read(p []byte) (n int, err error) {
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+	for s.remain == 0 {
+		if s.eof {
+			return 0, io.EOF
+		}
+		var hdr [2]byte
+		if _, err := io.ReadFull(s.ReadWriteCloser, hdr[:]); err != nil {
+			return 0, err
+		}
+		s.remain = int(binary.BigEndian.Uint16(hdr[:]))
+		s.eof = s.remain == 0
+	}
+	if len(p) > s.remain {
+		p = p[:s.remain]
+	}
+	n, err = s.ReadWriteCloser.Read(p)
+	s.remain -= n
+	return n, err
+}
+
+// Write implements io.Writer
+func (s *HalfCloseStream) Write(p []byte) (n int, err error) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	for len(p) > 0 {
+		size := len(p)
+		if size > halfCloseMaxFrame {
+			size = halfCloseMaxFrame
+		}
+		frame := make([]byte, 2+size)
+		binary.BigEndian.PutUint16(frame, uint16(size))
+		copy(frame[2:], p[:size])
+		if _, err := s.ReadWriteCloser.Write(frame); err != nil {
+			return n, err
+		}
+		n += size
+		p = p[size:]
+	}
+	return n, nil
+}
+
+// CloseWrite tells the peer that nothing more will be written
+func (s *HalfCloseStream) CloseWrite() error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	_, err := s.ReadWriteCloser.Write([]byte{0, 0})
+	return err
+}
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// CloseWrite shuts down the writing direction of conn, failing if it
+// doesn't support that
+func CloseWrite(conn io.ReadWriteCloser) error {
+	if cw, ok := conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("half close not supported")
+}
+
+// Pipe copies between p1 and p2 until both directions are done. The end
+// of one direction is passed on as a half close, or closes both when a
+// side can't half close. A half closed pipe closes after HalfCloseLinger.
+func Pipe(p1, p2 io.ReadWriteCloser) {
+	done := make(chan struct{}, 2)
+	halfClose := func(dst, src io.ReadWriteCloser) {
+		if _, err := io.Copy(dst, src); err != nil || CloseWrite(dst) != nil {
+			p1.Close()
+			p2.Close()
+		}
+		done <- struct{}{}
+	}
+	go halfClose(p1, p2)
+	go halfClose(p2, p1)
+
+	<-done
+	select {
+	case <-done:
+	case <-time.After(HalfCloseLinger):
+	}
+	p1.Close()
+	p2.Close()
+}
@@ -0,0 +1,231 @@
+package generic
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// With --handshake tls, every session starts with a TLS 1.3 handshake over
+// the KCP stream, and its streams then run inside the TLS connection. The
+// session gets keys of its own with forward secrecy, and the server is
+// authenticated by a certificate: a CA issued one, or by default an
+// ephemeral one bound to the pre-shared key, as with QUIC.
+const (
+	HandshakeNone = "none"
+	HandshakeTLS  = "tls"
+)
+
+// ErrAuthFailed is the cause of the errors of handshakes failing on a key:
+// the ends don't share -key, or a peer doesn't prove the key expected
+var ErrAuthFailed = errors.New("auth failed: key mismatch")
+
+// authFailed returns ErrAuthFailed annotated with what failed
+func authFailed(format string, args ...interface{}) error {
+	return errors.Wrapf(ErrAuthFailed, format, args...)
+}
+
+// IsAuthFailed reports whether err is caused by ErrAuthFailed
+func IsAuthFailed(err error) bool {
+	return errors.Cause(err) == ErrAuthFailed
+}
+
+// CheckHandshake validates a --handshake value
+func CheckHandshake(mode string) error {
+	switch mode {
+	case HandshakeNone, HandshakeTLS, HandshakeNoiseIK, HandshakeNoiseXK:
+		return nil
+	}
+	return errors.Errorf("handshake: unknown mode %q, must be none, tls, noise-ik or noise-xk", mode)
+}
+
+// NewHandshakeServerTLS serves the certificate in certFile and keyFile, or
+// an ephemeral one tagged with pass when certFile is empty
+func NewHandshakeServerTLS(certFile, keyFile string, pass []byte) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if certFile != "" {
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	} else {
+		cert, err = taggedCertificate(pass)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "handshake")
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
+
+// NewHandshakeClientTLS verifies the server's certificate for serverName
+// against the CAs in caFile, or accepts only certificates tagged with pass
+// when caFile is empty. With pins, the certificate's public key must also
+// match one of them, and the tag isn't checked.
+func NewHandshakeClientTLS(serverName, caFile string, pass []byte, pins []string) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS13,
+	}
+	if caFile == "" {
+		// the certificate is self-signed, VerifyPeerCertificate checks the
+		// tag or the pins
+		config.InsecureSkipVerify = true
+		config.VerifyPeerCertificate = verifyTag(pass, "handshake")
+	} else {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "handshake")
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("handshake: no certificate in %v", caFile)
+		}
+	}
+	if len(pins) > 0 {
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("handshake: no server certificate")
+			}
+			cert, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return errors.Wrap(err, "handshake")
+			}
+			return CheckPin(KeyPin(cert.RawSubjectPublicKeyInfo), pins)
+		}
+	}
+	return config, nil
+}
+
+// KeyPin returns the pin of a public key: sha256/ and the base64 of its
+// SHA-256 digest. TLS keys are pinned by their SubjectPublicKeyInfo, as
+// with HPKP, noise keys by their 32 bytes.
+func KeyPin(public []byte) string {
+	sum := sha256.Sum256(public)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// ParsePins splits a comma separated list of pins
+func ParsePins(s string) ([]string, error) {
+	var pins []string
+	for _, pin := range strings.Split(s, ",") {
+		if pin = strings.TrimSpace(pin); pin == "" {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(pin, "sha256/"))
+		if !strings.HasPrefix(pin, "sha256/") || err != nil || len(b) != sha256.Size {
+			return nil, errors.Errorf("pin: %q is not sha256/ and a base64 digest", pin)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// CheckPin returns an error unless pin is one of pins
+func CheckPin(pin string, pins []string) error {
+	for _, p := range pins {
+		if p == pin {
+			return nil
+		}
+	}
+	return authFailed("handshake: server key %v matches no pin", pin)
+}
+
+// PeerPin returns the pin of the key the peer proved in the handshake of
+// conn: the static key of a noise conn, the certificate key of a TLS one.
+// It's "" for none.
+func PeerPin(conn net.Conn) string {
+	switch conn := conn.(type) {
+	case *noiseConn:
+		if conn.peer == nil {
+			return conn.pin
+		}
+		return KeyPin(conn.peer)
+	case *tls.Conn:
+		if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			return KeyPin(certs[0].RawSubjectPublicKeyInfo)
+		}
+	}
+	return ""
+}
+
+// TLSPin returns the pin of the certificate served by config
+func TLSPin(config *tls.Config) (string, error) {
+	cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		return "", err
+	}
+	return KeyPin(cert.RawSubjectPublicKeyInfo), nil
+}
+
+// TLSHandshake runs the TLS handshake over conn, as the server or the
+// client, within timeout. The returned conn replaces conn.
+func TLSHandshake(conn net.Conn, config *tls.Config, server bool, timeout time.Duration) (net.Conn, error) {
+	var tconn *tls.Conn
+	if server {
+		tconn = tls.Server(conn, config)
+	} else {
+		tconn = tls.Client(conn, config)
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	if err := tconn.Handshake(); err != nil {
+		switch err.(type) {
+		case x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError:
+			return nil, authFailed("handshake: %v", err)
+		}
+		return nil, errors.Wrap(err, "handshake")
+	}
+	return tconn, nil
+}
+
+// KeyExchange runs the --handshake key exchange at the start of sessions,
+// set up by each end from its own flags
+type KeyExchange struct {
+	Mode    string
+	Server  bool // which end runs it
+	Timeout time.Duration
+	TLS     *tls.Config
+	Noise   *NoiseKey
+	Peer    []byte   // the server's noise public key, on the client
+	Allowed [][]byte // client noise public keys, any when empty, on the server
+	PQ      bool
+	Tokens  *TokenIssuer // of the sessions clients resume, on the server
+}
+
+// Run returns conn wrapped by the key exchange, conn itself for none. The
+// server resumes the sessions of clients presenting a token instead.
+func (kx *KeyExchange) Run(conn net.Conn) (net.Conn, error) {
+	if kx.Server && kx.Tokens != nil && kx.Mode != HandshakeNone && kx.Mode != "" {
+		br := bufio.NewReader(conn)
+		conn.SetReadDeadline(time.Now().Add(kx.Timeout))
+		magic, err := br.Peek(len(resumeMagic))
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			return nil, errors.Wrap(err, "handshake")
+		}
+		conn = &helloConn{conn, br}
+		if bytes.Equal(magic, resumeMagic) {
+			return kx.Tokens.resume(conn, kx.Timeout)
+		}
+	}
+	switch kx.Mode {
+	case HandshakeTLS:
+		return TLSHandshake(conn, kx.TLS, kx.Server, kx.Timeout)
+	case HandshakeNoiseIK, HandshakeNoiseXK:
+		if kx.Server {
+			return NoiseServer(conn, kx.Mode, kx.Noise, kx.Allowed, kx.PQ, kx.Timeout)
+		}
+		return NoiseClient(conn, kx.Mode, kx.Noise, kx.Peer, kx.PQ, kx.Timeout)
+	}
+	return conn, nil
+}
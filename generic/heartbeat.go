@@ -0,0 +1,175 @@
+package generic
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"net"
+	"sync"
+	"time"
+)
+
+// Heartbeats run below KCP, so a dead path is noticed whatever the streams
+// are doing. The client pings whenever it has heard nothing for an
+// interval, and gives up on the server after a dead peer threshold. The
+// server answers pings with pongs of the same size, no amplification. The
+// client times the pong of its last ping as a round trip, and keeps pinging
+// every interval when asked for them.
+//
+// | nonce(16B) | tag(8B) |
+const (
+	heartbeatNonceSize = 16
+	heartbeatTagSize   = 8
+	heartbeatSize      = heartbeatNonceSize + heartbeatTagSize
+)
+
+var (
+	heartbeatPing = []byte("kcptun-heartbeat-ping")
+	heartbeatPong = []byte("kcptun-heartbeat-pong")
+)
+
+// HeartbeatConn pings the server on the client side and answers the pings
+// on the server side, dropping the heartbeats it receives
+type HeartbeatConn struct {
+	net.PacketConn
+	key      []byte
+	raddr    net.Addr
+	interval time.Duration
+	dead     time.Duration
+
+	mu       sync.Mutex
+	lastRecv time.Time
+	onDead   func()
+	onRTT    func(time.Duration)
+	pingSent time.Time
+	pingTag  []byte // of the ping awaiting its pong
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// NewHeartbeatConn wraps conn with heartbeats. On the client side raddr is
+// the server to ping every interval of silence, and the function set with
+// OnDead runs once nothing has been heard for dead; 0 disables either. On
+// the server side raddr is nil.
+func NewHeartbeatConn(conn net.PacketConn, key string, raddr net.Addr, interval, dead time.Duration) *HeartbeatConn {
+	c := new(HeartbeatConn)
+	c.PacketConn = conn
+	c.key = []byte(key)
+	c.raddr = raddr
+	c.interval = interval
+	c.dead = dead
+	c.lastRecv = time.Now()
+	c.die = make(chan struct{})
+	if raddr != nil {
+		go c.loop()
+	}
+	return c
+}
+
+// OnRTT sets the function counting the round trips of the pings, which
+// then go out every interval, silent or not
+func (c *HeartbeatConn) OnRTT(fn func(time.Duration)) {
+	c.mu.Lock()
+	c.onRTT = fn
+	c.mu.Unlock()
+}
+
+// OnDead sets the function to run when the server is found dead
+func (c *HeartbeatConn) OnDead(fn func()) {
+	c.mu.Lock()
+	c.onDead = fn
+	c.mu.Unlock()
+}
+
+func (c *HeartbeatConn) tag(label, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write(label)
+	mac.Write(nonce)
+	return mac.Sum(nil)[:heartbeatTagSize]
+}
+
+// is reports whether p is a heartbeat of kind label
+func (c *HeartbeatConn) is(p, label []byte) bool {
+	return len(p) == heartbeatSize && hmac.Equal(p[heartbeatNonceSize:], c.tag(label, p[:heartbeatNonceSize]))
+}
+
+// ReadFrom implements net.PacketConn
+func (c *HeartbeatConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, addr, err = c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return
+		}
+		c.mu.Lock()
+		c.lastRecv = time.Now()
+		c.mu.Unlock()
+
+		switch {
+		case c.raddr == nil && c.is(p[:n], heartbeatPing):
+			pong := make([]byte, heartbeatSize)
+			copy(pong, p[:heartbeatNonceSize])
+			copy(pong[heartbeatNonceSize:], c.tag(heartbeatPong, pong[:heartbeatNonceSize]))
+			c.PacketConn.WriteTo(pong, addr)
+		case c.raddr != nil && c.is(p[:n], heartbeatPong):
+			c.mu.Lock()
+			onRTT := c.onRTT
+			var rtt time.Duration
+			if c.pingTag != nil && hmac.Equal(p[:heartbeatNonceSize], c.pingTag) {
+				rtt = time.Since(c.pingSent)
+				c.pingTag = nil
+			}
+			c.mu.Unlock()
+			if onRTT != nil && rtt > 0 {
+				onRTT(rtt)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Close implements net.PacketConn
+func (c *HeartbeatConn) Close() error {
+	c.dieOnce.Do(func() {
+		close(c.die)
+	})
+	return c.PacketConn.Close()
+}
+
+func (c *HeartbeatConn) loop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var lastPing time.Time
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.die:
+			return
+		}
+
+		now := time.Now()
+		c.mu.Lock()
+		silence := now.Sub(c.lastRecv)
+		onDead := c.onDead
+		timed := c.onRTT != nil
+		c.mu.Unlock()
+
+		if c.dead > 0 && silence >= c.dead {
+			if onDead != nil {
+				onDead()
+			}
+			return
+		}
+		if c.interval > 0 && (silence >= c.interval || timed) && now.Sub(lastPing) >= c.interval {
+			ping := make([]byte, heartbeatSize)
+			rand.Read(ping[:heartbeatNonceSize])
+			copy(ping[heartbeatNonceSize:], c.tag(heartbeatPing, ping[:heartbeatNonceSize]))
+			c.mu.Lock()
+			c.pingSent, c.pingTag = now, ping[:heartbeatNonceSize]
+			c.mu.Unlock()
+			c.PacketConn.WriteTo(ping, c.raddr)
+			lastPing = now
+		}
+	}
+}
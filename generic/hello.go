@@ -0,0 +1,255 @@
+package generic
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The hello exchange opens every KCP session, before compression and smux,
+// so that both ends agree on the protocol and its parameters, and builds
+// that can't talk to each other fail with a clear error:
+//
+// | magic(8B) | length(2B) | JSON encoded Hello |
+//
+// The first byte of the magic is neither a smux version nor the start of a
+// snappy stream, so the server still accepts clients sending no hello.
+const (
+	// ProtocolVersion is bumped on changes to the tunnel protocol which old
+	// builds can't handle, 2 frames the streams for half close
+	ProtocolVersion = 2
+
+	helloMaxSize = 4096
+)
+
+var helloMagic = []byte("\x00kcptun\x01")
+
+// ErrServerBusy is the cause of the errors of hellos a server refused for
+// being at its --maxsessions, which clients don't keep dialing into
+var ErrServerBusy = errors.New("server busy")
+
+// IsServerBusy reports whether err is caused by ErrServerBusy
+func IsServerBusy(err error) bool {
+	return errors.Cause(err) == ErrServerBusy
+}
+
+// refusal is the error of a hello the server refused for reason
+func refusal(reason string) error {
+	if reason == ErrServerBusy.Error() {
+		return errors.Wrap(ErrServerBusy, "hello: server refused")
+	}
+	return errors.Errorf("hello: server refused: %v", reason)
+}
+
+// Hello carries the protocol version and the parameters both ends must agree
+// on, Error is set by a server refusing the client
+type Hello struct {
+	Version     int    `json:"version"`
+	Crypt       string `json:"crypt"`
+	DataShard   int    `json:"datashard"`
+	ParityShard int    `json:"parityshard"`
+	NoComp      bool   `json:"nocomp"`
+	StreamComp  bool   `json:"streamcomp,omitempty"`
+	PQ          bool   `json:"pq,omitempty"` // the key exchange includes Kyber, see pqExchange
+	Interactive bool   `json:"interactive,omitempty"`
+	Telemetry   bool   `json:"telemetry,omitempty"` // a control stream opens the session, see NewTelemetry
+	StreamAck   bool   `json:"streamack,omitempty"` // the server answers every stream, see StreamStatus
+	Migrate     bool   `json:"migrate,omitempty"`   // streams move over to new sessions, see MigrateStream
+	Checksum    bool   `json:"checksum,omitempty"`  // stream data carries CRCs, see ChecksumStream
+	Tunnel      string `json:"tunnel,omitempty"`    // what the streams carry, "" for TCP
+	Error       string `json:"error,omitempty"`
+
+	// Push holds the session parameters a server imposes on its clients
+	Push *Params `json:"push,omitempty"`
+	// Recv is what the end receives with, sent by clients on asymmetric
+	// links and by all servers
+	Recv *RecvParams `json:"recv,omitempty"`
+	// Token is the resumption token issued by the server, or presented by
+	// a client resuming
+	Token []byte `json:"token,omitempty"`
+
+	// Time, Nonce and MAC are the client's stamp, see StampHello
+	Time  int64  `json:"time,omitempty"`
+	Nonce []byte `json:"nonce,omitempty"`
+	MAC   []byte `json:"mac,omitempty"`
+}
+
+// Params are the KCP parameters a server pushes, from the client's point of
+// view: SndWnd is the client's send window
+type Params struct {
+	MTU          int `json:"mtu"`
+	SndWnd       int `json:"sndwnd"`
+	RcvWnd       int `json:"rcvwnd"`
+	NoDelay      int `json:"nodelay"`
+	Interval     int `json:"interval"`
+	Resend       int `json:"resend"`
+	NoCongestion int `json:"nc"`
+}
+
+// RecvParams are what an end receives with, for the peer to size its send
+// window and pace its sending to, so each direction of an asymmetric link
+// gets its own
+type RecvParams struct {
+	RcvWnd int `json:"rcvwnd"`
+	Rate   int `json:"rate,omitempty"` // Mbit/s, 0 for unknown
+}
+
+// Check returns why a session between h and peer can't work, if it can't
+func (h *Hello) Check(peer *Hello) error {
+	switch {
+	case peer.Version != h.Version:
+		return errors.Errorf("incompatible version: protocol %v, peer speaks %v", h.Version, peer.Version)
+	case peer.Crypt != h.Crypt:
+		return errors.Errorf("crypt mismatch: %v, peer uses %v", h.Crypt, peer.Crypt)
+	case peer.DataShard != h.DataShard || peer.ParityShard != h.ParityShard:
+		return errors.Errorf("fec mismatch: %v/%v, peer uses %v/%v", h.DataShard, h.ParityShard, peer.DataShard, peer.ParityShard)
+	case peer.NoComp != h.NoComp || peer.StreamComp != h.StreamComp:
+		return errors.Errorf("compression mismatch: nocomp %v streamcomp %v, peer nocomp %v streamcomp %v", h.NoComp, h.StreamComp, peer.NoComp, peer.StreamComp)
+	case peer.PQ != h.PQ:
+		return errors.Errorf("post-quantum mismatch: pq %v, peer pq %v", h.PQ, peer.PQ)
+	case peer.Tunnel != h.Tunnel:
+		return errors.Errorf("tunnel mismatch: %q, peer carries %q", h.Tunnel, peer.Tunnel)
+	}
+	return nil
+}
+
+// WriteHello sends h to w in one write
+func WriteHello(w io.Writer, h *Hello) error {
+	body, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	msg := make([]byte, len(helloMagic)+2+len(body))
+	copy(msg, helloMagic)
+	binary.BigEndian.PutUint16(msg[len(helloMagic):], uint16(len(body)))
+	copy(msg[len(helloMagic)+2:], body)
+	_, err = w.Write(msg)
+	return err
+}
+
+// ReadHello receives a Hello from r
+func ReadHello(r io.Reader) (*Hello, error) {
+	hdr := make([]byte, len(helloMagic)+2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hdr[:len(helloMagic)], helloMagic) {
+		return nil, errors.New("hello: bad magic")
+	}
+	size := int(binary.BigEndian.Uint16(hdr[len(helloMagic):]))
+	if size > helloMaxSize {
+		return nil, errors.Errorf("hello: %v bytes is too large", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	h := new(Hello)
+	if err := json.Unmarshal(body, h); err != nil {
+		return nil, errors.Wrap(err, "hello")
+	}
+	return h, nil
+}
+
+// ClientHello sends local over conn and waits up to timeout for the server's
+// answer, returning the server's Hello. An answer to a stamped local is
+// verified under key.
+func ClientHello(conn net.Conn, local *Hello, key []byte, timeout time.Duration) (*Hello, error) {
+	if err := WriteHello(conn, local); err != nil {
+		return nil, errors.Wrap(err, "hello")
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	remote, err := ReadHello(conn)
+	if err != nil {
+		return nil, errors.Wrap(err, "hello: no answer, -key or -crypt may not match the server's (try the ping command), or the server may predate the hello exchange (try --nohello)")
+	}
+	if err := VerifyReply(local, remote, key); err != nil {
+		return remote, err
+	}
+	if remote.Error != "" {
+		return remote, refusal(remote.Error)
+	}
+	if err := local.Check(remote); err != nil {
+		return remote, errors.Wrap(err, "hello")
+	}
+	return remote, nil
+}
+
+// helloConn is a net.Conn reading through the buffer ServerHello peeked with
+type helloConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *helloConn) Read(p []byte) (n int, err error) {
+	return c.r.Read(p)
+}
+
+// ServerHello answers the hello of a client on conn with local, waiting up
+// to timeout for the client's first bytes. The returned conn replaces conn,
+// and the client's Hello is nil for clients sending none, which guard
+// refuses. A client failing the check, the guard or presenting a token
+// tokens doesn't accept is refused with the reason, as are all of them with
+// ErrServerBusy when busy, the others get a new token if tokens is not nil.
+// Tokens are bound to the key exchange of conn by b, and a session resumed
+// with one must spend it.
+func ServerHello(conn net.Conn, local *Hello, timeout time.Duration, tokens *TokenIssuer, guard *ReplayGuard, busy bool, b *TokenBinding) (net.Conn, *Hello, error) {
+	br := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	magic, err := br.Peek(len(helloMagic))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "hello")
+	}
+	wrapped := &helloConn{conn, br}
+	if !bytes.Equal(magic, helloMagic) {
+		if b.Token != nil {
+			return nil, nil, errors.New("hello: none sent in a resumed session")
+		}
+		if guard.strict() {
+			return nil, nil, errors.New("hello: none sent, replay protection requires one")
+		}
+		return wrapped, nil, nil
+	}
+
+	remote, err := ReadHello(br)
+	if err != nil {
+		return nil, nil, err
+	}
+	reply := *local
+	err = local.Check(remote)
+	if err == nil {
+		err = guard.Check(remote)
+	}
+	if err == nil && busy {
+		// the token is kept for when the server has room
+		err = ErrServerBusy
+	}
+	if err == nil && b.Token != nil && !bytes.Equal(remote.Token, b.Token) {
+		err = errors.New("resumption token not the one the session resumed with")
+	}
+	if err == nil && remote.Token != nil && (tokens == nil || !tokens.Redeem(remote.Token, remote, b)) {
+		err = errors.New("resumption token invalid, expired, spent or of another client")
+	}
+	if err != nil {
+		reply.Error = err.Error()
+		guard.sign(remote, &reply)
+		WriteHello(conn, &reply)
+		return nil, remote, errors.Wrap(err, "hello")
+	}
+	if tokens != nil {
+		reply.Token = tokens.Issue(remote, b)
+	}
+	guard.sign(remote, &reply)
+	if err := WriteHello(conn, &reply); err != nil {
+		return nil, remote, errors.Wrap(err, "hello")
+	}
+	return wrapped, remote, nil
+}
@@ -0,0 +1,85 @@
+package generic
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Histograms count durations in buckets growing by a quarter of an octave,
+// about 19% each, from histogramMin up, so that percentiles come out within
+// 10% whatever the spread, in constant memory.
+const (
+	histogramMin       = 16 * time.Microsecond
+	histogramPerOctave = 4
+	histogramBuckets   = 24 * histogramPerOctave // up to about 4 minutes
+)
+
+// Histogram counts durations, safe for concurrent use
+type Histogram struct {
+	mu     sync.Mutex
+	counts [histogramBuckets]uint64
+	total  uint64
+}
+
+// Add counts d
+func (h *Histogram) Add(d time.Duration) {
+	i := 0
+	if d > histogramMin {
+		i = int(math.Log2(float64(d)/float64(histogramMin)) * histogramPerOctave)
+	}
+	if i >= histogramBuckets {
+		i = histogramBuckets - 1
+	}
+	h.mu.Lock()
+	h.counts[i]++
+	h.total++
+	h.mu.Unlock()
+}
+
+// Percentiles summarizes a Histogram, in milliseconds
+type Percentiles struct {
+	Count uint64  `json:"count"`
+	P50   float64 `json:"p50"`
+	P95   float64 `json:"p95"`
+	P99   float64 `json:"p99"`
+}
+
+// Percentiles returns the summary of h, nil while it's empty
+func (h *Histogram) Percentiles() *Percentiles {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.total == 0 {
+		return nil
+	}
+	return &Percentiles{
+		Count: h.total,
+		P50:   h.percentile(50),
+		P95:   h.percentile(95),
+		P99:   h.percentile(99),
+	}
+}
+
+// describe prints p in the SIGUSR1 dump, named name, nothing for nil
+func (p *Percentiles) describe(name string) string {
+	if p == nil {
+		return ""
+	}
+	return fmt.Sprintf(" %v p50 %vms p95 %vms p99 %vms", name, p.P50, p.P95, p.P99)
+}
+
+// percentile returns the middle of the bucket of the p-th percentile,
+// nearest rank, with h.mu held
+func (h *Histogram) percentile(p uint64) float64 {
+	rank := (h.total*p + 99) / 100
+	var seen uint64
+	i := 0
+	for ; i < histogramBuckets-1; i++ {
+		if seen += h.counts[i]; seen >= rank {
+			break
+		}
+	}
+	mid := float64(histogramMin) * math.Exp2((float64(i)+0.5)/histogramPerOctave)
+	return math.Floor(mid/float64(time.Millisecond)*100+0.5) / 100
+}
@@ -0,0 +1,247 @@
+package generic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ICMP tunnels carry the KCP packets in the data of ICMP echo messages, for
+// captive networks passing nothing but ping. The client sends echo
+// requests with its own identifier and increasing sequence numbers, the
+// server answers with echo replies quoting the identifier and the latest
+// sequence number, which is what NATs track. The data starts with a magic
+// telling tunnel packets apart from real pings and from the kernel's own
+// answers to the requests.
+const (
+	icmpHeaderSize  = 8
+	icmpEchoReply   = 0
+	icmpEchoRequest = 8
+)
+
+var (
+	icmpRequestMagic = []byte("KCPq")
+	icmpReplyMagic   = []byte("KCPr")
+)
+
+// icmpAddr names a tunnel by the peer's address and echo identifier
+type icmpAddr struct {
+	ip net.IP
+	id uint16
+}
+
+func (a *icmpAddr) Network() string { return "icmp" }
+func (a *icmpAddr) String() string  { return fmt.Sprintf("%v#%v", a.ip, a.id) }
+
+// icmpFlow is the state of a tunnel on the server side
+type icmpFlow struct {
+	addr *icmpAddr
+	seq  uint16 // latest sequence number received
+}
+
+type icmpPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// ICMPConn is a PacketConn over ICMP echo messages
+type ICMPConn struct {
+	conn   *net.IPConn
+	server bool
+
+	// the client side talks to a single server with its own identifier
+	raddr *net.UDPAddr
+	id    uint16
+
+	mu    sync.Mutex
+	seq   uint16
+	flows map[string]*icmpFlow
+
+	in      chan icmpPacket
+	die     chan struct{}
+	readErr error
+}
+
+func newICMPConn(conn *net.IPConn) *ICMPConn {
+	c := new(ICMPConn)
+	c.conn = conn
+	c.flows = make(map[string]*icmpFlow)
+	c.in = make(chan icmpPacket, 1024)
+	c.die = make(chan struct{})
+	return c
+}
+
+// ListenICMP accepts ICMP tunnels on the IPv4 address ip, or on all
+// addresses when ip is empty
+func ListenICMP(ip string) (*ICMPConn, error) {
+	var laddr net.IP
+	if ip != "" {
+		laddr = net.ParseIP(ip)
+		if laddr == nil || laddr.To4() == nil {
+			return nil, errors.Errorf("icmp: %q is not an IPv4 address", ip)
+		}
+	}
+	conn, err := listenRaw("ip4:icmp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	c := newICMPConn(conn)
+	c.server = true
+	go c.readLoop()
+	return c, nil
+}
+
+// DialICMP opens an ICMP tunnel to the IPv4 host of addr, the port of
+// addr if any is ignored
+func DialICMP(addr string) (*ICMPConn, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ipaddr, err := net.ResolveIPAddr("ip4", host)
+	if err != nil {
+		return nil, errors.Wrap(err, "icmp")
+	}
+	conn, err := listenRaw("ip4:icmp", nil)
+	if err != nil {
+		return nil, err
+	}
+	c := newICMPConn(conn)
+	c.raddr = &net.UDPAddr{IP: ipaddr.IP}
+	c.id = uint16(rand.Intn(0xffff) + 1)
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *ICMPConn) send(ip net.IP, typ byte, id, seq uint16, magic, payload []byte) error {
+	msg := make([]byte, icmpHeaderSize+len(magic)+len(payload))
+	msg[0] = typ
+	binary.BigEndian.PutUint16(msg[4:], id)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	copy(msg[icmpHeaderSize:], magic)
+	copy(msg[icmpHeaderSize+len(magic):], payload)
+	binary.BigEndian.PutUint16(msg[2:], checksum(msg))
+	_, err := c.conn.WriteToIP(msg, &net.IPAddr{IP: ip})
+	return err
+}
+
+func (c *ICMPConn) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := c.conn.ReadFromIP(buf)
+		if err != nil {
+			c.readErr = err
+			close(c.die)
+			return
+		}
+		// the raw socket sees every ICMP message of the host
+		if n < icmpHeaderSize+len(icmpRequestMagic) {
+			continue
+		}
+		typ := buf[0]
+		id := binary.BigEndian.Uint16(buf[4:])
+		seq := binary.BigEndian.Uint16(buf[6:])
+		data := buf[icmpHeaderSize:n]
+
+		var from net.Addr
+		if c.server {
+			if typ != icmpEchoRequest || !bytes.HasPrefix(data, icmpRequestMagic) {
+				continue
+			}
+			key := (&icmpAddr{addr.IP, id}).String()
+			c.mu.Lock()
+			flow, ok := c.flows[key]
+			if !ok {
+				flow = &icmpFlow{addr: &icmpAddr{addr.IP, id}}
+				c.flows[key] = flow
+			}
+			flow.seq = seq
+			c.mu.Unlock()
+			from = flow.addr
+		} else {
+			if typ != icmpEchoReply || id != c.id || !addr.IP.Equal(c.raddr.IP) || !bytes.HasPrefix(data, icmpReplyMagic) {
+				continue
+			}
+			from = c.raddr
+		}
+
+		data = data[len(icmpRequestMagic):]
+		if len(data) == 0 {
+			continue
+		}
+		pkt := icmpPacket{make([]byte, len(data)), from}
+		copy(pkt.data, data)
+		select {
+		case c.in <- pkt:
+		case <-c.die:
+			return
+		}
+	}
+}
+
+// ReadFrom implements net.PacketConn
+func (c *ICMPConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	select {
+	case pkt := <-c.in:
+		return copy(p, pkt.data), pkt.addr, nil
+	case <-c.die:
+		return 0, nil, c.readErr
+	}
+}
+
+// WriteTo implements net.PacketConn. The client sends echo requests to its
+// server whatever addr is, the server answers the tunnel named addr.
+func (c *ICMPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if !c.server {
+		c.mu.Lock()
+		c.seq++
+		seq := c.seq
+		c.mu.Unlock()
+		err = c.send(c.raddr.IP, icmpEchoRequest, c.id, seq, icmpRequestMagic, p)
+	} else {
+		c.mu.Lock()
+		flow, ok := c.flows[addr.String()]
+		var seq uint16
+		if ok {
+			seq = flow.seq
+		}
+		c.mu.Unlock()
+		if !ok {
+			return 0, errors.Errorf("icmp: no tunnel %v", addr)
+		}
+		err = c.send(flow.addr.ip, icmpEchoReply, flow.addr.id, seq, icmpReplyMagic, p)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close implements net.PacketConn
+func (c *ICMPConn) Close() error { return c.conn.Close() }
+
+// LocalAddr implements net.PacketConn
+func (c *ICMPConn) LocalAddr() net.Addr { return c.conn.LocalAddr() }
+
+// RemoteAddr returns the server's address on the client side, nil otherwise
+func (c *ICMPConn) RemoteAddr() net.Addr {
+	if c.raddr == nil {
+		return nil
+	}
+	return c.raddr
+}
+
+// SetDeadline implements net.PacketConn, tunnels have no deadlines
+func (c *ICMPConn) SetDeadline(t time.Time) error { return nil }
+
+// SetReadDeadline implements net.PacketConn
+func (c *ICMPConn) SetReadDeadline(t time.Time) error { return nil }
+
+// SetWriteDeadline implements net.PacketConn
+func (c *ICMPConn) SetWriteDeadline(t time.Time) error { return nil }
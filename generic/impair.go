@@ -0,0 +1,175 @@
+package generic
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// how long a reordered packet is held back, letting later ones overtake it
+const reorderHold = 30 * time.Millisecond
+
+// Impairment describes the faults injected by ImpairConn, rates are in
+// percent and apply to each direction independently
+type Impairment struct {
+	Loss    float64
+	Dup     float64
+	Reorder float64
+	Delay   time.Duration
+	Jitter  time.Duration
+}
+
+// ParseImpairment parses a spec like "loss=5,dup=1,reorder=2,delay=50ms,jitter=10ms"
+func ParseImpairment(spec string) (*Impairment, error) {
+	imp := new(Impairment)
+	for _, field := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			return nil, errors.Errorf("impair: malformed field %q", field)
+		}
+		var err error
+		switch kv[0] {
+		case "loss":
+			imp.Loss, err = parseRate(kv[1])
+		case "dup":
+			imp.Dup, err = parseRate(kv[1])
+		case "reorder":
+			imp.Reorder, err = parseRate(kv[1])
+		case "delay":
+			imp.Delay, err = time.ParseDuration(kv[1])
+		case "jitter":
+			imp.Jitter, err = time.ParseDuration(kv[1])
+		default:
+			err = errors.Errorf("unknown fault %q", kv[0])
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "impair")
+		}
+	}
+	return imp, nil
+}
+
+func parseRate(s string) (float64, error) {
+	rate, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err == nil && (rate < 0 || rate > 100) {
+		err = errors.Errorf("rate %v out of range 0-100", rate)
+	}
+	return rate, err
+}
+
+type impairedPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// ImpairConn injects loss, duplication, reordering and delay into both the
+// send and the receive path of the wrapped PacketConn, simulating a bad
+// link for testing
+type ImpairConn struct {
+	net.PacketConn
+	imp Impairment
+
+	rng   *rand.Rand
+	rngMu sync.Mutex
+	clock Clock
+
+	in      chan impairedPacket
+	die     chan struct{}
+	readErr error
+}
+
+// NewImpairConn wraps conn with the given impairments
+func NewImpairConn(conn net.PacketConn, imp *Impairment) *ImpairConn {
+	c := new(ImpairConn)
+	c.PacketConn = conn
+	c.imp = *imp
+	c.rng = NewRand()
+	c.clock = clock
+	c.in = make(chan impairedPacket, 1024)
+	c.die = make(chan struct{})
+	go c.readLoop()
+	return c
+}
+
+func (c *ImpairConn) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	c.rngMu.Lock()
+	defer c.rngMu.Unlock()
+	return c.rng.Float64()*100 < rate
+}
+
+func (c *ImpairConn) delay() time.Duration {
+	d := c.imp.Delay
+	if c.imp.Jitter > 0 {
+		c.rngMu.Lock()
+		d += time.Duration(c.rng.Int63n(int64(2*c.imp.Jitter))) - c.imp.Jitter
+		c.rngMu.Unlock()
+	}
+	if c.roll(c.imp.Reorder) {
+		d += reorderHold
+	}
+	return d
+}
+
+// schedule runs fn zero, one or two times, immediately or delayed
+func (c *ImpairConn) schedule(fn func()) {
+	if c.roll(c.imp.Loss) {
+		return
+	}
+	n := 1
+	if c.roll(c.imp.Dup) {
+		n = 2
+	}
+	for i := 0; i < n; i++ {
+		if d := c.delay(); d > 0 {
+			c.clock.AfterFunc(d, fn)
+		} else {
+			fn()
+		}
+	}
+}
+
+func (c *ImpairConn) readLoop() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			c.readErr = err
+			close(c.die)
+			return
+		}
+		pkt := impairedPacket{make([]byte, n), addr}
+		copy(pkt.data, buf)
+		c.schedule(func() {
+			select {
+			case c.in <- pkt:
+			case <-c.die:
+			}
+		})
+	}
+}
+
+// ReadFrom implements net.PacketConn
+func (c *ImpairConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	select {
+	case pkt := <-c.in:
+		return copy(p, pkt.data), pkt.addr, nil
+	case <-c.die:
+		return 0, nil, c.readErr
+	}
+}
+
+// WriteTo implements net.PacketConn
+func (c *ImpairConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	data := make([]byte, len(p))
+	copy(data, p)
+	c.schedule(func() { c.PacketConn.WriteTo(data, addr) })
+	return len(p), nil
+}
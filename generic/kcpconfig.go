@@ -0,0 +1,76 @@
+package generic
+
+import (
+	"time"
+
+	kcp "github.com/xtaci/kcp-go"
+	"github.com/xtaci/smux"
+)
+
+// NewBlockCrypt derives the session key from key and returns the block
+// cipher named crypt, and the name of the one returned, aes for unknown
+// names
+func NewBlockCrypt(key, crypt string) (kcp.BlockCrypt, string) {
+	pass := DeriveKey(key)
+	var block kcp.BlockCrypt
+	switch crypt {
+	case "sm4":
+		block, _ = kcp.NewSM4BlockCrypt(pass[:16])
+	case "tea":
+		block, _ = kcp.NewTEABlockCrypt(pass[:16])
+	case "xor":
+		block, _ = kcp.NewSimpleXORBlockCrypt(pass)
+	case "none":
+		block, _ = kcp.NewNoneBlockCrypt(pass)
+	case "aes-128":
+		block, _ = kcp.NewAESBlockCrypt(pass[:16])
+	case "aes-192":
+		block, _ = kcp.NewAESBlockCrypt(pass[:24])
+	case "blowfish":
+		block, _ = kcp.NewBlowfishBlockCrypt(pass)
+	case "twofish":
+		block, _ = kcp.NewTwofishBlockCrypt(pass)
+	case "cast5":
+		block, _ = kcp.NewCast5BlockCrypt(pass[:16])
+	case "3des":
+		block, _ = kcp.NewTripleDESBlockCrypt(pass[:24])
+	case "xtea":
+		block, _ = kcp.NewXTEABlockCrypt(pass[:16])
+	case "salsa20":
+		block, _ = kcp.NewSalsa20BlockCrypt(pass)
+	default:
+		crypt = "aes"
+		block, _ = kcp.NewAESBlockCrypt(pass)
+	}
+	return block, crypt
+}
+
+// ModeProfile returns nodelay, interval, resend and nc of the --mode
+// profile mode, and false for manual, which keeps its own. auto starts as
+// fast.
+func ModeProfile(mode string) (nodelay, interval, resend, nc int, ok bool) {
+	switch mode {
+	case "fast3":
+		return 1, 10, 2, 1, true
+	case "auto":
+		mode = autoModes[autoModeStart].name
+	}
+	for _, m := range autoModes {
+		if m.name == mode {
+			return m.nodelay, m.interval, m.resend, m.nc, true
+		}
+	}
+	return
+}
+
+// NewSmuxConfig returns the stream multiplexer settings: the receive buffer
+// of a session in bytes, the keepalive interval and timeout in seconds and
+// the maximum frame size
+func NewSmuxConfig(sockbuf, keepalive, keepaliveTimeout, frame int) *smux.Config {
+	smuxConfig := smux.DefaultConfig()
+	smuxConfig.MaxReceiveBuffer = sockbuf
+	smuxConfig.KeepAliveInterval = time.Duration(keepalive) * time.Second
+	smuxConfig.KeepAliveTimeout = time.Duration(keepaliveTimeout) * time.Second
+	smuxConfig.MaxFrameSize = frame
+	return smuxConfig
+}
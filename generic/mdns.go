@@ -0,0 +1,195 @@
+package generic
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// On a LAN without fixed addresses, a server announces itself with multicast
+// DNS as an instance of the DNS-SD service _kcptun._udp.local, and clients
+// find it by asking for the instances of the service. Clients ask from a
+// port of their own, so servers answer them directly, repeating the query's
+// id and question; queries from port 5353, of other browsers like avahi,
+// are answered to the group. Clients take the address the answer comes
+// from with the port of its SRV record, so servers don't need to tell their
+// addresses apart by interface.
+const (
+	mdnsGroup   = "224.0.0.251:5353"
+	mdnsPort    = 5353
+	mdnsService = "_kcptun._udp.local"
+	mdnsTTL     = 120
+
+	dnsTypePTR = 12
+	dnsTypeANY = 255
+)
+
+// dnsName encodes a dotted name without compression
+func dnsName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// dnsRR encodes a resource record of class IN
+func dnsRR(name []byte, rtype uint16, ttl uint32, rdata []byte) []byte {
+	b := append([]byte{}, name...)
+	var hdr [10]byte
+	binary.BigEndian.PutUint16(hdr[:], rtype)
+	binary.BigEndian.PutUint16(hdr[2:], dnsClassIN)
+	binary.BigEndian.PutUint32(hdr[4:], ttl)
+	binary.BigEndian.PutUint16(hdr[8:], uint16(len(rdata)))
+	b = append(b, hdr[:]...)
+	return append(b, rdata...)
+}
+
+// mdnsAsks reports whether msg is a query for the instances of the service,
+// and returns its id
+func mdnsAsks(msg []byte) (uint16, bool) {
+	if len(msg) < dnsHeaderLen || msg[2]&0x80 != 0 {
+		return 0, false
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	off := dnsHeaderLen
+	for i := 0; i < qdcount; i++ {
+		labels, next, err := dnsParseName(msg, off)
+		if err != nil || next+4 > len(msg) {
+			return 0, false
+		}
+		qtype := binary.BigEndian.Uint16(msg[next:])
+		if strings.EqualFold(strings.Join(labels, "."), mdnsService) && (qtype == dnsTypePTR || qtype == dnsTypeANY) {
+			return binary.BigEndian.Uint16(msg), true
+		}
+		off = next + 4
+	}
+	return 0, false
+}
+
+// mdnsAnswer builds the answer naming instance on host, listening on port,
+// with the question repeated for the answers to a client's port
+func mdnsAnswer(id uint16, question bool, instance, host string, port int) []byte {
+	service := dnsName(mdnsService)
+	name := append([]byte{byte(len(instance))}, instance...)
+	name = append(name, service...)
+
+	msg := make([]byte, dnsHeaderLen)
+	binary.BigEndian.PutUint16(msg, id)
+	msg[2] = 0x84 // answer, authoritative
+	binary.BigEndian.PutUint16(msg[6:], 1)
+	binary.BigEndian.PutUint16(msg[10:], 2)
+	if question {
+		binary.BigEndian.PutUint16(msg[4:], 1)
+		msg = append(msg, service...)
+		msg = append(msg, 0, dnsTypePTR, 0, dnsClassIN)
+	}
+	msg = append(msg, dnsRR(service, dnsTypePTR, mdnsTTL, name)...)
+	srv := []byte{0, 0, 0, 0, byte(port >> 8), byte(port)}
+	srv = append(srv, dnsName(host+".local")...)
+	msg = append(msg, dnsRR(name, dnsTypeSRV, mdnsTTL, srv)...)
+	// DNS-SD wants a TXT record, empty here
+	return append(msg, dnsRR(name, dnsTypeTXT, mdnsTTL, []byte{0})...)
+}
+
+// AnnounceMDNS answers the queries for the service on the local network
+// with instance, a server listening on port, in the background
+func AnnounceMDNS(instance string, port int) error {
+	group, err := net.ResolveUDPAddr("udp4", mdnsGroup)
+	if err != nil {
+		return errors.Wrap(err, "mdns")
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return errors.Wrap(err, "mdns")
+	}
+	host, _ := os.Hostname()
+	if host = strings.Split(host, ".")[0]; host == "" {
+		host = "kcptun"
+	}
+	go func() {
+		buf := make([]byte, 9000)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				log.Println("mdns:", err)
+				return
+			}
+			id, ok := mdnsAsks(buf[:n])
+			if !ok {
+				continue
+			}
+			if from.Port == mdnsPort {
+				conn.WriteToUDP(mdnsAnswer(0, false, instance, host, port), group)
+			} else {
+				conn.WriteToUDP(mdnsAnswer(id, true, instance, host, port), from)
+			}
+		}
+	}()
+	return nil
+}
+
+// BrowseMDNS asks the local network for the servers announcing the service
+// and returns the addresses of those answering within timeout
+func BrowseMDNS(timeout time.Duration) ([]string, error) {
+	group, err := net.ResolveUDPAddr("udp4", mdnsGroup)
+	if err != nil {
+		return nil, errors.Wrap(err, "mdns")
+	}
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "mdns")
+	}
+	defer conn.Close()
+
+	query := make([]byte, dnsHeaderLen)
+	rand.Read(query[:2])
+	binary.BigEndian.PutUint16(query[4:], 1)
+	query = append(query, dnsName(mdnsService)...)
+	query = append(query, 0, dnsTypePTR, 0, dnsClassIN)
+	// asked twice, the network may drop multicast
+	if _, err := conn.WriteToUDP(query, group); err != nil {
+		return nil, errors.Wrap(err, "mdns")
+	}
+	resend := time.AfterFunc(timeout/3, func() { conn.WriteToUDP(query, group) })
+	defer resend.Stop()
+
+	var servers []string
+	seen := make(map[string]bool)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			// the deadline ends the browsing
+			return servers, nil
+		}
+		msg := buf[:n]
+		if n < dnsHeaderLen || msg[2]&0x80 == 0 || binary.BigEndian.Uint16(msg) != binary.BigEndian.Uint16(query) {
+			continue
+		}
+		records, err := dnsRecords(msg, dnsTypeSRV, true)
+		if err != nil {
+			continue
+		}
+		for _, rdata := range records {
+			if rdata.len < 7 {
+				continue
+			}
+			port := binary.BigEndian.Uint16(msg[rdata.off+4:])
+			server := net.JoinHostPort(from.IP.String(), strconv.Itoa(int(port)))
+			if !seen[server] {
+				seen[server] = true
+				servers = append(servers, server)
+			}
+		}
+	}
+}
@@ -0,0 +1,459 @@
+package generic
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A stream dies with its KCP session, and a long download with it, though
+// the client reconnects within seconds. Sessions which agreed on Migrate in
+// the hello run every stream as a logical stream, which moves over to a
+// new session. Each end keeps what it sent until the peer acknowledges it,
+// and once the session died the client opens a stream on another session
+// naming the logical stream and the bytes it received, the server answers
+// with those it received, and both send again what the other missed.
+//
+// The client opens every stream with:
+//
+// | kind(1B) | id(8B) | received(8B) |
+//
+// kind 0 for a new logical stream, with a random id the server closes when
+// already live, 1 for one moving over, which the server answers with the
+// bytes it received, | received(8B) |, or closes when it doesn't know id
+// for that client. Then both directions carry frames:
+//
+// | 0 | length(2B) | data |
+// | 1 | received(8B) |        acknowledgement
+// | 2 |                      close
+const (
+	migrateNew    = 0
+	migrateResume = 1
+
+	migrateData  = 0
+	migrateAck   = 1
+	migrateClose = 2
+
+	// MigrateBuffer is what an end keeps unacknowledged per stream before
+	// writes wait, the receiver acknowledges every quarter of it
+	MigrateBuffer = 1024 * 1024
+	migrateFrame  = 16 * 1024
+
+	// MigrateLinger is how long a logical stream waits for its session to
+	// be replaced
+	MigrateLinger = 2 * time.Minute
+)
+
+var (
+	errMigrateUnknown = errors.New("migrate: the server doesn't know the stream")
+	errMigrateLinger  = errors.Errorf("migrate: no new session within %v", MigrateLinger)
+)
+
+// MigrateDialer opens a stream to move the logical stream id to on a new
+// session, telling the server the bytes received. It returns the stream,
+// whether its session still runs and the bytes the server received.
+type MigrateDialer func(id, received uint64) (raw io.ReadWriteCloser, alive func() bool, peerReceived uint64, err error)
+
+// WriteMigrateHeader opens a stream for the logical stream id, moving it
+// over if resume
+func WriteMigrateHeader(w io.Writer, resume bool, id, received uint64) error {
+	var hdr [17]byte
+	if resume {
+		hdr[0] = migrateResume
+	}
+	binary.BigEndian.PutUint64(hdr[1:], id)
+	binary.BigEndian.PutUint64(hdr[9:], received)
+	_, err := w.Write(hdr[:])
+	return err
+}
+
+// ReadMigrateHeader reads the header of a stream opened by the client
+func ReadMigrateHeader(r io.Reader) (resume bool, id, received uint64, err error) {
+	var hdr [17]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return false, 0, 0, errors.Wrap(err, "migrate")
+	}
+	if hdr[0] != migrateNew && hdr[0] != migrateResume {
+		return false, 0, 0, errors.Errorf("migrate: unknown kind %v", hdr[0])
+	}
+	return hdr[0] == migrateResume, binary.BigEndian.Uint64(hdr[1:]), binary.BigEndian.Uint64(hdr[9:]), nil
+}
+
+// ReadMigrateReply reads the server's answer to a stream moving over
+func ReadMigrateReply(r io.Reader) (uint64, error) {
+	var received [8]byte
+	if _, err := io.ReadFull(r, received[:]); err == io.EOF {
+		return 0, errMigrateUnknown
+	} else if err != nil {
+		return 0, errors.Wrap(err, "migrate")
+	}
+	return binary.BigEndian.Uint64(received[:]), nil
+}
+
+// MigrateStream is a logical stream, carried by a stream of one session
+// after the other
+type MigrateStream struct {
+	id     uint64
+	redial MigrateDialer
+	linger time.Duration // MigrateLinger, shorter in tests
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	raw      io.ReadWriteCloser // nil while the session is replaced
+	alive    func() bool
+	gen      uint32 // of raw, frames of a replaced one are dropped
+	sent     uint64 // bytes written
+	unacked  []byte // the last of them, not acknowledged yet
+	received uint64 // bytes received from the peer
+	consumed uint64 // of them, read by the application
+	acked    uint64 // as last acknowledged, the peer keeps the rest
+	closed   bool   // by Close
+	eof      bool   // the peer closed
+	err      error  // the stream failed, or no new session came in time
+	rbuf     []byte // received, not read yet
+
+	wmu sync.Mutex // orders the frames written
+}
+
+// NewMigrateStream runs the logical stream id over raw, a stream of a
+// session alive reports running. On the client side redial opens the
+// stream to move to once the session died; on the server side it's nil and
+// Resume moves the stream.
+func NewMigrateStream(id uint64, raw io.ReadWriteCloser, alive func() bool, redial MigrateDialer) *MigrateStream {
+	s := &MigrateStream{id: id, redial: redial, linger: MigrateLinger, raw: raw, alive: alive}
+	s.cond = sync.NewCond(&s.mu)
+	go s.recvLoop()
+	return s
+}
+
+// Done reports whether s is closed or lost
+func (s *MigrateStream) Done() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed || s.err != nil
+}
+
+// carrier waits for a stream to carry s
+func (s *MigrateStream) carrier() (io.ReadWriteCloser, uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.raw == nil && !s.closed && s.err == nil {
+		s.cond.Wait()
+	}
+	switch {
+	case s.closed:
+		return nil, 0, io.ErrClosedPipe
+	case s.err != nil:
+		return nil, 0, s.err
+	}
+	return s.raw, s.gen, nil
+}
+
+// broken handles the failure err of the stream of generation gen. It
+// returns nil when s moved on or will, err when the session still runs,
+// which is a plain stream failure.
+func (s *MigrateStream) broken(gen uint32, err error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.gen != gen || s.closed || s.err != nil {
+		return nil
+	}
+	if s.alive() {
+		return err
+	}
+	s.raw.Close()
+	s.raw = nil
+	s.gen++
+	received := s.received
+	gen = s.gen
+	time.AfterFunc(s.linger, func() {
+		s.mu.Lock()
+		if s.gen == gen && s.raw == nil && !s.closed {
+			s.err = errMigrateLinger
+			s.cond.Broadcast()
+		}
+		s.mu.Unlock()
+	})
+	if s.redial != nil {
+		go s.migrate(received)
+	}
+	return nil
+}
+
+// migrate moves s over to a new session, on the client side
+func (s *MigrateStream) migrate(received uint64) {
+	for {
+		if s.Done() {
+			return
+		}
+		raw, alive, peerReceived, err := s.redial(s.id, received)
+		if err == errMigrateUnknown {
+			s.fail(err)
+			return
+		} else if err != nil {
+			time.Sleep(time.Second)
+			continue
+		}
+		if err := s.attach(raw, alive, peerReceived, false); err != nil {
+			s.fail(err)
+		}
+		return
+	}
+}
+
+// fail gives s up
+func (s *MigrateStream) fail(err error) {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// Resume moves s over to raw, a stream of the new session alive reports
+// running, answering the client with the bytes received. The client
+// received peerReceived.
+func (s *MigrateStream) Resume(raw io.ReadWriteCloser, alive func() bool, peerReceived uint64) error {
+	return s.attach(raw, alive, peerReceived, true)
+}
+
+// attach makes raw carry s and sends again what the peer didn't receive,
+// answering the client first if reply
+func (s *MigrateStream) attach(raw io.ReadWriteCloser, alive func() bool, peerReceived uint64, reply bool) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.mu.Lock()
+	start := s.sent - uint64(len(s.unacked))
+	if s.closed || s.err != nil || peerReceived < start || peerReceived > s.sent {
+		s.mu.Unlock()
+		raw.Close()
+		return errors.Errorf("migrate: can't resume from %v, holding %v to %v", peerReceived, start, s.sent)
+	}
+	s.unacked = s.unacked[peerReceived-start:]
+	old := s.raw
+	// frames still coming over the old stream are dropped
+	s.raw, s.alive = raw, alive
+	s.gen++
+	gen := s.gen
+	received := s.received
+	// acknowledgements go on from what the application read, as in Read
+	s.acked = s.consumed
+	pending := append([]byte(nil), s.unacked...)
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+
+	if reply {
+		var hdr [8]byte
+		binary.BigEndian.PutUint64(hdr[:], received)
+		if _, err := raw.Write(hdr[:]); err != nil {
+			return s.broken(gen, err)
+		}
+	}
+	return s.writeData(raw, gen, pending)
+}
+
+// writeData frames p over raw, with s.wmu held
+func (s *MigrateStream) writeData(raw io.ReadWriteCloser, gen uint32, p []byte) error {
+	for len(p) > 0 {
+		size := len(p)
+		if size > migrateFrame {
+			size = migrateFrame
+		}
+		frame := make([]byte, 3+size)
+		frame[0] = migrateData
+		binary.BigEndian.PutUint16(frame[1:], uint16(size))
+		copy(frame[3:], p[:size])
+		if _, err := raw.Write(frame); err != nil {
+			return s.broken(gen, err)
+		}
+		p = p[size:]
+	}
+	return nil
+}
+
+// recvLoop reads the frames of one stream after the other, so that the
+// acknowledgements get through while the application isn't reading
+func (s *MigrateStream) recvLoop() {
+	for {
+		raw, gen, err := s.carrier()
+		if err != nil {
+			return
+		}
+		kind, payload, err := readMigrateFrame(raw)
+		if err != nil {
+			if err := s.broken(gen, err); err != nil {
+				s.fail(err)
+				return
+			}
+			continue
+		}
+
+		s.mu.Lock()
+		// frames still coming over a replaced stream were sent again
+		if s.gen == gen {
+			switch kind {
+			case migrateData:
+				s.rbuf = append(s.rbuf, payload...)
+				s.received += uint64(len(payload))
+			case migrateAck:
+				received := binary.BigEndian.Uint64(payload)
+				start := s.sent - uint64(len(s.unacked))
+				if received > start && received <= s.sent {
+					s.unacked = s.unacked[received-start:]
+				}
+			case migrateClose:
+				s.eof = true
+			}
+			s.cond.Broadcast()
+		}
+		s.mu.Unlock()
+	}
+}
+
+// Read implements io.Reader, acknowledging what the application read
+func (s *MigrateStream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	for len(s.rbuf) == 0 && !s.eof && !s.closed && s.err == nil {
+		s.cond.Wait()
+	}
+	switch {
+	case len(s.rbuf) > 0:
+	case s.eof:
+		s.mu.Unlock()
+		return 0, io.EOF
+	case s.closed:
+		s.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	default:
+		err := s.err
+		s.mu.Unlock()
+		return 0, err
+	}
+	n := copy(p, s.rbuf)
+	s.rbuf = s.rbuf[n:]
+	s.consumed += uint64(n)
+	var ack []byte
+	raw, gen := s.raw, s.gen
+	if raw != nil && s.consumed >= s.acked+MigrateBuffer/4 {
+		s.acked = s.consumed
+		ack = make([]byte, 9)
+		ack[0] = migrateAck
+		binary.BigEndian.PutUint64(ack[1:], s.consumed)
+	}
+	s.mu.Unlock()
+
+	if ack != nil {
+		// not holding up the reading while the peer's busy writing
+		go func() {
+			s.wmu.Lock()
+			defer s.wmu.Unlock()
+			if _, err := raw.Write(ack); err != nil {
+				s.broken(gen, err)
+			}
+		}()
+	}
+	return n, nil
+}
+
+// readMigrateFrame reads a frame, returning its kind and payload
+func readMigrateFrame(r io.Reader) (byte, []byte, error) {
+	var hdr [3]byte
+	if _, err := io.ReadFull(r, hdr[:1]); err != nil {
+		return 0, nil, err
+	}
+	var payload []byte
+	switch hdr[0] {
+	case migrateData:
+		if _, err := io.ReadFull(r, hdr[1:]); err != nil {
+			return 0, nil, err
+		}
+		payload = make([]byte, binary.BigEndian.Uint16(hdr[1:]))
+	case migrateAck:
+		payload = make([]byte, 8)
+	case migrateClose:
+	default:
+		return 0, nil, errors.Errorf("migrate: unknown frame %v", hdr[0])
+	}
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return hdr[0], payload, nil
+}
+
+// Write implements io.Writer, waiting while MigrateBuffer bytes are
+// unacknowledged or the session is replaced
+func (s *MigrateStream) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		size := len(p)
+		if size > migrateFrame {
+			size = migrateFrame
+		}
+		s.mu.Lock()
+		for len(s.unacked)+size > MigrateBuffer && !s.closed && !s.eof && s.err == nil {
+			s.cond.Wait()
+		}
+		s.mu.Unlock()
+
+		s.wmu.Lock()
+		s.mu.Lock()
+		switch {
+		case s.closed || s.eof:
+			err = io.ErrClosedPipe
+		case s.err != nil:
+			err = s.err
+		}
+		if err != nil {
+			s.mu.Unlock()
+			s.wmu.Unlock()
+			return n, err
+		}
+		s.unacked = append(s.unacked, p[:size]...)
+		s.sent += uint64(size)
+		raw, gen := s.raw, s.gen
+		s.mu.Unlock()
+		// without a stream, the data goes once the session is replaced
+		if raw != nil {
+			err = s.writeData(raw, gen, p[:size])
+		}
+		s.wmu.Unlock()
+		if err != nil {
+			return n, err
+		}
+		n += size
+		p = p[size:]
+	}
+	return n, nil
+}
+
+// Close implements io.Closer, telling the peer once what's written went
+func (s *MigrateStream) Close() error {
+	s.mu.Lock()
+	for s.raw == nil && !s.closed && !s.eof && s.err == nil {
+		s.cond.Wait()
+	}
+	s.mu.Unlock()
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	raw := s.raw
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	if raw == nil {
+		return nil
+	}
+	raw.Write([]byte{migrateClose})
+	return raw.Close()
+}
@@ -0,0 +1,166 @@
+package generic
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMigrateHeader(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteMigrateHeader(&buf, true, 0x0102030405060708, 42); err != nil {
+		t.Fatal(err)
+	}
+	resume, id, received, err := ReadMigrateHeader(&buf)
+	if err != nil || !resume || id != 0x0102030405060708 || received != 42 {
+		t.Errorf("got %v, %x, %v and error %v", resume, id, received, err)
+	}
+	bad := make([]byte, 17)
+	bad[0] = 2
+	if _, _, _, err := ReadMigrateHeader(bytes.NewReader(bad)); err == nil {
+		t.Error("unknown kind: no error")
+	}
+	if _, _, _, err := ReadMigrateHeader(bytes.NewReader(bad[:16])); err == nil {
+		t.Error("truncated: no error")
+	}
+	if _, err := ReadMigrateReply(bytes.NewReader(nil)); err != errMigrateUnknown {
+		t.Errorf("closed without reply: error %v, want %v", err, errMigrateUnknown)
+	}
+}
+
+func TestReadMigrateFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		frame   string
+		kind    byte
+		payload string
+		err     bool
+	}{
+		{"data", "\x00\x00\x03abc", migrateData, "abc", false},
+		{"empty data", "\x00\x00\x00", migrateData, "", false},
+		{"ack", "\x01\x00\x00\x00\x00\x00\x00\x01\x00", migrateAck, "\x00\x00\x00\x00\x00\x00\x01\x00", false},
+		{"close", "\x02", migrateClose, "", false},
+		{"unknown", "\x03", 0, "", true},
+		{"truncated data", "\x00\x00\x03ab", 0, "", true},
+		{"truncated length", "\x00\x00", 0, "", true},
+		{"truncated ack", "\x01\x00\x00", 0, "", true},
+		{"empty", "", 0, "", true},
+	}
+	for _, test := range tests {
+		kind, payload, err := readMigrateFrame(bytes.NewReader([]byte(test.frame)))
+		if (err != nil) != test.err {
+			t.Errorf("%v: error %v, want error %v", test.name, err, test.err)
+			continue
+		}
+		if err == nil && (kind != test.kind || string(payload) != test.payload) {
+			t.Errorf("%v: got %v and %q, want %v and %q", test.name, kind, payload, test.kind, test.payload)
+		}
+	}
+}
+
+// running is the liveness of a session that never dies
+func running() bool { return true }
+
+// readResume reads the reply to a resume and the data frames after it off
+// conn, until size bytes of data came
+func readResume(conn io.Reader, size int) (uint64, []byte, error) {
+	received, err := ReadMigrateReply(conn)
+	if err != nil {
+		return 0, nil, err
+	}
+	var data []byte
+	for len(data) < size {
+		kind, payload, err := readMigrateFrame(conn)
+		if err != nil {
+			return 0, nil, err
+		}
+		if kind == migrateData {
+			data = append(data, payload...)
+		}
+	}
+	return received, data, nil
+}
+
+func TestMigrateResume(t *testing.T) {
+	raw, peer := net.Pipe()
+	defer peer.Close()
+	go io.Copy(ioutil.Discard, peer)
+	s := NewMigrateStream(1, raw, running, nil)
+	defer s.Close()
+	data := bytes.Repeat([]byte("0123456789"), 10)
+	if _, err := s.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	// the application reads part of what came
+	if _, err := peer.Write([]byte("\x00\x00\x05hello")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(s, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the peer can't have received more than was sent
+	next, nextPeer := net.Pipe()
+	defer nextPeer.Close()
+	if err := s.Resume(next, running, uint64(len(data))+1); err == nil {
+		t.Error("resumed past the bytes sent")
+	}
+
+	// what the peer missed is sent again after the reply
+	next, nextPeer = net.Pipe()
+	defer nextPeer.Close()
+	type result struct {
+		received uint64
+		data     []byte
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		received, data, err := readResume(nextPeer, 50)
+		done <- result{received, data, err}
+		io.Copy(ioutil.Discard, nextPeer)
+	}()
+	if err := s.Resume(next, running, 50); err != nil {
+		t.Fatal(err)
+	}
+	r := <-done
+	if r.err != nil || r.received != 5 || !bytes.Equal(r.data, data[50:]) {
+		t.Fatalf("got %v and %q, error %v, want 5 and %q", r.received, r.data, r.err, data[50:])
+	}
+	s.mu.Lock()
+	acked := s.acked
+	s.mu.Unlock()
+	if acked != 2 {
+		t.Errorf("acknowledged %v after the resume, want the 2 bytes read", acked)
+	}
+
+	// the bytes before are gone once resumed past them
+	last, lastPeer := net.Pipe()
+	defer lastPeer.Close()
+	if err := s.Resume(last, running, 49); err == nil {
+		t.Error("resumed before the bytes held")
+	}
+}
+
+func TestMigrateLinger(t *testing.T) {
+	raw, peer := net.Pipe()
+	s := NewMigrateStream(1, raw, func() bool { return false }, nil)
+	s.mu.Lock()
+	s.linger = 10 * time.Millisecond
+	s.mu.Unlock()
+
+	// the session died, and no new one comes
+	peer.Close()
+	if _, err := s.Read(make([]byte, 1)); err != errMigrateLinger {
+		t.Errorf("read error %v, want %v", err, errMigrateLinger)
+	}
+	if !s.Done() {
+		t.Error("not done after the linger")
+	}
+	if _, err := s.Write([]byte("late")); err != errMigrateLinger {
+		t.Errorf("write error %v, want %v", err, errMigrateLinger)
+	}
+}
@@ -0,0 +1,374 @@
+package generic
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Multipath bonds several UDP paths, one per local address of the client,
+// into a single KCP session. Every client packet carries a bond header
+// naming the session, so the server merges the paths and answers over them
+// in turn:
+//
+// | magic(4B) | bond id(8B) | flags(1B) | packet |
+//
+// Each path is measured with the probes of 'client ping', and only healthy
+// paths carry traffic: packets are striped over them, or duplicated on all
+// of them when reliability matters more than bandwidth. KCP reorders and
+// deduplicates at the receiver.
+const (
+	bondHeaderSize = 13
+	bondFlagDup    = 0x01
+
+	// MultipathOverhead is the per-packet overhead of the bond header
+	MultipathOverhead = bondHeaderSize
+
+	pathProbeInterval = 500 * time.Millisecond
+	pathDeadAfter     = 3 * time.Second
+	pathMaxLoss       = 0.5
+	bondPathExpire    = time.Minute
+)
+
+var bondMagic = []byte("\x00kmp")
+
+// bondAddr names a bonded client on the server side
+type bondAddr uint64
+
+func (a bondAddr) Network() string { return "bond" }
+func (a bondAddr) String() string  { return fmt.Sprintf("bond:%016x", uint64(a)) }
+
+type multipathPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// mpath is one path of a MultipathConn, with its probe statistics
+type mpath struct {
+	conn *net.UDPConn
+
+	mu       sync.Mutex
+	srtt     time.Duration
+	loss     float64 // moving average of unanswered probes
+	answered bool    // whether the last probe was answered
+	lastSeen time.Time
+	healthy  bool
+}
+
+func (p *mpath) isHealthy(now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return now.Sub(p.lastSeen) < pathDeadAfter && p.loss < pathMaxLoss
+}
+
+// MultipathConn is the client side of a bond, it spreads the packets to
+// one server over several local sockets
+type MultipathConn struct {
+	paths []*mpath
+	raddr *net.UDPAddr
+	id    uint64
+	dup   bool
+	rr    uint32
+
+	in      chan multipathPacket
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// NewMultipathConn bonds conns into one PacketConn to raddr, duplicating
+// every packet on all healthy paths if dup is set, striping otherwise
+func NewMultipathConn(conns []*net.UDPConn, raddr *net.UDPAddr, dup bool) (*MultipathConn, error) {
+	if len(conns) == 0 {
+		return nil, errors.New("multipath: no paths")
+	}
+	// random from crypto/rand, whatever --seed, as the server merges the
+	// paths of a session by it
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	c := new(MultipathConn)
+	c.raddr = raddr
+	c.id = binary.BigEndian.Uint64(id[:])
+	c.dup = dup
+	c.in = make(chan multipathPacket, 1024)
+	c.die = make(chan struct{})
+	now := time.Now()
+	for _, conn := range conns {
+		path := &mpath{conn: conn, lastSeen: now, healthy: true}
+		c.paths = append(c.paths, path)
+		go c.readLoop(path)
+	}
+	go c.probeLoop()
+	return c, nil
+}
+
+func (c *MultipathConn) readLoop(path *mpath) {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := path.conn.ReadFrom(buf)
+		if err != nil {
+			c.Close()
+			return
+		}
+		if _, sent, ok := ParseProbe(buf[:n]); ok {
+			rtt := time.Since(sent)
+			path.mu.Lock()
+			if path.srtt == 0 {
+				path.srtt = rtt
+			} else {
+				path.srtt = (7*path.srtt + rtt) / 8
+			}
+			path.answered = true
+			path.lastSeen = time.Now()
+			path.mu.Unlock()
+			continue
+		}
+		path.mu.Lock()
+		path.lastSeen = time.Now()
+		path.mu.Unlock()
+
+		pkt := multipathPacket{make([]byte, n), addr}
+		copy(pkt.data, buf)
+		select {
+		case c.in <- pkt:
+		case <-c.die:
+			return
+		}
+	}
+}
+
+// probeLoop measures every path and logs health changes
+func (c *MultipathConn) probeLoop() {
+	ticker := time.NewTicker(pathProbeInterval)
+	defer ticker.Stop()
+	var seq uint32
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.die:
+			return
+		}
+		now := time.Now()
+		for _, path := range c.paths {
+			path.mu.Lock()
+			if seq > 0 {
+				missed := 1.0
+				if path.answered {
+					missed = 0
+				}
+				path.loss = 0.9*path.loss + 0.1*missed
+			}
+			path.answered = false
+			path.mu.Unlock()
+
+			healthy := path.isHealthy(now)
+			path.mu.Lock()
+			changed := healthy != path.healthy
+			path.healthy = healthy
+			srtt, loss := path.srtt, path.loss
+			path.mu.Unlock()
+			if changed {
+				state := "down"
+				if healthy {
+					state = "up"
+				}
+				log.Printf("multipath: path %v is %v, srtt: %v, loss: %.1f%%", path.conn.LocalAddr(), state, srtt, loss*100)
+			}
+			path.conn.WriteTo(NewProbe(seq, now), c.raddr)
+		}
+		seq++
+	}
+}
+
+// pick returns the paths to send the next packet on
+func (c *MultipathConn) pick() []*mpath {
+	now := time.Now()
+	var healthy []*mpath
+	for _, path := range c.paths {
+		if path.isHealthy(now) {
+			healthy = append(healthy, path)
+		}
+	}
+	if len(healthy) == 0 {
+		// nothing is known to work, try everything
+		healthy = c.paths
+	}
+	if c.dup {
+		return healthy
+	}
+	rr := atomic.AddUint32(&c.rr, 1)
+	return healthy[int(rr)%len(healthy):][:1]
+}
+
+// ReadFrom implements net.PacketConn
+func (c *MultipathConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	select {
+	case pkt := <-c.in:
+		return copy(p, pkt.data), pkt.addr, nil
+	case <-c.die:
+		return 0, nil, errors.New("multipath: closed")
+	}
+}
+
+// WriteTo implements net.PacketConn, addr is ignored
+func (c *MultipathConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	pkt := make([]byte, bondHeaderSize+len(p))
+	copy(pkt, bondMagic)
+	binary.BigEndian.PutUint64(pkt[4:], c.id)
+	if c.dup {
+		pkt[12] = bondFlagDup
+	}
+	copy(pkt[bondHeaderSize:], p)
+
+	err = errors.New("multipath: no paths")
+	for _, path := range c.pick() {
+		if _, werr := path.conn.WriteTo(pkt, c.raddr); werr == nil {
+			err = nil
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close implements net.PacketConn
+func (c *MultipathConn) Close() error {
+	c.dieOnce.Do(func() {
+		close(c.die)
+		for _, path := range c.paths {
+			path.conn.Close()
+		}
+	})
+	return nil
+}
+
+// LocalAddr implements net.PacketConn, returning the first path's address
+func (c *MultipathConn) LocalAddr() net.Addr { return c.paths[0].conn.LocalAddr() }
+
+// SetDeadline implements net.PacketConn, bonds have no deadlines
+func (c *MultipathConn) SetDeadline(t time.Time) error { return nil }
+
+// SetReadDeadline implements net.PacketConn
+func (c *MultipathConn) SetReadDeadline(t time.Time) error { return nil }
+
+// SetWriteDeadline implements net.PacketConn
+func (c *MultipathConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// bond is the server side state of a bonded client
+type bond struct {
+	paths map[string]*bondPath
+	order []string
+	dup   bool
+	rr    int
+}
+
+type bondPath struct {
+	addr     net.Addr
+	lastSeen time.Time
+}
+
+// BondConn merges the paths of bonded clients on the server side, packets
+// without a bond header pass through untouched
+type BondConn struct {
+	net.PacketConn
+
+	mu    sync.Mutex
+	bonds map[bondAddr]*bond
+}
+
+// NewBondConn wraps conn with multipath support
+func NewBondConn(conn net.PacketConn) *BondConn {
+	return &BondConn{PacketConn: conn, bonds: make(map[bondAddr]*bond)}
+}
+
+// ReadFrom implements net.PacketConn
+func (c *BondConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(p)
+	if err != nil || n < bondHeaderSize || !bytes.Equal(p[:4], bondMagic) {
+		return
+	}
+
+	id := bondAddr(binary.BigEndian.Uint64(p[4:]))
+	now := time.Now()
+	c.mu.Lock()
+	b, ok := c.bonds[id]
+	if !ok {
+		b = &bond{paths: make(map[string]*bondPath)}
+		c.bonds[id] = b
+	}
+	b.dup = p[12]&bondFlagDup != 0
+	if path, ok := b.paths[addr.String()]; ok {
+		path.lastSeen = now
+	} else {
+		b.paths[addr.String()] = &bondPath{addr, now}
+		b.order = append(b.order, addr.String())
+	}
+	c.mu.Unlock()
+
+	n = copy(p, p[bondHeaderSize:n])
+	return n, id, nil
+}
+
+// WriteTo implements net.PacketConn, spreading packets to a bond over its
+// live paths
+func (c *BondConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	id, ok := addr.(bondAddr)
+	if !ok {
+		return c.PacketConn.WriteTo(p, addr)
+	}
+
+	now := time.Now()
+	var targets []net.Addr
+	c.mu.Lock()
+	if b, ok := c.bonds[id]; ok {
+		// expire the paths gone silent, and send on the live ones only
+		order := b.order[:0]
+		var live []net.Addr
+		var latest *bondPath
+		for _, key := range b.order {
+			path := b.paths[key]
+			if now.Sub(path.lastSeen) > bondPathExpire {
+				delete(b.paths, key)
+				continue
+			}
+			order = append(order, key)
+			if now.Sub(path.lastSeen) < pathDeadAfter {
+				live = append(live, path.addr)
+			}
+			if latest == nil || path.lastSeen.After(latest.lastSeen) {
+				latest = path
+			}
+		}
+		b.order = order
+		switch {
+		case len(b.order) == 0:
+			delete(c.bonds, id)
+		case len(live) == 0:
+			targets = []net.Addr{latest.addr}
+		case b.dup:
+			targets = live
+		default:
+			b.rr++
+			targets = []net.Addr{live[b.rr%len(live)]}
+		}
+	}
+	c.mu.Unlock()
+
+	if len(targets) == 0 {
+		return 0, errors.Errorf("multipath: no live path to %v", addr)
+	}
+	for _, target := range targets {
+		n, err = c.PacketConn.WriteTo(p, target)
+	}
+	return
+}
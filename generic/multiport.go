@@ -0,0 +1,231 @@
+package generic
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SplitListen splits a listen address like ":29900" or ":20000-20100"
+// into its host and port range
+func SplitListen(addr string) (host string, lo, hi int, err error) {
+	host, ports, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	if strings.Contains(ports, "-") {
+		lo, hi, err = ParsePortRange(ports)
+		return host, lo, hi, err
+	}
+	port, err := net.LookupPort("udp", ports)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	return host, port, port, nil
+}
+
+type multiPortPacket struct {
+	data []byte
+	addr net.Addr
+}
+
+// MultiPortConn merges UDP sockets on several ports of one address into a
+// single PacketConn for kcp.ServeConn. Peers are keyed by their own address
+// whatever port they reach, and answered from the port they used last.
+type MultiPortConn struct {
+	network string
+	ip      net.IP
+	setup   func(*net.UDPConn) net.PacketConn
+
+	mu      sync.Mutex
+	socks   map[int]net.PacketConn
+	static  map[int]bool
+	peers   map[string]int // port each peer arrived on last
+	current int            // preferred port for peers without a live one
+	laddr   net.Addr
+
+	in      chan multiPortPacket
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+// NewMultiPortConn creates an empty MultiPortConn on ip, setup is applied
+// to every socket it opens, the conn it returns replaces the socket
+func NewMultiPortConn(network string, ip net.IP, setup func(*net.UDPConn) net.PacketConn) *MultiPortConn {
+	c := new(MultiPortConn)
+	c.network = network
+	c.ip = ip
+	c.setup = setup
+	c.socks = make(map[int]net.PacketConn)
+	c.static = make(map[int]bool)
+	c.peers = make(map[string]int)
+	c.in = make(chan multiPortPacket, 1024)
+	c.die = make(chan struct{})
+	return c
+}
+
+// Listen opens port for good
+func (c *MultiPortConn) Listen(port int) error {
+	return c.listen(port, true)
+}
+
+func (c *MultiPortConn) listen(port int, static bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.socks[port]; ok {
+		c.static[port] = c.static[port] || static
+		return nil
+	}
+	udpconn, err := net.ListenUDP(c.network, &net.UDPAddr{IP: c.ip, Port: port})
+	if err != nil {
+		return err
+	}
+	var conn net.PacketConn = udpconn
+	if c.setup != nil {
+		conn = c.setup(udpconn)
+	}
+	c.socks[port] = conn
+	c.static[port] = static
+	if c.laddr == nil {
+		c.laddr = conn.LocalAddr()
+	}
+	if c.current == 0 {
+		c.current = port
+	}
+	go c.readLoop(port, conn)
+	return nil
+}
+
+// unlisten closes port unless it's static, c.mu must be held
+func (c *MultiPortConn) unlisten(port int) {
+	conn, ok := c.socks[port]
+	if !ok || c.static[port] {
+		return
+	}
+	delete(c.socks, port)
+	delete(c.static, port)
+	for peer, p := range c.peers {
+		if p == port {
+			delete(c.peers, peer)
+		}
+	}
+	conn.Close()
+}
+
+func (c *MultiPortConn) readLoop(port int, conn net.PacketConn) {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		c.mu.Lock()
+		c.peers[addr.String()] = port
+		c.mu.Unlock()
+
+		pkt := multiPortPacket{make([]byte, n), addr}
+		copy(pkt.data, buf)
+		select {
+		case c.in <- pkt:
+		case <-c.die:
+			return
+		}
+	}
+}
+
+// Hop keeps the ports of the previous, current and next time slot open,
+// in lockstep with the clients hopping with the same key, until c closes
+func (c *MultiPortConn) Hop(key []byte, lo, hi int, interval time.Duration) {
+	tick := interval / 4
+	if tick > time.Second {
+		tick = time.Second
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		wanted := map[int]bool{
+			HopPort(key, lo, hi, interval, now.Add(-interval)): true,
+			HopPort(key, lo, hi, interval, now):                true,
+			HopPort(key, lo, hi, interval, now.Add(interval)):  true,
+		}
+		for port := range wanted {
+			if err := c.listen(port, false); err != nil {
+				log.Printf("porthop: %v", err)
+			}
+		}
+		c.mu.Lock()
+		for port := range c.socks {
+			if !wanted[port] {
+				c.unlisten(port)
+			}
+		}
+		if _, ok := c.socks[HopPort(key, lo, hi, interval, now)]; ok {
+			c.current = HopPort(key, lo, hi, interval, now)
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-ticker.C:
+		case <-c.die:
+			return
+		}
+	}
+}
+
+// ReadFrom implements net.PacketConn
+func (c *MultiPortConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	select {
+	case pkt := <-c.in:
+		return copy(p, pkt.data), pkt.addr, nil
+	case <-c.die:
+		return 0, nil, errors.New("multiport: closed")
+	}
+}
+
+// WriteTo implements net.PacketConn
+func (c *MultiPortConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	c.mu.Lock()
+	conn, ok := c.socks[c.peers[addr.String()]]
+	if !ok {
+		conn, ok = c.socks[c.current]
+	}
+	c.mu.Unlock()
+	if !ok {
+		return 0, errors.New("multiport: no open port")
+	}
+	return conn.WriteTo(p, addr)
+}
+
+// Close implements net.PacketConn
+func (c *MultiPortConn) Close() error {
+	c.dieOnce.Do(func() {
+		close(c.die)
+		c.mu.Lock()
+		for _, conn := range c.socks {
+			conn.Close()
+		}
+		c.mu.Unlock()
+	})
+	return nil
+}
+
+// LocalAddr implements net.PacketConn, returning the first port's address
+func (c *MultiPortConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.laddr
+}
+
+// SetDeadline implements net.PacketConn, the ports have no deadlines
+func (c *MultiPortConn) SetDeadline(t time.Time) error { return nil }
+
+// SetReadDeadline implements net.PacketConn
+func (c *MultiPortConn) SetReadDeadline(t time.Time) error { return nil }
+
+// SetWriteDeadline implements net.PacketConn
+func (c *MultiPortConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,33 @@
+package generic
+
+import "testing"
+
+func TestSplitListen(t *testing.T) {
+	tests := []struct {
+		in     string
+		host   string
+		lo, hi int
+		err    bool
+	}{
+		{":29900", "", 29900, 29900, false},
+		{"0.0.0.0:20000-20100", "0.0.0.0", 20000, 20100, false},
+		{"[::1]:20000-20100", "::1", 20000, 20100, false},
+		{":20100-20000", "", 0, 0, true},
+		{":0-100", "", 0, 0, true},
+		{":20000-", "", 0, 0, true},
+		{":70000", "", 0, 0, true},
+		{"29900", "", 0, 0, true},
+		{"::1:29900", "", 0, 0, true},
+		{"", "", 0, 0, true},
+	}
+	for _, test := range tests {
+		host, lo, hi, err := SplitListen(test.in)
+		if (err != nil) != test.err {
+			t.Errorf("SplitListen(%q): error %v, want error %v", test.in, err, test.err)
+			continue
+		}
+		if err == nil && (host != test.host || lo != test.lo || hi != test.hi) {
+			t.Errorf("SplitListen(%q) = %q %v-%v, want %q %v-%v", test.in, host, lo, hi, test.host, test.lo, test.hi)
+		}
+	}
+}
@@ -0,0 +1,426 @@
+package generic
+
+import (
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// With --handshake noise-ik or noise-xk, every session starts with a Noise
+// handshake (Noise_IK/XK_25519_ChaChaPoly_SHA256), as WireGuard does: the
+// client knows the server's static public key beforehand, both sides prove
+// their static keys, and ephemeral keys give the session forward secrecy.
+// IK takes one round trip, XK one and a half but hides the client's key
+// from anyone holding the server's private key later. The streams then run
+// inside the Noise transport messages.
+const (
+	HandshakeNoiseIK = "noise-ik"
+	HandshakeNoiseXK = "noise-xk"
+
+	noiseKeySize = 32
+	// largest Noise message, length prefixed with 2 bytes
+	noiseMaxMessage = 65535
+	noisePrologue   = "kcptun"
+)
+
+// noisePatterns are the message tokens of the handshakes after the server's
+// static key is known, initiator first. In a DH token the first letter is
+// the initiator's key, the second the responder's.
+var noisePatterns = map[string][][]string{
+	HandshakeNoiseIK: {{"e", "es", "s", "ss"}, {"e", "ee", "se"}},
+	HandshakeNoiseXK: {{"e", "es"}, {"e", "ee"}, {"s", "se"}},
+}
+
+var noiseProtocols = map[string]string{
+	HandshakeNoiseIK: "Noise_IK_25519_ChaChaPoly_SHA256",
+	HandshakeNoiseXK: "Noise_XK_25519_ChaChaPoly_SHA256",
+}
+
+// NoiseKey is a Curve25519 key pair
+type NoiseKey struct {
+	Private, Public [noiseKeySize]byte
+}
+
+// GenerateNoiseKey returns a random key pair
+func GenerateNoiseKey() (*NoiseKey, error) {
+	k := new(NoiseKey)
+	if _, err := rand.Read(k.Private[:]); err != nil {
+		return nil, err
+	}
+	curve25519.ScalarBaseMult(&k.Public, &k.Private)
+	return k, nil
+}
+
+// PublicString returns the public key in base64
+func (k *NoiseKey) PublicString() string {
+	return base64.StdEncoding.EncodeToString(k.Public[:])
+}
+
+// PrivateString returns the private key in base64
+func (k *NoiseKey) PrivateString() string {
+	return base64.StdEncoding.EncodeToString(k.Private[:])
+}
+
+// ParseNoiseKey returns the key pair of a base64 private key
+func ParseNoiseKey(private string) (*NoiseKey, error) {
+	b, err := base64.StdEncoding.DecodeString(private)
+	if err != nil || len(b) != noiseKeySize {
+		return nil, errors.New("noise: private key must be 32 bytes in base64")
+	}
+	k := new(NoiseKey)
+	copy(k.Private[:], b)
+	curve25519.ScalarBaseMult(&k.Public, &k.Private)
+	return k, nil
+}
+
+// ParseNoisePublic decodes a base64 public key
+func ParseNoisePublic(public string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(public)
+	if err != nil || len(b) != noiseKeySize {
+		return nil, errors.Errorf("noise: public key %q must be 32 bytes in base64", public)
+	}
+	return b, nil
+}
+
+func noiseDH(private, public []byte) []byte {
+	var dst, priv, pub [noiseKeySize]byte
+	copy(priv[:], private)
+	copy(pub[:], public)
+	curve25519.ScalarMult(&dst, &priv, &pub)
+	return dst[:]
+}
+
+func noiseHMAC(key []byte, data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// noiseHKDF derives two keys from the chaining key ck and ikm
+func noiseHKDF(ck, ikm []byte) ([]byte, []byte) {
+	prk := noiseHMAC(ck, ikm)
+	k1 := noiseHMAC(prk, []byte{1})
+	k2 := noiseHMAC(prk, k1, []byte{2})
+	return k1, k2
+}
+
+// noiseCipher is a Noise CipherState
+type noiseCipher struct {
+	aead cipher.AEAD
+	n    uint64
+}
+
+func newNoiseCipher(key []byte) *noiseCipher {
+	aead, _ := chacha20poly1305.New(key)
+	return &noiseCipher{aead: aead}
+}
+
+func (c *noiseCipher) nonce() []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], c.n)
+	c.n++
+	return nonce
+}
+
+func (c *noiseCipher) seal(dst, plain, ad []byte) []byte {
+	return c.aead.Seal(dst, c.nonce(), plain, ad)
+}
+
+func (c *noiseCipher) open(dst, sealed, ad []byte) ([]byte, error) {
+	return c.aead.Open(dst, c.nonce(), sealed, ad)
+}
+
+// noiseSymmetric is a Noise SymmetricState
+type noiseSymmetric struct {
+	ck, h  []byte
+	cipher *noiseCipher // nil until the first mixKey
+}
+
+func (s *noiseSymmetric) mixHash(data []byte) {
+	sum := sha256.Sum256(append(append([]byte(nil), s.h...), data...))
+	s.h = sum[:]
+}
+
+func (s *noiseSymmetric) mixKey(ikm []byte) {
+	var k []byte
+	s.ck, k = noiseHKDF(s.ck, ikm)
+	s.cipher = newNoiseCipher(k)
+}
+
+func (s *noiseSymmetric) encryptAndHash(plain []byte) []byte {
+	out := plain
+	if s.cipher != nil {
+		out = s.cipher.seal(nil, plain, s.h)
+	}
+	s.mixHash(out)
+	return out
+}
+
+func (s *noiseSymmetric) decryptAndHash(sealed []byte) ([]byte, error) {
+	out := sealed
+	if s.cipher != nil {
+		var err error
+		if out, err = s.cipher.open(nil, sealed, s.h); err != nil {
+			return nil, authFailed("noise: handshake decryption failed, check the server key")
+		}
+	}
+	s.mixHash(sealed)
+	return out, nil
+}
+
+// noiseHandshake runs the handshake of mode over conn with the static key
+// s. The initiator knows the responder's static key rs beforehand, the
+// responder learns the initiator's, returned. The payloads of the first two
+// messages carry the post-quantum key exchange pq, nil for none.
+func noiseHandshake(conn net.Conn, mode string, initiator bool, s *NoiseKey, rs []byte, pq *pqExchange) (net.Conn, []byte, error) {
+	st := &noiseSymmetric{h: []byte(noiseProtocols[mode])}
+	st.ck = st.h
+	st.mixHash([]byte(noisePrologue))
+	// pre-message: the responder's static key
+	if initiator {
+		st.mixHash(rs)
+	} else {
+		st.mixHash(s.Public[:])
+	}
+
+	e, err := GenerateNoiseKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	var re, offer []byte
+	key := func(token byte) []byte {
+		if token == 'e' {
+			return e.Private[:]
+		}
+		return s.Private[:]
+	}
+	remote := func(token byte) []byte {
+		if token == 'e' {
+			return re
+		}
+		return rs
+	}
+
+	for i, tokens := range noisePatterns[mode] {
+		if (i%2 == 0) == initiator {
+			var msg []byte
+			for _, t := range tokens {
+				switch t {
+				case "e":
+					msg = append(msg, e.Public[:]...)
+					st.mixHash(e.Public[:])
+				case "s":
+					msg = append(msg, st.encryptAndHash(s.Public[:])...)
+				default:
+					local, peer := t[0], t[1]
+					if !initiator {
+						local, peer = peer, local
+					}
+					st.mixKey(noiseDH(key(local), remote(peer)))
+				}
+			}
+			var payload []byte
+			switch {
+			case i == 0:
+				payload, err = pq.offer()
+			case i == 1:
+				payload, err = pq.answer(offer)
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			msg = append(msg, st.encryptAndHash(payload)...)
+			if err := writeNoiseMessage(conn, msg); err != nil {
+				return nil, nil, err
+			}
+			if i == 1 && pq.secret() != nil {
+				st.mixKey(pq.secret())
+			}
+			continue
+		}
+
+		msg, err := readNoiseMessage(conn)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, t := range tokens {
+			switch t {
+			case "e":
+				if len(msg) < noiseKeySize {
+					return nil, nil, errors.New("noise: short handshake message")
+				}
+				re = msg[:noiseKeySize]
+				msg = msg[noiseKeySize:]
+				st.mixHash(re)
+			case "s":
+				size := noiseKeySize
+				if st.cipher != nil {
+					size += chacha20poly1305.Overhead
+				}
+				if len(msg) < size {
+					return nil, nil, errors.New("noise: short handshake message")
+				}
+				if rs, err = st.decryptAndHash(msg[:size]); err != nil {
+					return nil, nil, err
+				}
+				msg = msg[size:]
+			default:
+				local, peer := t[0], t[1]
+				if !initiator {
+					local, peer = peer, local
+				}
+				st.mixKey(noiseDH(key(local), remote(peer)))
+			}
+		}
+		payload, err := st.decryptAndHash(msg)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch {
+		case i == 0:
+			offer = payload
+		case i == 1:
+			if err := pq.finish(payload); err != nil {
+				return nil, nil, err
+			}
+			if pq.secret() != nil {
+				st.mixKey(pq.secret())
+			}
+		}
+	}
+
+	k1, k2 := noiseHKDF(st.ck, nil)
+	send, recv := newNoiseCipher(k1), newNoiseCipher(k2)
+	if !initiator {
+		send, recv = recv, send
+	}
+	resume := noiseHMAC(st.ck, []byte("kcptun resumption"))
+	return &noiseConn{Conn: conn, send: send, recv: recv, peer: rs, resume: resume}, rs, nil
+}
+
+func writeNoiseMessage(w io.Writer, msg []byte) error {
+	frame := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	copy(frame[2:], msg)
+	_, err := w.Write(frame)
+	return err
+}
+
+func readNoiseMessage(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// NoiseClient runs the handshake of mode as the initiator over conn, with
+// the static key local, towards the server with the public key server,
+// requiring the post-quantum key exchange if pq. The returned conn replaces
+// conn.
+func NoiseClient(conn net.Conn, mode string, local *NoiseKey, server []byte, pq bool, timeout time.Duration) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	var exchange *pqExchange
+	if pq {
+		exchange = newPQExchange()
+	}
+	nconn, _, err := noiseHandshake(conn, mode, true, local, server, exchange)
+	return nconn, err
+}
+
+// NoiseServer runs the handshake of mode as the responder over conn, with
+// the static key local, and refuses clients whose public key isn't in
+// allowed, unless allowed is empty. It requires the post-quantum key
+// exchange if pq. The returned conn replaces conn.
+func NoiseServer(conn net.Conn, mode string, local *NoiseKey, allowed [][]byte, pq bool, timeout time.Duration) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+	var exchange *pqExchange
+	if pq {
+		exchange = newPQExchange()
+	}
+	nconn, client, err := noiseHandshake(conn, mode, false, local, nil, exchange)
+	if err != nil {
+		return nil, err
+	}
+	if len(allowed) == 0 {
+		return nconn, nil
+	}
+	for _, k := range allowed {
+		if hmac.Equal(k, client) {
+			return nconn, nil
+		}
+	}
+	return nil, authFailed("noise: client key %v not allowed", base64.StdEncoding.EncodeToString(client))
+}
+
+// noiseConn carries data in Noise transport messages
+type noiseConn struct {
+	net.Conn
+	send, recv *noiseCipher
+	peer       []byte // the peer's static key, nil once resumed
+	pin        string // the peer's pin, of a session resumed on the server
+	resume     []byte // secret of the next resumption, see ResumptionSecret
+	token      []byte // the token the session resumed with, on the server
+
+	rmu  sync.Mutex
+	rbuf []byte // decrypted, not yet read
+
+	wmu sync.Mutex
+}
+
+func (c *noiseConn) Read(p []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if len(c.rbuf) == 0 {
+		msg, err := readNoiseMessage(c.Conn)
+		if err != nil {
+			return 0, err
+		}
+		if len(msg) == 0 {
+			return 0, errors.New("resume: server refused the token")
+		}
+		if c.rbuf, err = c.recv.open(msg[:0], msg, nil); err != nil {
+			return 0, errors.New("noise: transport decryption failed")
+		}
+	}
+	n := copy(p, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *noiseConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > noiseMaxMessage-chacha20poly1305.Overhead {
+			chunk = chunk[:noiseMaxMessage-chacha20poly1305.Overhead]
+		}
+		if err := writeNoiseMessage(c.Conn, c.send.seal(nil, chunk, nil)); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
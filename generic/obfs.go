@@ -0,0 +1,198 @@
+package generic
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sort"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// Obfuscator disguises every UDP payload on the wire, so that DPI boxes
+// flagging KCP don't throttle the flow. Both ends must use the same one.
+type Obfuscator interface {
+	// Obfuscate returns the wire form of p
+	Obfuscate(p []byte) []byte
+	// Deobfuscate returns the packet carried by wire, ok is false if wire
+	// doesn't look like an obfuscated packet
+	Deobfuscate(wire []byte) (p []byte, ok bool)
+	// Overhead is the number of bytes Obfuscate adds
+	Overhead() int
+}
+
+var obfuscators = map[string]func(key string) Obfuscator{
+	"scramble": newScrambleObfs,
+	"dtls":     newDTLSObfs,
+}
+
+// RegisterObfuscator makes an obfuscator available to NewObfuscator
+func RegisterObfuscator(name string, fn func(key string) Obfuscator) {
+	obfuscators[name] = fn
+}
+
+// Obfuscators lists the registered obfuscator names
+func Obfuscators() []string {
+	var names []string
+	for name := range obfuscators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewObfuscator creates the obfuscator name keyed with key, it returns nil
+// for "" and "none"
+func NewObfuscator(name, key string) (Obfuscator, error) {
+	if name == "" || name == "none" {
+		return nil, nil
+	}
+	fn, ok := obfuscators[name]
+	if !ok {
+		return nil, errors.Errorf("obfs: unknown obfuscator %q, available: %v", name, Obfuscators())
+	}
+	return fn(key), nil
+}
+
+// ObfsConn applies an Obfuscator to the wrapped PacketConn, packets not
+// recognized as obfuscated are passed through
+type ObfsConn struct {
+	net.PacketConn
+	obfs Obfuscator
+}
+
+// NewObfsConn wraps conn with obfs
+func NewObfsConn(conn net.PacketConn, obfs Obfuscator) *ObfsConn {
+	return &ObfsConn{conn, obfs}
+}
+
+// ReadFrom implements net.PacketConn
+func (c *ObfsConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(p)
+	if err != nil {
+		return
+	}
+	if plain, ok := c.obfs.Deobfuscate(p[:n]); ok {
+		n = copy(p, plain)
+	}
+	return
+}
+
+// WriteTo implements net.PacketConn, probe replies stay plaintext
+func (c *ObfsConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if IsProbe(p) {
+		return c.PacketConn.WriteTo(p, addr)
+	}
+	if _, err := c.PacketConn.WriteTo(c.obfs.Obfuscate(p), addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// scrambleObfs XORs the head of every packet, where the KCP and FEC headers
+// are, with a keystream derived from the key and a random per-packet salt.
+// The check bytes come from the keystream too, to recognize the packets.
+//
+// | salt(4B) | check(2B) | scrambled packet |
+type scrambleObfs struct {
+	key []byte
+}
+
+const (
+	scrambleSaltSize   = 4
+	scrambleCheckSize  = 2
+	scrambleHeaderSize = scrambleSaltSize + scrambleCheckSize
+)
+
+func newScrambleObfs(key string) Obfuscator {
+	sum := sha256.Sum256([]byte("kcptun-obfs-scramble" + key))
+	return &scrambleObfs{sum[:]}
+}
+
+// keystream returns 64 bytes, the check bytes followed by the XOR mask
+func (o *scrambleObfs) keystream(salt []byte) []byte {
+	h := sha256.New()
+	h.Write(o.key)
+	h.Write(salt)
+	a := h.Sum(nil)
+	h.Write(a)
+	return h.Sum(a)
+}
+
+func scramble(dst, src, mask []byte) {
+	copy(dst, src)
+	for i := 0; i < len(dst) && i < len(mask); i++ {
+		dst[i] ^= mask[i]
+	}
+}
+
+func (o *scrambleObfs) Obfuscate(p []byte) []byte {
+	wire := make([]byte, scrambleHeaderSize+len(p))
+	rand.Read(wire[:scrambleSaltSize])
+	ks := o.keystream(wire[:scrambleSaltSize])
+	copy(wire[scrambleSaltSize:], ks[:scrambleCheckSize])
+	scramble(wire[scrambleHeaderSize:], p, ks[scrambleCheckSize:])
+	return wire
+}
+
+func (o *scrambleObfs) Deobfuscate(wire []byte) ([]byte, bool) {
+	if len(wire) < scrambleHeaderSize {
+		return nil, false
+	}
+	ks := o.keystream(wire[:scrambleSaltSize])
+	if !bytes.Equal(wire[scrambleSaltSize:scrambleHeaderSize], ks[:scrambleCheckSize]) {
+		return nil, false
+	}
+	p := make([]byte, len(wire)-scrambleHeaderSize)
+	scramble(p, wire[scrambleHeaderSize:], ks[scrambleCheckSize:])
+	return p, true
+}
+
+func (o *scrambleObfs) Overhead() int { return scrambleHeaderSize }
+
+// dtlsObfs frames every packet as a DTLS 1.2 application data record
+//
+// | type(1B)=23 | version(2B)=0xfefd | epoch(2B)=1 | sequence(6B) | length(2B) | packet |
+type dtlsObfs struct {
+	seq uint64
+}
+
+const (
+	dtlsHeaderSize      = 13
+	dtlsApplicationData = 23
+	dtlsVersion         = 0xfefd
+)
+
+func newDTLSObfs(key string) Obfuscator {
+	var seed [8]byte
+	rand.Read(seed[:6])
+	return &dtlsObfs{seq: binary.BigEndian.Uint64(seed[:]) >> 24}
+}
+
+func (o *dtlsObfs) Obfuscate(p []byte) []byte {
+	wire := make([]byte, dtlsHeaderSize+len(p))
+	wire[0] = dtlsApplicationData
+	binary.BigEndian.PutUint16(wire[1:], dtlsVersion)
+	binary.BigEndian.PutUint16(wire[3:], 1)
+	seq := atomic.AddUint64(&o.seq, 1)
+	wire[5] = byte(seq >> 40)
+	wire[6] = byte(seq >> 32)
+	binary.BigEndian.PutUint32(wire[7:], uint32(seq))
+	binary.BigEndian.PutUint16(wire[11:], uint16(len(p)))
+	copy(wire[dtlsHeaderSize:], p)
+	return wire
+}
+
+func (o *dtlsObfs) Deobfuscate(wire []byte) ([]byte, bool) {
+	if len(wire) < dtlsHeaderSize || wire[0] != dtlsApplicationData ||
+		binary.BigEndian.Uint16(wire[1:]) != dtlsVersion ||
+		int(binary.BigEndian.Uint16(wire[11:])) != len(wire)-dtlsHeaderSize {
+		return nil, false
+	}
+	return wire[dtlsHeaderSize:], true
+}
+
+func (o *dtlsObfs) Overhead() int { return dtlsHeaderSize }
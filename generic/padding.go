@@ -0,0 +1,166 @@
+package generic
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Padding hides KCP's characteristic packet sizes from traffic classifiers
+// by growing every packet to a random or bucketed size within the MTU. A
+// trailer tells the receiver how much to strip:
+//
+// | packet | padding | padding length(2B) | tag(4B) |
+//
+// Length and tag are masked with an HMAC of the packet's first bytes, the
+// random nonce of the encryption, so the trailer looks random too. The
+// server strips the padding of any client sending a valid trailer, and pads
+// its replies to that client in return.
+const (
+	// PaddingOverhead is the room padding needs in every packet
+	PaddingOverhead = 6
+
+	padMaskInput = 16
+	padBucket    = 128
+
+	// server side peers silent for this long get their replies unpadded,
+	// until they pad again, and are forgotten
+	padPeerExpiry = 2 * time.Minute
+)
+
+// CheckPaddingMode validates a --padding mode
+func CheckPaddingMode(mode string) error {
+	switch mode {
+	case "", "none", "random", "bucket":
+		return nil
+	}
+	return errors.Errorf("padding: unknown mode %q, use none, random or bucket", mode)
+}
+
+// PadConn pads the packets written and strips the padding of the packets
+// read
+type PadConn struct {
+	net.PacketConn
+	key    []byte
+	mode   string
+	mtu    int
+	server bool
+
+	rng   *rand.Rand
+	rngMu sync.Mutex
+
+	mu     sync.Mutex
+	peers  map[string]time.Time // last heard from the peers known to pad, on the server side
+	pruned time.Time
+}
+
+// NewPadConn wraps conn with padding in mode, packets never exceed mtu. On
+// the server side only the replies to padding clients are padded.
+func NewPadConn(conn net.PacketConn, key string, mode string, mtu int, server bool) *PadConn {
+	c := new(PadConn)
+	c.PacketConn = conn
+	c.key = []byte(key)
+	c.mode = mode
+	c.mtu = mtu
+	c.server = server
+	c.rng = NewRand()
+	c.peers = make(map[string]time.Time)
+	return c
+}
+
+func (c *PadConn) mask(p []byte) []byte {
+	if len(p) > padMaskInput {
+		p = p[:padMaskInput]
+	}
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte("kcptun-padding"))
+	mac.Write(p)
+	return mac.Sum(nil)[:PaddingOverhead]
+}
+
+// ReadFrom implements net.PacketConn
+func (c *PadConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(p)
+	if err != nil || n < padMaskInput+PaddingOverhead {
+		return
+	}
+	trailer := p[n-PaddingOverhead : n]
+	m := c.mask(p[:n])
+	if !hmac.Equal(trailer[2:], m[2:]) {
+		return
+	}
+	padlen := int(uint16(trailer[0]^m[0])<<8 | uint16(trailer[1]^m[1]))
+	if padlen+PaddingOverhead+padMaskInput > n {
+		return
+	}
+	if c.server {
+		now := time.Now()
+		c.mu.Lock()
+		c.peers[addr.String()] = now
+		if now.Sub(c.pruned) > padPeerExpiry {
+			for key, seen := range c.peers {
+				if now.Sub(seen) > padPeerExpiry {
+					delete(c.peers, key)
+				}
+			}
+			c.pruned = now
+		}
+		c.mu.Unlock()
+	}
+	return n - PaddingOverhead - padlen, addr, nil
+}
+
+// WriteTo implements net.PacketConn
+func (c *PadConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if len(p) < padMaskInput || IsProbe(p) {
+		return c.PacketConn.WriteTo(p, addr)
+	}
+	if c.server {
+		c.mu.Lock()
+		seen, padded := c.peers[addr.String()]
+		c.mu.Unlock()
+		if !padded || time.Since(seen) > padPeerExpiry {
+			return c.PacketConn.WriteTo(p, addr)
+		}
+	}
+
+	size := len(p) + PaddingOverhead
+	room := c.mtu - size
+	if room < 0 {
+		room = 0
+	}
+	switch c.mode {
+	case "random":
+		c.rngMu.Lock()
+		size += c.rng.Intn(room + 1)
+		c.rngMu.Unlock()
+	case "bucket":
+		if bucketed := (size + padBucket - 1) / padBucket * padBucket; bucketed <= c.mtu {
+			size = bucketed
+		} else {
+			size += room
+		}
+	}
+	padlen := size - len(p) - PaddingOverhead
+
+	pkt := make([]byte, size)
+	copy(pkt, p)
+	c.rngMu.Lock()
+	c.rng.Read(pkt[len(p) : len(p)+padlen])
+	c.rngMu.Unlock()
+	m := c.mask(p)
+	trailer := pkt[size-PaddingOverhead:]
+	trailer[0] = byte(padlen>>8) ^ m[0]
+	trailer[1] = byte(padlen) ^ m[1]
+	copy(trailer[2:], m[2:])
+
+	if _, err := c.PacketConn.WriteTo(pkt, addr); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,160 @@
+package generic
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go"
+)
+
+const (
+	pcapMagic   = 0xa1b2c3d4
+	pcapSnapLen = 65535
+	linkTypeRaw = 101 // raw IPv4/IPv6, no link layer
+)
+
+// PcapWriter writes UDP packets to a libpcap file, synthesizing the IP and
+// UDP headers so that wireshark can dissect the flows
+type PcapWriter struct {
+	f  *os.File
+	mu sync.Mutex
+}
+
+// NewPcapWriter creates path and writes the pcap file header
+func NewPcapWriter(path string) (*PcapWriter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], pcapSnapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], linkTypeRaw)
+	if _, err := f.Write(hdr); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &PcapWriter{f: f}, nil
+}
+
+// WritePacket records a UDP datagram from src to dst
+func (w *PcapWriter) WritePacket(src, dst net.Addr, payload []byte) error {
+	srcAddr, _ := src.(*net.UDPAddr)
+	dstAddr, _ := dst.(*net.UDPAddr)
+	if srcAddr == nil || dstAddr == nil {
+		return nil
+	}
+
+	// a socket bound to the unspecified address may carry either family
+	v4 := func(ip net.IP) bool { return ip.To4() != nil || ip.IsUnspecified() }
+	var ip []byte
+	if v4(srcAddr.IP) && v4(dstAddr.IP) {
+		ip = ipv4Header(srcAddr.IP, dstAddr.IP, 8+len(payload))
+	} else {
+		ip = ipv6Header(srcAddr.IP, dstAddr.IP, 8+len(payload))
+	}
+	udp := make([]byte, 8)
+	binary.BigEndian.PutUint16(udp[0:], uint16(srcAddr.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dstAddr.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+
+	n := len(ip) + len(udp) + len(payload)
+	now := time.Now()
+	rec := make([]byte, 16, 16+n)
+	binary.LittleEndian.PutUint32(rec[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(rec[8:], uint32(n))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(n))
+	rec = append(rec, ip...)
+	rec = append(rec, udp...)
+	rec = append(rec, payload...)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := w.f.Write(rec)
+	return err
+}
+
+// Close closes the underlying file
+func (w *PcapWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.f.Close()
+}
+
+func ipv4Header(src, dst net.IP, length int) []byte {
+	h := make([]byte, 20)
+	h[0] = 0x45
+	binary.BigEndian.PutUint16(h[2:], uint16(20+length))
+	h[8] = 64
+	h[9] = 17 // udp
+	copy(h[12:16], src.To4())
+	if src.To4() == nil {
+		copy(h[12:16], net.IPv4zero.To4())
+	}
+	copy(h[16:20], dst.To4())
+	var sum uint32
+	for i := 0; i < 20; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(h[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	binary.BigEndian.PutUint16(h[10:], ^uint16(sum))
+	return h
+}
+
+func ipv6Header(src, dst net.IP, length int) []byte {
+	h := make([]byte, 40)
+	h[0] = 0x60
+	binary.BigEndian.PutUint16(h[4:], uint16(length))
+	h[6] = 17 // udp
+	h[7] = 64
+	copy(h[8:24], src.To16())
+	copy(h[24:40], dst.To16())
+	return h
+}
+
+// PcapConn mirrors every datagram passing through the wrapped PacketConn
+// to a PcapWriter. With a non-nil block, packets are decrypted before being
+// written, showing the FEC and KCP headers in clear.
+type PcapConn struct {
+	net.PacketConn
+	w     *PcapWriter
+	block kcp.BlockCrypt
+}
+
+// NewPcapConn wraps conn with packet capturing, block may be nil to capture
+// the packets as seen on the wire
+func NewPcapConn(conn net.PacketConn, w *PcapWriter, block kcp.BlockCrypt) *PcapConn {
+	return &PcapConn{conn, w, block}
+}
+
+func (c *PcapConn) capture(src, dst net.Addr, p []byte) {
+	if c.block != nil {
+		plain := make([]byte, len(p))
+		c.block.Decrypt(plain, p)
+		p = plain
+	}
+	c.w.WritePacket(src, dst, p)
+}
+
+// ReadFrom implements net.PacketConn
+func (c *PcapConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(p)
+	if err == nil {
+		c.capture(addr, c.LocalAddr(), p[:n])
+	}
+	return
+}
+
+// WriteTo implements net.PacketConn
+func (c *PcapConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	c.capture(c.LocalAddr(), addr, p)
+	return c.PacketConn.WriteTo(p, addr)
+}
@@ -0,0 +1,111 @@
+package generic
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// A socket bound to an unspecified address answers from the address the
+// routing table picks, which on a multihomed host may not be the one the
+// client sent to, and NATs drop answers from the wrong source. PktInfoConn
+// learns from IP_PKTINFO which local address each peer reached, and sends
+// to the peer from it.
+const (
+	// peers not heard from for this long are forgotten
+	pktInfoExpiry = 5 * time.Minute
+)
+
+type pktInfo struct {
+	dst     net.IP
+	ifindex int
+	seen    time.Time
+}
+
+// PktInfoConn answers every peer from the local address it reached
+type PktInfoConn struct {
+	*net.UDPConn
+	v4 *ipv4.PacketConn
+	v6 *ipv6.PacketConn
+
+	mu     sync.Mutex
+	peers  map[string]pktInfo
+	pruned time.Time
+}
+
+// NewPktInfoConn wraps conn, it fails where the system doesn't report the
+// destination address of packets
+func NewPktInfoConn(conn *net.UDPConn) (*PktInfoConn, error) {
+	c := &PktInfoConn{UDPConn: conn, peers: make(map[string]pktInfo), pruned: time.Now()}
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		c.v6 = ipv6.NewPacketConn(conn)
+		if err := c.v6.SetControlMessage(ipv6.FlagDst|ipv6.FlagInterface, true); err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	c.v4 = ipv4.NewPacketConn(conn)
+	if err := c.v4.SetControlMessage(ipv4.FlagDst|ipv4.FlagInterface, true); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ReadFrom implements net.PacketConn
+func (c *PktInfoConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	var dst net.IP
+	var ifindex int
+	if c.v6 != nil {
+		var cm *ipv6.ControlMessage
+		n, cm, addr, err = c.v6.ReadFrom(p)
+		if cm != nil {
+			dst, ifindex = cm.Dst, cm.IfIndex
+		}
+	} else {
+		var cm *ipv4.ControlMessage
+		n, cm, addr, err = c.v4.ReadFrom(p)
+		if cm != nil {
+			dst, ifindex = cm.Dst, cm.IfIndex
+		}
+	}
+	if err != nil || dst == nil {
+		return
+	}
+
+	now := time.Now()
+	c.mu.Lock()
+	c.peers[addr.String()] = pktInfo{dst, ifindex, now}
+	if now.Sub(c.pruned) > pktInfoExpiry {
+		for peer, info := range c.peers {
+			if now.Sub(info.seen) > pktInfoExpiry {
+				delete(c.peers, peer)
+			}
+		}
+		c.pruned = now
+	}
+	c.mu.Unlock()
+	return
+}
+
+// WriteTo implements net.PacketConn, sending from the address addr reached
+func (c *PktInfoConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	info, ok := c.peers[addr.String()]
+	c.mu.Unlock()
+	if !ok {
+		return c.UDPConn.WriteTo(p, addr)
+	}
+	// the interface only matters to link-local addresses, the others
+	// leave it to the routing of the source address
+	var ifindex int
+	if info.dst.IsLinkLocalUnicast() {
+		ifindex = info.ifindex
+	}
+	if c.v6 != nil {
+		return c.v6.WriteTo(p, &ipv6.ControlMessage{Src: info.dst, IfIndex: ifindex}, addr)
+	}
+	return c.v4.WriteTo(p, &ipv4.ControlMessage{Src: info.dst, IfIndex: ifindex}, addr)
+}
@@ -0,0 +1,78 @@
+package generic
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Port hopping moves the UDP traffic to a new server port every interval,
+// evading per-port throttling and stale conntrack state. Both ends derive
+// the port of a time slot from the key, so they need clocks in sync well
+// within an interval; the server keeps the neighbour slots' ports open.
+
+// ParsePortRange parses a range like "20000-30000"
+func ParsePortRange(s string) (lo, hi int, err error) {
+	bounds := strings.SplitN(s, "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, errors.Errorf("port range %q is not like 20000-30000", s)
+	}
+	if lo, err = strconv.Atoi(strings.TrimSpace(bounds[0])); err != nil {
+		return 0, 0, errors.Wrap(err, "port range")
+	}
+	if hi, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil {
+		return 0, 0, errors.Wrap(err, "port range")
+	}
+	if lo < 1 || hi > 65535 || lo > hi {
+		return 0, 0, errors.Errorf("port range %q is out of 1-65535 or reversed", s)
+	}
+	return lo, hi, nil
+}
+
+// HopPort returns the port in [lo, hi] of the time slot containing t
+func HopPort(key []byte, lo, hi int, interval time.Duration, t time.Time) int {
+	var slot [8]byte
+	binary.BigEndian.PutUint64(slot[:], uint64(t.UnixNano()/int64(interval)))
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("kcptun-porthop"))
+	mac.Write(slot[:])
+	return lo + int(binary.BigEndian.Uint32(mac.Sum(nil))%uint32(hi-lo+1))
+}
+
+// HopConn is the client side of port hopping, it sends every packet to the
+// port of the current time slot and presents the replies as coming from
+// raddr, so the KCP session doesn't notice the hops
+type HopConn struct {
+	net.PacketConn
+	raddr    *net.UDPAddr
+	key      []byte
+	lo, hi   int
+	interval time.Duration
+}
+
+// NewHopConn wraps conn for hopping over the ports of raddr's host
+func NewHopConn(conn net.PacketConn, raddr *net.UDPAddr, key []byte, lo, hi int, interval time.Duration) *HopConn {
+	return &HopConn{conn, raddr, key, lo, hi, interval}
+}
+
+// ReadFrom implements net.PacketConn
+func (c *HopConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(p)
+	if udpaddr, ok := addr.(*net.UDPAddr); ok && udpaddr.IP.Equal(c.raddr.IP) {
+		addr = c.raddr
+	}
+	return
+}
+
+// WriteTo implements net.PacketConn, addr is ignored
+func (c *HopConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	dst := *c.raddr
+	dst.Port = HopPort(c.key, c.lo, c.hi, c.interval, time.Now())
+	return c.PacketConn.WriteTo(p, &dst)
+}
@@ -0,0 +1,34 @@
+package generic
+
+import "testing"
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		in     string
+		lo, hi int
+		err    bool
+	}{
+		{"20000-30000", 20000, 30000, false},
+		{" 1 - 65535 ", 1, 65535, false},
+		{"443-443", 443, 443, false},
+		{"30000-20000", 0, 0, true},
+		{"0-100", 0, 0, true},
+		{"60000-70000", 0, 0, true},
+		{"20000", 0, 0, true},
+		{"20000-", 0, 0, true},
+		{"-20000", 0, 0, true},
+		{"a-b", 0, 0, true},
+		{"1-2-3", 0, 0, true},
+		{"", 0, 0, true},
+	}
+	for _, test := range tests {
+		lo, hi, err := ParsePortRange(test.in)
+		if (err != nil) != test.err {
+			t.Errorf("ParsePortRange(%q): error %v, want error %v", test.in, err, test.err)
+			continue
+		}
+		if lo != test.lo || hi != test.hi {
+			t.Errorf("ParsePortRange(%q) = %v-%v, want %v-%v", test.in, lo, hi, test.lo, test.hi)
+		}
+	}
+}
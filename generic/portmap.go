@@ -0,0 +1,344 @@
+package generic
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A server on a home connection asks the gateway to forward its UDP ports,
+// with NAT-PMP (RFC 6886) where the gateway speaks it, UPnP IGD otherwise.
+// Mappings are leased, so they're renewed at half their lifetime and lapse
+// on their own once the server is gone.
+const (
+	PortMapLifetime = time.Hour
+
+	portMapTimeout = 3 * time.Second
+	// wait before trying again after the gateway refused or went missing
+	portMapRetry = time.Minute
+
+	natpmpPort = 5351
+	ssdpAddr   = "239.255.255.250:1900"
+)
+
+// PortMapper maps UDP ports of the gateway to this host
+type PortMapper interface {
+	// Map forwards the external port of the gateway to port of this host
+	// for lifetime, returning the external port granted
+	Map(port int, lifetime time.Duration) (external int, err error)
+	String() string
+}
+
+// DiscoverPortMapper finds a gateway answering NAT-PMP or UPnP
+func DiscoverPortMapper() (PortMapper, error) {
+	gw, err := defaultGateway()
+	if err == nil {
+		pmp := &natPMP{gateway: &net.UDPAddr{IP: gw, Port: natpmpPort}}
+		if _, err := pmp.externalAddr(); err == nil {
+			return pmp, nil
+		}
+	}
+	igd, err := discoverIGD()
+	if err != nil {
+		return nil, errors.Wrap(err, "portmap: no NAT-PMP or UPnP gateway")
+	}
+	return igd, nil
+}
+
+// KeepPortsMapped maps ports on the gateway and renews the mappings for as
+// long as the process runs
+func KeepPortsMapped(ports []int) {
+	var mapper PortMapper
+	for {
+		if mapper == nil {
+			var err error
+			if mapper, err = DiscoverPortMapper(); err != nil {
+				log.Println(err)
+				time.Sleep(portMapRetry)
+				continue
+			}
+		}
+		wait := PortMapLifetime / 2
+		for _, port := range ports {
+			external, err := mapper.Map(port, PortMapLifetime)
+			if err != nil {
+				log.Printf("portmap: %v: port %v: %v", mapper, port, err)
+				mapper, wait = nil, portMapRetry
+				break
+			}
+			log.Printf("portmap: %v: udp %v -> %v for %v", mapper, external, port, PortMapLifetime)
+		}
+		time.Sleep(wait)
+	}
+}
+
+// defaultGateway reads the default route of the host, or guesses the first
+// address of the outbound interface's network where there's no
+// /proc/net/route
+func defaultGateway() (net.IP, error) {
+	if f, err := os.Open("/proc/net/route"); err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			// Iface Destination Gateway ...
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 3 || fields[1] != "00000000" {
+				continue
+			}
+			b, err := hex.DecodeString(fields[2])
+			if err != nil || len(b) != 4 {
+				continue
+			}
+			// little endian
+			return net.IPv4(b[3], b[2], b[1], b[0]), nil
+		}
+	}
+	ip := outboundIP(&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 9})
+	if ip == nil || ip.To4() == nil {
+		return nil, errors.New("no default gateway")
+	}
+	ip = ip.To4()
+	return net.IPv4(ip[0], ip[1], ip[2], 1), nil
+}
+
+// natPMP maps ports with NAT-PMP
+type natPMP struct {
+	gateway *net.UDPAddr
+}
+
+func (p *natPMP) String() string {
+	return "NAT-PMP " + p.gateway.IP.String()
+}
+
+// call sends req to the gateway, and returns its answer of at least size
+// bytes
+func (p *natPMP) call(req []byte, size int) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, p.gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	resp := make([]byte, 16)
+	// the RFC's retransmissions start at 250ms and double
+	for wait := 250 * time.Millisecond; wait <= portMapTimeout; wait *= 2 {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(wait))
+		n, err := conn.Read(resp)
+		if err != nil {
+			continue
+		}
+		// version, opcode + 128, result code
+		if n < size || resp[0] != 0 || resp[1] != req[1]+128 {
+			continue
+		}
+		if code := binary.BigEndian.Uint16(resp[2:]); code != 0 {
+			return nil, errors.Errorf("result code %v", code)
+		}
+		return resp[:n], nil
+	}
+	return nil, errors.New("no answer")
+}
+
+func (p *natPMP) externalAddr() (net.IP, error) {
+	resp, err := p.call([]byte{0, 0}, 12)
+	if err != nil {
+		return nil, err
+	}
+	return net.IP(resp[8:12]), nil
+}
+
+func (p *natPMP) Map(port int, lifetime time.Duration) (int, error) {
+	// version, opcode 1 (udp), reserved(2B), internal port(2B), suggested
+	// external port(2B), lifetime(4B)
+	req := make([]byte, 12)
+	req[1] = 1
+	binary.BigEndian.PutUint16(req[4:], uint16(port))
+	binary.BigEndian.PutUint16(req[6:], uint16(port))
+	binary.BigEndian.PutUint32(req[8:], uint32(lifetime/time.Second))
+	resp, err := p.call(req, 16)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(resp[10:])), nil
+}
+
+// upnpIGD maps ports with the WAN connection service of a UPnP internet
+// gateway device
+type upnpIGD struct {
+	control string // control url of the service
+	service string // service type
+	local   net.IP // this host's address towards the gateway
+}
+
+func (d *upnpIGD) String() string {
+	u, err := url.Parse(d.control)
+	if err != nil {
+		return "UPnP"
+	}
+	return "UPnP " + u.Host
+}
+
+// discoverIGD searches the LAN for a gateway device with SSDP, and reads
+// its description for the WAN connection service
+func discoverIGD() (*upnpIGD, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	group, err := net.ResolveUDPAddr("udp4", ssdpAddr)
+	if err != nil {
+		return nil, err
+	}
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpAddr + "\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(search), group); err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(portMapTimeout))
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return nil, errors.New("no answer to SSDP search")
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		location := resp.Header.Get("Location")
+		if location == "" {
+			continue
+		}
+		igd, err := describeIGD(location)
+		if err != nil {
+			log.Printf("portmap: %v: %v", location, err)
+			continue
+		}
+		igd.local = outboundIP(from.(*net.UDPAddr))
+		return igd, nil
+	}
+}
+
+// igdDevice is the part of a UPnP device description leading to services
+type igdDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []igdDevice `xml:"deviceList>device"`
+}
+
+// wanService returns the first WAN IP or PPP connection service under d
+func (d *igdDevice) wanService() (service, control string) {
+	for _, s := range d.Services {
+		if strings.Contains(s.ServiceType, ":WANIPConnection:") || strings.Contains(s.ServiceType, ":WANPPPConnection:") {
+			return s.ServiceType, s.ControlURL
+		}
+	}
+	for k := range d.Devices {
+		if service, control = d.Devices[k].wanService(); service != "" {
+			return
+		}
+	}
+	return "", ""
+}
+
+func describeIGD(location string) (*upnpIGD, error) {
+	client := http.Client{Timeout: portMapTimeout}
+	resp, err := client.Get(location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var root struct {
+		Device igdDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&root); err != nil {
+		return nil, err
+	}
+	service, control := root.Device.wanService()
+	if service == "" {
+		return nil, errors.New("no WAN connection service")
+	}
+	base, err := url.Parse(location)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := url.Parse(control)
+	if err != nil {
+		return nil, err
+	}
+	return &upnpIGD{control: base.ResolveReference(ref).String(), service: service}, nil
+}
+
+func (d *upnpIGD) Map(port int, lifetime time.Duration) (int, error) {
+	if d.local == nil {
+		return 0, errors.New("no local address towards the gateway")
+	}
+	args := fmt.Sprintf("<NewRemoteHost></NewRemoteHost>"+
+		"<NewExternalPort>%d</NewExternalPort>"+
+		"<NewProtocol>UDP</NewProtocol>"+
+		"<NewInternalPort>%d</NewInternalPort>"+
+		"<NewInternalClient>%s</NewInternalClient>"+
+		"<NewEnabled>1</NewEnabled>"+
+		"<NewPortMappingDescription>kcptun</NewPortMappingDescription>"+
+		"<NewLeaseDuration>%d</NewLeaseDuration>",
+		port, port, d.local, int(lifetime/time.Second))
+	body := `<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:AddPortMapping xmlns:u="` + d.service + `">` + args + `</u:AddPortMapping></s:Body></s:Envelope>`
+
+	req, err := http.NewRequest("POST", d.control, strings.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+d.service+`#AddPortMapping"`)
+	client := http.Client{Timeout: portMapTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fault, _ := ioutil.ReadAll(resp.Body)
+		desc := upnpFault(fault)
+		// older gateways only take mappings without a lease
+		if desc == "OnlyPermanentLeasesSupported" && lifetime != 0 {
+			return d.Map(port, 0)
+		}
+		return 0, errors.Errorf("%v: %s", resp.Status, desc)
+	}
+	return port, nil
+}
+
+// upnpFault extracts the error description of a SOAP fault
+func upnpFault(body []byte) string {
+	var fault struct {
+		Description string `xml:"Body>Fault>detail>UPnPError>errorDescription"`
+	}
+	if xml.Unmarshal(body, &fault) == nil && fault.Description != "" {
+		return fault.Description
+	}
+	return "fault"
+}
@@ -0,0 +1,94 @@
+package generic
+
+import (
+	"github.com/cloudflare/circl/kem"
+	"github.com/cloudflare/circl/kem/kyber/kyber768"
+	"github.com/pkg/errors"
+)
+
+// With --pq, the Noise handshakes also agree on a Kyber768 shared secret,
+// mixed into the session keys along with the X25519 ones: recorded traffic
+// stays safe unless both are broken, so a future quantum computer alone
+// isn't enough. The client offers a Kyber public key in the payload of the
+// first message, the server answers with a ciphertext in the payload of the
+// second. Payloads start with the kind of key exchange, an empty one being
+// the classical handshake. Both ends with --pq require the exchange, and
+// also advertise it in the hello, where a mismatch is refused, so neither
+// falls back to a classical handshake unnoticed.
+const pqKyber768 = 1
+
+// pqExchange is the Kyber part of a hybrid handshake. A nil pqExchange
+// offers nothing and declines offers.
+type pqExchange struct {
+	scheme kem.Scheme
+	sk     kem.PrivateKey
+	ss     []byte // the shared secret, once agreed
+}
+
+func newPQExchange() *pqExchange {
+	return &pqExchange{scheme: kyber768.Scheme()}
+}
+
+// offer is the initiator's first payload
+func (p *pqExchange) offer() ([]byte, error) {
+	if p == nil {
+		return nil, nil
+	}
+	pk, sk, err := p.scheme.GenerateKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	b, err := pk.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	p.sk = sk
+	return append([]byte{pqKyber768}, b...), nil
+}
+
+// answer is the responder's payload to offer
+func (p *pqExchange) answer(offer []byte) ([]byte, error) {
+	if p == nil {
+		return nil, nil
+	}
+	if len(offer) == 0 || offer[0] != pqKyber768 {
+		return nil, errors.New("pq: the client offered no post-quantum key exchange, start it with --pq")
+	}
+	pk, err := p.scheme.UnmarshalBinaryPublicKey(offer[1:])
+	if err != nil {
+		return nil, errors.Wrap(err, "pq")
+	}
+	ct, ss, err := p.scheme.Encapsulate(pk)
+	if err != nil {
+		return nil, errors.Wrap(err, "pq")
+	}
+	p.ss = ss
+	return append([]byte{pqKyber768}, ct...), nil
+}
+
+// finish reads the responder's answer to the offer
+func (p *pqExchange) finish(answer []byte) error {
+	if p == nil {
+		return nil
+	}
+	if len(answer) == 0 {
+		return errors.New("pq: the server declined the post-quantum key exchange, start it with --pq")
+	}
+	if answer[0] != pqKyber768 || len(answer)-1 != p.scheme.CiphertextSize() {
+		return errors.New("pq: bad answer")
+	}
+	ss, err := p.scheme.Decapsulate(p.sk, answer[1:])
+	if err != nil {
+		return errors.Wrap(err, "pq")
+	}
+	p.ss = ss
+	return nil
+}
+
+// secret returns the shared secret, nil if none was agreed
+func (p *pqExchange) secret() []byte {
+	if p == nil {
+		return nil
+	}
+	return p.ss
+}
@@ -0,0 +1,67 @@
+// Package generic contains the pieces shared by kcptun client and server.
+package generic
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// Probe packets are plaintext UDP datagrams sent by 'client ping' and echoed
+// back verbatim by a server running with --echoprobe. They never reach the
+// KCP layer, so they tell a blocked port apart from a key mismatch.
+//
+// layout: | magic(16B) | seq(4B) | send time in unix nanoseconds(8B) |
+const (
+	probeSize = 28
+)
+
+var probeMagic = []byte("\x00kcptun-probe-v1")
+
+// NewProbe builds a probe packet for sequence number seq stamped with now
+func NewProbe(seq uint32, now time.Time) []byte {
+	p := make([]byte, probeSize)
+	copy(p, probeMagic)
+	binary.LittleEndian.PutUint32(p[16:], seq)
+	binary.LittleEndian.PutUint64(p[20:], uint64(now.UnixNano()))
+	return p
+}
+
+// IsProbe reports whether p is a probe packet
+func IsProbe(p []byte) bool {
+	return len(p) == probeSize && bytes.Equal(p[:16], probeMagic)
+}
+
+// ParseProbe extracts the sequence number and send time of a probe packet
+func ParseProbe(p []byte) (seq uint32, sent time.Time, ok bool) {
+	if !IsProbe(p) {
+		return 0, time.Time{}, false
+	}
+	seq = binary.LittleEndian.Uint32(p[16:])
+	sent = time.Unix(0, int64(binary.LittleEndian.Uint64(p[20:])))
+	return seq, sent, true
+}
+
+// EchoConn answers probe packets in place and passes everything else
+// through to the wrapped PacketConn's reader
+type EchoConn struct {
+	net.PacketConn
+}
+
+// NewEchoConn wraps conn with probe answering
+func NewEchoConn(conn net.PacketConn) *EchoConn {
+	return &EchoConn{conn}
+}
+
+// ReadFrom implements net.PacketConn
+func (c *EchoConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, addr, err = c.PacketConn.ReadFrom(p)
+		if err != nil || !IsProbe(p[:n]) {
+			return
+		}
+		// replies are the same size as requests, no amplification
+		c.PacketConn.WriteTo(p[:n], addr)
+	}
+}
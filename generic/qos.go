@@ -0,0 +1,86 @@
+package generic
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Streams are either interactive, like SSH, or bulk, like downloads.
+// Interactive streams ride a KCP session of their own, so they don't queue
+// behind bulk data in its windows, and while they're active the bulk
+// streams sharing the link hold back their writes for them.
+const (
+	// interactive traffic within this long makes bulk writes wait
+	qosHold = 20 * time.Millisecond
+	// the longest a bulk write waits, so bulk streams never starve
+	qosMaxWait = 50 * time.Millisecond
+)
+
+// QoS schedules the bulk streams of a process behind its interactive ones
+type QoS struct {
+	mu   sync.Mutex
+	last time.Time // last interactive write
+}
+
+// NewQoS creates a QoS without interactive traffic yet
+func NewQoS() *QoS {
+	return new(QoS)
+}
+
+// Wrap returns stream with its writes scheduled as interactive or bulk, a
+// nil QoS returns stream as is
+func (q *QoS) Wrap(stream io.ReadWriteCloser, interactive bool) io.ReadWriteCloser {
+	if q == nil {
+		return stream
+	}
+	return &qosStream{stream, q, interactive}
+}
+
+func (q *QoS) mark() {
+	q.mu.Lock()
+	q.last = time.Now()
+	q.mu.Unlock()
+}
+
+// wait blocks until interactive traffic paused for qosHold, or qosMaxWait
+// passed
+func (q *QoS) wait() {
+	deadline := time.Now().Add(qosMaxWait)
+	for {
+		q.mu.Lock()
+		idle := time.Since(q.last)
+		q.mu.Unlock()
+		if idle >= qosHold {
+			return
+		}
+		now := time.Now()
+		if !now.Before(deadline) {
+			return
+		}
+		sleep := qosHold - idle
+		if now.Add(sleep).After(deadline) {
+			sleep = deadline.Sub(now)
+		}
+		time.Sleep(sleep)
+	}
+}
+
+type qosStream struct {
+	io.ReadWriteCloser
+	qos         *QoS
+	interactive bool
+}
+
+func (s *qosStream) Write(p []byte) (n int, err error) {
+	if s.interactive {
+		s.qos.mark()
+	} else {
+		s.qos.wait()
+	}
+	return s.ReadWriteCloser.Write(p)
+}
+
+func (s *qosStream) CloseWrite() error {
+	return CloseWrite(s.ReadWriteCloser)
+}
@@ -0,0 +1,118 @@
+package generic
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"time"
+
+	quic "github.com/lucas-clemente/quic-go"
+	"github.com/pkg/errors"
+)
+
+// QUIC replaces KCP and smux with QUIC sessions and streams, for comparing
+// the two on a path. Certificates are ephemeral and bound to the pre-shared
+// key: the server's certificate carries an HMAC of its public key, and the
+// client opens every stream with an auth token.
+const (
+	quicALPN = "kcptun"
+
+	// QUICAuthSize is the size of the token opening every client stream
+	QUICAuthSize = 16
+)
+
+func quicTag(pass, data []byte) string {
+	mac := hmac.New(sha256.New, pass)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// QUICAuthToken derives the stream auth token from the pre-shared key
+func QUICAuthToken(pass []byte) []byte {
+	mac := hmac.New(sha256.New, pass)
+	mac.Write([]byte("kcptun-quic-client"))
+	return mac.Sum(nil)[:QUICAuthSize]
+}
+
+// NewQUICConfig returns the QUIC parameters matching kcptun's sockbuf and
+// keepalive settings
+func NewQUICConfig(sockbuf, keepalive int) *quic.Config {
+	return &quic.Config{
+		HandshakeTimeout:                      10 * time.Second,
+		IdleTimeout:                           time.Duration(keepalive*3) * time.Second,
+		MaxReceiveStreamFlowControlWindow:     uint64(sockbuf),
+		MaxReceiveConnectionFlowControlWindow: uint64(sockbuf) * 4,
+		KeepAlive:                             true,
+	}
+}
+
+// NewQUICServerTLS generates an ephemeral certificate tagged with pass
+func NewQUICServerTLS(pass []byte) (*tls.Config, error) {
+	cert, err := taggedCertificate(pass)
+	if err != nil {
+		return nil, errors.Wrap(err, "NewQUICServerTLS")
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{quicALPN},
+	}, nil
+}
+
+// taggedCertificate generates a self-signed certificate whose common name
+// is an HMAC of its public key under pass
+func taggedCertificate(pass []byte) (tls.Certificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: quicTag(pass, pub)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}, nil
+}
+
+// NewQUICClientTLS accepts only server certificates tagged with pass
+func NewQUICClientTLS(pass []byte) *tls.Config {
+	return &tls.Config{
+		// the certificate is self-signed, VerifyPeerCertificate checks the tag
+		InsecureSkipVerify:    true,
+		NextProtos:            []string{quicALPN},
+		VerifyPeerCertificate: verifyTag(pass, "quic"),
+	}
+}
+
+// verifyTag accepts only a certificate made by taggedCertificate with pass,
+// errors starting with prefix
+func verifyTag(pass []byte, prefix string) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New(prefix + ": no server certificate")
+		}
+		cert, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return errors.Wrap(err, prefix)
+		}
+		if !hmac.Equal([]byte(cert.Subject.CommonName), []byte(quicTag(pass, cert.RawSubjectPublicKeyInfo))) {
+			return authFailed("%v: server certificate doesn't match the key", prefix)
+		}
+		return nil
+	}
+}
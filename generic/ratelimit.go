@@ -0,0 +1,82 @@
+package generic
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket of bytes. A nil RateLimiter, or one with a
+// rate of 0, doesn't limit.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter limits to rate bytes per second
+func NewRateLimiter(rate int) *RateLimiter {
+	l := new(RateLimiter)
+	l.SetRate(rate)
+	return l
+}
+
+// SetRate changes the rate to rate bytes per second, 0 for unlimited
+func (l *RateLimiter) SetRate(rate int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = float64(rate)
+	// a burst of 100ms
+	l.tokens = l.rate / 10
+	l.last = time.Now()
+}
+
+// Wait blocks until n bytes may pass. Bytes beyond the tokens at hand are
+// borrowed and paid back before the next ones pass.
+func (l *RateLimiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	if l.rate == 0 {
+		l.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if burst := l.rate / 10; l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(wait)
+}
+
+// rateLimitedConn paces the bytes read from and written to a conn
+type rateLimitedConn struct {
+	net.Conn
+	in, out *RateLimiter
+}
+
+// NewRateLimitedConn paces the bytes read from conn with in, and the bytes
+// written with out
+func NewRateLimitedConn(conn net.Conn, in, out *RateLimiter) net.Conn {
+	return &rateLimitedConn{conn, in, out}
+}
+
+func (c *rateLimitedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.in.Wait(n)
+	return n, err
+}
+
+func (c *rateLimitedConn) Write(p []byte) (int, error) {
+	c.out.Wait(len(p))
+	return c.Conn.Write(p)
+}
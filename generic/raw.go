@@ -0,0 +1,39 @@
+package generic
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// listenRaw opens a raw IP socket, explaining the privileges it needs
+func listenRaw(network string, ip net.IP) (*net.IPConn, error) {
+	conn, err := net.ListenIP(network, &net.IPAddr{IP: ip})
+	if err != nil {
+		if opErr, ok := err.(*net.OpError); ok && os.IsPermission(opErr.Err) {
+			return nil, errors.Errorf("%v needs raw sockets: run as root or grant CAP_NET_RAW, e.g. setcap cap_net_raw+ep <binary>", network)
+		}
+		return nil, errors.Wrap(err, network)
+	}
+	return conn, nil
+}
+
+// checksum computes the internet checksum over the concatenated parts,
+// every part but the last must have an even length
+func checksum(parts ...[]byte) uint16 {
+	var sum uint32
+	for _, b := range parts {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i:]))
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,92 @@
+package generic
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// readAheadConn reads the packets of a socket in a goroutine of its own,
+// up to depth ahead of the reader, so that the syscall of the next packet
+// runs while KCP processes the last one. It's used on windows, see
+// ReadAhead; elsewhere kcp-go reads batches of the socket itself.
+type readAheadConn struct {
+	net.PacketConn
+	packets chan readAheadPacket
+	free    chan []byte
+
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+type readAheadPacket struct {
+	buf  []byte
+	n    int
+	addr net.Addr
+	err  error
+}
+
+// readAheadSize holds the largest packet of an --mtu of 1500 with the
+// headers of the layers below KCP
+const readAheadSize = 4096
+
+func newReadAheadConn(conn net.PacketConn, depth int) *readAheadConn {
+	c := &readAheadConn{
+		PacketConn: conn,
+		packets:    make(chan readAheadPacket, depth),
+		free:       make(chan []byte, depth),
+		die:        make(chan struct{}),
+	}
+	for i := 0; i < depth; i++ {
+		c.free <- make([]byte, readAheadSize)
+	}
+	go c.read()
+	return c
+}
+
+// read reads packets into the free buffers until the first error, which
+// every read returns from then on
+func (c *readAheadConn) read() {
+	for {
+		var buf []byte
+		select {
+		case buf = <-c.free:
+		case <-c.die:
+			return
+		}
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		select {
+		case c.packets <- readAheadPacket{buf, n, addr, err}:
+		case <-c.die:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ReadFrom implements net.PacketConn
+func (c *readAheadConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case pkt := <-c.packets:
+		if pkt.err != nil {
+			// sticky for the next reads
+			c.packets <- pkt
+			return 0, nil, pkt.err
+		}
+		n := copy(p, pkt.buf[:pkt.n])
+		c.free <- pkt.buf
+		return n, pkt.addr, nil
+	case <-c.die:
+		return 0, nil, io.ErrClosedPipe
+	}
+}
+
+// Close implements net.PacketConn
+func (c *readAheadConn) Close() error {
+	c.dieOnce.Do(func() {
+		close(c.die)
+	})
+	return c.PacketConn.Close()
+}
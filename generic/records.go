@@ -0,0 +1,121 @@
+package generic
+
+import (
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// With --records, the writes of a session are coalesced for a moment and
+// cut again into records of random sizes, each sent in packets of its own,
+// so that the sizes of the application's writes, like its TLS records,
+// don't show in the sizes of the tunnel's packets. Only the sender cuts,
+// the peer reads a byte stream as before. Padding hides the sizes of
+// single packets, records the pattern of a burst.
+const recordCoalesce = 2 * time.Millisecond
+
+// ParseRecords parses a --records range like 64-1200, 0 to 0 for none
+func ParseRecords(s string) (min, max int, err error) {
+	if s == "" || s == "none" {
+		return 0, 0, nil
+	}
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) == 2 {
+		min, err = strconv.Atoi(parts[0])
+		if err == nil {
+			max, err = strconv.Atoi(parts[1])
+		}
+	}
+	if len(parts) != 2 || err != nil || min < 1 || max < min {
+		return 0, 0, errors.Errorf("records: %q is not a range of sizes like 64-1200", s)
+	}
+	return min, max, nil
+}
+
+// RecordConn cuts the writes to a session into records of random sizes
+type RecordConn struct {
+	net.Conn
+	min, max int
+	rng      *rand.Rand
+
+	mu     sync.Mutex
+	buf    []byte
+	timer  *time.Timer
+	err    error
+	closed bool
+}
+
+// NewRecordConn cuts the writes to conn into records of min to max bytes,
+// the last of a burst may be shorter
+func NewRecordConn(conn net.Conn, min, max int) *RecordConn {
+	return &RecordConn{
+		Conn: conn,
+		min:  min,
+		max:  max,
+		rng:  NewRand(),
+	}
+}
+
+// Write implements net.Conn, p goes out within recordCoalesce
+func (c *RecordConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.buf = append(c.buf, p...)
+	// full records go at once, the rest waits for more
+	for len(c.buf) >= c.max && c.err == nil {
+		c.emit(c.size())
+	}
+	if len(c.buf) > 0 && c.timer == nil && c.err == nil {
+		c.timer = time.AfterFunc(recordCoalesce, c.flush)
+	}
+	return len(p), c.err
+}
+
+// size returns the size of the next record
+func (c *RecordConn) size() int {
+	return c.min + c.rng.Intn(c.max-c.min+1)
+}
+
+// emit writes the first n bytes buffered as a record, with c.mu held
+func (c *RecordConn) emit(n int) {
+	if n > len(c.buf) {
+		n = len(c.buf)
+	}
+	if _, err := c.Conn.Write(c.buf[:n]); err != nil {
+		c.err = err
+		return
+	}
+	c.buf = c.buf[:copy(c.buf, c.buf[n:])]
+}
+
+// flush writes out what's buffered once the writes paused
+func (c *RecordConn) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.timer = nil
+	for len(c.buf) > 0 && c.err == nil && !c.closed {
+		c.emit(c.size())
+	}
+}
+
+// Close implements net.Conn, writing out what's buffered first
+func (c *RecordConn) Close() error {
+	c.mu.Lock()
+	for len(c.buf) > 0 && c.err == nil && !c.closed {
+		c.emit(c.size())
+	}
+	c.closed = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
@@ -0,0 +1,34 @@
+package generic
+
+import "testing"
+
+func TestParseRecords(t *testing.T) {
+	tests := []struct {
+		in       string
+		min, max int
+		err      bool
+	}{
+		{"", 0, 0, false},
+		{"none", 0, 0, false},
+		{"64-1200", 64, 1200, false},
+		{"1-1", 1, 1, false},
+		{"1200-64", 0, 0, true},
+		{"0-1200", 0, 0, true},
+		{"-1-1200", 0, 0, true},
+		{"64", 0, 0, true},
+		{"64-", 0, 0, true},
+		{"64-x", 0, 0, true},
+		{" 64-1200", 0, 0, true},
+		{"64-1200-2000", 0, 0, true},
+	}
+	for _, test := range tests {
+		min, max, err := ParseRecords(test.in)
+		if (err != nil) != test.err {
+			t.Errorf("ParseRecords(%q): error %v, want error %v", test.in, err, test.err)
+			continue
+		}
+		if min != test.min || max != test.max {
+			t.Errorf("ParseRecords(%q) = %v-%v, want %v-%v", test.in, min, max, test.min, test.max)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package generic
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Rendezvous links two ends behind NAT. A server behind NAT registers under
+// a peer id with an introducer, a server with a public address, from the
+// socket it serves on, so the introducer learns its public address and the
+// NAT keeps the mapping open. A client looks the peer id up at the
+// introducer from the socket of its session; the introducer tells it the
+// peer's public address and tells the peer the client's. Both ends then
+// punch packets at each other until the NATs let the KCP session through.
+// The messages run below the obfuscation, signed with the key:
+//
+// | magic(4B) | type(1B) | body | tag(8B) |
+const (
+	rendezvousMagic   = "\x00krv"
+	rendezvousTagSize = 8
+	rendezvousMinSize = len(rendezvousMagic) + 1 + rendezvousTagSize
+
+	rvRegister  = 1 // peer → introducer, body: peer id
+	rvLookup    = 2 // client → introducer, body: peer id
+	rvPeer      = 3 // introducer → client, body: peer's address, empty if unknown
+	rvIntroduce = 4 // introducer → peer, body: client's address
+	rvPunch     = 5 // between the ends
+
+	// RendezvousRegisterInterval keeps a peer registered and its NAT
+	// mapping open
+	RendezvousRegisterInterval = 15 * time.Second
+
+	// registrations expire after missing a few renewals
+	rendezvousExpiry = 4 * RendezvousRegisterInterval
+	// punches to send to the other end, and the time between them
+	rendezvousPunches    = 5
+	rendezvousPunchDelay = 200 * time.Millisecond
+	// lookup retransmission while waiting for the introducer
+	rendezvousRetry = 500 * time.Millisecond
+)
+
+var rendezvousLabel = []byte("kcptun-rendezvous")
+
+type rendezvousPeer struct {
+	addr net.Addr
+	seen time.Time
+}
+
+// RendezvousConn answers rendezvous messages on a server's socket, as the
+// introducer and as a registered peer, and drops them on either end of a
+// session
+type RendezvousConn struct {
+	net.PacketConn
+	key        []byte
+	introducer bool
+
+	mu     sync.Mutex
+	peers  map[string]rendezvousPeer // registered peer id → address
+	server net.Addr                  // introducer registered with
+}
+
+// NewRendezvousConn wraps conn, acting as an introducer to registered peers
+// if introducer is set
+func NewRendezvousConn(conn net.PacketConn, key string, introducer bool) *RendezvousConn {
+	c := new(RendezvousConn)
+	c.PacketConn = conn
+	c.key = []byte(key)
+	c.introducer = introducer
+	c.peers = make(map[string]rendezvousPeer)
+	return c
+}
+
+func rendezvousTag(key []byte, msg []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(rendezvousLabel)
+	mac.Write(msg)
+	return mac.Sum(nil)[:rendezvousTagSize]
+}
+
+func newRendezvousMessage(key []byte, typ byte, body []byte) []byte {
+	msg := make([]byte, 0, rendezvousMinSize+len(body))
+	msg = append(msg, rendezvousMagic...)
+	msg = append(msg, typ)
+	msg = append(msg, body...)
+	return append(msg, rendezvousTag(key, msg)...)
+}
+
+// parseRendezvousMessage returns the type and body of a rendezvous message,
+// ok is false for anything else
+func parseRendezvousMessage(key []byte, p []byte) (typ byte, body []byte, ok bool) {
+	if len(p) < rendezvousMinSize || string(p[:len(rendezvousMagic)]) != rendezvousMagic {
+		return 0, nil, false
+	}
+	msg, tag := p[:len(p)-rendezvousTagSize], p[len(p)-rendezvousTagSize:]
+	if !hmac.Equal(tag, rendezvousTag(key, msg)) {
+		return 0, nil, false
+	}
+	return msg[len(rendezvousMagic)], msg[len(rendezvousMagic)+1:], true
+}
+
+// sameUDPAddr compares addresses, an IPv4 one and its IPv6 mapped form
+// being the same
+func sameUDPAddr(a, b net.Addr) bool {
+	ua, ok1 := a.(*net.UDPAddr)
+	ub, ok2 := b.(*net.UDPAddr)
+	if !ok1 || !ok2 {
+		return a.String() == b.String()
+	}
+	return ua.IP.Equal(ub.IP) && ua.Port == ub.Port
+}
+
+func (c *RendezvousConn) send(typ byte, body []byte, addr net.Addr) {
+	c.PacketConn.WriteTo(newRendezvousMessage(c.key, typ, body), addr)
+}
+
+// punch sends punches to addr, opening the NAT mapping towards it
+func (c *RendezvousConn) punch(addr net.Addr) {
+	for i := 0; i < rendezvousPunches; i++ {
+		c.send(rvPunch, nil, addr)
+		time.Sleep(rendezvousPunchDelay)
+	}
+}
+
+// ReadFrom implements net.PacketConn
+func (c *RendezvousConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	for {
+		n, addr, err = c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return
+		}
+		typ, body, ok := parseRendezvousMessage(c.key, p[:n])
+		if !ok {
+			return
+		}
+		switch typ {
+		case rvRegister:
+			if c.introducer && len(body) > 0 {
+				c.mu.Lock()
+				if _, ok := c.peers[string(body)]; !ok {
+					log.Printf("rendezvous: peer %q registered from %v", body, addr)
+				}
+				c.peers[string(body)] = rendezvousPeer{addr, time.Now()}
+				c.mu.Unlock()
+			}
+		case rvLookup:
+			if c.introducer {
+				c.introduce(string(body), addr)
+			}
+		case rvIntroduce:
+			c.mu.Lock()
+			fromIntroducer := c.server != nil && sameUDPAddr(c.server, addr)
+			c.mu.Unlock()
+			if fromIntroducer {
+				if client, err := net.ResolveUDPAddr("udp", string(body)); err == nil {
+					go c.punch(client)
+				}
+			}
+		}
+	}
+}
+
+// introduce tells client and the peer registered as id each other's
+// addresses
+func (c *RendezvousConn) introduce(id string, client net.Addr) {
+	c.mu.Lock()
+	peer, ok := c.peers[id]
+	if ok && time.Since(peer.seen) > rendezvousExpiry {
+		delete(c.peers, id)
+		ok = false
+	}
+	c.mu.Unlock()
+	if !ok {
+		c.send(rvPeer, nil, client)
+		return
+	}
+	log.Printf("rendezvous: introducing %v to peer %q at %v", client, id, peer.addr)
+	c.send(rvIntroduce, []byte(client.String()), peer.addr)
+	c.send(rvPeer, []byte(peer.addr.String()), client)
+}
+
+// Register keeps registering as id with the introducer at addr until conn
+// is closed
+func (c *RendezvousConn) Register(addr, id string) error {
+	server, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.server = server
+	c.mu.Unlock()
+	for {
+		if _, err := c.PacketConn.WriteTo(newRendezvousMessage(c.key, rvRegister, []byte(id)), server); err != nil {
+			return err
+		}
+		time.Sleep(RendezvousRegisterInterval)
+	}
+}
+
+// Rendezvous looks up the peer registered as id at introducer from conn,
+// and punches towards it. It returns the peer's address to run the session
+// to. conn must be wrapped with a RendezvousConn afterwards, to drop the
+// punches still to come.
+func Rendezvous(conn net.PacketConn, key string, introducer net.Addr, id string, timeout time.Duration) (net.Addr, error) {
+	lookup := newRendezvousMessage([]byte(key), rvLookup, []byte(id))
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for time.Now().Before(deadline) {
+		if _, err := conn.WriteTo(lookup, introducer); err != nil {
+			return nil, errors.Wrap(err, "rendezvous")
+		}
+		conn.SetReadDeadline(time.Now().Add(rendezvousRetry))
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			typ, body, ok := parseRendezvousMessage([]byte(key), buf[:n])
+			if !ok || typ != rvPeer || !sameUDPAddr(from, introducer) {
+				continue
+			}
+			conn.SetReadDeadline(time.Time{})
+			if len(body) == 0 {
+				return nil, errors.Errorf("rendezvous: peer %q not registered", id)
+			}
+			peer, err := net.ResolveUDPAddr("udp", string(body))
+			if err != nil {
+				return nil, errors.Wrap(err, "rendezvous")
+			}
+			rc := NewRendezvousConn(conn, key, false)
+			go rc.punch(peer)
+			return peer, nil
+		}
+	}
+	conn.SetReadDeadline(time.Time{})
+	return nil, errors.Errorf("rendezvous: no answer from introducer %v", introducer)
+}
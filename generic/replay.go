@@ -0,0 +1,132 @@
+package generic
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A captured hello can be replayed to open sessions long after the client
+// sent it. Clients stamp their hello with the time and a random nonce,
+// authenticated with the pre-shared key, and a server with a ReplayGuard
+// refuses hellos stamped outside its clock skew window, or seen before
+// within it. The server's answer to a stamped hello is authenticated in
+// turn, so both ends tell a key mismatch apart from other failures.
+const helloNonceSize = 16
+
+// helloMAC authenticates the stamp and the parameters of h under key
+func helloMAC(h *Hello, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("kcptun hello"))
+	var t [8]byte
+	binary.BigEndian.PutUint64(t[:], uint64(h.Time))
+	mac.Write(t[:])
+	mac.Write(h.Nonce)
+	mac.Write(h.digest())
+	return mac.Sum(nil)
+}
+
+// replyMAC authenticates the answer reply to the stamped hello request
+// under key, refusal included
+func replyMAC(request, reply *Hello, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("kcptun hello reply"))
+	mac.Write(request.MAC)
+	mac.Write(reply.digest())
+	mac.Write([]byte(reply.Error))
+	return mac.Sum(nil)
+}
+
+// VerifyReply checks the server's answer reply to the stamped hello
+// request, under key. Servers predating the stamp don't authenticate their
+// answer, it passes.
+func VerifyReply(request, reply *Hello, key []byte) error {
+	if reply.MAC == nil || request.MAC == nil {
+		return nil
+	}
+	if !hmac.Equal(reply.MAC, replyMAC(request, reply, key)) {
+		return authFailed("hello: the server's answer doesn't verify, check -key")
+	}
+	return nil
+}
+
+// StampHello sets the time, a fresh nonce and their MAC under key on h
+func StampHello(h *Hello, key []byte) {
+	h.Time = time.Now().Unix()
+	h.Nonce = make([]byte, helloNonceSize)
+	rand.Read(h.Nonce)
+	h.MAC = helloMAC(h, key)
+}
+
+// ReplayGuard checks the stamps of hellos and authenticates the answers.
+// With a skew of 0, it accepts hellos without a stamp and doesn't check
+// the time. A nil ReplayGuard accepts any hello.
+type ReplayGuard struct {
+	key  []byte
+	skew time.Duration
+
+	mu   sync.Mutex
+	seen map[string]time.Time // nonce to when it leaves the window
+}
+
+// NewReplayGuard accepts hellos stamped under key at most skew away from
+// the local clock, any time if skew is 0
+func NewReplayGuard(key []byte, skew time.Duration) *ReplayGuard {
+	return &ReplayGuard{key: key, skew: skew, seen: make(map[string]time.Time)}
+}
+
+// Check returns why h is stale or replayed, if it is
+func (g *ReplayGuard) Check(h *Hello) error {
+	if g == nil {
+		return nil
+	}
+	if h.MAC == nil {
+		if g.skew == 0 {
+			return nil
+		}
+		return errors.New("hello not stamped, the client may predate replay protection")
+	}
+	if len(h.Nonce) != helloNonceSize || !hmac.Equal(h.MAC, helloMAC(h, g.key)) {
+		return authFailed("the client's stamp doesn't verify, check -key")
+	}
+	if g.skew == 0 {
+		return nil
+	}
+	now := time.Now()
+	stamped := time.Unix(h.Time, 0)
+	if skew := now.Sub(stamped); skew > g.skew || skew < -g.skew {
+		return errors.Errorf("hello stamped %v away, beyond the clock skew allowed of %v, check the clocks", skew, g.skew)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for nonce, expiry := range g.seen {
+		if now.After(expiry) {
+			delete(g.seen, nonce)
+		}
+	}
+	if _, ok := g.seen[string(h.Nonce)]; ok {
+		return errors.New("hello replayed")
+	}
+	// past this, the stamp itself is out of the window
+	g.seen[string(h.Nonce)] = stamped.Add(g.skew)
+	return nil
+}
+
+// strict reports whether g refuses clients without a stamp
+func (g *ReplayGuard) strict() bool {
+	return g != nil && g.skew > 0
+}
+
+// sign authenticates reply, the answer to request, if request is stamped
+func (g *ReplayGuard) sign(request, reply *Hello) {
+	if g == nil || request.MAC == nil {
+		return
+	}
+	reply.MAC = replyMAC(request, reply, g.key)
+}
@@ -0,0 +1,376 @@
+package generic
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	resolveTimeout = 10 * time.Second
+
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsTypeSRV  = 33
+	dnsClassIN  = 1
+)
+
+// LookupIP resolves host to its IPv4 and IPv6 addresses using resolver,
+// which is either empty for the system resolver, a DNS server as ip:port,
+// or a DNS-over-HTTPS URL like https://1.1.1.1/dns-query
+func LookupIP(resolver, host string) ([]net.IP, error) {
+	ips, _, err := LookupIPTTL(resolver, host)
+	return ips, err
+}
+
+// LookupIPTTL is LookupIP returning the time the addresses may be cached
+// for as well, the lowest TTL of their records, 0 when the system resolver
+// doesn't tell
+func LookupIPTTL(resolver, host string) ([]net.IP, time.Duration, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, 0, nil
+	}
+	switch {
+	case resolver == "":
+		ips, err := net.LookupIP(host)
+		return ips, 0, err
+	case strings.HasPrefix(resolver, "https://"):
+		return lookupDoH(resolver, host)
+	default:
+		ips, ttl, err := lookupUDP(resolver, host)
+		if err == errTruncated {
+			// the resolver of the standard library retries over TCP
+			ips, err = lookupDNS(resolver, host)
+		}
+		return ips, ttl, err
+	}
+}
+
+// LookupSRV returns the servers of the SRV records of _kcptun._udp.name
+// using resolver as LookupIP does, ordered by priority and, within the same
+// priority, shuffled by weight as RFC 2782 asks
+func LookupSRV(resolver, name string) ([]*net.SRV, error) {
+	switch {
+	case resolver == "":
+		_, srvs, err := net.LookupSRV("kcptun", "udp", name)
+		return srvs, err
+	case strings.HasPrefix(resolver, "https://"):
+		return lookupDoHSRV(resolver, "_kcptun._udp."+name)
+	default:
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		defer cancel()
+		_, srvs, err := dnsResolver(resolver).LookupSRV(ctx, "kcptun", "udp", name)
+		return srvs, err
+	}
+}
+
+// dnsResolver returns a resolver querying server
+func dnsResolver(server string) *net.Resolver {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// errTruncated is the error of answers too large for UDP
+var errTruncated = errors.New("dns: truncated")
+
+// lookupUDP queries the A and AAAA records of host from server over UDP
+func lookupUDP(server, host string) ([]net.IP, time.Duration, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	conn, err := net.Dial("udp", server)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(resolveTimeout))
+
+	var ips []net.IP
+	ttl := time.Duration(-1)
+	buf := make([]byte, 512)
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		query, err := dnsQuery(host, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		rand.Read(query[:2])
+		if _, err := conn.Write(query); err != nil {
+			return nil, 0, err
+		}
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, 0, err
+			}
+			if n < 12 || buf[0] != query[0] || buf[1] != query[1] {
+				continue // a late answer to a previous query
+			}
+			if buf[2]&0x02 != 0 {
+				return nil, 0, errTruncated
+			}
+			answers, answerTTL, err := dnsAnswers(buf[:n], qtype)
+			if err != nil {
+				return nil, 0, err
+			}
+			if len(answers) > 0 && (ttl < 0 || answerTTL < ttl) {
+				ttl = answerTTL
+			}
+			ips = append(ips, answers...)
+			break
+		}
+	}
+	if len(ips) == 0 {
+		return nil, 0, errors.Errorf("dns: no address for %v", host)
+	}
+	return ips, ttl, nil
+}
+
+func lookupDNS(server, host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	addrs, err := dnsResolver(server).LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for k := range addrs {
+		ips[k] = addrs[k].IP
+	}
+	return ips, nil
+}
+
+// lookupDoH queries A and AAAA records in the RFC 8484 wire format
+func lookupDoH(url, host string) ([]net.IP, time.Duration, error) {
+	client := &http.Client{Timeout: resolveTimeout}
+	var ips []net.IP
+	ttl := time.Duration(-1)
+	var lastErr error
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		body, err := dohExchange(client, url, host, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		answers, answerTTL, err := dnsAnswers(body, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(answers) > 0 && (ttl < 0 || answerTTL < ttl) {
+			ttl = answerTTL
+		}
+		ips = append(ips, answers...)
+	}
+	if len(ips) == 0 {
+		if lastErr == nil {
+			lastErr = errors.Errorf("doh: no address for %v", host)
+		}
+		return nil, 0, lastErr
+	}
+	return ips, ttl, nil
+}
+
+// lookupDoHSRV queries the SRV records of name in the RFC 8484 wire format
+func lookupDoHSRV(url, name string) ([]*net.SRV, error) {
+	client := &http.Client{Timeout: resolveTimeout}
+	body, err := dohExchange(client, url, name, dnsTypeSRV)
+	if err != nil {
+		return nil, err
+	}
+	records, err := dnsRecords(body, dnsTypeSRV, false)
+	if err != nil {
+		return nil, err
+	}
+	var srvs []*net.SRV
+	for _, rdata := range records {
+		if rdata.len < 7 {
+			continue
+		}
+		target, _, err := dnsParseName(body, rdata.off+6)
+		if err != nil {
+			return nil, err
+		}
+		srvs = append(srvs, &net.SRV{
+			Priority: binary.BigEndian.Uint16(body[rdata.off:]),
+			Weight:   binary.BigEndian.Uint16(body[rdata.off+2:]),
+			Port:     binary.BigEndian.Uint16(body[rdata.off+4:]),
+			Target:   strings.Join(target, ".") + ".",
+		})
+	}
+	if len(srvs) == 0 {
+		return nil, errors.Errorf("doh: no SRV record for %v", name)
+	}
+	sortSRV(srvs)
+	return srvs, nil
+}
+
+// sortSRV orders srvs by priority, and shuffles those of the same priority
+// by weight
+func sortSRV(srvs []*net.SRV) {
+	sort.Slice(srvs, func(i, j int) bool { return srvs[i].Priority < srvs[j].Priority })
+	rng := NewRand()
+	for i := 0; i < len(srvs); {
+		j := i + 1
+		for j < len(srvs) && srvs[j].Priority == srvs[i].Priority {
+			j++
+		}
+		// pick each next one with a chance proportional to its weight
+		for k := i; k < j; k++ {
+			sum := 0
+			for _, srv := range srvs[k:j] {
+				sum += int(srv.Weight) + 1
+			}
+			n := rng.Intn(sum)
+			for l := k; l < j; l++ {
+				if n -= int(srvs[l].Weight) + 1; n < 0 {
+					srvs[k], srvs[l] = srvs[l], srvs[k]
+					break
+				}
+			}
+		}
+		i = j
+	}
+}
+
+// dohExchange posts a query for host of type qtype to url and returns the
+// response
+func dohExchange(client *http.Client, url, host string, qtype uint16) ([]byte, error) {
+	query, err := dnsQuery(host, qtype)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Post(url, "application/dns-message", bytes.NewReader(query))
+	if err != nil {
+		return nil, errors.Wrap(err, "doh")
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "doh")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("doh: %v", resp.Status)
+	}
+	return body, nil
+}
+
+// dnsQuery builds a recursive query for host, with id 0 as RFC 8484 asks
+func dnsQuery(host string, qtype uint16) ([]byte, error) {
+	msg := []byte{0, 0, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, errors.Errorf("dns: invalid name %q", host)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+	return msg, nil
+}
+
+// dnsSkipName returns the offset following the name at off
+func dnsSkipName(msg []byte, off int) (int, error) {
+	for off < len(msg) {
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1, nil
+		case n&0xc0 == 0xc0:
+			return off + 2, nil
+		default:
+			off += n + 1
+		}
+	}
+	return 0, errors.New("dns: truncated name")
+}
+
+// dnsRecord locates the data of a resource record in a response
+type dnsRecord struct {
+	off, len int
+	ttl      time.Duration
+}
+
+// dnsAnswers extracts the addresses of type qtype from a response, and the
+// lowest TTL of their records
+func dnsAnswers(msg []byte, qtype uint16) ([]net.IP, time.Duration, error) {
+	records, err := dnsRecords(msg, qtype, false)
+	if err != nil {
+		return nil, 0, err
+	}
+	var ips []net.IP
+	var ttl time.Duration
+	for _, rdata := range records {
+		if rdata.len == net.IPv4len || rdata.len == net.IPv6len {
+			ip := make(net.IP, rdata.len)
+			copy(ip, msg[rdata.off:])
+			ips = append(ips, ip)
+			if len(ips) == 1 || rdata.ttl < ttl {
+				ttl = rdata.ttl
+			}
+		}
+	}
+	return ips, ttl, nil
+}
+
+// dnsRecords locates the data of the answers of type qtype in a response,
+// and of the authority and additional records with additional
+func dnsRecords(msg []byte, qtype uint16, additional bool) ([]dnsRecord, error) {
+	if len(msg) < 12 {
+		return nil, errors.New("dns: short response")
+	}
+	if rcode := msg[3] & 0x0f; rcode != 0 {
+		return nil, errors.Errorf("dns: rcode %v", rcode)
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	if additional {
+		ancount += int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	}
+
+	off := 12
+	var err error
+	for i := 0; i < qdcount; i++ {
+		if off, err = dnsSkipName(msg, off); err != nil {
+			return nil, err
+		}
+		off += 4
+	}
+	var records []dnsRecord
+	for i := 0; i < ancount; i++ {
+		if off, err = dnsSkipName(msg, off); err != nil {
+			return nil, err
+		}
+		if off+10 > len(msg) {
+			return nil, errors.New("dns: truncated answer")
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		ttl := time.Duration(binary.BigEndian.Uint32(msg[off+4:])) * time.Second
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, errors.New("dns: truncated answer")
+		}
+		if rtype == qtype {
+			records = append(records, dnsRecord{off, rdlen, ttl})
+		}
+		off += rdlen
+	}
+	return records, nil
+}
@@ -0,0 +1,279 @@
+package generic
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Resumption tokens save a round trip when a client reconnects. The server
+// hands out a token in every hello answer, sealed with a key only it knows,
+// vouching for the client's parameters. A client holding one starts the
+// next session right after its hello, without waiting for the answer, and
+// reads the answer along with the first data. A server which no longer
+// accepts the token, e.g. after a restart, refuses the session, and the
+// client falls back to a full hello. Tokens open a single session, so the
+// early data of a recorded session can't be replayed with its hello.
+//
+// With --handshake, a token also carries a secret both ends derived from
+// the key exchange of the session it was issued in, and the pin of the key
+// the client proved there. A client resuming skips the key exchange and
+// opens with:
+//
+// | resumeMagic(8B) | length(2B) | token | nonce(16B) |
+//
+// and both ends key the session with its secret and nonce, as Noise
+// transport messages, the client being who it was. A token the server
+// doesn't accept is answered with an empty message, refusing the session.
+// Resumed sessions save the key exchange, but their forward secrecy is
+// that of the session the chain of tokens started with.
+const (
+	tokenNonceSize    = 12
+	resumeNonceSize   = 16
+	resumeSecretSize  = 32
+	resumeMaxTokenLen = 512
+)
+
+// resumeMagic opens a resumed key exchange, neither a TLS record nor the
+// length of a Noise handshake message
+var resumeMagic = []byte("\x00kcptun\x02")
+
+// TokenBinding is what a token carries over from the key exchange of the
+// session it's issued in: the resumption secret and the pin of the client.
+// Token is the one a session resumed with, for its hello to spend.
+type TokenBinding struct {
+	Secret []byte
+	Pin    string
+	Token  []byte
+}
+
+// Bind returns the binding of conn, returned by the key exchange
+func Bind(conn net.Conn) *TokenBinding {
+	b := &TokenBinding{Secret: ResumptionSecret(conn), Pin: PeerPin(conn)}
+	if nconn, ok := conn.(*noiseConn); ok {
+		b.Token = nconn.token
+	}
+	return b
+}
+
+// ResumptionSecret returns the secret the ends of conn derived from its key
+// exchange for resumption, nil for none
+func ResumptionSecret(conn net.Conn) []byte {
+	switch conn := conn.(type) {
+	case *noiseConn:
+		return conn.resume
+	case *tls.Conn:
+		state := conn.ConnectionState()
+		secret, err := state.ExportKeyingMaterial("kcptun resumption", nil, resumeSecretSize)
+		if err == nil {
+			return secret
+		}
+	}
+	return nil
+}
+
+// TokenIssuer seals and opens resumption tokens
+type TokenIssuer struct {
+	aead cipher.AEAD
+	ttl  time.Duration
+
+	mu    sync.Mutex
+	spent map[string]time.Time // nonce of the tokens redeemed to their expiry
+}
+
+// NewTokenIssuer creates an issuer of tokens valid for ttl, under a random
+// key which lives as long as the process
+func NewTokenIssuer(ttl time.Duration) (*TokenIssuer, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &TokenIssuer{aead: aead, ttl: ttl, spent: make(map[string]time.Time)}, nil
+}
+
+// digest identifies the parameters of h a token vouches for
+func (h *Hello) digest() []byte {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%v/%v/%v/%v/%v/%v", h.Version, h.Crypt, h.DataShard, h.ParityShard, h.NoComp, h.PQ)))
+	return sum[:]
+}
+
+// Issue returns a token for a client which sent h, over a session bound
+// by b
+func (t *TokenIssuer) Issue(h *Hello, b *TokenBinding) []byte {
+	plain := make([]byte, 8, 8+sha256.Size+1+len(b.Pin)+len(b.Secret))
+	binary.BigEndian.PutUint64(plain, uint64(time.Now().Add(t.ttl).Unix()))
+	plain = append(plain, h.digest()...)
+	plain = append(plain, byte(len(b.Pin)))
+	plain = append(plain, b.Pin...)
+	plain = append(plain, b.Secret...)
+	nonce := make([]byte, tokenNonceSize)
+	rand.Read(nonce)
+	return t.aead.Seal(nonce, nonce, plain, nil)
+}
+
+// open returns the expiry, the digest of the hello and the binding of
+// token, false unless the server issued it and it hasn't expired
+func (t *TokenIssuer) open(token []byte) (expiry time.Time, digest []byte, b *TokenBinding, ok bool) {
+	if t == nil || len(token) < tokenNonceSize {
+		return
+	}
+	plain, err := t.aead.Open(nil, token[:tokenNonceSize], token[tokenNonceSize:], nil)
+	if err != nil || len(plain) < 8+sha256.Size+1 {
+		return
+	}
+	expiry = time.Unix(int64(binary.BigEndian.Uint64(plain)), 0)
+	digest = plain[8 : 8+sha256.Size]
+	rest := plain[8+sha256.Size:]
+	pin := int(rest[0])
+	if len(rest) < 1+pin {
+		return
+	}
+	b = &TokenBinding{Pin: string(rest[1 : 1+pin]), Secret: rest[1+pin:]}
+	return expiry, digest, b, time.Now().Before(expiry)
+}
+
+// Redeem reports whether token was issued for h over a session with the
+// client of b, hasn't expired and wasn't redeemed before, and spends it
+func (t *TokenIssuer) Redeem(token []byte, h *Hello, b *TokenBinding) bool {
+	expiry, digest, bound, ok := t.open(token)
+	if !ok || string(digest) != string(h.digest()) || bound.Pin != b.Pin {
+		return false
+	}
+
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for nonce, expiry := range t.spent {
+		if now.After(expiry) {
+			delete(t.spent, nonce)
+		}
+	}
+	nonce := string(token[:tokenNonceSize])
+	if _, ok := t.spent[nonce]; ok {
+		return false
+	}
+	t.spent[nonce] = expiry
+	return true
+}
+
+// resumeConn reads the server's hello answer before the first data
+type resumeConn struct {
+	net.Conn
+	local   *Hello
+	key     []byte
+	onReply func(*Hello, error)
+
+	once sync.Once
+	err  error
+}
+
+func (c *resumeConn) Read(p []byte) (n int, err error) {
+	c.once.Do(func() {
+		remote, err := ReadHello(c.Conn)
+		if err == nil {
+			err = VerifyReply(c.local, remote, c.key)
+		}
+		switch {
+		case err != nil:
+		case remote.Error != "":
+			err = refusal(remote.Error)
+		default:
+			err = c.local.Check(remote)
+		}
+		c.err = err
+		c.onReply(remote, err)
+	})
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(p)
+}
+
+// ResumeHello sends local, carrying a token, over conn without waiting for
+// the answer. The returned conn replaces conn, it hands the answer or the
+// failure to onReply on the first read. An answer to a stamped local is
+// verified under key.
+func ResumeHello(conn net.Conn, local *Hello, key []byte, onReply func(*Hello, error)) (net.Conn, error) {
+	if err := WriteHello(conn, local); err != nil {
+		return nil, errors.Wrap(err, "hello")
+	}
+	return &resumeConn{Conn: conn, local: local, key: key, onReply: onReply}, nil
+}
+
+// resumeKeys returns the keys of a session resumed with secret and nonce,
+// the client's sending one first, and the secret of the next resumption
+func resumeKeys(secret, nonce []byte) (k1, k2, next []byte) {
+	k1, k2 = noiseHKDF(secret, nonce)
+	return k1, k2, noiseHMAC(secret, nonce, []byte("kcptun resumption"))
+}
+
+// ResumeClient resumes the key exchange of the session token was issued in
+// over conn, keyed with its secret, without waiting for the server. The
+// returned conn replaces conn, a server refusing the token fails its first
+// read.
+func ResumeClient(conn net.Conn, token, secret []byte) (net.Conn, error) {
+	if len(token) > resumeMaxTokenLen || len(secret) != resumeSecretSize {
+		return nil, errors.New("resume: bad token")
+	}
+	nonce := make([]byte, resumeNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, 0, len(resumeMagic)+2+len(token)+resumeNonceSize)
+	msg = append(msg, resumeMagic...)
+	msg = append(msg, byte(len(token)>>8), byte(len(token)))
+	msg = append(msg, token...)
+	msg = append(msg, nonce...)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, errors.Wrap(err, "resume")
+	}
+	k1, k2, next := resumeKeys(secret, nonce)
+	return &noiseConn{Conn: conn, send: newNoiseCipher(k1), recv: newNoiseCipher(k2), resume: next}, nil
+}
+
+// resume runs the server's end of a resumed key exchange over conn, which
+// starts with resumeMagic, within timeout. The hello of the session must
+// spend the token.
+func (t *TokenIssuer) resume(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	head := make([]byte, len(resumeMagic)+2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return nil, errors.Wrap(err, "resume")
+	}
+	size := int(binary.BigEndian.Uint16(head[len(resumeMagic):]))
+	if size > resumeMaxTokenLen {
+		return nil, errors.New("resume: token too long")
+	}
+	msg := make([]byte, size+resumeNonceSize)
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, errors.Wrap(err, "resume")
+	}
+	token := msg[:size]
+	_, _, b, ok := t.open(token)
+	if !ok || len(b.Secret) != resumeSecretSize {
+		// the client can't open it, and does a full key exchange next
+		writeNoiseMessage(conn, nil)
+		return nil, errors.New("resume: token invalid or expired")
+	}
+	k1, k2, next := resumeKeys(b.Secret, msg[size:])
+	return &noiseConn{Conn: conn, send: newNoiseCipher(k2), recv: newNoiseCipher(k1), resume: next, pin: b.Pin, token: token}, nil
+}
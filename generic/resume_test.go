@@ -0,0 +1,143 @@
+package generic
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// testBinding binds tokens to the client pin with a secret of its own
+func testBinding(pin string) *TokenBinding {
+	return &TokenBinding{Secret: bytes.Repeat([]byte{0x5a}, resumeSecretSize), Pin: pin}
+}
+
+func TestTokenRedeem(t *testing.T) {
+	issuer, err := NewTokenIssuer(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Hello{Version: 1, Crypt: "aes", DataShard: 10, ParityShard: 3}
+	b := testBinding("alice")
+	token := issuer.Issue(h, b)
+	tampered := append([]byte(nil), token...)
+	tampered[len(tampered)-1] ^= 1
+	other := &Hello{Version: 1, Crypt: "aes", DataShard: 10, ParityShard: 3, NoComp: true}
+	expired, err := NewTokenIssuer(-time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		issuer *TokenIssuer
+		token  []byte
+		h      *Hello
+		b      *TokenBinding
+		ok     bool
+	}{
+		{"tampered", issuer, tampered, h, b, false},
+		{"short", issuer, token[:tokenNonceSize-1], h, b, false},
+		{"mismatched pin", issuer, token, h, testBinding("mallory"), false},
+		{"other parameters", issuer, token, other, b, false},
+		{"other issuer", expired, token, h, b, false},
+		{"nil issuer", nil, token, h, b, false},
+		{"valid", issuer, token, h, b, true},
+		{"spent", issuer, token, h, b, false},
+		{"expired", expired, expired.Issue(h, b), h, b, false},
+	}
+	for _, test := range tests {
+		if ok := test.issuer.Redeem(test.token, test.h, test.b); ok != test.ok {
+			t.Errorf("%v: redeemed %v, want %v", test.name, ok, test.ok)
+		}
+	}
+}
+
+// resumed is how both ends saw a resumed key exchange
+type resumed struct {
+	conn      net.Conn // the server's
+	err       error    // the server's
+	read      []byte   // by the client, of the server's first message
+	clientErr error
+}
+
+// resumeOver resumes with token and secret over a pipe to issuer
+func resumeOver(issuer *TokenIssuer, token, secret []byte) resumed {
+	c, s := net.Pipe()
+	defer s.Close()
+	client := make(chan resumed, 1)
+	go func() {
+		defer c.Close()
+		conn, err := ResumeClient(c, token, secret)
+		if err != nil {
+			client <- resumed{clientErr: err}
+			return
+		}
+		buf := make([]byte, 4)
+		n, err := conn.Read(buf)
+		client <- resumed{read: buf[:n], clientErr: err}
+	}()
+	r := resumed{}
+	if r.conn, r.err = issuer.resume(s, time.Second); r.err == nil {
+		r.conn.Write([]byte("pong"))
+	}
+	got := <-client
+	r.read, r.clientErr = got.read, got.clientErr
+	return r
+}
+
+func TestResume(t *testing.T) {
+	issuer, err := NewTokenIssuer(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := NewTokenIssuer(-time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &Hello{Version: 1, Crypt: "aes"}
+	b := testBinding("alice")
+	token := issuer.Issue(h, b)
+
+	r := resumeOver(issuer, token, b.Secret)
+	if r.err != nil || r.clientErr != nil || string(r.read) != "pong" {
+		t.Fatalf("valid: server error %v, client error %v, read %q", r.err, r.clientErr, r.read)
+	}
+	bound := Bind(r.conn)
+	if bound.Pin != "alice" || !bytes.Equal(bound.Token, token) || len(bound.Secret) != resumeSecretSize {
+		t.Errorf("valid: bound to pin %q and token %x", bound.Pin, bound.Token)
+	}
+	if bytes.Equal(bound.Secret, b.Secret) {
+		t.Error("valid: the next resumption reuses the secret")
+	}
+
+	// the server can't tell a client without the secret, which can't read
+	// the session
+	if r := resumeOver(issuer, token, bytes.Repeat([]byte{1}, resumeSecretSize)); r.err != nil || r.clientErr == nil {
+		t.Errorf("wrong secret: server error %v, client error %v", r.err, r.clientErr)
+	}
+
+	tampered := append([]byte(nil), token...)
+	tampered[tokenNonceSize] ^= 1
+	refused := []struct {
+		name   string
+		issuer *TokenIssuer
+		token  []byte
+	}{
+		{"tampered", issuer, tampered},
+		{"expired", expired, expired.Issue(h, b)},
+		{"other issuer", expired, token},
+	}
+	for _, test := range refused {
+		if r := resumeOver(test.issuer, test.token, b.Secret); r.err == nil || r.clientErr == nil {
+			t.Errorf("%v: server error %v, client error %v", test.name, r.err, r.clientErr)
+		}
+	}
+
+	if _, err := ResumeClient(nil, token, b.Secret[1:]); err == nil {
+		t.Error("short secret: no error")
+	}
+	if _, err := ResumeClient(nil, make([]byte, resumeMaxTokenLen+1), b.Secret); err == nil {
+		t.Error("long token: no error")
+	}
+}
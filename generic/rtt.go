@@ -0,0 +1,115 @@
+package generic
+
+import (
+	"sync"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go"
+	"github.com/xtaci/smux"
+)
+
+// kcp-go keeps the round trip estimate of a session to itself, so kcptun
+// estimates its own from the round trips it times below KCP: the
+// heartbeats of the client, and on the server the estimate the client
+// reports over telemetry, the round trip being the same from either end.
+const (
+	rttMinRTO = 30 * time.Millisecond
+	rttMaxRTO = 60 * time.Second
+)
+
+// RTT estimates the smoothed round trip time and its variation from
+// samples, the way RFC 6298 does
+type RTT struct {
+	mu           sync.Mutex
+	srtt, rttvar time.Duration
+}
+
+// Add counts a round trip sample
+func (r *RTT) Add(sample time.Duration) {
+	if r == nil || sample <= 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.srtt == 0 {
+		r.srtt, r.rttvar = sample, sample/2
+		return
+	}
+	delta := sample - r.srtt
+	if delta < 0 {
+		delta = -delta
+	}
+	r.rttvar = (3*r.rttvar + delta) / 4
+	r.srtt = (7*r.srtt + sample) / 8
+}
+
+// Set takes over an estimate made elsewhere
+func (r *RTT) Set(srtt, rttvar time.Duration) {
+	if r == nil || srtt <= 0 {
+		return
+	}
+	r.mu.Lock()
+	r.srtt, r.rttvar = srtt, rttvar
+	r.mu.Unlock()
+}
+
+// Get returns the smoothed round trip time, its variation and the
+// retransmission timeout they make, all zero until the first sample
+func (r *RTT) Get() (srtt, rttvar, rto time.Duration) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.srtt == 0 {
+		return
+	}
+	rto = r.srtt + 4*r.rttvar
+	if rto < rttMinRTO {
+		rto = rttMinRTO
+	} else if rto > rttMaxRTO {
+		rto = rttMaxRTO
+	}
+	return r.srtt, r.rttvar, rto
+}
+
+// millis returns the estimate in milliseconds, as link reports carry it
+func (r *RTT) millis() (srtt, rttvar int32, rto uint32) {
+	s, v, o := r.Get()
+	return int32(s / time.Millisecond), int32(v / time.Millisecond), uint32(o / time.Millisecond)
+}
+
+// rtts are the estimates of the sessions tracked
+var rtts = struct {
+	sync.Mutex
+	m map[*kcp.UDPSession]*RTT
+}{m: make(map[*kcp.UDPSession]*RTT)}
+
+// TrackRTT returns the estimate of the session over kcpconn, created on the
+// first call and dropped once mux is closed
+func TrackRTT(kcpconn *kcp.UDPSession, mux *smux.Session) *RTT {
+	rtts.Lock()
+	defer rtts.Unlock()
+	if r, ok := rtts.m[kcpconn]; ok {
+		return r
+	}
+	r := new(RTT)
+	rtts.m[kcpconn] = r
+	go func() {
+		for !mux.IsClosed() {
+			time.Sleep(time.Second)
+		}
+		rtts.Lock()
+		delete(rtts.m, kcpconn)
+		rtts.Unlock()
+	}()
+	return r
+}
+
+// SessionRTT returns the estimate of the session over kcpconn, nil unless
+// tracked
+func SessionRTT(kcpconn *kcp.UDPSession) *RTT {
+	rtts.Lock()
+	defer rtts.Unlock()
+	return rtts.m[kcpconn]
+}
@@ -0,0 +1,118 @@
+package generic
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// BandwidthProfile caps the tunnel's bandwidth between two times of the
+// day, local time. To before From spans midnight.
+type BandwidthProfile struct {
+	From string `json:"from"` // "08:00"
+	To   string `json:"to"`   // "18:00"
+	Up   int    `json:"up"`   // Mbit/s, 0 for unlimited
+	Down int    `json:"down"` // Mbit/s, 0 for unlimited
+}
+
+// minutes parses "15:04" into minutes since midnight
+func minutes(clock string) (int, error) {
+	t, err := time.Parse("15:04", clock)
+	if err != nil {
+		return 0, errors.Errorf("schedule: bad time %q, want like 08:30", clock)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// covers tells whether p applies at minute of the day
+func (p *BandwidthProfile) covers(minute int) bool {
+	from, _ := minutes(p.From)
+	to, _ := minutes(p.To)
+	if from <= to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
+
+// CheckSchedule validates the profiles of a schedule
+func CheckSchedule(profiles []BandwidthProfile) error {
+	for _, p := range profiles {
+		if _, err := minutes(p.From); err != nil {
+			return err
+		}
+		if _, err := minutes(p.To); err != nil {
+			return err
+		}
+		if p.Up < 0 || p.Down < 0 {
+			return errors.Errorf("schedule: %v-%v: bandwidth must not be negative", p.From, p.To)
+		}
+	}
+	return nil
+}
+
+// Schedule paces the tunnel with the profile of the time of day, the first
+// covering it, unlimited outside of all of them. Its limiters are shared
+// by all sessions.
+type Schedule struct {
+	Up, Down *RateLimiter
+
+	mu       sync.Mutex
+	profiles []BandwidthProfile
+	active   *BandwidthProfile
+	applied  bool
+}
+
+// NewSchedule starts pacing with profiles
+func NewSchedule(profiles []BandwidthProfile) *Schedule {
+	s := &Schedule{Up: NewRateLimiter(0), Down: NewRateLimiter(0)}
+	s.Set(profiles)
+	go s.run()
+	return s
+}
+
+// Set replaces the profiles, applying the one of now at once
+func (s *Schedule) Set(profiles []BandwidthProfile) {
+	s.mu.Lock()
+	s.profiles = profiles
+	s.applied = false
+	s.mu.Unlock()
+	s.apply(time.Now())
+}
+
+// run applies the profiles as the minutes pass
+func (s *Schedule) run() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		s.apply(now)
+	}
+}
+
+// apply sets the limiters to the profile of now, when it changed
+func (s *Schedule) apply(now time.Time) {
+	minute := now.Hour()*60 + now.Minute()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var active *BandwidthProfile
+	for i := range s.profiles {
+		if s.profiles[i].covers(minute) {
+			active = &s.profiles[i]
+			break
+		}
+	}
+	if s.applied && active == s.active {
+		return
+	}
+	s.active, s.applied = active, true
+	var up, down int
+	if active != nil {
+		up, down = active.Up, active.Down
+		log.Printf("schedule: %v-%v, up %v Mbit/s down %v Mbit/s", active.From, active.To, up, down)
+	} else {
+		log.Println("schedule: no profile, unlimited")
+	}
+	s.Up.SetRate(up * 1000 * 1000 / 8)
+	s.Down.SetRate(down * 1000 * 1000 / 8)
+}
@@ -0,0 +1,58 @@
+package generic
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// With --seed, the random choices of kcptun outside the crypto come from
+// sources derived from the seed: the faults of --impair, the sizes of the
+// padding, chaff and --records, the order of SRV targets. Two runs with
+// the same seed and the same traffic then make the same choices, in the
+// order their sources are created, and a protocol stall can be replayed
+// by the developers it's reported to. The global source of math/rand is
+// left alone: the keys, IVs, nonces and tokens stay random, from
+// crypto/rand, as do the flow and path ids, which an observer could
+// otherwise guess, and the conversation ids kcp-go draws.
+//
+// The delays of --impair are scheduled on the clock set with SetClock, so
+// a test can run them on a virtual one. KCP's own update and flush timers
+// run inside kcp-go, on the wall clock, as do the rest of kcptun's.
+var (
+	seed    int64
+	seeded  bool
+	sources int64 // created since, for each to get a seed of its own
+
+	clock Clock = wallClock{}
+)
+
+// SetSeed makes the random choices reproducible from s, before any is made
+func SetSeed(s int64) {
+	seed, seeded = s, true
+}
+
+// NewRand returns a source for the random choices of a component, seeded
+// from --seed if set, from the time otherwise
+func NewRand() *rand.Rand {
+	if !seeded {
+		return rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return rand.New(rand.NewSource(seed + atomic.AddInt64(&sources, 1)))
+}
+
+// Clock schedules the timed faults of the packet layer
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func())
+}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time                      { return time.Now() }
+func (wallClock) AfterFunc(d time.Duration, f func()) { time.AfterFunc(d, f) }
+
+// SetClock replaces the wall clock of the connections created from then on
+func SetClock(c Clock) {
+	clock = c
+}
@@ -0,0 +1,134 @@
+package generic
+
+import (
+	"net"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// Shadowsocks runs its transport plugins as in SIP003: with no arguments,
+// the addresses and the options of the plugin in the environment. The
+// plugin of ss-local listens on SS_LOCAL_HOST:SS_LOCAL_PORT and reaches
+// its peer at SS_REMOTE_HOST:SS_REMOTE_PORT; the plugin of ss-server
+// listens on the remote address and forwards to the local one.
+// SS_PLUGIN_OPTIONS holds the flags as name=value pairs separated by
+// semicolons, a backslash escaping the next character, and a name alone
+// for a boolean flag, like "key=it's a secret;crypt=aes;nocomp". The
+// option server picks the server where the binary can't tell by its name.
+const (
+	PluginServer = "server"
+
+	// pluginFastOpen is added by ss-libev with fast_open, which KCP has no
+	// use for
+	pluginFastOpen = "fast-open"
+)
+
+// PluginEnv is the environment shadowsocks runs a plugin with
+type PluginEnv struct {
+	RemoteHost string
+	RemotePort string
+	LocalHost  string
+	LocalPort  string
+	Options    [][2]string // in order, a boolean's value is "true"
+}
+
+// ParsePluginEnv returns the plugin environment of shadowsocks, nil when
+// not run as a plugin
+func ParsePluginEnv() (*PluginEnv, error) {
+	env := &PluginEnv{
+		RemoteHost: os.Getenv("SS_REMOTE_HOST"),
+		RemotePort: os.Getenv("SS_REMOTE_PORT"),
+		LocalHost:  os.Getenv("SS_LOCAL_HOST"),
+		LocalPort:  os.Getenv("SS_LOCAL_PORT"),
+	}
+	if env.RemoteHost == "" && env.LocalHost == "" {
+		return nil, nil
+	}
+	if env.RemoteHost == "" || env.RemotePort == "" || env.LocalHost == "" || env.LocalPort == "" {
+		return nil, errors.New("sip003: SS_REMOTE_HOST, SS_REMOTE_PORT, SS_LOCAL_HOST and SS_LOCAL_PORT must all be set")
+	}
+	options, err := parsePluginOptions(os.Getenv("SS_PLUGIN_OPTIONS"))
+	if err != nil {
+		return nil, err
+	}
+	env.Options = options
+	return env, nil
+}
+
+// parsePluginOptions splits SS_PLUGIN_OPTIONS into its pairs
+func parsePluginOptions(s string) ([][2]string, error) {
+	var options [][2]string
+	var field []byte
+	var name string
+	named := false
+	end := func() {
+		if !named {
+			name = string(field)
+		}
+		if name = strings.TrimSpace(name); name != "" {
+			value := "true"
+			if named {
+				value = string(field)
+			}
+			options = append(options, [2]string{name, value})
+		}
+		field, name, named = nil, "", false
+	}
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\':
+			if i++; i == len(s) {
+				return nil, errors.New("sip003: SS_PLUGIN_OPTIONS ends with a backslash")
+			}
+			field = append(field, s[i])
+		case c == '=' && !named:
+			name, named = string(field), true
+			field = nil
+		case c == ';':
+			end()
+		default:
+			field = append(field, c)
+		}
+	}
+	end()
+	return options, nil
+}
+
+// Server reports whether the options pick the server
+func (e *PluginEnv) Server() bool {
+	for _, option := range e.Options {
+		if option[0] == PluginServer {
+			return option[1] != "false"
+		}
+	}
+	return false
+}
+
+// Local is the address of shadowsocks' end, SS_LOCAL_HOST:SS_LOCAL_PORT
+func (e *PluginEnv) Local() string {
+	return net.JoinHostPort(e.LocalHost, e.LocalPort)
+}
+
+// Remote is SS_REMOTE_HOST:SS_REMOTE_PORT
+func (e *PluginEnv) Remote() string {
+	return net.JoinHostPort(e.RemoteHost, e.RemotePort)
+}
+
+// Apply sets the flags of c to the options, a nil environment sets none
+func (e *PluginEnv) Apply(c *cli.Context) error {
+	if e == nil {
+		return nil
+	}
+	for _, option := range e.Options {
+		if option[0] == PluginServer || option[0] == pluginFastOpen {
+			continue
+		}
+		if err := c.Set(option[0], option[1]); err != nil {
+			return errors.Wrapf(err, "sip003: option %v", option[0])
+		}
+	}
+	return nil
+}
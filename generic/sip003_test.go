@@ -0,0 +1,37 @@
+package generic
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePluginOptions(t *testing.T) {
+	tests := []struct {
+		in      string
+		options [][2]string
+		err     bool
+	}{
+		{"", nil, false},
+		{"server", [][2]string{{"server", "true"}}, false},
+		{"key=secret;crypt=aes", [][2]string{{"key", "secret"}, {"crypt", "aes"}}, false},
+		{";;server;", [][2]string{{"server", "true"}}, false},
+		{" mode =fast", [][2]string{{"mode", "fast"}}, false},
+		{"key=", [][2]string{{"key", ""}}, false},
+		{"=orphan", nil, false},
+		{"key=a=b", [][2]string{{"key", "a=b"}}, false},
+		{`key=a\;b\=c\\d`, [][2]string{{"key", `a;b=c\d`}}, false},
+		{`k\=x=y`, [][2]string{{"k=x", "y"}}, false},
+		{`key=a\`, nil, true},
+		{`\`, nil, true},
+	}
+	for _, test := range tests {
+		options, err := parsePluginOptions(test.in)
+		if (err != nil) != test.err {
+			t.Errorf("parsePluginOptions(%q): error %v, want error %v", test.in, err, test.err)
+			continue
+		}
+		if !reflect.DeepEqual(options, test.options) {
+			t.Errorf("parsePluginOptions(%q) = %q, want %q", test.in, options, test.options)
+		}
+	}
+}
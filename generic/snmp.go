@@ -0,0 +1,49 @@
+package generic
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go"
+)
+
+// SnmpLogger appends kcp-go's counters to the csv file of --snmplog every
+// interval seconds, then resets them, with the column named extra filled
+// by value. The file name is a time layout, e.g. ./snmp-20060102.log.
+func SnmpLogger(path string, interval int, extra string, value func() string) {
+	if path == "" || interval == 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// split path into dirname and filename
+			logdir, logfile := filepath.Split(path)
+			// only format logfile
+			f, err := os.OpenFile(logdir+time.Now().Format(logfile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			w := csv.NewWriter(f)
+			// write header in empty file
+			if stat, err := f.Stat(); err == nil && stat.Size() == 0 {
+				if err := w.Write(append(append([]string{"Unix"}, kcp.DefaultSnmp.Header()...), extra)); err != nil {
+					log.Println(err)
+				}
+			}
+			if err := w.Write(append(append([]string{fmt.Sprint(time.Now().Unix())}, kcp.DefaultSnmp.ToSlice()...), value())); err != nil {
+				log.Println(err)
+			}
+			kcp.DefaultSnmp.Reset()
+			w.Flush()
+			f.Close()
+		}
+	}
+}
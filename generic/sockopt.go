@@ -0,0 +1,95 @@
+package generic
+
+import (
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// SetDSCP sets the DSCP field of outgoing packets on conn. It is used where
+// conn gets wrapped before being handed to KCP, since the wrapped listener
+// can no longer reach the socket itself.
+func SetDSCP(conn *net.UDPConn, dscp int) error {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		if err := ipv6.NewConn(conn).SetTrafficClass(dscp << 2); err != nil {
+			return err
+		}
+		// dual-stack sockets may carry IPv4 traffic too, best effort
+		ipv4.NewConn(conn).SetTOS(dscp << 2)
+		return nil
+	}
+	return ipv4.NewConn(conn).SetTOS(dscp << 2)
+}
+
+// SetTTL sets the TTL, or the hop limit on IPv6, of outgoing packets on
+// conn, 0 leaves the system default
+func SetTTL(conn *net.UDPConn, ttl int) error {
+	if ttl == 0 {
+		return nil
+	}
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		if err := ipv6.NewConn(conn).SetHopLimit(ttl); err != nil {
+			return err
+		}
+		// dual-stack sockets may carry IPv4 traffic too, best effort
+		ipv4.NewConn(conn).SetTTL(ttl)
+		return nil
+	}
+	return ipv4.NewConn(conn).SetTTL(ttl)
+}
+
+// Values of --df, see SetDF
+const (
+	DFDo    = "do"
+	DFDont  = "dont"
+	DFProbe = "probe"
+)
+
+// CheckDF validates a --df value
+func CheckDF(mode string) error {
+	switch mode {
+	case "", DFDo, DFDont, DFProbe:
+		return nil
+	}
+	return errors.Errorf("df: unknown mode %q, must be do, dont or probe", mode)
+}
+
+// TCPOptions are the socket options of the TCP connections at both ends of
+// the tunnel: the client's local ones and the server's to the target
+type TCPOptions struct {
+	NoDelay   bool
+	KeepAlive int // seconds between keepalive probes, 0 leaves the default
+	Linger    int // seconds, -1 leaves the default
+}
+
+// NewTCPOptions returns the options of --tcp-nodelay, --tcp-keepalive and
+// --tcp-linger
+func NewTCPOptions(nodelay bool, keepalive, linger int) *TCPOptions {
+	return &TCPOptions{NoDelay: nodelay, KeepAlive: keepalive, Linger: linger}
+}
+
+// Apply sets the options on conn, if it's a TCP connection
+func (o *TCPOptions) Apply(conn net.Conn) error {
+	tcpconn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if err := tcpconn.SetNoDelay(o.NoDelay); err != nil {
+		return err
+	}
+	if o.KeepAlive > 0 {
+		if err := tcpconn.SetKeepAlive(true); err != nil {
+			return err
+		}
+		if err := tcpconn.SetKeepAlivePeriod(time.Duration(o.KeepAlive) * time.Second); err != nil {
+			return err
+		}
+	}
+	if o.Linger >= 0 {
+		return tcpconn.SetLinger(o.Linger)
+	}
+	return nil
+}
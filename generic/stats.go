@@ -0,0 +1,465 @@
+package generic
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go"
+	"github.com/xtaci/smux"
+)
+
+// Stats keeps track of the live sessions and streams of a process, for the
+// snapshot logged on SIGUSR1 where no metrics stack is at hand. kcp-go only
+// counts retransmissions process wide, they're in the KCP SNMP line.
+//
+// Each session keeps histograms of its smoothed RTT, sampled every
+// rttSampleInterval, and of the gaps between the packets it receives, on
+// the sockets wrapped with TimePackets, to back "the tunnel feels laggy"
+// with percentiles.
+type Stats struct {
+	// totals of all the streams so far, first for 64-bit alignment
+	in, out uint64
+	opened  uint64
+	refused uint64 // sessions refused by a limit
+
+	mu       sync.Mutex
+	sessions []*sessionStats
+	targets  map[string]*targetStats
+
+	// timings finds the sessions of the packets TimePackets sees, by
+	// their local and remote addresses
+	timings sync.Map
+}
+
+const rttSampleInterval = time.Second
+
+// targetStats are the totals of the streams forwarded to a target
+type targetStats struct {
+	// first for 64-bit alignment
+	in, out uint64
+	opened  uint64
+	live    int64
+}
+
+type sessionStats struct {
+	// bytes of all its streams so far, first for 64-bit alignment
+	in, out    uint64
+	lastPacket int64 // unix nanoseconds, of the last packet received
+
+	kcpconn *kcp.UDPSession
+	mux     *smux.Session
+	opened  time.Time
+	est     *RTT // round trip estimate, see TrackRTT
+
+	rtt Histogram
+	gap Histogram
+
+	mu      sync.Mutex
+	streams map[*countedStream]struct{}
+	closed  uint64 // streams closed so far
+}
+
+// NewStats creates an empty Stats
+func NewStats() *Stats {
+	return new(Stats)
+}
+
+// AddSession tracks mux running over kcpconn until mux is closed
+func (s *Stats) AddSession(kcpconn *kcp.UDPSession, mux *smux.Session) {
+	sess := &sessionStats{
+		kcpconn: kcpconn,
+		mux:     mux,
+		opened:  time.Now(),
+		est:     TrackRTT(kcpconn, mux),
+		streams: make(map[*countedStream]struct{}),
+	}
+	s.mu.Lock()
+	s.sessions = append(s.sessions, sess)
+	s.mu.Unlock()
+	s.timings.Store(timingKey(kcpconn.LocalAddr(), kcpconn.RemoteAddr()), sess)
+	go sess.sampleRTT()
+}
+
+// sampleRTT counts the smoothed RTT of the session until it's closed
+func (sess *sessionStats) sampleRTT() {
+	ticker := time.NewTicker(rttSampleInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if sess.mux.IsClosed() {
+			return
+		}
+		// zero until the first sample
+		if srtt, _, _ := sess.est.Get(); srtt > 0 {
+			sess.rtt.Add(srtt)
+		}
+	}
+}
+
+func timingKey(local, remote net.Addr) string {
+	return local.String() + " " + remote.String()
+}
+
+// TimePackets counts the gaps between the packets conn receives, towards
+// the sessions over it
+func (s *Stats) TimePackets(conn net.PacketConn) net.PacketConn {
+	return &timedConn{conn, s}
+}
+
+// timedConn times the packets read towards the sessions of stats
+type timedConn struct {
+	net.PacketConn
+	stats *Stats
+}
+
+func (c *timedConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(p)
+	if err != nil {
+		return
+	}
+	if v, ok := c.stats.timings.Load(timingKey(c.LocalAddr(), addr)); ok {
+		sess := v.(*sessionStats)
+		now := time.Now().UnixNano()
+		if last := atomic.SwapInt64(&sess.lastPacket, now); last != 0 {
+			sess.gap.Add(time.Duration(now - last))
+		}
+	}
+	return
+}
+
+func (s *Stats) session(mux *smux.Session) *sessionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sess := range s.sessions {
+		if sess.mux == mux {
+			return sess
+		}
+	}
+	return nil
+}
+
+// TrackStream counts the bytes of stream, of the session mux, until it's
+// closed. Streams of untracked sessions are returned as is.
+func (s *Stats) TrackStream(mux *smux.Session, stream *smux.Stream) io.ReadWriteCloser {
+	sess := s.session(mux)
+	if sess == nil {
+		return stream
+	}
+	atomic.AddUint64(&s.opened, 1)
+	c := &countedStream{Stream: stream, stats: s, sess: sess, opened: time.Now()}
+	sess.mu.Lock()
+	sess.streams[c] = struct{}{}
+	sess.mu.Unlock()
+	return c
+}
+
+// TrackTarget counts the bytes of stream, returned by TrackStream, towards
+// target as well, before it's used
+func (s *Stats) TrackTarget(stream io.ReadWriteCloser, target string) {
+	c, ok := stream.(*countedStream)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	if s.targets == nil {
+		s.targets = make(map[string]*targetStats)
+	}
+	t := s.targets[target]
+	if t == nil {
+		t = new(targetStats)
+		s.targets[target] = t
+	}
+	s.mu.Unlock()
+	atomic.AddUint64(&t.opened, 1)
+	atomic.AddInt64(&t.live, 1)
+	c.target = t
+}
+
+// countedStream counts the bytes read from and written to the tunnel
+type countedStream struct {
+	*smux.Stream
+	stats  *Stats
+	sess   *sessionStats
+	target *targetStats // nil for untracked targets
+	opened time.Time
+	in     uint64
+	out    uint64
+	once   sync.Once
+}
+
+func (c *countedStream) Read(p []byte) (n int, err error) {
+	n, err = c.Stream.Read(p)
+	atomic.AddUint64(&c.in, uint64(n))
+	atomic.AddUint64(&c.sess.in, uint64(n))
+	atomic.AddUint64(&c.stats.in, uint64(n))
+	if c.target != nil {
+		atomic.AddUint64(&c.target.in, uint64(n))
+	}
+	return
+}
+
+func (c *countedStream) Write(p []byte) (n int, err error) {
+	n, err = c.Stream.Write(p)
+	atomic.AddUint64(&c.out, uint64(n))
+	atomic.AddUint64(&c.sess.out, uint64(n))
+	atomic.AddUint64(&c.stats.out, uint64(n))
+	if c.target != nil {
+		atomic.AddUint64(&c.target.out, uint64(n))
+	}
+	return
+}
+
+func (c *countedStream) Close() error {
+	c.once.Do(func() {
+		c.sess.mu.Lock()
+		delete(c.sess.streams, c)
+		c.sess.closed++
+		c.sess.mu.Unlock()
+		if c.target != nil {
+			atomic.AddInt64(&c.target.live, -1)
+		}
+	})
+	return c.Stream.Close()
+}
+
+// StreamBytes returns the bytes read from and written to a stream returned
+// by TrackStream, zeros for untracked ones
+func StreamBytes(stream io.ReadWriteCloser) (in, out uint64) {
+	if c, ok := stream.(*countedStream); ok {
+		return atomic.LoadUint64(&c.in), atomic.LoadUint64(&c.out)
+	}
+	return 0, 0
+}
+
+// Refuse counts a session refused by a limit
+func (s *Stats) Refuse() {
+	atomic.AddUint64(&s.refused, 1)
+}
+
+// live forgets the closed sessions and returns the others
+func (s *Stats) live() []*sessionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	live := s.sessions[:0]
+	for _, sess := range s.sessions {
+		if !sess.mux.IsClosed() {
+			live = append(live, sess)
+		} else {
+			s.timings.Delete(timingKey(sess.kcpconn.LocalAddr(), sess.kcpconn.RemoteAddr()))
+		}
+	}
+	s.sessions = live
+	return append([]*sessionStats(nil), live...)
+}
+
+// TargetSnapshot is the totals of a target, since the start
+type TargetSnapshot struct {
+	Target   string `json:"target"`
+	Streams  int64  `json:"streams"` // live now
+	Opened   uint64 `json:"opened"`
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+}
+
+// Targets reads the totals of the targets, by name
+func (s *Stats) Targets() []TargetSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	targets := []TargetSnapshot{}
+	for name, t := range s.targets {
+		targets = append(targets, TargetSnapshot{
+			Target:   name,
+			Streams:  atomic.LoadInt64(&t.live),
+			Opened:   atomic.LoadUint64(&t.opened),
+			BytesIn:  atomic.LoadUint64(&t.in),
+			BytesOut: atomic.LoadUint64(&t.out),
+		})
+	}
+	sort.Slice(targets, func(i, j int) bool { return targets[i].Target < targets[j].Target })
+	return targets
+}
+
+// Counters is a reading of Stats for metrics sinks
+type Counters struct {
+	Sessions, Streams int    // live now
+	StreamsOpened     uint64 // since the start
+	SessionsRefused   uint64 // since the start
+	BytesIn, BytesOut uint64 // since the start
+	SRTT              []int  // smoothed rtt of the live sessions, in ms
+}
+
+// Counters reads the totals and the live sessions
+func (s *Stats) Counters() Counters {
+	c := Counters{
+		StreamsOpened:   atomic.LoadUint64(&s.opened),
+		SessionsRefused: atomic.LoadUint64(&s.refused),
+		BytesIn:         atomic.LoadUint64(&s.in),
+		BytesOut:        atomic.LoadUint64(&s.out),
+	}
+	for _, sess := range s.live() {
+		sess.mu.Lock()
+		c.Streams += len(sess.streams)
+		sess.mu.Unlock()
+		srtt, _, _ := sess.est.millis()
+		c.SRTT = append(c.SRTT, int(srtt))
+	}
+	c.Sessions = len(c.SRTT)
+	return c
+}
+
+// Snapshot is a reading of the live sessions and streams, served on the
+// admin socket. Times are in milliseconds, bytes count since the opening.
+type Snapshot struct {
+	Time     time.Time         `json:"time"`
+	BytesIn  uint64            `json:"bytes_in"`
+	BytesOut uint64            `json:"bytes_out"`
+	Refused  uint64            `json:"refused"` // sessions refused by a limit so far
+	Sessions []SessionSnapshot `json:"sessions"`
+	// Targets are the totals of the targets the server forwards to
+	Targets []TargetSnapshot `json:"targets,omitempty"`
+	// OutSegs and RetransSegs are kcp-go's process wide counters, since
+	// the start or the last snmplog line
+	OutSegs     uint64 `json:"out_segs"`
+	RetransSegs uint64 `json:"retrans_segs"`
+}
+
+// SessionSnapshot is a session of a Snapshot
+type SessionSnapshot struct {
+	Conv     uint32           `json:"conv"`
+	Local    string           `json:"local"`
+	Remote   string           `json:"remote"`
+	Age      int64            `json:"age"`
+	SRTT     int32            `json:"srtt"`
+	RTTVar   int32            `json:"rttvar"`
+	RTO      uint32           `json:"rto"`
+	BytesIn  uint64           `json:"bytes_in"`
+	BytesOut uint64           `json:"bytes_out"`
+	Closed   uint64           `json:"closed"` // streams closed so far
+	Streams  []StreamSnapshot `json:"streams"`
+	// Link and PeerLink are the last link reports of both ends, for
+	// sessions with telemetry
+	Link     *LinkReport `json:"link,omitempty"`
+	PeerLink *LinkReport `json:"peer_link,omitempty"`
+	// RTTPercentiles are of the smoothed RTT sampled every second,
+	// GapPercentiles of the gaps between the packets received
+	RTTPercentiles *Percentiles `json:"rtt_percentiles,omitempty"`
+	GapPercentiles *Percentiles `json:"gap_percentiles,omitempty"`
+	// MuxRTTPercentiles are of the round trips of the telemetry reports
+	// through smux, for sessions with telemetry
+	MuxRTTPercentiles *Percentiles `json:"mux_rtt_percentiles,omitempty"`
+}
+
+// StreamSnapshot is a stream of a SessionSnapshot
+type StreamSnapshot struct {
+	ID       uint32 `json:"id"`
+	Age      int64  `json:"age"`
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+}
+
+// Snapshot reads the live sessions and their streams
+func (s *Stats) Snapshot() *Snapshot {
+	now := time.Now()
+	snmp := kcp.DefaultSnmp.Copy()
+	snap := &Snapshot{
+		Time:        now,
+		BytesIn:     atomic.LoadUint64(&s.in),
+		BytesOut:    atomic.LoadUint64(&s.out),
+		Refused:     atomic.LoadUint64(&s.refused),
+		Sessions:    []SessionSnapshot{},
+		Targets:     s.Targets(),
+		OutSegs:     snmp.OutSegs,
+		RetransSegs: snmp.RetransSegs,
+	}
+	for _, sess := range s.live() {
+		srtt, rttvar, rto := sess.est.millis()
+		ss := SessionSnapshot{
+			Conv:     sess.kcpconn.GetConv(),
+			Local:    sess.kcpconn.LocalAddr().String(),
+			Remote:   sess.kcpconn.RemoteAddr().String(),
+			Age:      int64(now.Sub(sess.opened) / time.Millisecond),
+			SRTT:     srtt,
+			RTTVar:   rttvar,
+			RTO:      rto,
+			BytesIn:  atomic.LoadUint64(&sess.in),
+			BytesOut: atomic.LoadUint64(&sess.out),
+			Streams:  []StreamSnapshot{},
+
+			RTTPercentiles: sess.rtt.Percentiles(),
+			GapPercentiles: sess.gap.Percentiles(),
+		}
+		if t := telemetryOf(sess.mux); t != nil {
+			ss.Link, ss.PeerLink = t.Reports()
+			ss.MuxRTTPercentiles = t.MuxRTT()
+		}
+		sess.mu.Lock()
+		ss.Closed = sess.closed
+		for c := range sess.streams {
+			ss.Streams = append(ss.Streams, StreamSnapshot{
+				ID:       c.ID(),
+				Age:      int64(now.Sub(c.opened) / time.Millisecond),
+				BytesIn:  atomic.LoadUint64(&c.in),
+				BytesOut: atomic.LoadUint64(&c.out),
+			})
+		}
+		sess.mu.Unlock()
+		snap.Sessions = append(snap.Sessions, ss)
+	}
+	return snap
+}
+
+// Dump returns a snapshot of the sessions and their streams, a line each,
+// and forgets the sessions closed since the last one
+func (s *Stats) Dump() []string {
+	sessions := s.live()
+
+	now := time.Now()
+	var lines []string
+	var total int
+	for _, sess := range sessions {
+		srtt, rttvar, rto := sess.est.millis()
+		sess.mu.Lock()
+		lines = append(lines, fmt.Sprintf("session %v -> %v age %v srtt %vms rttvar %vms rto %vms streams %v closed %v",
+			sess.kcpconn.LocalAddr(), sess.kcpconn.RemoteAddr(), now.Sub(sess.opened).Round(time.Second),
+			srtt, rttvar, rto, len(sess.streams), sess.closed))
+		if t := telemetryOf(sess.mux); t != nil {
+			if local, peer := t.Reports(); peer != nil {
+				lines = append(lines, fmt.Sprintf("  link out retrans %.1f%% in retrans %.1f%% peer srtt %vms rttvar %vms rto %vms",
+					local.Loss(), peer.Loss(), peer.SRTT, peer.RTTVar, peer.RTO))
+			}
+		}
+		var mux *Percentiles
+		if t := telemetryOf(sess.mux); t != nil {
+			mux = t.MuxRTT()
+		}
+		if rtt, gap := sess.rtt.Percentiles(), sess.gap.Percentiles(); rtt != nil || gap != nil || mux != nil {
+			lines = append(lines, "  latency"+rtt.describe("rtt")+gap.describe("gap")+mux.describe("mux rtt"))
+		}
+		for c := range sess.streams {
+			lines = append(lines, fmt.Sprintf("  stream %v age %v in %v out %v",
+				c.ID(), now.Sub(c.opened).Round(time.Second), atomic.LoadUint64(&c.in), atomic.LoadUint64(&c.out)))
+		}
+		total += len(sess.streams)
+		sess.mu.Unlock()
+	}
+	for _, t := range s.Targets() {
+		lines = append(lines, fmt.Sprintf("target %v streams %v opened %v in %v out %v", t.Target, t.Streams, t.Opened, t.BytesIn, t.BytesOut))
+	}
+	header := fmt.Sprintf("=== sessions: %v streams: %v refused: %v ===", len(sessions), total, atomic.LoadUint64(&s.refused))
+	return append(append([]string{header}, lines...), "=== end ===")
+}
+
+// LiveStreams returns the streams to target open now
+func (s *Stats) LiveStreams(target string) int64 {
+	s.mu.Lock()
+	t := s.targets[target]
+	s.mu.Unlock()
+	if t == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&t.live)
+}
@@ -0,0 +1,140 @@
+package generic
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go"
+)
+
+// Metrics are pushed to statsd over UDP, or to graphite's plaintext
+// protocol over TCP for a graphite:// address. Totals go as statsd
+// counters of their increase over the interval, the rest as gauges.
+const (
+	// statsd lines are packed in datagrams up to this size
+	statsdMaxPacket = 1400
+	graphiteScheme  = "graphite://"
+)
+
+// StatsdSink pushes the counters of stats and the process wide KCP
+// retransmissions to addr every interval, named under prefix
+func StatsdSink(addr, prefix string, interval time.Duration, stats *Stats) {
+	graphite := strings.HasPrefix(addr, graphiteScheme)
+	addr = strings.TrimPrefix(addr, graphiteScheme)
+
+	var last Counters
+	var lastRetrans uint64
+	lastTargets := make(map[string]TargetSnapshot)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c := stats.Counters()
+		// the snmp log resets the KCP counters, count from zero then
+		retrans := kcp.DefaultSnmp.Copy().RetransSegs
+		if retrans < lastRetrans {
+			lastRetrans = 0
+		}
+
+		var lines []string
+		gauge := func(name string, value interface{}) {
+			if graphite {
+				lines = append(lines, fmt.Sprintf("%v.%v %v %v\n", prefix, name, value, time.Now().Unix()))
+			} else {
+				lines = append(lines, fmt.Sprintf("%v.%v:%v|g\n", prefix, name, value))
+			}
+		}
+		counter := func(name string, total, last uint64) {
+			if graphite {
+				// graphite keeps the running total, derivatives are its job
+				gauge(name, total)
+			} else {
+				lines = append(lines, fmt.Sprintf("%v.%v:%v|c\n", prefix, name, total-last))
+			}
+		}
+		gauge("sessions", c.Sessions)
+		gauge("streams", c.Streams)
+		counter("streams_opened", c.StreamsOpened, last.StreamsOpened)
+		counter("sessions_refused", c.SessionsRefused, last.SessionsRefused)
+		counter("bytes_in", c.BytesIn, last.BytesIn)
+		counter("bytes_out", c.BytesOut, last.BytesOut)
+		counter("retransmits", retrans, lastRetrans)
+		if len(c.SRTT) > 0 {
+			sort.Ints(c.SRTT)
+			gauge("rtt.p50", percentile(c.SRTT, 50))
+			gauge("rtt.p90", percentile(c.SRTT, 90))
+			gauge("rtt.p99", percentile(c.SRTT, 99))
+			gauge("rtt.max", c.SRTT[len(c.SRTT)-1])
+		}
+		for _, t := range stats.Targets() {
+			name := "targets." + metricName(t.Target)
+			prev := lastTargets[t.Target]
+			gauge(name+".streams", t.Streams)
+			counter(name+".streams_opened", t.Opened, prev.Opened)
+			counter(name+".bytes_in", t.BytesIn, prev.BytesIn)
+			counter(name+".bytes_out", t.BytesOut, prev.BytesOut)
+			lastTargets[t.Target] = t
+		}
+		last, lastRetrans = c, retrans
+
+		if err := pushMetrics(addr, graphite, lines); err != nil {
+			log.Println("statsd:", err)
+		}
+	}
+}
+
+// metricName makes s a single component of a metric name, with the dots,
+// colons and other separators of addresses replaced
+func metricName(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-':
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+// percentile returns the p-th percentile of sorted, nearest rank
+func percentile(sorted []int, p int) int {
+	k := (len(sorted)*p + 99) / 100
+	if k < 1 {
+		k = 1
+	}
+	return sorted[k-1]
+}
+
+// pushMetrics sends lines to statsd in as few datagrams as fit, or to
+// graphite in one connection
+func pushMetrics(addr string, graphite bool, lines []string) error {
+	network := "udp"
+	if graphite {
+		network = "tcp"
+	}
+	conn, err := net.DialTimeout(network, addr, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if graphite {
+		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		_, err := conn.Write([]byte(strings.Join(lines, "")))
+		return err
+	}
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+len(line) > statsdMaxPacket {
+			if _, err := conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		buf.WriteString(line)
+	}
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,111 @@
+package generic
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/smux"
+)
+
+// smux opens streams without asking the peer, so a client learns that the
+// server couldn't take a stream only when it closes, after the dial timeout
+// and retries, and the local application hangs until then. Sessions which
+// agreed on StreamAck in the hello have the server answer every stream with
+// a status byte once it's connected to the target, or gave up:
+//
+// | status(1B) | stream data |
+//
+// The status goes ahead of the half close frames.
+type StreamStatus byte
+
+const (
+	StreamOK           StreamStatus = 0 // connected to the target
+	StreamOverCapacity StreamStatus = 1 // refused, the server is at --maxstreams
+	StreamUnreachable  StreamStatus = 2 // the target didn't answer
+	StreamOverQuota    StreamStatus = 3 // refused, the server's or client's quota is used up
+)
+
+var (
+	errOverCapacity = errors.New("stream: server over capacity")
+	errUnreachable  = errors.New("stream: target unreachable")
+	errOverQuota    = errors.New("stream: quota exceeded")
+)
+
+// Err returns the error status stands for, nil for StreamOK
+func (status StreamStatus) Err() error {
+	switch status {
+	case StreamOK:
+		return nil
+	case StreamOverCapacity:
+		return errOverCapacity
+	case StreamUnreachable:
+		return errUnreachable
+	case StreamOverQuota:
+		return errOverQuota
+	}
+	return errors.Errorf("stream: unknown status %v", byte(status))
+}
+
+// WriteStreamStatus answers a stream with status
+func WriteStreamStatus(stream io.Writer, status StreamStatus) error {
+	_, err := stream.Write([]byte{byte(status)})
+	return err
+}
+
+// AckedStream waits on the first read for the status the server answers
+// the stream with
+type AckedStream struct {
+	io.ReadWriteCloser
+	raw      *smux.Stream
+	timeout  time.Duration
+	deadline time.Time
+	failed   func(error)
+
+	once sync.Once
+	err  error
+}
+
+// NewAckedStream wraps stream, running over raw, to read the server's
+// status first. Without a status within timeout, or with an error status,
+// reads fail after failed is called with the reason. A zero timeout waits
+// as long as the stream lives.
+func NewAckedStream(stream io.ReadWriteCloser, raw *smux.Stream, timeout time.Duration, failed func(error)) *AckedStream {
+	s := &AckedStream{ReadWriteCloser: stream, raw: raw, timeout: timeout, failed: failed}
+	if timeout > 0 {
+		s.deadline = time.Now().Add(timeout)
+		raw.SetReadDeadline(s.deadline)
+	}
+	return s
+}
+
+// ack reads the status
+func (s *AckedStream) ack() {
+	var status [1]byte
+	_, err := io.ReadFull(s.ReadWriteCloser, status[:])
+	switch {
+	case err == nil:
+		s.err = StreamStatus(status[0]).Err()
+	case s.timeout > 0 && !time.Now().Before(s.deadline):
+		// smux times out with a plain error
+		s.err = errors.Errorf("stream: no answer from the server within %v", s.timeout)
+	default:
+		s.err = err
+	}
+	if s.timeout > 0 {
+		s.raw.SetReadDeadline(time.Time{})
+	}
+	if s.err != nil && s.failed != nil {
+		s.failed(s.err)
+	}
+}
+
+// Read implements io.Reader
+func (s *AckedStream) Read(p []byte) (int, error) {
+	s.once.Do(s.ack)
+	if s.err != nil {
+		return 0, s.err
+	}
+	return s.ReadWriteCloser.Read(p)
+}
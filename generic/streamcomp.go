@@ -0,0 +1,150 @@
+package generic
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// With --streamcomp, each direction of each stream decides on its own
+// whether to compress, from the first bytes written: TLS, SSH, media and
+// archives are sent as is, where compressing would only burn CPU. The
+// first byte of a direction tells the reader which it is:
+//
+// | streamCompRaw or streamCompSnappy(1B) | data |
+const (
+	streamCompRaw    = 0
+	streamCompSnappy = 1
+
+	// entropy above which a sample is deemed compressed, in bits per byte
+	streamCompEntropy = 7.2
+	// sample size the entropy is computed on, and the least it needs
+	streamCompSample    = 512
+	streamCompMinSample = 128
+)
+
+// magics of formats which are compressed or encrypted already
+var streamCompMagics = [][]byte{
+	[]byte("SSH-"),                   // encrypted after the banner
+	{0x1f, 0x8b},                     // gzip
+	{0x28, 0xb5, 0x2f, 0xfd},         // zstd
+	[]byte("PK\x03\x04"),             // zip
+	[]byte("\x89PNG"),                // png
+	{0xff, 0xd8, 0xff},               // jpeg
+	{0xfd, 0x37, 0x7a, 0x58, 0x5a},   // xz
+	[]byte("BZh"),                    // bzip2
+	{0x37, 0x7a, 0xbc, 0xaf},         // 7z
+	{0x1a, 0x45, 0xdf, 0xa3},         // matroska, webm
+	[]byte("\xff\x06\x00\x00sNaPpY"), // snappy
+}
+
+// Compressible guesses from the first bytes p written to a stream whether
+// compressing the stream is worth it
+func Compressible(p []byte) bool {
+	// TLS records: handshake, alert, change cipher spec, application data
+	if len(p) >= 2 && p[0] >= 0x14 && p[0] <= 0x17 && p[1] == 0x03 {
+		return false
+	}
+	for _, magic := range streamCompMagics {
+		if bytes.HasPrefix(p, magic) {
+			return false
+		}
+	}
+	// mp4, mov
+	if len(p) >= 8 && string(p[4:8]) == "ftyp" {
+		return false
+	}
+	if len(p) < streamCompMinSample {
+		return true
+	}
+	if len(p) > streamCompSample {
+		p = p[:streamCompSample]
+	}
+	var counts [256]int
+	for _, b := range p {
+		counts[b]++
+	}
+	var entropy float64
+	for _, n := range counts {
+		if n > 0 {
+			f := float64(n) / float64(len(p))
+			entropy -= f * math.Log2(f)
+		}
+	}
+	return entropy < streamCompEntropy
+}
+
+// StreamComp compresses the directions of a stream which benefit from it
+type StreamComp struct {
+	stream io.ReadWriteCloser
+
+	rmu sync.Mutex
+	r   io.Reader // nil until the first byte is read
+
+	wmu sync.Mutex
+	w   io.Writer // nil until the first write
+	sw  *snappy.Writer
+}
+
+// NewStreamComp wraps stream, both ends of which must be wrapped
+func NewStreamComp(stream io.ReadWriteCloser) *StreamComp {
+	return &StreamComp{stream: stream}
+}
+
+// Read implements io.Reader
+func (s *StreamComp) Read(p []byte) (int, error) {
+	s.rmu.Lock()
+	defer s.rmu.Unlock()
+	if s.r == nil {
+		var mode [1]byte
+		if _, err := io.ReadFull(s.stream, mode[:]); err != nil {
+			return 0, err
+		}
+		if mode[0] == streamCompSnappy {
+			s.r = snappy.NewReader(s.stream)
+		} else {
+			s.r = s.stream
+		}
+	}
+	return s.r.Read(p)
+}
+
+// Write implements io.Writer, every write is flushed
+func (s *StreamComp) Write(p []byte) (int, error) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	if s.w == nil {
+		mode := byte(streamCompRaw)
+		if Compressible(p) {
+			mode = streamCompSnappy
+		}
+		if _, err := s.stream.Write([]byte{mode}); err != nil {
+			return 0, err
+		}
+		if mode == streamCompSnappy {
+			s.sw = snappy.NewBufferedWriter(s.stream)
+			s.w = s.sw
+		} else {
+			s.w = s.stream
+		}
+	}
+	n, err := s.w.Write(p)
+	if err == nil && s.sw != nil {
+		err = s.sw.Flush()
+	}
+	return n, err
+}
+
+// CloseWrite passes the half close on, a direction closed before any
+// write reads as empty
+func (s *StreamComp) CloseWrite() error {
+	return CloseWrite(s.stream)
+}
+
+// Close implements io.Closer
+func (s *StreamComp) Close() error {
+	return s.stream.Close()
+}
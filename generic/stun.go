@@ -0,0 +1,189 @@
+package generic
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A STUN binding request (RFC 5389) tells the address a NAT maps a socket
+// to. Asking two servers from the same socket tells the kind of NAT: one
+// keeping the mapping whatever the destination lets hole punching through,
+// a symmetric one mapping every destination apart doesn't.
+const (
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunMagicCookie     = 0x2112A442
+	stunHeaderSize      = 20
+
+	stunMappedAddress    = 0x0001
+	stunXORMappedAddress = 0x0020
+
+	// requests sent to a server before giving up on it
+	stunAttempts = 3
+)
+
+// NAT kinds reported by DiscoverNAT
+const (
+	NATNone                = "none"
+	NATEndpointIndependent = "endpoint-independent"
+	NATSymmetric           = "symmetric"
+	NATUnknown             = "unknown"
+)
+
+// STUNResult is the public address of a socket and the kind of NAT in front
+// of it
+type STUNResult struct {
+	Public *net.UDPAddr
+	NAT    string
+}
+
+func (r *STUNResult) String() string {
+	return r.Public.String() + " nat: " + r.NAT
+}
+
+// DiscoverNAT asks the comma separated STUN servers for the public address
+// of a fresh UDP socket, waiting timeout for each
+func DiscoverNAT(servers string, timeout time.Duration) (*STUNResult, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var result *STUNResult
+	for _, server := range strings.Split(servers, ",") {
+		raddr, err := net.ResolveUDPAddr("udp4", strings.TrimSpace(server))
+		if err != nil {
+			return nil, errors.Wrap(err, "stun")
+		}
+		public, err := STUNBinding(conn, raddr, timeout)
+		if err != nil {
+			log.Printf("stun: %v: %v", server, err)
+			continue
+		}
+		if result == nil {
+			result = &STUNResult{Public: public, NAT: NATUnknown}
+			local := outboundIP(raddr)
+			if local != nil && local.Equal(public.IP) && conn.LocalAddr().(*net.UDPAddr).Port == public.Port {
+				result.NAT = NATNone
+				break
+			}
+			continue
+		}
+		if public.IP.Equal(result.Public.IP) && public.Port == result.Public.Port {
+			result.NAT = NATEndpointIndependent
+		} else {
+			result.NAT = NATSymmetric
+		}
+		break
+	}
+	if result == nil {
+		return nil, errors.New("stun: no server answered")
+	}
+	return result, nil
+}
+
+// outboundIP returns the local address packets to raddr leave from
+func outboundIP(raddr *net.UDPAddr) net.IP {
+	conn, err := net.DialUDP("udp4", nil, raddr)
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+// STUNBinding sends binding requests to server from conn, and returns the
+// mapped address of the answer
+func STUNBinding(conn net.PacketConn, server net.Addr, timeout time.Duration) (*net.UDPAddr, error) {
+	req := make([]byte, stunHeaderSize)
+	binary.BigEndian.PutUint16(req, stunBindingRequest)
+	binary.BigEndian.PutUint32(req[4:], stunMagicCookie)
+	rand.Read(req[8:stunHeaderSize])
+	txid := req[8:stunHeaderSize]
+
+	defer conn.SetReadDeadline(time.Time{})
+	buf := make([]byte, 1500)
+	for i := 0; i < stunAttempts; i++ {
+		if _, err := conn.WriteTo(req, server); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout / stunAttempts))
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				break
+			}
+			if addr, ok := parseSTUNResponse(buf[:n], txid); ok {
+				return addr, nil
+			}
+		}
+	}
+	return nil, errors.New("no answer")
+}
+
+// parseSTUNResponse returns the mapped address of a binding response to
+// the transaction txid
+func parseSTUNResponse(p, txid []byte) (*net.UDPAddr, bool) {
+	if len(p) < stunHeaderSize ||
+		binary.BigEndian.Uint16(p) != stunBindingResponse ||
+		binary.BigEndian.Uint32(p[4:]) != stunMagicCookie ||
+		string(p[8:stunHeaderSize]) != string(txid) {
+		return nil, false
+	}
+	length := int(binary.BigEndian.Uint16(p[2:]))
+	if stunHeaderSize+length > len(p) {
+		return nil, false
+	}
+	var mapped *net.UDPAddr
+	attrs := p[stunHeaderSize : stunHeaderSize+length]
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs)
+		size := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+size > len(attrs) {
+			break
+		}
+		value := attrs[4 : 4+size]
+		switch typ {
+		case stunXORMappedAddress:
+			if addr := parseSTUNAddress(value, true); addr != nil {
+				return addr, true
+			}
+		case stunMappedAddress:
+			mapped = parseSTUNAddress(value, false)
+		}
+		// attributes are padded to 4 bytes
+		size = (size + 3) &^ 3
+		if 4+size > len(attrs) {
+			break
+		}
+		attrs = attrs[4+size:]
+	}
+	return mapped, mapped != nil
+}
+
+// parseSTUNAddress decodes an IPv4 (XOR-)MAPPED-ADDRESS value
+func parseSTUNAddress(value []byte, xor bool) *net.UDPAddr {
+	// reserved(1B), family(1B), port(2B), address(4B)
+	if len(value) < 8 || value[1] != 0x01 {
+		return nil
+	}
+	port := binary.BigEndian.Uint16(value[2:])
+	ip := make(net.IP, 4)
+	copy(ip, value[4:8])
+	if xor {
+		port ^= stunMagicCookie >> 16
+		var cookie [4]byte
+		binary.BigEndian.PutUint32(cookie[:], stunMagicCookie)
+		for k := range ip {
+			ip[k] ^= cookie[k]
+		}
+	}
+	return &net.UDPAddr{IP: ip, Port: int(port)}
+}
@@ -0,0 +1,68 @@
+package generic
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// TAP mode bridges two LAN segments, carrying Ethernet frames where TUN
+// mode carries IP packets. A filter keeps chatty protocols of one segment,
+// like the discovery broadcasts of printers and media servers, off the
+// tunnel.
+const ethHeaderSize = 14
+
+// etherTypes names the EtherTypes of a frame filter
+var etherTypes = map[string]uint16{
+	"ipv4": 0x0800,
+	"arp":  0x0806,
+	"vlan": 0x8100,
+	"ipv6": 0x86dd,
+}
+
+// ParseFrameFilter parses a comma separated list of the frames to carry:
+// EtherTypes by name (ipv4, ipv6, arp, vlan) or number (0x88cc), and
+// "nobroadcast" to drop broadcast frames but ARP. Frames of other types are
+// dropped, listing none carries all types. An empty spec returns a nil
+// filter, carrying everything.
+func ParseFrameFilter(spec string) (func([]byte) bool, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	types := make(map[uint16]bool)
+	var noBroadcast bool
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "nobroadcast" {
+			noBroadcast = true
+			continue
+		}
+		if t, ok := etherTypes[name]; ok {
+			types[t] = true
+			continue
+		}
+		t, err := strconv.ParseUint(name, 0, 16)
+		if err != nil || t < 0x0600 {
+			return nil, errors.Errorf("tapfilter: unknown frame type %q", name)
+		}
+		types[uint16(t)] = true
+	}
+
+	return func(frame []byte) bool {
+		if len(frame) < ethHeaderSize {
+			return false
+		}
+		etherType := binary.BigEndian.Uint16(frame[12:])
+		if len(types) > 0 && !types[etherType] {
+			return false
+		}
+		// the broadcast address is all ones, ARP needs it to resolve
+		// anything at all
+		if noBroadcast && etherType != etherTypes["arp"] && string(frame[:6]) == "\xff\xff\xff\xff\xff\xff" {
+			return false
+		}
+		return true
+	}, nil
+}
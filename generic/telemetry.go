@@ -0,0 +1,230 @@
+package generic
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go"
+	"github.com/xtaci/smux"
+)
+
+// With telemetry, the client opens a control stream first thing in a session
+// and both ends exchange link reports on it, a JSON line each: the client
+// every interval, the server in answer. Each end then knows how the other
+// sees the link, the loss of the direction it receives included, instead of
+// guessing it from its own retransmissions.
+//
+// The client also times each report until the answer comes back. That
+// round trip goes through smux, its stream windows and the frames queued
+// ahead, on top of KCP, so a mux RTT well above the srtt tells stalls in
+// the mux apart from latency on the network. Both ends keep a histogram of
+// it, the server from the client's reports. The srtt is the estimate of
+// TrackRTT, which the server takes over from the client's reports.
+const (
+	// mux round trips this many times the srtt, and muxStallMin longer,
+	// are logged as stalls
+	muxStallFactor = 4
+	muxStallMin    = 200 * time.Millisecond
+)
+
+// LinkReport is how an end sees the link. Times are in milliseconds. The
+// segments count since the previous report, and are kcp-go's process wide
+// counters, shared by all the sessions of the process.
+type LinkReport struct {
+	SRTT        int32  `json:"srtt"`
+	RTTVar      int32  `json:"rttvar"`
+	RTO         uint32 `json:"rto"`
+	OutSegs     uint64 `json:"out_segs"`
+	RetransSegs uint64 `json:"retrans_segs"`
+	// MuxRTT is the round trip of the client's previous report through
+	// smux, sent by clients
+	MuxRTT int32 `json:"mux_rtt,omitempty"`
+}
+
+// Loss returns the share of the segments sent which were retransmitted, in
+// percent
+func (r *LinkReport) Loss() float64 {
+	if r == nil || r.OutSegs == 0 {
+		return 0
+	}
+	return float64(r.RetransSegs) * 100 / float64(r.OutSegs)
+}
+
+// Telemetry runs the control stream of a session
+type Telemetry struct {
+	mux      *smux.Session
+	stream   *smux.Stream
+	kcpconn  *kcp.UDPSession
+	rtt      *RTT
+	interval time.Duration
+
+	mu                   sync.Mutex
+	lastOut, lastRetrans uint64
+	local, peer          *LinkReport
+	sent                 time.Time     // of the report awaiting its answer, on the client
+	lastMux              time.Duration // round trip of the previous report
+	muxRTT               Histogram
+
+	// profile of --mode auto, see AutoMode
+	auto        bool
+	level, calm int
+}
+
+// telemetries are the running control streams by session
+var telemetries = struct {
+	sync.Mutex
+	m map[*smux.Session]*Telemetry
+}{m: make(map[*smux.Session]*Telemetry)}
+
+// NewTelemetry runs the control stream of mux over kcpconn until either is
+// closed. With an interval, it reports every interval, as the client does;
+// without, it answers the peer's reports, as the server does.
+func NewTelemetry(mux *smux.Session, stream *smux.Stream, kcpconn *kcp.UDPSession, interval time.Duration) *Telemetry {
+	t := &Telemetry{mux: mux, stream: stream, kcpconn: kcpconn, interval: interval}
+	t.rtt = TrackRTT(kcpconn, mux)
+	snmp := kcp.DefaultSnmp.Copy()
+	t.lastOut, t.lastRetrans = snmp.OutSegs, snmp.RetransSegs
+
+	telemetries.Lock()
+	telemetries.m[mux] = t
+	telemetries.Unlock()
+
+	go t.read()
+	if interval > 0 {
+		go t.report()
+	}
+	return t
+}
+
+// telemetryOf returns the control stream of mux, nil without
+func telemetryOf(mux *smux.Session) *Telemetry {
+	telemetries.Lock()
+	defer telemetries.Unlock()
+	return telemetries.m[mux]
+}
+
+// UserStreams returns the streams open on mux, its control stream aside
+func UserStreams(mux *smux.Session) int {
+	n := mux.NumStreams()
+	if t := telemetryOf(mux); t != nil && n > 0 {
+		n--
+	}
+	return n
+}
+
+// Reports returns the last reports of this end and of the peer, nil until
+// there's one
+func (t *Telemetry) Reports() (local, peer *LinkReport) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.local, t.peer
+}
+
+// measure reports the link as seen from here
+func (t *Telemetry) measure() *LinkReport {
+	snmp := kcp.DefaultSnmp.Copy()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	// the snmp log resets the KCP counters, count from zero then
+	if snmp.OutSegs < t.lastOut || snmp.RetransSegs < t.lastRetrans {
+		t.lastOut, t.lastRetrans = 0, 0
+	}
+	srtt, rttvar, rto := t.rtt.millis()
+	t.local = &LinkReport{
+		SRTT:        srtt,
+		RTTVar:      rttvar,
+		RTO:         rto,
+		OutSegs:     snmp.OutSegs - t.lastOut,
+		RetransSegs: snmp.RetransSegs - t.lastRetrans,
+		MuxRTT:      int32(t.lastMux / time.Millisecond),
+	}
+	t.lastOut, t.lastRetrans = snmp.OutSegs, snmp.RetransSegs
+	return t.local
+}
+
+func (t *Telemetry) send() error {
+	b, err := json.Marshal(t.measure())
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.sent = time.Now()
+	t.mu.Unlock()
+	_, err = t.stream.Write(append(b, '\n'))
+	return err
+}
+
+// MuxRTT returns the percentiles of the round trips through smux, nil
+// until there's one
+func (t *Telemetry) MuxRTT() *Percentiles {
+	return t.muxRTT.Percentiles()
+}
+
+// timeMux counts the round trip of the report answered by peer on the
+// client, or the one peer tells of on the server, with t.mu held
+func (t *Telemetry) timeMux(peer *LinkReport) {
+	var rtt time.Duration
+	if t.interval > 0 {
+		rtt = time.Since(t.sent)
+		t.lastMux = rtt
+	} else if peer.MuxRTT > 0 {
+		rtt = time.Duration(peer.MuxRTT) * time.Millisecond
+	} else {
+		return
+	}
+	t.muxRTT.Add(rtt)
+	srtt, _, _ := t.rtt.Get()
+	if srtt > 0 && rtt > muxStallFactor*srtt && rtt > srtt+muxStallMin {
+		log.Printf("telemetry: %v mux rtt %v against srtt %v, the mux stalls", t.kcpconn.RemoteAddr(), rtt, srtt)
+	}
+}
+
+// report sends a report every interval
+func (t *Telemetry) report() {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if t.mux.IsClosed() {
+			return
+		}
+		if err := t.send(); err != nil {
+			t.stream.Close()
+			return
+		}
+	}
+}
+
+// read takes in the peer's reports, answering them without an interval
+func (t *Telemetry) read() {
+	defer func() {
+		telemetries.Lock()
+		delete(telemetries.m, t.mux)
+		telemetries.Unlock()
+		t.stream.Close()
+	}()
+	scanner := bufio.NewScanner(t.stream)
+	for scanner.Scan() {
+		peer := new(LinkReport)
+		if err := json.Unmarshal(scanner.Bytes(), peer); err != nil {
+			return
+		}
+		if t.interval == 0 {
+			t.rtt.Set(time.Duration(peer.SRTT)*time.Millisecond, time.Duration(peer.RTTVar)*time.Millisecond)
+		}
+		t.mu.Lock()
+		t.peer = peer
+		t.timeMux(peer)
+		t.mu.Unlock()
+		if t.interval == 0 {
+			if err := t.send(); err != nil {
+				return
+			}
+		}
+		t.mu.Lock()
+		t.retune()
+		t.mu.Unlock()
+	}
+}
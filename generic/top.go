@@ -0,0 +1,191 @@
+package generic
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+// TopCommand shows the sessions and streams of a running client or server,
+// read from its admin socket, in a table refreshed like top's
+var TopCommand = cli.Command{
+	Name:      "top",
+	Usage:     "show the live sessions and streams of a kcptun process with --admin, with throughput, rtt and loss",
+	ArgsUsage: "[admin address]",
+	Flags: []cli.Flag{
+		cli.IntFlag{
+			Name:   "interval",
+			Value:  1,
+			Usage:  "seconds between two refreshes",
+			EnvVar: "KCPTUN_TOP_INTERVAL",
+		},
+		cli.IntFlag{
+			Name:   "streams",
+			Value:  5,
+			Usage:  "busiest streams shown under each session, 0 for none",
+			EnvVar: "KCPTUN_TOP_STREAMS",
+		},
+	},
+	Action: top,
+}
+
+// rate is the throughput of a session or stream between two snapshots, in
+// bytes per second
+type rate struct {
+	in, out float64
+}
+
+// topStream keys a stream across snapshots
+type topStream struct {
+	conv, id uint32
+}
+
+func top(c *cli.Context) error {
+	addr := c.Args().First()
+	if addr == "" {
+		addr = c.Parent().String("admin")
+	}
+	if addr == "" {
+		return cli.NewExitError("top: no admin address, pass it or --admin", ExitConfig)
+	}
+	interval := time.Duration(c.Int("interval")) * time.Second
+	if interval <= 0 {
+		return cli.NewExitError("top: interval must be positive", ExitConfig)
+	}
+
+	var last *Snapshot
+	for {
+		snap, err := ReadAdmin(addr)
+		if err != nil {
+			return cli.NewExitError(err.Error(), ExitError)
+		}
+		os.Stdout.Write(renderTop(addr, last, snap, c.Int("streams")))
+		last = snap
+		time.Sleep(interval)
+	}
+}
+
+// renderTop draws snap as a screen, with the rates since last, which is nil
+// at first
+func renderTop(addr string, last, snap *Snapshot, maxStreams int) []byte {
+	var elapsed float64
+	sessions := make(map[uint32]SessionSnapshot)
+	streams := make(map[topStream]StreamSnapshot)
+	if last != nil {
+		elapsed = snap.Time.Sub(last.Time).Seconds()
+		for _, sess := range last.Sessions {
+			sessions[sess.Conv] = sess
+			for _, st := range sess.Streams {
+				streams[topStream{sess.Conv, st.ID}] = st
+			}
+		}
+	}
+	// rates against the previous reading of the same session or stream, 0
+	// for new ones
+	rateOf := func(in, out uint64, prevIn, prevOut uint64, seen bool) rate {
+		if !seen || elapsed <= 0 || in < prevIn || out < prevOut {
+			return rate{}
+		}
+		return rate{float64(in-prevIn) / elapsed, float64(out-prevOut) / elapsed}
+	}
+
+	var total rate
+	var nstreams int
+	rates := make([]rate, len(snap.Sessions))
+	for k, sess := range snap.Sessions {
+		prev, seen := sessions[sess.Conv]
+		rates[k] = rateOf(sess.BytesIn, sess.BytesOut, prev.BytesIn, prev.BytesOut, seen)
+		total.in += rates[k].in
+		total.out += rates[k].out
+		nstreams += len(sess.Streams)
+	}
+	order := make([]int, len(snap.Sessions))
+	for k := range order {
+		order[k] = k
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return rates[order[i]].in+rates[order[i]].out > rates[order[j]].in+rates[order[j]].out
+	})
+
+	// retransmissions over the interval, process wide
+	retrans := "-"
+	if last != nil && snap.OutSegs > last.OutSegs && snap.RetransSegs >= last.RetransSegs {
+		retrans = fmt.Sprintf("%.1f%%", float64(snap.RetransSegs-last.RetransSegs)*100/float64(snap.OutSegs-last.OutSegs))
+	}
+
+	var buf bytes.Buffer
+	// home and clear the screen
+	buf.WriteString("\x1b[H\x1b[2J")
+	fmt.Fprintf(&buf, "kcptun top - %v - %v\n", addr, snap.Time.Format("15:04:05"))
+	fmt.Fprintf(&buf, "sessions: %v  streams: %v  in: %v/s  out: %v/s  retrans: %v\n\n",
+		len(snap.Sessions), nstreams, humanBytes(total.in), humanBytes(total.out), retrans)
+
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "CONV\tREMOTE\tAGE\tSRTT\tRTTVAR\tRTO\tRETX OUT\tRETX IN\tSTREAMS\tIN/s\tOUT/s\tIN\tOUT\t")
+	for _, k := range order {
+		sess := snap.Sessions[k]
+		// retransmissions each way, known with telemetry only
+		retxOut, retxIn := "-", "-"
+		if sess.PeerLink != nil {
+			retxOut, retxIn = fmt.Sprintf("%.1f%%", sess.Link.Loss()), fmt.Sprintf("%.1f%%", sess.PeerLink.Loss())
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%vms\t%vms\t%vms\t%v\t%v\t%v\t%v\t%v\t%v\t%v\t\n",
+			sess.Conv, sess.Remote, (time.Duration(sess.Age) * time.Millisecond).Round(time.Second),
+			sess.SRTT, sess.RTTVar, sess.RTO, retxOut, retxIn, len(sess.Streams),
+			humanBytes(rates[k].in), humanBytes(rates[k].out), humanBytes(float64(sess.BytesIn)), humanBytes(float64(sess.BytesOut)))
+
+		if maxStreams <= 0 {
+			continue
+		}
+		stRates := make([]rate, len(sess.Streams))
+		stOrder := make([]int, len(sess.Streams))
+		for i, st := range sess.Streams {
+			prev, seen := streams[topStream{sess.Conv, st.ID}]
+			stRates[i] = rateOf(st.BytesIn, st.BytesOut, prev.BytesIn, prev.BytesOut, seen)
+			stOrder[i] = i
+		}
+		sort.SliceStable(stOrder, func(i, j int) bool {
+			return stRates[stOrder[i]].in+stRates[stOrder[i]].out > stRates[stOrder[j]].in+stRates[stOrder[j]].out
+		})
+		if len(stOrder) > maxStreams {
+			stOrder = stOrder[:maxStreams]
+		}
+		for _, i := range stOrder {
+			st := sess.Streams[i]
+			fmt.Fprintf(w, "\tstream %v\t%v\t\t\t\t\t\t\t%v\t%v\t%v\t%v\t\n",
+				st.ID, (time.Duration(st.Age) * time.Millisecond).Round(time.Second),
+				humanBytes(stRates[i].in), humanBytes(stRates[i].out), humanBytes(float64(st.BytesIn)), humanBytes(float64(st.BytesOut)))
+		}
+	}
+	w.Flush()
+
+	if len(snap.Targets) > 0 {
+		buf.WriteString("\n")
+		w = tabwriter.NewWriter(&buf, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(w, "TARGET\tSTREAMS\tOPENED\tIN\tOUT\t")
+		for _, t := range snap.Targets {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t\n", t.Target, t.Streams, t.Opened, humanBytes(float64(t.BytesIn)), humanBytes(float64(t.BytesOut)))
+		}
+		w.Flush()
+	}
+	return buf.Bytes()
+}
+
+// humanBytes formats n bytes with a binary unit
+func humanBytes(n float64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%.0fB", n)
+	}
+	k := -1
+	for n >= 1024 && k < len(units)-1 {
+		n /= 1024
+		k++
+	}
+	return fmt.Sprintf("%.1f%c", n, units[k])
+}
@@ -0,0 +1,243 @@
+package generic
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Tracing exports spans of the session and stream lifecycles to an
+// OpenTelemetry collector, in the OTLP/HTTP JSON encoding, so tunnel
+// latency shows next to the traces of the applications using it. Spans are
+// batched and sent every few seconds; a collector that's down loses them,
+// the tunnel never waits for it.
+const (
+	traceFlushInterval = 5 * time.Second
+	traceMaxBatch      = 512
+	// spans kept while the collector is slow, the rest are dropped
+	traceMaxQueue = 8192
+
+	otlpStatusError = 2
+)
+
+// Tracer records spans and exports them to a collector. A nil Tracer
+// records nothing, so tracing costs nothing when disabled.
+type Tracer struct {
+	url     string
+	service string
+	client  *http.Client
+
+	mu    sync.Mutex
+	queue []*Span
+	kick  chan struct{}
+}
+
+// Span is an operation of the tunnel, like a handshake or a stream
+type Span struct {
+	tracer  *Tracer
+	traceID string
+	spanID  string
+	parent  string
+	name    string
+	start   time.Time
+
+	mu    sync.Mutex
+	attrs map[string]interface{}
+	err   error
+	ended bool
+	end   time.Time
+}
+
+// NewTracer exports spans of service to the collector at endpoint, like
+// http://localhost:4318, and returns nil for an empty endpoint
+func NewTracer(endpoint, service string) *Tracer {
+	if endpoint == "" {
+		return nil
+	}
+	t := &Tracer{
+		url:     strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		service: service,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		kick:    make(chan struct{}, 1),
+	}
+	go t.loop()
+	return t
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Start begins a span named name, a child of parent if not nil
+func (t *Tracer) Start(name string, parent *Span) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{
+		tracer: t,
+		spanID: randomHex(8),
+		name:   name,
+		start:  time.Now(),
+		attrs:  make(map[string]interface{}),
+	}
+	if parent != nil {
+		s.traceID, s.parent = parent.traceID, parent.spanID
+	} else {
+		s.traceID = randomHex(16)
+	}
+	return s
+}
+
+// SetAttr annotates s with a string, integer or boolean value
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+// SetError marks s as failed with err, if not nil
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+// End finishes s and queues it for export, only the first call counts
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	s.tracer.enqueue(s)
+}
+
+func (t *Tracer) enqueue(s *Span) {
+	t.mu.Lock()
+	if len(t.queue) < traceMaxQueue {
+		t.queue = append(t.queue, s)
+	}
+	full := len(t.queue) >= traceMaxBatch
+	t.mu.Unlock()
+	if full {
+		select {
+		case t.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *Tracer) loop() {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-t.kick:
+		}
+		for {
+			t.mu.Lock()
+			n := len(t.queue)
+			if n > traceMaxBatch {
+				n = traceMaxBatch
+			}
+			batch := t.queue[:n]
+			t.queue = t.queue[n:]
+			t.mu.Unlock()
+			if n == 0 {
+				break
+			}
+			if err := t.export(batch); err != nil {
+				log.Println("otlp:", err)
+				break
+			}
+		}
+	}
+}
+
+// otlpAttr encodes an attribute as an OTLP KeyValue
+func otlpAttr(key string, value interface{}) map[string]interface{} {
+	var v map[string]interface{}
+	switch value := value.(type) {
+	case int, int64, uint32, uint64:
+		// int64 values are strings in the JSON encoding
+		v = map[string]interface{}{"intValue": fmt.Sprint(value)}
+	case bool:
+		v = map[string]interface{}{"boolValue": value}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(value)}
+	}
+	return map[string]interface{}{"key": key, "value": v}
+}
+
+func (t *Tracer) export(batch []*Span) error {
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		attrs := make([]map[string]interface{}, 0, len(s.attrs))
+		for k, v := range s.attrs {
+			attrs = append(attrs, otlpAttr(k, v))
+		}
+		span := map[string]interface{}{
+			"traceId":           s.traceID,
+			"spanId":            s.spanID,
+			"parentSpanId":      s.parent,
+			"name":              s.name,
+			"kind":              1, // internal
+			"startTimeUnixNano": fmt.Sprint(s.start.UnixNano()),
+			"endTimeUnixNano":   fmt.Sprint(s.end.UnixNano()),
+			"attributes":        attrs,
+		}
+		if s.err != nil {
+			span["status"] = map[string]interface{}{"code": otlpStatusError, "message": s.err.Error()}
+		}
+		s.mu.Unlock()
+		spans = append(spans, span)
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []interface{}{otlpAttr("service.name", t.service)},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]interface{}{"name": "kcptun"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("collector answered %v", resp.Status)
+	}
+	return nil
+}
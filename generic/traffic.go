@@ -0,0 +1,176 @@
+package generic
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A trace of the traffic of real streams, their timing and sizes without
+// the payload, replayed through other parameters compares them on the
+// workload they're meant for rather than on a bulk transfer. A trace file
+// holds an event a line, in JSON:
+//
+// {"t":1234,"s":3,"op":"up","n":1460}
+//
+// t is the time in microseconds since the recording started, s the stream,
+// numbered as they open, op one of open, up, down and close, and n the
+// bytes of up and down.
+const (
+	TrafficOpen  = "open"
+	TrafficUp    = "up"
+	TrafficDown  = "down"
+	TrafficClose = "close"
+
+	trafficFlush = time.Second
+)
+
+// TrafficEvent is a line of a trace
+type TrafficEvent struct {
+	T      int64  `json:"t"`
+	Stream uint32 `json:"s"`
+	Op     string `json:"op"`
+	N      int    `json:"n,omitempty"`
+}
+
+// TrafficRecorder writes the events of the streams it tracks to a trace
+type TrafficRecorder struct {
+	start time.Time
+	f     *os.File
+
+	mu      sync.Mutex
+	w       *bufio.Writer
+	streams uint32
+	err     error
+}
+
+// NewTrafficRecorder starts a trace in path, replacing the file
+func NewTrafficRecorder(path string) (*TrafficRecorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "recordtraffic")
+	}
+	r := &TrafficRecorder{start: time.Now(), f: f, w: bufio.NewWriter(f)}
+	go r.flush()
+	return r, nil
+}
+
+// flush writes the events out every trafficFlush, so that a client killed
+// loses little of its trace
+func (r *TrafficRecorder) flush() {
+	ticker := time.NewTicker(trafficFlush)
+	defer ticker.Stop()
+	for range ticker.C {
+		r.mu.Lock()
+		if r.err == nil {
+			r.fail(r.w.Flush())
+		}
+		r.mu.Unlock()
+	}
+}
+
+// fail stops the trace on its first error, with r.mu held
+func (r *TrafficRecorder) fail(err error) {
+	if err != nil && r.err == nil {
+		r.err = err
+		log.Println("recordtraffic:", err, "the trace stops here")
+	}
+}
+
+// record writes an event of stream, with r.mu held
+func (r *TrafficRecorder) record(stream uint32, op string, n int) {
+	if r.err != nil {
+		return
+	}
+	line, err := json.Marshal(&TrafficEvent{T: int64(time.Since(r.start) / time.Microsecond), Stream: stream, Op: op, N: n})
+	if err == nil {
+		_, err = r.w.Write(append(line, '\n'))
+	}
+	r.fail(err)
+}
+
+// Track records the traffic of stream, the writes up and the reads down, as
+// a new stream of the trace; a nil recorder returns stream as is
+func (r *TrafficRecorder) Track(stream io.ReadWriteCloser) io.ReadWriteCloser {
+	if r == nil {
+		return stream
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.streams++
+	r.record(r.streams, TrafficOpen, 0)
+	return &trafficStream{ReadWriteCloser: stream, r: r, id: r.streams}
+}
+
+// trafficStream is a stream tracked by a TrafficRecorder
+type trafficStream struct {
+	io.ReadWriteCloser
+	r    *TrafficRecorder
+	id   uint32
+	once sync.Once
+}
+
+func (s *trafficStream) Read(p []byte) (int, error) {
+	n, err := s.ReadWriteCloser.Read(p)
+	if n > 0 {
+		s.r.mu.Lock()
+		s.r.record(s.id, TrafficDown, n)
+		s.r.mu.Unlock()
+	}
+	return n, err
+}
+
+func (s *trafficStream) Write(p []byte) (int, error) {
+	n, err := s.ReadWriteCloser.Write(p)
+	if n > 0 {
+		s.r.mu.Lock()
+		s.r.record(s.id, TrafficUp, n)
+		s.r.mu.Unlock()
+	}
+	return n, err
+}
+
+// CloseWrite passes the half close on
+func (s *trafficStream) CloseWrite() error {
+	return CloseWrite(s.ReadWriteCloser)
+}
+
+// Close records the end of the stream once
+func (s *trafficStream) Close() error {
+	s.once.Do(func() {
+		s.r.mu.Lock()
+		s.r.record(s.id, TrafficClose, 0)
+		s.r.mu.Unlock()
+	})
+	return s.ReadWriteCloser.Close()
+}
+
+// ReadTrafficTrace reads the events of a trace in path
+func ReadTrafficTrace(path string) ([]TrafficEvent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "trace")
+	}
+	defer f.Close()
+	var events []TrafficEvent
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var e TrafficEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// the last line of a trace cut short by a kill may be partial
+			log.Printf("trace: %v line %v: %v, skipped", path, line, err)
+			continue
+		}
+		events = append(events, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "trace")
+	}
+	return events, nil
+}
@@ -0,0 +1,119 @@
+package generic
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// In TUN mode the tunnel carries IP packets between two interfaces instead
+// of TCP streams, as a point to point VPN. A session carries them on a
+// single stream, each packet framed with its length:
+//
+// | length(2B) | packet |
+//
+// Packets are sized to fit a KCP segment, so the interface MTU follows the
+// KCP MTU minus the headers of the layers in between: KCP(24B), the nonce
+// and checksum of the crypt(20B), FEC(8B), smux(8B) and the frame(2B).
+const tunOverhead = 24 + 20 + 8 + 8 + 2
+
+// TunnelKind returns what the streams carry with --tun and --tap, told to
+// the peer in the hello: tun, tap, or empty for TCP streams
+func TunnelKind(tun, tap string) string {
+	switch {
+	case tun != "":
+		return "tun"
+	case tap != "":
+		return "tap"
+	}
+	return ""
+}
+
+// TunMTU returns the interface MTU for a KCP MTU of mtu
+func TunMTU(mtu int) int {
+	return mtu - tunOverhead
+}
+
+// TapMTU returns the interface MTU in TAP mode, which carries the Ethernet
+// header too
+func TapMTU(mtu int) int {
+	return TunMTU(mtu) - ethHeaderSize
+}
+
+// PacketRelay moves the packets of a device over the stream of the current
+// session. Packets read from the device while there's no stream are dropped,
+// like on a link that's down.
+type PacketRelay struct {
+	dev    io.ReadWriter
+	filter func([]byte) bool
+
+	mu     sync.Mutex
+	stream io.ReadWriteCloser
+}
+
+// NewPacketRelay starts reading packets from dev, sending those filter
+// passes, or all with a nil filter
+func NewPacketRelay(dev io.ReadWriter, filter func([]byte) bool) *PacketRelay {
+	r := &PacketRelay{dev: dev, filter: filter}
+	go r.readDev()
+	return r
+}
+
+func (r *PacketRelay) readDev() {
+	buf := make([]byte, 2+65535)
+	for {
+		n, err := r.dev.Read(buf[2:])
+		if err != nil {
+			Exit(ExitTransport, errors.Wrap(err, "packet relay"))
+		}
+		if r.filter != nil && !r.filter(buf[2:2+n]) {
+			continue
+		}
+		binary.BigEndian.PutUint16(buf, uint16(n))
+		r.mu.Lock()
+		stream := r.stream
+		r.mu.Unlock()
+		if stream != nil {
+			if _, err := stream.Write(buf[:2+n]); err != nil {
+				stream.Close()
+			}
+		}
+	}
+}
+
+// Serve relays the packets of stream to the device until it fails. It
+// replaces the stream of the previous session, if any.
+func (r *PacketRelay) Serve(stream io.ReadWriteCloser) error {
+	r.mu.Lock()
+	if r.stream != nil {
+		r.stream.Close()
+	}
+	r.stream = stream
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		if r.stream == stream {
+			r.stream = nil
+		}
+		r.mu.Unlock()
+		stream.Close()
+	}()
+
+	buf := make([]byte, 65535)
+	var hdr [2]byte
+	for {
+		if _, err := io.ReadFull(stream, hdr[:]); err != nil {
+			return err
+		}
+		packet := buf[:binary.BigEndian.Uint16(hdr[:])]
+		if _, err := io.ReadFull(stream, packet); err != nil {
+			return err
+		}
+		if _, err := r.dev.Write(packet); err != nil {
+			log.Println("packet relay:", err)
+		}
+	}
+}
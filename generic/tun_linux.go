@@ -0,0 +1,80 @@
+package generic
+
+import (
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// ifreqFlags and ifreqMTU are struct ifreq of <linux/if.h>, with the union
+// taken as flags or mtu
+type ifreqFlags struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+type ifreqMTU struct {
+	name [syscall.IFNAMSIZ]byte
+	mtu  int32
+	_    [20]byte
+}
+
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// OpenTun creates or attaches to the TUN interface name, sets its MTU and
+// brings it up, the addresses are left to the system. A name like tun%d
+// lets the kernel pick the number. It returns the device and its name.
+func OpenTun(name string, mtu int) (io.ReadWriteCloser, string, error) {
+	return openTunTap(name, syscall.IFF_TUN, mtu)
+}
+
+// OpenTap is OpenTun for a TAP interface, carrying Ethernet frames
+func OpenTap(name string, mtu int) (io.ReadWriteCloser, string, error) {
+	return openTunTap(name, syscall.IFF_TAP, mtu)
+}
+
+func openTunTap(name string, kind uint16, mtu int) (io.ReadWriteCloser, string, error) {
+	f, err := os.OpenFile("/dev/net/tun", os.O_RDWR, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	var req ifreqFlags
+	copy(req.name[:syscall.IFNAMSIZ-1], name)
+	req.flags = kind | syscall.IFF_NO_PI
+	if err := ioctl(f.Fd(), syscall.TUNSETIFF, unsafe.Pointer(&req)); err != nil {
+		f.Close()
+		return nil, "", os.NewSyscallError("TUNSETIFF", err)
+	}
+	name = strings.TrimRight(string(req.name[:]), "\x00")
+
+	// interface settings go through any socket
+	sock, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		f.Close()
+		return nil, "", err
+	}
+	defer syscall.Close(sock)
+	mtureq := ifreqMTU{name: req.name, mtu: int32(mtu)}
+	if err := ioctl(uintptr(sock), syscall.SIOCSIFMTU, unsafe.Pointer(&mtureq)); err != nil {
+		f.Close()
+		return nil, "", os.NewSyscallError("SIOCSIFMTU", err)
+	}
+	if err := ioctl(uintptr(sock), syscall.SIOCGIFFLAGS, unsafe.Pointer(&req)); err != nil {
+		f.Close()
+		return nil, "", os.NewSyscallError("SIOCGIFFLAGS", err)
+	}
+	req.flags |= syscall.IFF_UP | syscall.IFF_RUNNING
+	if err := ioctl(uintptr(sock), syscall.SIOCSIFFLAGS, unsafe.Pointer(&req)); err != nil {
+		f.Close()
+		return nil, "", os.NewSyscallError("SIOCSIFFLAGS", err)
+	}
+	return f, name, nil
+}
@@ -0,0 +1,19 @@
+// +build !linux
+
+package generic
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// OpenTun is only supported on linux
+func OpenTun(name string, mtu int) (io.ReadWriteCloser, string, error) {
+	return nil, "", errors.New("tun: only supported on linux")
+}
+
+// OpenTap is only supported on linux
+func OpenTap(name string, mtu int) (io.ReadWriteCloser, string, error) {
+	return nil, "", errors.New("tap: only supported on linux")
+}
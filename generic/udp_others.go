@@ -0,0 +1,21 @@
+// +build !windows
+
+package generic
+
+import "net"
+
+// TuneTimers is only needed on windows
+func TuneTimers() error {
+	return nil
+}
+
+// ReadAhead is only needed on windows, conn is returned as is for kcp-go
+// to read it in batches
+func ReadAhead(conn net.PacketConn) net.PacketConn {
+	return conn
+}
+
+// TuneUDP is only needed on windows
+func TuneUDP(conn *net.UDPConn) error {
+	return nil
+}
@@ -0,0 +1,71 @@
+// +build windows
+
+package generic
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+// Windows clients ran at about half the speed of linux ones on the same
+// machine. Two causes are fixed here:
+//
+// The system timer ticks every 15.6ms, so KCP's updates at an --interval
+// of 10 or 20ms come late by up to a tick, and acks and retransmissions
+// with them. TuneTimers asks for 1ms ticks for the life of the process.
+//
+// An ICMP port unreachable, e.g. from a server restarting, fails the next
+// read of the socket with WSAECONNRESET, which ends kcp-go's read loop and
+// with it every session of the socket. TuneUDP turns that report off, with
+// SIO_UDP_CONNRESET, on the sockets shared by sessions: the listeners and
+// the unconnected sockets of the client. A connected socket carries one
+// session, which the report rightly ends.
+//
+// kcp-go reads a packet a syscall on windows, where linux gets batches
+// from recvmmsg. The reads go through the IOCP of the runtime already, so
+// ReadAhead keeps readAheadDepth of them going in a goroutine of their own
+// instead, while KCP processes the previous packets, and the --sockbuf
+// receive buffer, 4MB by default, absorbs the bursts beyond. Batching the
+// syscalls themselves, with RIO, is left to kcp-go.
+const (
+	sioUDPConnReset = syscall.IOC_IN | syscall.IOC_VENDOR | 12
+	readAheadDepth  = 64
+)
+
+var timeBeginPeriod = syscall.NewLazyDLL("winmm.dll").NewProc("timeBeginPeriod")
+
+// TuneTimers raises the resolution of the system timer to 1ms
+func TuneTimers() error {
+	if err := timeBeginPeriod.Find(); err != nil {
+		return errors.Wrap(err, "timeBeginPeriod")
+	}
+	if ret, _, _ := timeBeginPeriod.Call(1); ret != 0 {
+		return errors.Errorf("timeBeginPeriod: error %v", ret)
+	}
+	return nil
+}
+
+// ReadAhead reads the packets of conn ahead of its reader
+func ReadAhead(conn net.PacketConn) net.PacketConn {
+	return newReadAheadConn(conn, readAheadDepth)
+}
+
+// TuneUDP keeps ICMP errors from failing the reads of conn, unconnected
+func TuneUDP(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return errors.Wrap(err, "SIO_UDP_CONNRESET")
+	}
+	var ioctlErr error
+	err = raw.Control(func(fd uintptr) {
+		var flag, ret uint32
+		ioctlErr = syscall.WSAIoctl(syscall.Handle(fd), sioUDPConnReset, (*byte)(unsafe.Pointer(&flag)), uint32(unsafe.Sizeof(flag)), nil, 0, &ret, nil, 0)
+	})
+	if err == nil {
+		err = ioctlErr
+	}
+	return errors.Wrap(err, "SIO_UDP_CONNRESET")
+}
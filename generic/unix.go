@@ -0,0 +1,32 @@
+package generic
+
+import (
+	"net"
+	"os"
+	"strings"
+)
+
+// unixPrefix marks the addresses of unix domain sockets, for services which
+// only listen on one, e.g. unix:/var/run/app.sock
+const unixPrefix = "unix:"
+
+// SplitNetwork returns the network and address to dial or listen on for
+// addr, either a unix socket or a TCP host:port
+func SplitNetwork(addr string) (network, address string) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		return "unix", strings.TrimPrefix(addr, unixPrefix)
+	}
+	return "tcp", addr
+}
+
+// ListenStream listens on the TCP or unix socket address addr. A socket file
+// left over by a previous run is removed first.
+func ListenStream(addr string) (net.Listener, error) {
+	network, address := SplitNetwork(addr)
+	if network == "unix" {
+		if fi, err := os.Stat(address); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(address)
+		}
+	}
+	return net.Listen(network, address)
+}
@@ -0,0 +1,177 @@
+package generic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go"
+)
+
+// With --webhook, events of the tunnel are POSTed as JSON to a URL, one
+// request each, for chat notifications and alerting. The text field reads
+// as a message, as Slack and Mattermost incoming webhooks expect. Events
+// are sent in the background; a hook that's down loses them, the tunnel
+// never waits for it.
+const (
+	webhookTimeout  = 10 * time.Second
+	webhookMaxQueue = 64
+
+	// the retransmissions are sampled every webhookLossInterval, and loss
+	// is sustained after webhookLossSustain samples in a row
+	webhookLossInterval = 10 * time.Second
+	webhookLossSustain  = 3
+)
+
+// WebhookEvent is the body POSTed for an event
+type WebhookEvent struct {
+	Event  string                 `json:"event"`
+	Text   string                 `json:"text"`
+	Source string                 `json:"source"` // kcptun-client or kcptun-server
+	Host   string                 `json:"host"`
+	Time   time.Time              `json:"time"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+// Webhook posts events to a URL. A nil Webhook posts nothing.
+type Webhook struct {
+	url    string
+	source string
+	host   string
+	client *http.Client
+	queue  chan *WebhookEvent
+}
+
+// CheckWebhook validates a --webhook URL
+func CheckWebhook(rawurl string) error {
+	if rawurl == "" {
+		return nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.Errorf("webhook: %q is not an http or https URL", rawurl)
+	}
+	return nil
+}
+
+// NewWebhook posts the events of source to rawurl, and returns nil for an
+// empty one
+func NewWebhook(rawurl, source string) *Webhook {
+	if rawurl == "" {
+		return nil
+	}
+	host, _ := os.Hostname()
+	w := &Webhook{
+		url:    rawurl,
+		source: source,
+		host:   host,
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan *WebhookEvent, webhookMaxQueue),
+	}
+	go w.loop()
+	return w
+}
+
+func (w *Webhook) event(event, text string, fields map[string]interface{}) *WebhookEvent {
+	return &WebhookEvent{
+		Event:  event,
+		Text:   w.source + " on " + w.host + ": " + text,
+		Source: w.source,
+		Host:   w.host,
+		Time:   time.Now(),
+		Fields: fields,
+	}
+}
+
+// Post queues an event, dropped when the hook is behind
+func (w *Webhook) Post(event, text string, fields map[string]interface{}) {
+	if w == nil {
+		return
+	}
+	select {
+	case w.queue <- w.event(event, text, fields):
+	default:
+	}
+}
+
+// PostNow sends an event and waits for the hook, for the last words of a
+// process
+func (w *Webhook) PostNow(event, text string, fields map[string]interface{}) {
+	if w == nil {
+		return
+	}
+	if err := w.send(w.event(event, text, fields)); err != nil {
+		log.Println("webhook:", err)
+	}
+}
+
+func (w *Webhook) loop() {
+	for e := range w.queue {
+		if err := w.send(e); err != nil {
+			log.Println("webhook:", err)
+		}
+	}
+}
+
+func (w *Webhook) send(e *WebhookEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("%v answered %v", e.Event, resp.Status)
+	}
+	return nil
+}
+
+// WatchLoss posts a loss event once the share of the segments retransmitted
+// stays above threshold percent for webhookLossSustain samples, and a
+// loss_recovered one once it stays below as long
+func (w *Webhook) WatchLoss(threshold float64) {
+	if w == nil || threshold <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(webhookLossInterval)
+		defer ticker.Stop()
+		snmp := kcp.DefaultSnmp.Copy()
+		lastOut, lastRetrans := snmp.OutSegs, snmp.RetransSegs
+		var lossy bool
+		var streak int
+		for range ticker.C {
+			snmp := kcp.DefaultSnmp.Copy()
+			// the snmp log resets the counters, count from zero then
+			if snmp.OutSegs < lastOut || snmp.RetransSegs < lastRetrans {
+				lastOut, lastRetrans = 0, 0
+			}
+			report := LinkReport{OutSegs: snmp.OutSegs - lastOut, RetransSegs: snmp.RetransSegs - lastRetrans}
+			lastOut, lastRetrans = snmp.OutSegs, snmp.RetransSegs
+			if report.OutSegs == 0 || (report.Loss() > threshold) == lossy {
+				streak = 0
+				continue
+			}
+			if streak++; streak < webhookLossSustain {
+				continue
+			}
+			streak = 0
+			lossy = !lossy
+			fields := map[string]interface{}{"retrans_percent": report.Loss(), "threshold_percent": threshold}
+			if lossy {
+				w.Post("loss", fmt.Sprintf("%.1f%% of the segments retransmitted for %v", report.Loss(), webhookLossInterval*webhookLossSustain), fields)
+			} else {
+				w.Post("loss_recovered", fmt.Sprintf("retransmissions back to %.1f%%", report.Loss()), fields)
+			}
+		}
+	}()
+}
@@ -0,0 +1,68 @@
+package generic
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/websocket"
+)
+
+// DialWebSocket opens a client carrier to a server's WebSocket endpoint,
+// rawurl is ws://host[:port]/path, or wss:// for WebSocket over TLS
+func DialWebSocket(rawurl string) (*StreamPacketConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, errors.Wrap(err, "DialWebSocket")
+	}
+	host := u.Host
+	if u.Port() == "" {
+		switch u.Scheme {
+		case "ws":
+			host = net.JoinHostPort(u.Hostname(), "80")
+		case "wss":
+			host = net.JoinHostPort(u.Hostname(), "443")
+		default:
+			return nil, errors.Errorf("DialWebSocket: unsupported scheme %q", u.Scheme)
+		}
+	}
+
+	config, err := websocket.NewConfig(rawurl, "http://"+u.Host)
+	if err != nil {
+		return nil, errors.Wrap(err, "DialWebSocket")
+	}
+	rwc, err := net.DialTimeout("tcp", host, 10*time.Second)
+	if err != nil {
+		return nil, errors.Wrap(err, "DialWebSocket")
+	}
+	raddr := rwc.RemoteAddr()
+	if u.Scheme == "wss" {
+		rwc = tls.Client(rwc, &tls.Config{ServerName: u.Hostname()})
+	}
+	ws, err := websocket.NewClient(config, rwc)
+	if err != nil {
+		rwc.Close()
+		return nil, errors.Wrap(err, "DialWebSocket")
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	return &StreamPacketConn{conn: ws, raddr: raddr}, nil
+}
+
+// ListenWebSocket accepts WebSocket carriers on addr at path and feeds them
+// into c, serving TLS when certFile and keyFile are set. It blocks like
+// http.ListenAndServe.
+func ListenWebSocket(c *CarrierConn, addr, path, certFile, keyFile string) error {
+	mux := http.NewServeMux()
+	mux.Handle(path, websocket.Handler(func(ws *websocket.Conn) {
+		ws.PayloadType = websocket.BinaryFrame
+		c.Serve(ws, "ws:"+ws.Request().RemoteAddr)
+	}))
+	server := &http.Server{Addr: addr, Handler: mux}
+	if certFile != "" && keyFile != "" {
+		return server.ListenAndServeTLS(certFile, keyFile)
+	}
+	return server.ListenAndServe()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+	"github.com/xtaci/kcptun/client"
+	"github.com/xtaci/kcptun/generic"
+	"github.com/xtaci/kcptun/server"
+)
+
+// kcptun is the client and the server in one binary, "kcptun client ..."
+// and "kcptun server ...". Named or linked as client_linux_amd64 or
+// server_linux_amd64 like the binaries of the releases before, it runs
+// that half with the arguments as they are.
+func main() {
+	rand.Seed(int64(time.Now().Nanosecond()))
+	if generic.VERSION == "SELFBUILD" {
+		// add more log flags for debugging
+		log.SetFlags(log.LstdFlags | log.Lshortfile)
+	}
+
+	name := filepath.Base(os.Args[0])
+	switch {
+	case strings.HasPrefix(name, "client"):
+		run(client.NewApp(), os.Args[1:])
+		return
+	case strings.HasPrefix(name, "server"):
+		run(server.NewApp(), os.Args[1:])
+		return
+	}
+	// shadowsocks runs its plugin without arguments, the server with the
+	// option server
+	if plugin, err := generic.ParsePluginEnv(); len(os.Args) == 1 && (plugin != nil || err != nil) {
+		generic.Exit(generic.ExitConfig, err)
+		if plugin.Server() {
+			run(server.NewApp(), nil)
+		} else {
+			run(client.NewApp(), nil)
+		}
+		return
+	}
+
+	myApp := cli.NewApp()
+	myApp.Name = "kcptun"
+	myApp.Usage = "a fast and reliable tunnel over KCP, run as its client or its server"
+	myApp.Version = generic.VERSION
+	myApp.Commands = []cli.Command{
+		half("client", "listen locally and forward to a kcptun server", client.NewApp),
+		half("server", "accept kcptun clients and forward to the target", server.NewApp),
+		generic.GenKeyCommand,
+		generic.TopCommand,
+	}
+	if err := myApp.Run(os.Args); err != nil {
+		generic.Exit(generic.ExitError, err)
+	}
+}
+
+// half is the subcommand running the client or the server, which parses
+// its own flags
+func half(name, usage string, newApp func() *cli.App) cli.Command {
+	return cli.Command{
+		Name:            name,
+		Usage:           usage,
+		SkipFlagParsing: true,
+		HideHelp:        true,
+		Action: func(c *cli.Context) error {
+			run(newApp(), c.Args())
+			return nil
+		},
+	}
+}
+
+func run(app *cli.App, args []string) {
+	if err := app.Run(append([]string{app.HelpName}, args...)); err != nil {
+		generic.Exit(generic.ExitError, err)
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"hash/fnv"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// A --target of several backends, "10.0.0.1:80,10.0.0.2:80", spreads the
+// streams over those passing their health checks:
+//
+// roundrobin: each in turn
+// leastconn: the one with the fewest streams open
+// hash: the same for all streams of a client, its name with --clients or
+// its IP, by rendezvous hashing: a backend going down only moves its own
+// clients, and they move back once it's up
+const (
+	balanceRoundRobin = "roundrobin"
+	balanceLeastConn  = "leastconn"
+	balanceHash       = "hash"
+)
+
+// checkBalance validates --balance
+func checkBalance(mode string) error {
+	switch mode {
+	case balanceRoundRobin, balanceLeastConn, balanceHash:
+		return nil
+	}
+	return errors.Errorf("balance: unknown mode %q, must be roundrobin, leastconn or hash", mode)
+}
+
+// backends splits a target into its backends, a command of exec: whole
+func backends(target string) []string {
+	if strings.HasPrefix(target, execPrefix) {
+		return []string{target}
+	}
+	return strings.Split(target, ",")
+}
+
+// roundRobin is the next backend of each target list
+var roundRobin = struct {
+	sync.Mutex
+	next map[string]int
+}{next: make(map[string]int)}
+
+// mix64 is the finalizer of murmur3, fnv alone spreads backends whose
+// names differ in a character or two unevenly
+func mix64(k uint64) uint64 {
+	k ^= k >> 33
+	k *= 0xff51afd7ed558ccd
+	k ^= k >> 33
+	k *= 0xc4ceb9fe1a85ec53
+	k ^= k >> 33
+	return k
+}
+
+// stickyKey identifies the client of a session for --balance hash
+func stickyKey(client string, remote net.Addr) string {
+	if client != "" {
+		return "client " + client
+	}
+	return sourceIP(remote)
+}
+
+// pickTarget returns the backend of a new stream of the client of key,
+// among those of --target up, or --standby while they're all down. All
+// down, it returns an error and the first backend.
+func pickTarget(config *Config, key string) (string, error) {
+	all := backends(config.Target)
+	up := all[:0:0]
+	var err error
+	for _, backend := range all {
+		if ok, backendErr := health.up(backend); ok {
+			up = append(up, backend)
+		} else if err == nil {
+			err = backendErr
+		}
+	}
+	switch {
+	case len(up) == 1:
+		return up[0], nil
+	case len(up) > 1:
+		return balance(config.Target, up, config.Balance, key), nil
+	}
+	if config.Standby != "" {
+		if standbyUp, _ := health.up(config.Standby); standbyUp {
+			return config.Standby, nil
+		}
+	}
+	return all[0], errors.Errorf("target %v down: %v", config.Target, err)
+}
+
+// balance picks one of the backends up of target with mode, for the client
+// of key
+func balance(target string, up []string, mode, key string) string {
+	switch mode {
+	case balanceHash:
+		var best string
+		var highest uint64
+		for _, backend := range up {
+			h := fnv.New64a()
+			h.Write([]byte(key))
+			h.Write([]byte{0})
+			h.Write([]byte(backend))
+			if sum := mix64(h.Sum64()); best == "" || sum > highest {
+				best, highest = backend, sum
+			}
+		}
+		return best
+	case balanceLeastConn:
+		best, fewest := up[0], stats.LiveStreams(up[0])
+		for _, backend := range up[1:] {
+			if n := stats.LiveStreams(backend); n < fewest {
+				best, fewest = backend, n
+			}
+		}
+		return best
+	}
+	roundRobin.Lock()
+	defer roundRobin.Unlock()
+	i := roundRobin.next[target] % len(up)
+	roundRobin.next[target] = i + 1
+	return up[i]
+}
@@ -0,0 +1,310 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+	"github.com/xtaci/kcptun/generic"
+	"github.com/xtaci/smux"
+)
+
+var checkCommand = cli.Command{
+	Name:  "check",
+	Usage: "validate the configuration and print the effective settings, no socket is opened",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Value:  "",
+			Usage:  "json config file to check, same as the global -c",
+			EnvVar: "KCPTUN_CHECK_CONFIG",
+		},
+		cli.IntFlag{
+			Name:   "rtt",
+			Value:  200,
+			Usage:  "expected round trip time to clients in ms, used to size the windows",
+			EnvVar: "KCPTUN_CHECK_RTT",
+		},
+		cli.IntFlag{
+			Name:   "bandwidth",
+			Value:  50,
+			Usage:  "expected bandwidth towards clients in Mbit/s, used to size the windows",
+			EnvVar: "KCPTUN_CHECK_BANDWIDTH",
+		},
+		cli.BoolFlag{
+			Name:   "json",
+			Usage:  "print the effective settings and the findings as one JSON object",
+			EnvVar: "KCPTUN_CHECK_JSON",
+		},
+	},
+	Action: check,
+}
+
+func check(c *cli.Context) error {
+	if path := c.String("config"); path != "" {
+		c.Parent().Set("c", path)
+	}
+	config := loadConfig(c.Parent())
+	rtt := time.Duration(c.Int("rtt")) * time.Millisecond
+
+	var r generic.Report
+	var ports int
+	for _, listen := range strings.Split(config.Listen, ",") {
+		if _, lo, hi, err := generic.SplitListen(listen); err != nil {
+			r.Errorf("listen: %v", err)
+		} else {
+			ports += hi - lo + 1
+		}
+	}
+	if ports > 1000 {
+		r.Warnf("listen: %v ports take a socket and a goroutine each", ports)
+	}
+	if strings.HasPrefix(config.Target, execPrefix) {
+		if args := strings.Fields(strings.TrimPrefix(config.Target, execPrefix)); len(args) == 0 {
+			r.Errorf("target: empty command")
+		} else if _, err := exec.LookPath(args[0]); err != nil {
+			r.Errorf("target: %v", err)
+		}
+	} else {
+		for _, backend := range backends(config.Target) {
+			r.CheckAddr("target", backend)
+		}
+	}
+	if err := checkBalance(config.Balance); err != nil {
+		r.Errorf("%v", err)
+	} else if len(backends(config.Target)) > 1 && (config.HealthCheck == "" || config.HealthCheck == "none") {
+		r.Warnf("target: without healthcheck, the streams keep going to the backends down")
+	}
+	if err := checkHealthCheck(config.HealthCheck); err != nil {
+		r.Errorf("%v", err)
+	} else if config.HealthInterval <= 0 {
+		r.Errorf("healthinterval: must be positive")
+	}
+	if config.Standby != "" {
+		r.CheckAddr("standby", config.Standby)
+		if config.HealthCheck == "" || config.HealthCheck == "none" {
+			r.Errorf("standby: needs healthcheck to tell when the target is down")
+		}
+	}
+	if config.TCPKeepAlive < 0 || config.TCPLinger < -1 {
+		r.Errorf("tcp-keepalive, tcp-linger: out of range")
+	}
+	if config.DialTimeout <= 0 {
+		r.Errorf("dial-timeout: must be positive")
+	}
+	if config.DNSCache < 0 {
+		r.Errorf("dnscache: must not be negative")
+	} else if config.Resolver != "" && config.DNSCache == 0 {
+		r.Errorf("resolver: needs dnscache")
+	}
+	if config.Pool < 0 {
+		r.Errorf("pool: must not be negative")
+	} else if config.Pool > 0 {
+		if config.PoolIdle <= 0 {
+			r.Errorf("poolidle: must be positive")
+		}
+		if strings.HasPrefix(config.Target, execPrefix) || generic.TunnelKind(config.Tun, config.Tap) != "" {
+			r.Warnf("pool: only pools tcp and unix targets")
+		}
+	}
+	if config.HandshakeTimeout <= 0 {
+		r.Errorf("handshaketimeout: must be positive")
+	}
+	if config.ClockSkew < 0 {
+		r.Errorf("clockskew: must not be negative")
+	} else if config.ClockSkew > 0 && config.ClockSkew < 5 {
+		r.Warnf("clockskew: %v seconds leaves little room for drifting clocks", config.ClockSkew)
+	}
+	if config.PQ && config.Handshake != generic.HandshakeNoiseIK && config.Handshake != generic.HandshakeNoiseXK {
+		r.Errorf("pq: requires handshake noise-ik or noise-xk")
+	}
+	if err := generic.CheckHandshake(config.Handshake); err != nil {
+		r.Errorf("%v", err)
+	} else if _, err := newKeyExchange(&config); err != nil {
+		r.Errorf("%v", err)
+	} else if config.Clients != "" {
+		if config.Handshake == generic.HandshakeNone {
+			r.Errorf("clients: requires a handshake proving the client key, tls, noise-ik or noise-xk")
+		}
+		if config.NoiseClients != "" {
+			r.Errorf("clients, noiseclients: pick one")
+		}
+		if _, err := readClients(config.Clients); err != nil {
+			r.Errorf("%v", err)
+		}
+	} else if config.NoiseClients == "" && (config.Handshake == generic.HandshakeNoiseIK || config.Handshake == generic.HandshakeNoiseXK) {
+		r.Warnf("noiseclients: empty, any client key is accepted")
+	}
+	if config.IdleTimeout < 0 {
+		r.Errorf("idletimeout: must not be negative")
+	}
+	if config.DialRetries < 0 || config.DialRetries > 10 {
+		r.Errorf("dial-retries: %v is out of 0-10", config.DialRetries)
+	}
+	if len(config.MDNS) > 63 {
+		r.Errorf("mdns: %q is longer than the 63 bytes of a DNS label", config.MDNS)
+	}
+	if err := generic.CheckDecoy(config.Decoy); err != nil {
+		r.Errorf("%v", err)
+	} else if config.Decoy != "" && config.Decoy != generic.DecoyNone {
+		if config.EchoProbe {
+			r.Warnf("decoy: echoprobe answers the probes of 'client ping' as kcptun, giving the decoy away")
+		}
+		if config.MDNS != "" {
+			r.Warnf("decoy: mdns announces the server as kcptun, giving the decoy away")
+		}
+		if config.Introducer {
+			r.Warnf("decoy: the introducer answers rendezvous requests as kcptun")
+		}
+	}
+	if config.MaxSessionsPerIP < 0 {
+		r.Errorf("max-sessions-per-ip: must not be negative")
+	}
+	if config.MaxStreams < 0 {
+		r.Errorf("maxstreams: must not be negative")
+	}
+	if config.MaxSessions < 0 {
+		r.Errorf("maxsessions: must not be negative")
+	}
+	switch full := sessionMemory(config.SndWnd, config.RcvWnd, config.MTU, config.SockBuf); {
+	case config.MaxMemory < 0:
+		r.Errorf("max-memory: must not be negative")
+	case config.MaxMemory > 0 && int64(config.MaxMemory)*1024*1024 < full:
+		r.Warnf("max-memory: %vMB doesn't hold one session at full windows, %v bytes, every session runs with smaller ones", config.MaxMemory, full)
+	}
+	switch {
+	case config.StreamLife < 0 || config.StreamLifeWarn < 0:
+		r.Errorf("streamlife: must not be negative")
+	case config.StreamLife > 0 && config.StreamLifeWarn >= config.StreamLife:
+		r.Warnf("streamlifewarn: %vs is not under streamlife, streams are warned about as they open", config.StreamLifeWarn)
+	}
+	if config.Quota < 0 {
+		r.Errorf("quota: must not be negative")
+	}
+	if err := checkQuotaMode(config.QuotaAction, config.QuotaPeriod); err != nil {
+		r.Errorf("%v", err)
+	}
+	if config.QuotaState != "" && config.Quota == 0 && config.Clients == "" {
+		r.Warnf("quotastate: no quota to keep, set quota or the clients' quotas")
+	}
+	if config.DNS != "" {
+		r.CheckAddr("dnslisten", config.DNSListen)
+	}
+	if config.Tun != "" && config.Tap != "" {
+		r.Errorf("tun, tap: pick one")
+	}
+	if _, err := generic.ParseFrameFilter(config.TapFilter); err != nil {
+		r.Errorf("%v", err)
+	} else if config.TapFilter != "" && config.Tap == "" {
+		r.Warnf("tapfilter: only applies with tap")
+	}
+	if config.PortMap {
+		if ports > 16 {
+			r.Warnf("portmap: %v ports to map, gateways may limit their mappings", ports)
+		}
+	}
+	if config.Rendezvous != "" {
+		r.CheckAddr("rendezvous", config.Rendezvous)
+		if config.PeerID == "" {
+			r.Errorf("peer-id: required with rendezvous")
+		}
+	}
+	if config.PortRange != "" {
+		if _, _, err := generic.ParsePortRange(config.PortRange); err != nil {
+			r.Errorf("port-range: %v", err)
+		}
+		if config.HopInterval < 10 {
+			r.Errorf("hop-interval: %v seconds is too short for clock skew, 10 at least", config.HopInterval)
+		}
+	}
+	r.CheckCrypt(config.Key, config.Crypt)
+	if err := generic.CheckPaddingMode(config.Padding); err != nil {
+		r.Errorf("%v", err)
+	}
+	if config.Seed != 0 {
+		r.Warnf("seed: the padding, chaff and record sizes are predictable, for debugging only")
+	}
+	if _, max, err := generic.ParseRecords(config.Records); err != nil {
+		r.Errorf("%v", err)
+	} else if max > config.MTU {
+		r.Warnf("records: %v bytes don't fit a packet of mtu %v, records are cut in several", max, config.MTU)
+	}
+	if _, err := generic.NewObfuscator(config.Obfs, config.Key); err != nil {
+		r.Errorf("%v", err)
+	}
+	if config.Chaff < 0 {
+		r.Errorf("chaff: interval must not be negative")
+	}
+	if config.OTLP != "" && !strings.HasPrefix(config.OTLP, "http://") && !strings.HasPrefix(config.OTLP, "https://") {
+		r.Errorf("otlp: %v is not an http(s) url", config.OTLP)
+	}
+	if err := generic.CheckWebhook(config.Webhook); err != nil {
+		r.Errorf("%v", err)
+	}
+	if config.WebhookLoss < 0 || config.WebhookLoss > 100 {
+		r.Errorf("webhookloss: %v out of range 0-100", config.WebhookLoss)
+	}
+	if config.KVStore != "" {
+		if _, err := newKVSource(config.KVStore); err != nil {
+			r.Errorf("%v", err)
+		}
+	}
+	if config.Admin != "" {
+		r.CheckAddr("admin", config.Admin)
+		r.CheckLoopback("admin", config.Admin)
+	}
+	if config.Statsd != "" {
+		r.CheckAddr("statsd", strings.TrimPrefix(config.Statsd, "graphite://"))
+		if config.StatsdPeriod <= 0 {
+			r.Errorf("statsdperiod: must be positive")
+		}
+	}
+	if config.AuditLog != "" && config.QUICListen != "" {
+		r.Warnf("auditlog: sessions over quic are not recorded")
+	}
+	r.CheckMode(config.Mode)
+	r.CheckMTU(config.MTU)
+	r.CheckWindow("sndwnd", config.SndWnd, config.MTU, rtt, c.Int("bandwidth"))
+	if config.RcvWnd <= 0 {
+		r.Errorf("rcvwnd: window must be positive")
+	}
+	r.CheckFEC(config.DataShard, config.ParityShard)
+	r.CheckDSCP(config.DSCP)
+	if err := generic.CheckDF(config.DF); err != nil {
+		r.Errorf("%v", err)
+	}
+	if config.TTL < 0 || config.TTL > 255 {
+		r.Errorf("ttl: %v out of range 1-255", config.TTL)
+	}
+	if config.FWMark < 0 {
+		r.Errorf("fwmark: must not be negative")
+	}
+	r.CheckSockBuf(config.SockBuf, config.SndWnd, config.MTU)
+
+	if err := smux.VerifyConfig(generic.NewSmuxConfig(config.SockBuf, config.KeepAlive, config.KeepAliveTimeout, config.SmuxFrame)); err != nil {
+		r.Errorf("smux: %v", err)
+	}
+
+	// print the effective configuration without leaking the key
+	config.Key = "********"
+	if config.NoiseKey != "" {
+		config.NoiseKey = "********"
+	}
+	if c.Bool("json") {
+		checkError(generic.PrintJSON(os.Stdout, r.Result(config)))
+	} else {
+		out, err := json.MarshalIndent(config, "", "    ")
+		checkError(err)
+		fmt.Println(string(out))
+		r.Print(os.Stdout)
+	}
+
+	if len(r.Errors) > 0 {
+		return cli.NewExitError("configuration check failed", generic.ExitConfig)
+	}
+	return nil
+}
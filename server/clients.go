@@ -0,0 +1,180 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"sync"
+
+	"github.com/pkg/errors"
+	kcp "github.com/xtaci/kcp-go"
+	"github.com/xtaci/kcptun/generic"
+)
+
+// clients names the clients of --clients by the key they prove in the
+// handshake, nil without
+var clients *clientRegistry
+
+// clientPolicy is an entry of the --clients file
+type clientPolicy struct {
+	Key       string `json:"key,omitempty"`       // noise public key
+	Pin       string `json:"pin,omitempty"`       // pin of the TLS client certificate key
+	Target    string `json:"target,omitempty"`    // overrides --target
+	Bandwidth int    `json:"bandwidth,omitempty"` // Mbit/s each way, 0 for unlimited
+	Quota     int    `json:"quota,omitempty"`     // GB per --quotaperiod, 0 for unlimited
+}
+
+// clientIdentity is a named client, with its limiters shared by all its
+// sessions
+type clientIdentity struct {
+	name    string
+	policy  clientPolicy
+	in, out *generic.RateLimiter
+}
+
+// clientRegistry holds the clients of the --clients file, reloaded on
+// SIGHUP
+type clientRegistry struct {
+	path string
+
+	mu       sync.Mutex
+	byPin    map[string]*clientIdentity
+	sessions map[*kcp.UDPSession]*clientIdentity
+}
+
+// readClients parses the --clients file, names to policies
+func readClients(path string) (map[string]clientPolicy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "clients")
+	}
+	return parseClients(b)
+}
+
+// parseClients parses the JSON of a --clients file
+func parseClients(b []byte) (map[string]clientPolicy, error) {
+	var policies map[string]clientPolicy
+	if err := json.Unmarshal(b, &policies); err != nil {
+		return nil, errors.Wrap(err, "clients")
+	}
+	for name, p := range policies {
+		if (p.Key == "") == (p.Pin == "") {
+			return nil, errors.Errorf("clients: %v: needs a key or a pin", name)
+		}
+		if p.Bandwidth < 0 {
+			return nil, errors.Errorf("clients: %v: bandwidth must not be negative", name)
+		}
+		if p.Quota < 0 {
+			return nil, errors.Errorf("clients: %v: quota must not be negative", name)
+		}
+	}
+	return policies, nil
+}
+
+// pin returns the pin identifying p in the handshake
+func (p *clientPolicy) pin() (string, error) {
+	if p.Pin != "" {
+		pins, err := generic.ParsePins(p.Pin)
+		if err != nil || len(pins) != 1 {
+			return "", errors.Errorf("clients: bad pin %q", p.Pin)
+		}
+		return pins[0], nil
+	}
+	public, err := generic.ParseNoisePublic(p.Key)
+	if err != nil {
+		return "", err
+	}
+	return generic.KeyPin(public), nil
+}
+
+func loadClients(path string) (*clientRegistry, error) {
+	r := &clientRegistry{
+		path:     path,
+		byPin:    make(map[string]*clientIdentity),
+		sessions: make(map[*kcp.UDPSession]*clientIdentity),
+	}
+	return r, r.reload()
+}
+
+// reload reads the file again. Clients removed, or whose key changed, are
+// revoked: their sessions are closed. The others keep their sessions, with
+// the new policy for the new ones and the new bandwidth for all.
+func (r *clientRegistry) reload() error {
+	policies, err := readClients(r.path)
+	if err != nil {
+		return err
+	}
+	return r.load(policies, r.path)
+}
+
+// load replaces the clients with policies, from source, as reload does
+func (r *clientRegistry) load(policies map[string]clientPolicy, source string) error {
+	byPin := make(map[string]*clientIdentity)
+	for name, p := range policies {
+		pin, err := p.pin()
+		if err != nil {
+			return errors.Wrap(err, name)
+		}
+		if _, ok := byPin[pin]; ok {
+			return errors.Errorf("clients: %v: key used twice", name)
+		}
+		byPin[pin] = &clientIdentity{name: name, policy: p}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for pin, id := range byPin {
+		rate := id.policy.Bandwidth * 1000 * 1000 / 8
+		if old, ok := r.byPin[pin]; ok && old.name == id.name {
+			// keep the limiters the sessions use
+			id.in, id.out = old.in, old.out
+			id.in.SetRate(rate)
+			id.out.SetRate(rate)
+			old.policy = id.policy
+			byPin[pin] = old
+			continue
+		}
+		id.in, id.out = generic.NewRateLimiter(rate), generic.NewRateLimiter(rate)
+	}
+	for conn, id := range r.sessions {
+		if byPin[mustPin(id)] != id {
+			log.Println("client", id.name, "revoked, closing", conn.RemoteAddr())
+			conn.Close()
+			delete(r.sessions, conn)
+		}
+	}
+	r.byPin = byPin
+	for _, id := range byPin {
+		quotas.setLimit(id.name, id.policy.Quota)
+	}
+	log.Println("clients:", len(byPin), "loaded from", source)
+	return nil
+}
+
+// mustPin returns the pin of a loaded identity
+func mustPin(id *clientIdentity) string {
+	pin, _ := id.policy.pin()
+	return pin
+}
+
+// identify returns the client proving the key of pin, and tracks its session
+// conn until untrack
+func (r *clientRegistry) identify(pin string, conn *kcp.UDPSession) (clientIdentity, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id, ok := r.byPin[pin]
+	if !ok {
+		if pin == "" {
+			return clientIdentity{}, errors.New("clients: no client key in the handshake")
+		}
+		return clientIdentity{}, errors.Wrapf(generic.ErrAuthFailed, "clients: unknown client key %v", pin)
+	}
+	r.sessions[conn] = id
+	return *id, nil
+}
+
+func (r *clientRegistry) untrack(conn *kcp.UDPSession) {
+	r.mu.Lock()
+	delete(r.sessions, conn)
+	r.mu.Unlock()
+}
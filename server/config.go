@@ -1,4 +1,4 @@
-package main
+package server
 
 import (
 	"encoding/json"
@@ -7,30 +7,113 @@ import (
 
 // Config for server
 type Config struct {
-	Listen       string `json:"listen"`
-	Target       string `json:"target"`
-	Key          string `json:"key"`
-	Crypt        string `json:"crypt"`
-	Mode         string `json:"mode"`
-	MTU          int    `json:"mtu"`
-	SndWnd       int    `json:"sndwnd"`
-	RcvWnd       int    `json:"rcvwnd"`
-	DataShard    int    `json:"datashard"`
-	ParityShard  int    `json:"parityshard"`
-	DSCP         int    `json:"dscp"`
-	NoComp       bool   `json:"nocomp"`
-	AckNodelay   bool   `json:"acknodelay"`
-	NoDelay      int    `json:"nodelay"`
-	Interval     int    `json:"interval"`
-	Resend       int    `json:"resend"`
-	NoCongestion int    `json:"nc"`
-	SockBuf      int    `json:"sockbuf"`
-	KeepAlive    int    `json:"keepalive"`
-	Log          string `json:"log"`
-	SnmpLog      string `json:"snmplog"`
-	SnmpPeriod   int    `json:"snmpperiod"`
-	Pprof        bool   `json:"pprof"`
-	Quiet        bool   `json:"quiet"`
+	Listen           string `json:"listen"`
+	Target           string `json:"target"`
+	Tun              string `json:"tun"`
+	Tap              string `json:"tap"`
+	TapFilter        string `json:"tapfilter"`
+	DialTimeout      int    `json:"dial-timeout"`
+	DialRetries      int    `json:"dial-retries"`
+	DNSCache         int    `json:"dnscache"`
+	Resolver         string `json:"resolver"`
+	Balance          string `json:"balance"`
+	Standby          string `json:"standby"`
+	HealthCheck      string `json:"healthcheck"`
+	HealthInterval   int    `json:"healthinterval"`
+	MaxSessionsPerIP int    `json:"max-sessions-per-ip"`
+	MaxStreams       int    `json:"maxstreams"`
+	MaxSessions      int    `json:"maxsessions"`
+	MaxMemory        int    `json:"max-memory"`
+	StreamLife       int    `json:"streamlife"`
+	StreamLifeWarn   int    `json:"streamlifewarn"`
+	Quota            int    `json:"quota"`
+	QuotaPeriod      string `json:"quotaperiod"`
+	QuotaAction      string `json:"quotaaction"`
+	QuotaState       string `json:"quotastate"`
+	Pool             int    `json:"pool"`
+	PoolIdle         int    `json:"poolidle"`
+	Introducer       bool   `json:"introducer"`
+	Rendezvous       string `json:"rendezvous"`
+	PeerID           string `json:"peer-id"`
+	PortMap          bool   `json:"portmap"`
+	OTLP             string `json:"otlp"`
+	Webhook          string `json:"webhook"`
+	WebhookLoss      int    `json:"webhookloss"`
+	AuditLog         string `json:"auditlog"`
+	Key              string `json:"key"`
+	Crypt            string `json:"crypt"`
+	Mode             string `json:"mode"`
+	MTU              int    `json:"mtu"`
+	SndWnd           int    `json:"sndwnd"`
+	RcvWnd           int    `json:"rcvwnd"`
+	DataShard        int    `json:"datashard"`
+	ParityShard      int    `json:"parityshard"`
+	DSCP             int    `json:"dscp"`
+	DF               string `json:"df"`
+	TTL              int    `json:"ttl"`
+	FWMark           int    `json:"fwmark"`
+	NoComp           bool   `json:"nocomp"`
+	StreamComp       bool   `json:"streamcomp"`
+	AckNodelay       bool   `json:"acknodelay"`
+	NoDelay          int    `json:"nodelay"`
+	Interval         int    `json:"interval"`
+	Resend           int    `json:"resend"`
+	NoCongestion     int    `json:"nc"`
+	SockBuf          int    `json:"sockbuf"`
+	KeepAlive        int    `json:"keepalive"`
+	KeepAliveTimeout int    `json:"keepalivetimeout"`
+	Handshake        string `json:"handshake"`
+	PQ               bool   `json:"pq"`
+	NoiseKey         string `json:"noisekey"`
+	NoiseClients     string `json:"noiseclients"`
+	Clients          string `json:"clients"`
+	HandshakeTimeout int    `json:"handshaketimeout"`
+	ClockSkew        int    `json:"clockskew"`
+	NoResume         bool   `json:"noresume"`
+	IdleTimeout      int    `json:"idletimeout"`
+	TCPNoDelay       bool   `json:"tcp-nodelay"`
+	TCPKeepAlive     int    `json:"tcp-keepalive"`
+	TCPLinger        int    `json:"tcp-linger"`
+	SmuxFrame        int    `json:"smuxframe"`
+	Log              string `json:"log"`
+	SnmpLog          string `json:"snmplog"`
+	SnmpPeriod       int    `json:"snmpperiod"`
+	Statsd           string `json:"statsd"`
+	StatsdPeriod     int    `json:"statsdperiod"`
+	StatsdPrefix     string `json:"statsdprefix"`
+	Admin            string `json:"admin"`
+	Pprof            bool   `json:"pprof"`
+	EchoProbe        bool   `json:"echoprobe"`
+	MDNS             string `json:"mdns"`
+	Decoy            string `json:"decoy"`
+	Multipath        bool   `json:"multipath"`
+	PortRange        string `json:"port-range"`
+	HopInterval      int    `json:"hop-interval"`
+	Padding          string `json:"padding"`
+	Records          string `json:"records"`
+	Obfs             string `json:"obfs"`
+	Chaff            int    `json:"chaff"`
+	Push             bool   `json:"push"`
+	TCP              bool   `json:"tcp"`
+	FakeTCP          string `json:"faketcp"`
+	QUICListen       string `json:"quiclisten"`
+	ICMP             bool   `json:"icmp"`
+	WSListen         string `json:"wslisten"`
+	DNS              string `json:"dns"`
+	DNSListen        string `json:"dnslisten"`
+	WSPath           string `json:"wspath"`
+	TLSCert          string `json:"tlscert"`
+	TLSKey           string `json:"tlskey"`
+	Quiet            bool   `json:"quiet"`
+	Pcap             string `json:"pcap"`
+	PcapPlain        bool   `json:"pcapplain"`
+	Impair           string `json:"impair"`
+	Seed             int64  `json:"seed"`
+	KVStore          string `json:"kvstore"`
+
+	// clientTarget is set on the config of a session whose client of
+	// --clients has its own target, kept over the target of --kvstore
+	clientTarget bool
 }
 
 func parseJSONConfig(config *Config, path string) error {
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// execPrefix marks a target command, spawned for every stream inetd-style
+// with the stream wired to its stdin and stdout, e.g. exec:/usr/bin/someserver
+const execPrefix = "exec:"
+
+// execGrace is how long a process gets to exit after its stream closed
+const execGrace = 5 * time.Second
+
+// execConn is a stream to the stdio of a process spawned for it
+type execConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	exited chan struct{}
+}
+
+// startExec spawns command, its arguments separated by spaces
+func startExec(command string) (*execConn, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("exec: empty command")
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, errors.Wrap(err, "exec")
+	}
+	// a pipe of our own, as Wait closes that of StdoutPipe on exit, with
+	// the tail of the output possibly still unread
+	stdout, w, err := os.Pipe()
+	if err != nil {
+		stdin.Close()
+		return nil, errors.Wrap(err, "exec")
+	}
+	cmd.Stdout = w
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		stdin.Close()
+		stdout.Close()
+		return nil, errors.Wrap(err, "exec")
+	}
+	c := &execConn{cmd, stdin, stdout, make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		close(c.exited)
+	}()
+	return c, nil
+}
+
+func (c *execConn) Read(p []byte) (n int, err error) {
+	return c.stdout.Read(p)
+}
+
+func (c *execConn) Write(p []byte) (n int, err error) {
+	return c.stdin.Write(p)
+}
+
+// CloseWrite passes the end of the stream on as EOF on the process' stdin
+func (c *execConn) CloseWrite() error {
+	return c.stdin.Close()
+}
+
+// Close closes the process' stdin and kills it unless it exits in time
+func (c *execConn) Close() error {
+	c.stdin.Close()
+	select {
+	case <-c.exited:
+	case <-time.After(execGrace):
+		c.cmd.Process.Kill()
+	}
+	return c.stdout.Close()
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"crypto/tls"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/generic"
+)
+
+// kx runs the --handshake key exchange at the start of sessions
+var kx *generic.KeyExchange
+
+// newKeyExchange prepares the key exchange of config
+func newKeyExchange(config *Config) (*generic.KeyExchange, error) {
+	kx := &generic.KeyExchange{Mode: config.Handshake, Server: true, Timeout: time.Duration(config.HandshakeTimeout) * time.Second, PQ: config.PQ}
+	// clients resume with the tokens of the hello
+	kx.Tokens = tokens
+	var err error
+	switch config.Handshake {
+	case generic.HandshakeTLS:
+		pass := generic.DeriveKey(config.Key)
+		kx.TLS, err = generic.NewHandshakeServerTLS(config.TLSCert, config.TLSKey, pass)
+		if err == nil && config.Clients != "" {
+			// clients are known by their certificate, checked by pin
+			kx.TLS.ClientAuth = tls.RequireAnyClientCert
+		}
+	case generic.HandshakeNoiseIK, generic.HandshakeNoiseXK:
+		if config.NoiseKey == "" {
+			return nil, errors.New("noisekey: required with " + config.Handshake)
+		}
+		if kx.Noise, err = generic.ParseNoiseKey(config.NoiseKey); err != nil {
+			return nil, err
+		}
+		for _, s := range strings.Split(config.NoiseClients, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			public, err := generic.ParseNoisePublic(s)
+			if err != nil {
+				return nil, err
+			}
+			kx.Allowed = append(kx.Allowed, public)
+		}
+	}
+	return kx, err
+}
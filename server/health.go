@@ -0,0 +1,136 @@
+package server
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/generic"
+)
+
+// With --healthcheck, the server probes its targets every --healthinterval
+// seconds, with a TCP connect or an HTTP GET of a path. A target failing
+// healthDownAfter probes in a row is down until one passes: its streams
+// go to --standby, or fail at once instead of through the dial retries.
+const healthDownAfter = 2
+
+// health probes the targets with --healthcheck, nil without
+var health *healthChecker
+
+type healthChecker struct {
+	check    string // "tcp", or the path to GET
+	interval time.Duration
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	targets map[string]*targetHealth
+}
+
+// targetHealth is the state of a target probed
+type targetHealth struct {
+	down     bool
+	failures int
+	err      error
+}
+
+// checkHealthCheck validates --healthcheck
+func checkHealthCheck(check string) error {
+	if check == "" || check == "none" || check == "tcp" || strings.HasPrefix(check, "/") {
+		return nil
+	}
+	return errors.Errorf("healthcheck: %q must be none, tcp or an HTTP path like /health", check)
+}
+
+func newHealthChecker(check string, interval, timeout time.Duration) *healthChecker {
+	return &healthChecker{
+		check:    check,
+		interval: interval,
+		timeout:  timeout,
+		targets:  make(map[string]*targetHealth),
+	}
+}
+
+// up tells whether target passes its probes, with the last error when not.
+// Targets are probed from the first time they're asked about, up until
+// then; commands of exec: aren't probed.
+func (h *healthChecker) up(target string) (bool, error) {
+	if h == nil || strings.HasPrefix(target, execPrefix) {
+		return true, nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t, ok := h.targets[target]
+	if !ok {
+		t = new(targetHealth)
+		h.targets[target] = t
+		go h.watch(target, t)
+	}
+	return !t.down, t.err
+}
+
+// watch probes target every interval
+func (h *healthChecker) watch(target string, t *targetHealth) {
+	for {
+		err := h.probe(target)
+		h.mu.Lock()
+		wasDown := t.down
+		if err != nil {
+			t.failures++
+			t.err = err
+			t.down = t.down || t.failures >= healthDownAfter
+		} else {
+			t.failures, t.err, t.down = 0, nil, false
+		}
+		down := t.down
+		h.mu.Unlock()
+		switch {
+		case down && !wasDown:
+			log.Println("health:", target, "down:", err)
+			webhook.Post("target_down", target+" down: "+err.Error(), map[string]interface{}{"target": target, "error": err.Error()})
+		case !down && wasDown:
+			log.Println("health:", target, "up")
+			webhook.Post("target_up", target+" up", map[string]interface{}{"target": target})
+		}
+		time.Sleep(h.interval)
+	}
+}
+
+// probe checks target once
+func (h *healthChecker) probe(target string) error {
+	network, address := generic.SplitNetwork(target)
+	conn, err := dnsCache.Dial(network, address, h.timeout)
+	if err != nil || h.check == "tcp" {
+		if conn != nil {
+			conn.Close()
+		}
+		return err
+	}
+	conn.Close()
+
+	client := http.Client{
+		Timeout: h.timeout,
+		Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return dnsCache.Dial(network, address, h.timeout)
+			},
+			DisableKeepAlives: true,
+		},
+	}
+	host := address
+	if network == "unix" {
+		host = "localhost"
+	}
+	resp, err := client.Get("http://" + host + h.check)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return errors.Errorf("%v answered %v", h.check, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,312 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// With --kvstore, a fleet of servers is reconfigured at runtime from a
+// prefix of consul or etcd, each key under it overriding a setting:
+//
+// target, balance, standby, dial-timeout, dial-retries, maxstreams,
+// streamlife, streamlifewarn: for the new streams
+// max-sessions-per-ip: for the new sessions
+// clients: the JSON of a --clients file, reloaded as on SIGHUP
+//
+// Removing a key brings back the setting of the command line. Both are read
+// over their HTTP APIs: consul with blocking queries, etcd polled.
+const (
+	kvWait       = 5 * time.Minute // of a consul blocking query
+	kvPoll       = 10 * time.Second
+	kvRetry      = 5 * time.Second
+	kvTimeout    = kvWait + 30*time.Second
+	kvClientsKey = "clients"
+)
+
+// kvSettings set the fields of a config from the values of their keys
+var kvSettings = map[string]func(config *Config, value string) error{
+	"target":              kvString(func(c *Config) *string { return &c.Target }),
+	"balance":             kvString(func(c *Config) *string { return &c.Balance }),
+	"standby":             kvString(func(c *Config) *string { return &c.Standby }),
+	"dial-timeout":        kvInt(func(c *Config) *int { return &c.DialTimeout }),
+	"dial-retries":        kvInt(func(c *Config) *int { return &c.DialRetries }),
+	"maxstreams":          kvInt(func(c *Config) *int { return &c.MaxStreams }),
+	"streamlife":          kvInt(func(c *Config) *int { return &c.StreamLife }),
+	"streamlifewarn":      kvInt(func(c *Config) *int { return &c.StreamLifeWarn }),
+	"max-sessions-per-ip": kvInt(func(c *Config) *int { return &c.MaxSessionsPerIP }),
+}
+
+func kvString(field func(*Config) *string) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		*field(c) = strings.TrimSpace(value)
+		return nil
+	}
+}
+
+func kvInt(field func(*Config) *int) func(*Config, string) error {
+	return func(c *Config, value string) error {
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || n < 0 {
+			return errors.Errorf("%q is not a non-negative integer", value)
+		}
+		*field(c) = n
+		return nil
+	}
+}
+
+// dynamic holds the settings of --kvstore, nil without
+var dynamic *dynamicConfig
+
+type dynamicConfig struct {
+	mu     sync.Mutex
+	values map[string]string // by key, under the prefix
+}
+
+// apply returns config with the settings of the store, config itself
+// without any. A client's own target of --clients is kept.
+func (d *dynamicConfig) apply(config *Config) *Config {
+	if d == nil {
+		return config
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.values) == 0 {
+		return config
+	}
+	c := *config
+	for key, value := range d.values {
+		if key == "target" && config.clientTarget {
+			continue
+		}
+		if set, ok := kvSettings[key]; ok {
+			set(&c, value)
+		}
+	}
+	return &c
+}
+
+// update takes in the values of the store, checked against config, the
+// command line's. On an error, the previous values stay.
+func (d *dynamicConfig) update(values map[string]string, config *Config) error {
+	c := *config
+	for key, value := range values {
+		if key == kvClientsKey {
+			continue
+		}
+		set, ok := kvSettings[key]
+		if !ok {
+			log.Println("kvstore: unknown key", key, "ignored")
+			continue
+		}
+		if err := set(&c, value); err != nil {
+			return errors.Wrap(err, key)
+		}
+	}
+	for _, backend := range backends(c.Target) {
+		if backend == "" {
+			return errors.New("target: empty")
+		}
+	}
+	if err := checkBalance(c.Balance); err != nil {
+		return err
+	}
+	if c.DialTimeout <= 0 {
+		return errors.New("dial-timeout: must be positive")
+	}
+
+	var policies map[string]clientPolicy
+	if data, ok := values[kvClientsKey]; ok {
+		if clients == nil {
+			return errors.New("clients: start the server with --clients to take them from the store")
+		}
+		var err error
+		if policies, err = parseClients([]byte(data)); err != nil {
+			return err
+		}
+	}
+
+	d.mu.Lock()
+	changed := !reflect.DeepEqual(d.values, values)
+	_, hadClients := d.values[kvClientsKey]
+	clientsChanged := values[kvClientsKey] != d.values[kvClientsKey] || (policies == nil) == hadClients
+	d.mu.Unlock()
+	if !changed {
+		return nil
+	}
+	if clientsChanged {
+		var err error
+		if policies != nil {
+			err = clients.load(policies, "kvstore")
+		} else if clients != nil {
+			// the key was removed, back to the file
+			err = clients.reload()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	d.mu.Lock()
+	d.values = values
+	d.mu.Unlock()
+	log.Printf("kvstore: target %v balance %v standby %v maxstreams %v streamlife %v max-sessions-per-ip %v",
+		c.Target, c.Balance, c.Standby, c.MaxStreams, c.StreamLife, c.MaxSessionsPerIP)
+	sourceLimit.setMax(c.MaxSessionsPerIP)
+	return nil
+}
+
+// kvSource reads the keys under a prefix of a store, blocking until they
+// changed from index where the store supports it
+type kvSource interface {
+	fetch(index uint64) (values map[string]string, next uint64, err error)
+}
+
+// newKVSource parses --kvstore, consul://host:8500/prefix or
+// etcd://host:2379/prefix
+func newKVSource(rawurl string) (kvSource, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		return nil, errors.Errorf("kvstore: %q is not like consul://127.0.0.1:8500/kcptun", rawurl)
+	}
+	prefix := strings.TrimPrefix(u.Path, "/")
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	client := &http.Client{Timeout: kvTimeout}
+	switch u.Scheme {
+	case "consul":
+		return &consulKV{base: "http://" + u.Host, prefix: prefix, client: client}, nil
+	case "etcd":
+		return &etcdKV{base: "http://" + u.Host, prefix: "/" + prefix, client: client}, nil
+	}
+	return nil, errors.Errorf("kvstore: unknown store %q, must be consul or etcd", u.Scheme)
+}
+
+// consulKV reads consul's KV store, with the token of CONSUL_HTTP_TOKEN
+type consulKV struct {
+	base, prefix string
+	client       *http.Client
+}
+
+func (s *consulKV) fetch(index uint64) (map[string]string, uint64, error) {
+	req, err := http.NewRequest("GET", s.base+"/v1/kv/"+s.prefix+"?recurse=true&index="+strconv.FormatUint(index, 10)+"&wait="+kvWait.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	values := make(map[string]string)
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		// nothing under the prefix
+		return values, next, nil
+	case http.StatusOK:
+	default:
+		return nil, 0, errors.Errorf("consul answered %v", resp.Status)
+	}
+	var kvs []struct {
+		Key   string
+		Value []byte // base64 in the JSON
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&kvs); err != nil {
+		return nil, 0, err
+	}
+	for _, kv := range kvs {
+		if key := strings.TrimPrefix(kv.Key, s.prefix); key != "" {
+			values[key] = string(kv.Value)
+		}
+	}
+	return values, next, nil
+}
+
+// etcdKV reads etcd v3 over its JSON gateway, polled every kvPoll
+type etcdKV struct {
+	base, prefix string
+	client       *http.Client
+}
+
+func (s *etcdKV) fetch(index uint64) (map[string]string, uint64, error) {
+	if index > 0 {
+		time.Sleep(kvPoll)
+	}
+	// the range of the keys starting with the prefix
+	end := []byte(s.prefix)
+	end[len(end)-1]++
+	body, _ := json.Marshal(map[string]string{
+		"key":       base64.StdEncoding.EncodeToString([]byte(s.prefix)),
+		"range_end": base64.StdEncoding.EncodeToString(end),
+	})
+	resp, err := s.client.Post(s.base+"/v3/kv/range", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return nil, 0, errors.Errorf("etcd answered %v: %s", resp.Status, bytes.TrimSpace(b))
+	}
+	var result struct {
+		Header struct {
+			Revision string `json:"revision"`
+		} `json:"header"`
+		Kvs []struct {
+			Key   []byte `json:"key"`
+			Value []byte `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, 0, err
+	}
+	values := make(map[string]string)
+	for _, kv := range result.Kvs {
+		if key := strings.TrimPrefix(string(kv.Key), s.prefix); key != "" {
+			values[key] = string(kv.Value)
+		}
+	}
+	next, _ := strconv.ParseUint(result.Header.Revision, 10, 64)
+	if next == 0 {
+		next = 1
+	}
+	return values, next, nil
+}
+
+// watchKV applies the settings of src over config's as they change
+func watchKV(src kvSource, config *Config) {
+	var index uint64
+	for {
+		values, next, err := src.fetch(index)
+		if err != nil {
+			log.Println("kvstore:", err)
+			time.Sleep(kvRetry)
+			continue
+		}
+		if next < index {
+			// the store was reset, start over
+			next = 0
+		}
+		index = next
+		if err := dynamic.update(values, config); err != nil {
+			log.Println("kvstore:", err, "keeping the previous settings")
+		}
+	}
+}
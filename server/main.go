@@ -1,89 +1,358 @@
-package main
+package server
 
 import (
-	"crypto/sha1"
-	"encoding/csv"
 	"fmt"
 	"io"
 	"log"
-	"math/rand"
 	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"golang.org/x/crypto/pbkdf2"
-
-	"path/filepath"
-
-	"github.com/golang/snappy"
+	"github.com/pkg/errors"
 	"github.com/urfave/cli"
 	kcp "github.com/xtaci/kcp-go"
+	"github.com/xtaci/kcptun/generic"
 	"github.com/xtaci/smux"
 )
 
-var (
-	// VERSION is injected by buildflags
-	VERSION = "SELFBUILD"
-	// SALT is use for pbkdf2 key expansion
-	SALT = "kcp-go"
-)
+// tokens issues the resumption tokens, valid until the server restarts,
+// nil with --noresume
+var tokens *generic.TokenIssuer
 
-type compStream struct {
-	conn net.Conn
-	w    *snappy.Writer
-	r    *snappy.Reader
-}
+// webhook posts the events of the server with --webhook, nil without
+var webhook *generic.Webhook
 
-func (c *compStream) Read(p []byte) (n int, err error) {
-	return c.r.Read(p)
+// shutdown saves the quotas and tells the webhook the server stops on
+// SIGINT or SIGTERM, then exits as the signal would have
+func shutdown() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	sig := <-ch
+	log.Println("stopping on", sig)
+	quotas.save()
+	webhook.PostNow("down", "stopping on "+sig.String(), nil)
+	if s, ok := sig.(syscall.Signal); ok {
+		os.Exit(128 + int(s))
+	}
+	os.Exit(1)
 }
 
-func (c *compStream) Write(p []byte) (n int, err error) {
-	n, err = c.w.Write(p)
-	err = c.w.Flush()
-	return n, err
-}
+// qos holds back the bulk streams of all clients for the interactive ones
+var qos = generic.NewQoS()
 
-func (c *compStream) Close() error {
-	return c.conn.Close()
-}
+// stats tracks the sessions and streams for the SIGUSR1 snapshot
+var stats = generic.NewStats()
 
-func newCompStream(conn net.Conn) *compStream {
-	c := new(compStream)
-	c.conn = conn
-	c.w = snappy.NewBufferedWriter(conn)
-	c.r = snappy.NewReader(conn)
-	return c
-}
+// tracer exports the spans of sessions and streams with --otlp
+var tracer *generic.Tracer
 
-// handle multiplex-ed connection
-func handleMux(conn io.ReadWriteCloser, config *Config) {
-	// stream multiplex
-	smuxConfig := smux.DefaultConfig()
-	smuxConfig.MaxReceiveBuffer = config.SockBuf
-	smuxConfig.KeepAliveInterval = time.Duration(config.KeepAlive) * time.Second
+// audit records the sessions and streams with --auditlog
+var audit *generic.AuditLog
+
+// replays authenticates the hellos, and refuses stale and replayed ones
+// with --clockskew
+var replays *generic.ReplayGuard
+
+// dnsCache resolves the targets given by name, nil with --dnscache 0
+var dnsCache *generic.DNSCache
 
-	mux, err := smux.Server(conn, smuxConfig)
+// tunRelay carries the packets of the TUN or TAP interface in those modes,
+// over the stream of the latest client
+var tunRelay *generic.PacketRelay
+
+// handle multiplex-ed connection conn running over kcpconn, hello is nil
+// for clients without the hello exchange. The streams of interactive
+// sessions are served ahead of the others. The bytes of the session and
+// why it ended go to rec, once its streams are done.
+func handleMux(conn io.ReadWriteCloser, kcpconn *kcp.UDPSession, config *Config, hello *generic.Hello, span *generic.Span, rec *generic.AuditRecord) {
+	// stream multiplex
+	mux, err := smux.Server(conn, generic.NewSmuxConfig(config.SockBuf, config.KeepAlive, config.KeepAliveTimeout, config.SmuxFrame))
 	if err != nil {
 		log.Println(err)
+		rec.Reason = err.Error()
 		return
 	}
+	var wg sync.WaitGroup
+	var in, out uint64
+	defer func() {
+		wg.Wait()
+		rec.BytesIn, rec.BytesOut = in, out
+	}()
 	defer mux.Close()
-	for {
-		p1, err := mux.AcceptStream()
+	stats.AddSession(kcpconn, mux)
+	if hello != nil && hello.Telemetry {
+		// the client opens its control stream first
+		control, err := mux.AcceptStream()
 		if err != nil {
 			log.Println(err)
+			rec.Reason = err.Error()
 			return
 		}
-		p2, err := net.DialTimeout("tcp", config.Target, 5*time.Second)
+		t := generic.NewTelemetry(mux, control, kcpconn, 0)
+		if config.Mode == "auto" {
+			t.AutoMode()
+		}
+	}
+	// serve forwards p1 to a target, running it as the logical stream
+	// *migrateID unless nil
+	serve := func(p1 *smux.Stream, migrateID *uint64) {
+		streamSpan := tracer.Start("stream", span)
+		streamSpan.SetAttr("stream.id", p1.ID())
+		// --kvstore applies from the next stream on
+		streamConfig := dynamic.apply(config)
+		target, pickErr := pickTarget(streamConfig, stickyKey(rec.Client, kcpconn.RemoteAddr()))
+		streamRec := &generic.AuditRecord{
+			Kind:   "stream",
+			Opened: time.Now(),
+			Remote: rec.Remote,
+			Client: rec.Client,
+			Conv:   rec.Conv,
+			Stream: p1.ID(),
+			Target: target,
+		}
+		// sessions past the hello frame their streams for half close
+		counted := stats.TrackStream(mux, p1)
+		stats.TrackTarget(counted, target)
+		stream := counted
+		if migrateID != nil {
+			logical := generic.NewMigrateStream(*migrateID, counted, func() bool { return !mux.IsClosed() }, nil)
+			addMigrating(rec.Client, *migrateID, logical)
+			stream = logical
+		}
+		var ack func(generic.StreamStatus)
+		if hello != nil && hello.StreamAck {
+			// the status goes ahead of the frames
+			ack = func(status generic.StreamStatus) {
+				generic.WriteStreamStatus(stream, status)
+			}
+		}
+		var refused error
+		var status generic.StreamStatus
+		_, overQuota := quotas.exceeded(quotaNames(rec.Client))
+		switch {
+		case pickErr != nil:
+			refused, status = pickErr, generic.StreamUnreachable
+		case overQuota && streamConfig.QuotaAction == quotaStop:
+			refused, status = errOverQuota, generic.StreamOverQuota
+		case !acquireStream(streamConfig):
+			refused, status = errOverCapacity, generic.StreamOverCapacity
+		}
+		if refused != nil {
+			if ack != nil {
+				ack(status)
+			}
+			stream.Close()
+			streamSpan.SetError(refused)
+			streamSpan.End()
+			streamRec.Closed, streamRec.Reason = time.Now(), refused.Error()
+			audit.Record(streamRec)
+			return
+		}
+		if hello != nil {
+			stream = generic.NewHalfCloseStream(stream)
+			if hello.StreamComp {
+				stream = generic.NewStreamComp(stream)
+			}
+			if hello.Checksum {
+				stream = generic.NewChecksumStream(stream, func(err error) {
+					log.Println(rec.Remote, "stream", streamRec.Stream, "to", target+":", err)
+				})
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer releaseStream()
+			stop := limitLife(counted, fmt.Sprintf("%v stream %v", rec.Remote, streamRec.Stream), streamConfig)
+			streamRec.Reason = "closed"
+			if err := handleStream(qos.Wrap(stream, hello != nil && hello.Interactive), target, streamConfig, streamSpan, ack); err != nil {
+				streamRec.Reason = "dial: " + err.Error()
+			}
+			if stop() {
+				streamRec.Reason = reasonMaxLife
+			}
+			streamIn, streamOut := generic.StreamBytes(counted)
+			streamSpan.SetAttr("bytes.in", streamIn)
+			streamSpan.SetAttr("bytes.out", streamOut)
+			streamSpan.End()
+			streamRec.Closed, streamRec.BytesIn, streamRec.BytesOut = time.Now(), streamIn, streamOut
+			audit.Record(streamRec)
+			atomic.AddUint64(&in, streamIn)
+			atomic.AddUint64(&out, streamOut)
+		}()
+	}
+	var idle int32
+	if config.IdleTimeout > 0 {
+		go func() {
+			if closeIdle(mux, kcpconn.RemoteAddr(), time.Duration(config.IdleTimeout)*time.Second) {
+				atomic.StoreInt32(&idle, 1)
+			}
+		}()
+	}
+	for {
+		p1, err := mux.AcceptStream()
 		if err != nil {
-			p1.Close()
 			log.Println(err)
+			rec.Reason = err.Error()
+			if atomic.LoadInt32(&idle) == 1 {
+				rec.Reason = "idle timeout"
+			}
+			return
+		}
+		if tunRelay != nil {
+			if hello == nil {
+				log.Println(generic.TunnelKind(config.Tun, config.Tap) + ": client without hello refused")
+				rec.Reason = "no hello"
+				return
+			}
+			go func() {
+				log.Println(generic.TunnelKind(config.Tun, config.Tap)+":", tunRelay.Serve(p1))
+			}()
 			continue
 		}
-		go handleClient(p1, p2, config.Quiet)
+		if hello != nil && hello.Migrate {
+			// the header tells new logical streams from those moving over
+			wg.Add(1)
+			go func(p1 *smux.Stream) {
+				defer wg.Done()
+				id, open, err := acceptMigrate(mux, rec.Client, kcpconn.RemoteAddr(), p1)
+				if err != nil {
+					log.Println(err)
+					p1.Close()
+				} else if open {
+					serve(p1, &id)
+				}
+			}(p1)
+			continue
+		}
+		serve(p1, nil)
+	}
+}
+
+// closeIdle closes mux, the session of raddr, once it went without streams
+// for timeout, and tells whether it did
+func closeIdle(mux *smux.Session, raddr net.Addr, timeout time.Duration) bool {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	idleSince := time.Now()
+	for range ticker.C {
+		switch {
+		case mux.IsClosed():
+			return false
+		case generic.UserStreams(mux) > 0:
+			idleSince = time.Now()
+		case time.Since(idleSince) >= timeout:
+			log.Println(raddr, "idle for", timeout, "closing")
+			mux.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// dialFailures counts the streams reset because the target was unreachable
+var dialFailures uint64
+
+// liveStreams counts the streams being served, for --maxstreams
+var liveStreams int64
+
+// liveSessions counts the sessions being served, for --maxsessions
+var liveSessions int64
+
+var (
+	errOverCapacity = errors.New("over capacity")
+	errOverQuota    = errors.New("over quota")
+)
+
+// acquireStream takes a slot for a new stream, failing when --maxstreams
+// are live
+func acquireStream(config *Config) bool {
+	if n := atomic.AddInt64(&liveStreams, 1); config.MaxStreams > 0 && n > int64(config.MaxStreams) {
+		atomic.AddInt64(&liveStreams, -1)
+		return false
+	}
+	return true
+}
+
+// releaseStream frees the slot of a stream done
+func releaseStream() {
+	atomic.AddInt64(&liveStreams, -1)
+}
+
+// acquireSession takes a slot for a new session, failing when --maxsessions
+// are live
+func acquireSession(config *Config) bool {
+	if n := atomic.AddInt64(&liveSessions, 1); config.MaxSessions > 0 && n > int64(config.MaxSessions) {
+		atomic.AddInt64(&liveSessions, -1)
+		return false
+	}
+	return true
+}
+
+// releaseSession frees the slot of a session done
+func releaseSession() {
+	atomic.AddInt64(&liveSessions, -1)
+}
+
+// handleStream forwards a stream to the target, the dial runs off the
+// accept loop so a hung target doesn't stall the other streams. A failed
+// dial only resets this stream, the session keeps serving the others. The
+// dial is traced as a child of span, its error returned. With ack, the
+// client is told how the dial went before any data.
+func handleStream(p1 io.ReadWriteCloser, target string, config *Config, span *generic.Span, ack func(generic.StreamStatus)) error {
+	dialSpan := tracer.Start("dial", span)
+	dialSpan.SetAttr("target", target)
+	p2, err := dialTarget(target, config)
+	dialSpan.SetError(err)
+	dialSpan.End()
+	if err != nil {
+		span.SetError(err)
+		if ack != nil {
+			ack(generic.StreamUnreachable)
+		}
+		p1.Close()
+		log.Println(err, "streams reset so far:", atomic.AddUint64(&dialFailures, 1))
+		return err
+	}
+	if ack != nil {
+		ack(generic.StreamOK)
+	}
+	if conn, ok := p2.(net.Conn); ok {
+		if err := generic.NewTCPOptions(config.TCPNoDelay, config.TCPKeepAlive, config.TCPLinger).Apply(conn); err != nil {
+			log.Println("tcp options:", err)
+		}
+	}
+	handleClient(p1, p2, config.Quiet)
+	return nil
+}
+
+// dialTarget connects to target, retrying with backoff so that streams
+// survive a target restarting, or spawns the target command
+func dialTarget(target string, config *Config) (io.ReadWriteCloser, error) {
+	if strings.HasPrefix(target, execPrefix) {
+		return startExec(strings.TrimPrefix(target, execPrefix))
+	}
+	network, address := generic.SplitNetwork(target)
+	if conn := pool.get(network, address); conn != nil {
+		return conn, nil
+	}
+	timeout := time.Duration(config.DialTimeout) * time.Second
+	backoff := 250 * time.Millisecond
+	for i := 0; ; i++ {
+		conn, err := dnsCache.Dial(network, address, timeout)
+		if err == nil || i >= config.DialRetries {
+			return conn, err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
 	}
 }
 
@@ -92,337 +361,1331 @@ func handleClient(p1, p2 io.ReadWriteCloser, quiet bool) {
 		log.Println("stream opened")
 		defer log.Println("stream closed")
 	}
-	defer p1.Close()
-	defer p2.Close()
-
-	// start tunnel
-	p1die := make(chan struct{})
-	go func() { io.Copy(p1, p2); close(p1die) }()
+	generic.Pipe(p1, p2)
+}
 
-	p2die := make(chan struct{})
-	go func() { io.Copy(p2, p1); close(p2die) }()
+func checkError(err error) {
+	generic.Exit(generic.ExitError, err)
+}
 
-	// wait for tunnel termination
-	select {
-	case <-p1die:
-	case <-p2die:
+// setSockOpts applies the socket options to a listening UDP socket
+func setSockOpts(conn *net.UDPConn, config *Config) {
+	if err := generic.SetDSCP(conn, config.DSCP); err != nil {
+		log.Println("SetDSCP:", err)
+	}
+	if err := generic.SetDF(conn, config.DF); err != nil {
+		log.Println("SetDF:", err)
+	}
+	if err := generic.SetTTL(conn, config.TTL); err != nil {
+		log.Println("SetTTL:", err)
+	}
+	if config.FWMark != 0 {
+		if err := generic.SetMark(conn, config.FWMark); err != nil {
+			log.Println("SetMark:", err)
+		}
+	}
+	if err := generic.TuneUDP(conn); err != nil {
+		log.Println("TuneUDP:", err)
+	}
+	if err := conn.SetReadBuffer(config.SockBuf); err != nil {
+		log.Println("SetReadBuffer:", err)
+	}
+	if err := conn.SetWriteBuffer(config.SockBuf); err != nil {
+		log.Println("SetWriteBuffer:", err)
 	}
 }
 
-func checkError(err error) {
+// listenPacket opens the UDP sockets of listen, an address or a port range
+// sharing the sessions, hopping over --port-range if set
+func listenPacket(listen string, config *Config) (net.PacketConn, string, error) {
+	host, lo, hi, err := generic.SplitListen(listen)
+	if err != nil {
+		return nil, "", err
+	}
+	udpaddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(lo)))
 	if err != nil {
-		log.Printf("%+v\n", err)
-		os.Exit(-1)
+		return nil, "", err
 	}
+	// an unspecified address listens dual-stack, unless the host
+	// disables IPv6 or sets net.ipv6.bindv6only
+	network := "udp"
+	switch {
+	case udpaddr.IP.To4() != nil:
+		network = "udp4"
+	case udpaddr.IP != nil && !udpaddr.IP.IsUnspecified():
+		network = "udp6"
+	}
+	// on an unspecified address, answer from the address the client reached
+	setup := func(conn *net.UDPConn) net.PacketConn {
+		setSockOpts(conn, config)
+		if udpaddr.IP != nil && !udpaddr.IP.IsUnspecified() {
+			return generic.ReadAhead(conn)
+		}
+		pconn, err := generic.NewPktInfoConn(conn)
+		if err != nil {
+			log.Println("pktinfo:", err)
+			return generic.ReadAhead(conn)
+		}
+		return generic.ReadAhead(pconn)
+	}
+	if config.PortRange == "" && hi == lo {
+		conn, err := net.ListenUDP(network, udpaddr)
+		if err != nil {
+			return nil, "", err
+		}
+		return setup(conn), network, nil
+	}
+
+	// every port shares the sessions
+	mconn := generic.NewMultiPortConn(network, udpaddr.IP, setup)
+	for port := lo; port <= hi; port++ {
+		if err := mconn.Listen(port); err != nil {
+			mconn.Close()
+			return nil, "", err
+		}
+	}
+	if config.PortRange != "" {
+		hopLo, hopHi, err := generic.ParsePortRange(config.PortRange)
+		if err != nil {
+			mconn.Close()
+			return nil, "", err
+		}
+		go mconn.Hop([]byte(config.Key), hopLo, hopHi, time.Duration(config.HopInterval)*time.Second)
+	}
+	return mconn, network, nil
 }
 
-func main() {
-	rand.Seed(int64(time.Now().Nanosecond()))
-	if VERSION == "SELFBUILD" {
-		// add more log flags for debugging
-		log.SetFlags(log.LstdFlags | log.Lshortfile)
+// loadConfig builds the server configuration from the command line,
+// the optional json file and the selected mode profile
+func loadConfig(c *cli.Context) Config {
+	// run by shadowsocks, the flags come from SS_PLUGIN_OPTIONS too
+	plugin, err := generic.ParsePluginEnv()
+	generic.Exit(generic.ExitConfig, err)
+	generic.Exit(generic.ExitConfig, plugin.Apply(c))
+
+	config := Config{}
+	// repeated, or comma separated in the json file
+	config.Listen = strings.Join(c.StringSlice("listen"), ",")
+	if config.Listen == "" {
+		config.Listen = ":29900"
+	}
+	// repeated, or comma separated in the json file
+	config.Target = strings.Join(c.StringSlice("target"), ",")
+	if config.Target == "" {
+		config.Target = "127.0.0.1:12948"
+	}
+	config.Balance = c.String("balance")
+	config.DialTimeout = c.Int("dial-timeout")
+	config.DialRetries = c.Int("dial-retries")
+	config.DNSCache = c.Int("dnscache")
+	config.Resolver = c.String("resolver")
+	config.Standby = c.String("standby")
+	config.HealthCheck = c.String("healthcheck")
+	config.HealthInterval = c.Int("healthinterval")
+	config.MaxSessionsPerIP = c.Int("max-sessions-per-ip")
+	config.MaxStreams = c.Int("maxstreams")
+	config.MaxSessions = c.Int("maxsessions")
+	config.MaxMemory = c.Int("max-memory")
+	config.StreamLife = c.Int("streamlife")
+	config.StreamLifeWarn = c.Int("streamlifewarn")
+	config.Quota = c.Int("quota")
+	config.QuotaPeriod = c.String("quotaperiod")
+	config.QuotaAction = c.String("quotaaction")
+	config.QuotaState = c.String("quotastate")
+	config.Pool = c.Int("pool")
+	config.PoolIdle = c.Int("poolidle")
+	config.Introducer = c.Bool("introducer")
+	config.Rendezvous = c.String("rendezvous")
+	config.PeerID = c.String("peer-id")
+	config.PortMap = c.Bool("portmap")
+	config.OTLP = c.String("otlp")
+	config.Webhook = c.String("webhook")
+	config.WebhookLoss = c.Int("webhookloss")
+	config.KVStore = c.String("kvstore")
+	config.AuditLog = c.String("auditlog")
+	config.Tun = c.String("tun")
+	config.Tap = c.String("tap")
+	config.TapFilter = c.String("tapfilter")
+	config.Key = c.String("key")
+	config.Crypt = c.String("crypt")
+	config.Mode = c.String("mode")
+	config.MTU = c.Int("mtu")
+	config.SndWnd = c.Int("sndwnd")
+	config.RcvWnd = c.Int("rcvwnd")
+	config.DataShard = c.Int("datashard")
+	config.ParityShard = c.Int("parityshard")
+	config.DSCP = c.Int("dscp")
+	config.DF = c.String("df")
+	config.TTL = c.Int("ttl")
+	config.FWMark = c.Int("fwmark")
+	config.NoComp = c.Bool("nocomp")
+	config.StreamComp = c.Bool("streamcomp")
+	config.AckNodelay = c.Bool("acknodelay")
+	config.NoDelay = c.Int("nodelay")
+	config.Interval = c.Int("interval")
+	config.Resend = c.Int("resend")
+	config.NoCongestion = c.Int("nc")
+	config.SockBuf = c.Int("sockbuf")
+	config.KeepAlive = c.Int("keepalive")
+	config.KeepAliveTimeout = c.Int("keepalivetimeout")
+	config.Handshake = c.String("handshake")
+	config.PQ = c.Bool("pq")
+	config.NoiseKey = c.String("noisekey")
+	config.NoiseClients = c.String("noiseclients")
+	config.Clients = c.String("clients")
+	config.HandshakeTimeout = c.Int("handshaketimeout")
+	config.ClockSkew = c.Int("clockskew")
+	config.NoResume = c.Bool("noresume")
+	config.IdleTimeout = c.Int("idletimeout")
+	config.TCPNoDelay = c.BoolT("tcp-nodelay")
+	config.TCPKeepAlive = c.Int("tcp-keepalive")
+	config.TCPLinger = c.Int("tcp-linger")
+	config.SmuxFrame = c.Int("smuxframe")
+	config.Log = c.String("log")
+	config.SnmpLog = c.String("snmplog")
+	config.SnmpPeriod = c.Int("snmpperiod")
+	config.Statsd = c.String("statsd")
+	config.StatsdPeriod = c.Int("statsdperiod")
+	config.StatsdPrefix = c.String("statsdprefix")
+	config.Admin = c.String("admin")
+	config.Pprof = c.Bool("pprof")
+	config.EchoProbe = c.Bool("echoprobe")
+	config.MDNS = c.String("mdns")
+	config.Decoy = c.String("decoy")
+	config.Multipath = c.Bool("multipath")
+	config.PortRange = c.String("port-range")
+	config.Padding = c.String("padding")
+	config.Records = c.String("records")
+	config.Obfs = c.String("obfs")
+	config.Chaff = c.Int("chaff")
+	config.Push = c.Bool("push")
+	config.HopInterval = c.Int("hop-interval")
+	config.Quiet = c.Bool("quiet")
+	config.Pcap = c.String("pcap")
+	config.PcapPlain = c.Bool("pcapplain")
+	config.Impair = c.String("impair")
+	config.Seed = c.Int64("seed")
+	config.TCP = c.Bool("tcp")
+	config.FakeTCP = c.String("faketcp")
+	config.QUICListen = c.String("quiclisten")
+	config.ICMP = c.Bool("icmp")
+	config.WSListen = c.String("wslisten")
+	config.DNS = c.String("dns")
+	config.DNSListen = c.String("dnslisten")
+	config.WSPath = c.String("wspath")
+	config.TLSCert = c.String("tlscert")
+	config.TLSKey = c.String("tlskey")
+
+	if c.String("c") != "" {
+		//Now only support json config file
+		err := parseJSONConfig(&config, c.String("c"))
+		generic.Exit(generic.ExitConfig, err)
 	}
+	if plugin != nil {
+		// between ss-local's plugin and ss-server
+		config.Listen, config.Target = plugin.Remote(), plugin.Local()
+	}
+	if config.StreamComp {
+		// the streams compress on their own
+		config.NoComp = true
+	}
+
+	if nodelay, interval, resend, nc, ok := generic.ModeProfile(config.Mode); ok {
+		config.NoDelay, config.Interval, config.Resend, config.NoCongestion = nodelay, interval, resend, nc
+	}
+	return config
+}
+
+// packetOverhead returns the bytes the padding and obfuscation below KCP
+// add to every packet
+func packetOverhead(config *Config) int {
+	var overhead int
+	if config.Padding != "" && config.Padding != "none" {
+		overhead += generic.PaddingOverhead
+	}
+	if obfs, _ := generic.NewObfuscator(config.Obfs, config.Key); obfs != nil {
+		overhead += obfs.Overhead()
+	}
+	return overhead
+}
+
+// newHello describes config for the hello exchange
+func newHello(config *Config) *generic.Hello {
+	hello := &generic.Hello{
+		Version:     generic.ProtocolVersion,
+		Crypt:       config.Crypt,
+		DataShard:   config.DataShard,
+		ParityShard: config.ParityShard,
+		NoComp:      config.NoComp,
+		StreamComp:  config.StreamComp,
+		PQ:          config.PQ,
+		Telemetry:   true,
+		StreamAck:   true,
+		Migrate:     true,
+		Checksum:    true,
+		Recv:        &generic.RecvParams{RcvWnd: config.RcvWnd},
+	}
+	hello.Tunnel = generic.TunnelKind(config.Tun, config.Tap)
+	if config.Push {
+		// the client's windows mirror the server's
+		hello.Push = &generic.Params{
+			MTU:          config.MTU,
+			SndWnd:       config.RcvWnd,
+			RcvWnd:       config.SndWnd,
+			NoDelay:      config.NoDelay,
+			Interval:     config.Interval,
+			Resend:       config.Resend,
+			NoCongestion: config.NoCongestion,
+		}
+	}
+	return hello
+}
+
+// NewApp returns the command line of the server, run by "kcptun server"
+func NewApp() *cli.App {
 	myApp := cli.NewApp()
 	myApp.Name = "kcptun"
+	myApp.HelpName = "kcptun server"
 	myApp.Usage = "server(with SMUX)"
-	myApp.Version = VERSION
+	myApp.Version = generic.VERSION
 	myApp.Flags = []cli.Flag{
-		cli.StringFlag{
-			Name:  "listen,l",
-			Value: ":29900",
-			Usage: "kcp server listen address",
+		cli.StringSliceFlag{
+			Name:   "listen,l",
+			Usage:  "kcp server listen address, or a port range sharing the sessions, like :20000-20100, repeat to listen on several (default: \":29900\")",
+			EnvVar: "KCPTUN_LISTEN",
+		},
+		cli.StringSliceFlag{
+			Name:   "target, t",
+			Usage:  "target server address, unix:/path/to.sock for a unix socket, or exec:/path/to/command to spawn per stream, repeat to balance over several (default: \"127.0.0.1:12948\")",
+			EnvVar: "KCPTUN_TARGET",
 		},
 		cli.StringFlag{
-			Name:  "target, t",
-			Value: "127.0.0.1:12948",
-			Usage: "target server address",
+			Name:   "balance",
+			Value:  "roundrobin",
+			Usage:  "spreads the streams over several targets: roundrobin, leastconn(the fewest streams open), hash(the same for all streams of a client)",
+			EnvVar: "KCPTUN_BALANCE",
+		},
+		cli.IntFlag{
+			Name:   "dial-timeout",
+			Value:  5,
+			Usage:  "seconds to wait for a connection to the target",
+			EnvVar: "KCPTUN_DIAL_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "dial-retries",
+			Value:  2,
+			Usage:  "times to retry a failed target connection, waiting 250ms, 500ms, ... in between",
+			EnvVar: "KCPTUN_DIAL_RETRIES",
+		},
+		cli.IntFlag{
+			Name:   "dnscache",
+			Value:  60,
+			Usage:  "cache the addresses of targets given by name for up to this many seconds, failures for 10 seconds, 0 to ask the resolver on every dial",
+			EnvVar: "KCPTUN_DNSCACHE",
 		},
 		cli.StringFlag{
-			Name:   "key",
-			Value:  "it's a secrect",
-			Usage:  "pre-shared secret between client and server",
-			EnvVar: "KCPTUN_KEY",
+			Name:   "resolver",
+			Value:  "",
+			Usage:  "resolve the targets with this DNS server, like 1.1.1.1:53, or DNS-over-HTTPS url, like https://1.1.1.1/dns-query, instead of the system resolver, needs dnscache",
+			EnvVar: "KCPTUN_RESOLVER",
 		},
 		cli.StringFlag{
-			Name:  "crypt",
-			Value: "aes",
-			Usage: "aes, aes-128, aes-192, salsa20, blowfish, twofish, cast5, 3des, tea, xtea, xor, sm4, none",
+			Name:   "standby",
+			Value:  "",
+			Usage:  "target address the streams go to while --target fails its health checks",
+			EnvVar: "KCPTUN_STANDBY",
 		},
 		cli.StringFlag{
-			Name:  "mode",
-			Value: "fast",
-			Usage: "profiles: fast3, fast2, fast, normal, manual",
+			Name:   "healthcheck",
+			Value:  "none",
+			Usage:  "probe the targets: none, tcp(connect), or an HTTP path to GET like /health",
+			EnvVar: "KCPTUN_HEALTHCHECK",
+		},
+		cli.IntFlag{
+			Name:   "healthinterval",
+			Value:  10,
+			Usage:  "seconds between the health checks of a target",
+			EnvVar: "KCPTUN_HEALTHINTERVAL",
+		},
+		cli.IntFlag{
+			Name:   "max-sessions-per-ip",
+			Value:  0,
+			Usage:  "live sessions allowed from one source IP, more are dropped and counted in stats, 0 for unlimited",
+			EnvVar: "KCPTUN_MAX_SESSIONS_PER_IP",
+		},
+		cli.IntFlag{
+			Name:   "maxstreams",
+			Value:  0,
+			Usage:  "live streams allowed over all sessions, more are answered as over capacity, 0 for unlimited",
+			EnvVar: "KCPTUN_MAXSTREAMS",
+		},
+		cli.IntFlag{
+			Name:   "maxsessions",
+			Value:  0,
+			Usage:  "live sessions allowed, the hellos of more are answered as server busy, 0 for unlimited",
+			EnvVar: "KCPTUN_MAXSESSIONS",
 		},
 		cli.IntFlag{
-			Name:  "mtu",
-			Value: 1350,
-			Usage: "set maximum transmission unit for UDP packets",
+			Name:   "max-memory",
+			Value:  0,
+			Usage:  "MB the windows of all sessions may buffer, new sessions get smaller windows or are answered as server busy past it, 0 for unlimited",
+			EnvVar: "KCPTUN_MAX_MEMORY",
 		},
 		cli.IntFlag{
-			Name:  "sndwnd",
-			Value: 1024,
-			Usage: "set send window size(num of packets)",
+			Name:   "streamlife",
+			Value:  0,
+			Usage:  "seconds a stream may live before it's closed, like 86400 for a day, 0 for unlimited",
+			EnvVar: "KCPTUN_STREAMLIFE",
 		},
 		cli.IntFlag{
-			Name:  "rcvwnd",
-			Value: 1024,
-			Usage: "set receive window size(num of packets)",
+			Name:   "streamlifewarn",
+			Value:  300,
+			Usage:  "seconds ahead of --streamlife to log a warning about the stream",
+			EnvVar: "KCPTUN_STREAMLIFEWARN",
 		},
 		cli.IntFlag{
-			Name:  "datashard,ds",
-			Value: 10,
-			Usage: "set reed-solomon erasure coding - datashard",
+			Name:   "quota",
+			Value:  0,
+			Usage:  "GB the server may transfer each --quotaperiod, both ways, 0 for unlimited",
+			EnvVar: "KCPTUN_QUOTA",
+		},
+		cli.StringFlag{
+			Name:   "quotaperiod",
+			Value:  "month",
+			Usage:  "period of the quotas, starting at local midnight: day, month",
+			EnvVar: "KCPTUN_QUOTAPERIOD",
+		},
+		cli.StringFlag{
+			Name:   "quotaaction",
+			Value:  "stop",
+			Usage:  "past a quota: stop(refuse new streams, let the open ones finish), throttle(slow everything to a trickle)",
+			EnvVar: "KCPTUN_QUOTAACTION",
+		},
+		cli.StringFlag{
+			Name:   "quotastate",
+			Value:  "",
+			Usage:  "file to keep the transfer of the period in across restarts",
+			EnvVar: "KCPTUN_QUOTASTATE",
 		},
 		cli.IntFlag{
-			Name:  "parityshard,ps",
-			Value: 3,
-			Usage: "set reed-solomon erasure coding - parityshard",
+			Name:   "pool",
+			Value:  0,
+			Usage:  "connections to each target kept dialed ahead of the streams, 0 to dial on demand",
+			EnvVar: "KCPTUN_POOL",
 		},
 		cli.IntFlag{
-			Name:  "dscp",
-			Value: 0,
-			Usage: "set DSCP(6bit)",
+			Name:   "poolidle",
+			Value:  30,
+			Usage:  "seconds after which an unused pooled connection is replaced, before the target drops it",
+			EnvVar: "KCPTUN_POOLIDLE",
 		},
 		cli.BoolFlag{
-			Name:  "nocomp",
-			Usage: "disable compression",
+			Name:   "introducer",
+			Usage:  "introduce clients to the servers registered here by peer id, for direct sessions through NAT",
+			EnvVar: "KCPTUN_INTRODUCER",
+		},
+		cli.StringFlag{
+			Name:   "rendezvous",
+			Value:  "",
+			Usage:  "address of an introducer to register with, for a server behind NAT",
+			EnvVar: "KCPTUN_RENDEZVOUS",
+		},
+		cli.StringFlag{
+			Name:   "peer-id",
+			Value:  "",
+			Usage:  "peer id to register with --rendezvous, clients connect with --peer",
+			EnvVar: "KCPTUN_PEER_ID",
 		},
 		cli.BoolFlag{
-			Name:   "acknodelay",
-			Usage:  "flush ack immediately when a packet is received",
-			Hidden: true,
+			Name:   "portmap",
+			Usage:  "forward the listen ports on the home gateway with NAT-PMP or UPnP, renewing the mappings",
+			EnvVar: "KCPTUN_PORTMAP",
+		},
+		cli.StringFlag{
+			Name:   "tun",
+			Value:  "",
+			Usage:  "relay IP packets of this TUN interface, like tun0, instead of forwarding streams to the target",
+			EnvVar: "KCPTUN_TUN",
 		},
+		cli.StringFlag{
+			Name:   "tap",
+			Value:  "",
+			Usage:  "bridge Ethernet frames of this TAP interface, like tap0, instead of forwarding streams to the target",
+			EnvVar: "KCPTUN_TAP",
+		},
+		generic.TapFilterFlag,
+		generic.KeyFlag,
+		generic.CryptFlag,
+		generic.ModeFlag,
+		generic.MTUFlag,
 		cli.IntFlag{
-			Name:   "nodelay",
-			Value:  0,
-			Hidden: true,
+			Name:   "sndwnd",
+			Value:  1024,
+			Usage:  "set send window size(num of packets)",
+			EnvVar: "KCPTUN_SNDWND",
 		},
 		cli.IntFlag{
-			Name:   "interval",
-			Value:  50,
-			Hidden: true,
+			Name:   "rcvwnd",
+			Value:  1024,
+			Usage:  "set receive window size(num of packets)",
+			EnvVar: "KCPTUN_RCVWND",
+		},
+		generic.DataShardFlag,
+		generic.ParityShardFlag,
+		generic.DSCPFlag,
+		generic.DFFlag,
+		generic.TTLFlag,
+		generic.FWMarkFlag,
+		generic.NoCompFlag,
+		generic.StreamCompFlag,
+		generic.AckNodelayFlag,
+		generic.NoDelayFlag,
+		generic.IntervalFlag,
+		generic.ResendFlag,
+		generic.NoCongestionFlag,
+		generic.SockBufFlag,
+		generic.KeepAliveFlag,
+		generic.KeepAliveTimeoutFlag,
+		cli.StringFlag{
+			Name:   "handshake",
+			Value:  "none",
+			Usage:  "key exchange starting every session: none(pre-shared key only), tls(TLS 1.3 with the --tlscert certificate, or one bound to the key), noise-ik, noise-xk(Noise with --noisekey), must match the client",
+			EnvVar: "KCPTUN_HANDSHAKE",
+		},
+		cli.StringFlag{
+			Name:   "noisekey",
+			Value:  "",
+			Usage:  "the server's noise private key in base64, from genkey --noise",
+			EnvVar: "KCPTUN_NOISEKEY",
+		},
+		cli.StringFlag{
+			Name:   "noiseclients",
+			Value:  "",
+			Usage:  "comma separated noise public keys of the clients allowed, any client when empty",
+			EnvVar: "KCPTUN_NOISECLIENTS",
+		},
+		cli.StringFlag{
+			Name:   "clients",
+			Value:  "",
+			Usage:  "json file of the clients allowed, by name, with their noise key or certificate pin, target and bandwidth, reloaded on SIGHUP",
+			EnvVar: "KCPTUN_CLIENTS",
+		},
+		cli.BoolFlag{
+			Name:   "pq",
+			Usage:  "accept the hybrid X25519+Kyber768 key exchange clients offer in the noise handshake",
+			EnvVar: "KCPTUN_PQ",
+		},
+		cli.IntFlag{
+			Name:   "handshaketimeout",
+			Value:  30,
+			Usage:  "seconds to wait for a new session's hello, clients without it send a smux keepalive within keepalive seconds",
+			EnvVar: "KCPTUN_HANDSHAKETIMEOUT",
 		},
 		cli.IntFlag{
-			Name:   "resend",
+			Name:   "clockskew",
 			Value:  0,
-			Hidden: true,
+			Usage:  "refuse hellos stamped more than this many seconds away from the server's clock, or replayed, 0 to accept any",
+			EnvVar: "KCPTUN_CLOCKSKEW",
+		},
+		cli.BoolFlag{
+			Name:   "noresume",
+			Usage:  "issue no resumption tokens, clients do a full hello and key exchange every session",
+			EnvVar: "KCPTUN_NORESUME",
+		},
+		cli.IntFlag{
+			Name:   "idletimeout",
+			Value:  0,
+			Usage:  "seconds a session may stay without streams before it's closed, 0 to disable",
+			EnvVar: "KCPTUN_IDLETIMEOUT",
+		},
+		cli.BoolTFlag{
+			Name:   "tcp-nodelay",
+			Usage:  "disable Nagle's algorithm on the target TCP connections, --tcp-nodelay=false to enable it",
+			EnvVar: "KCPTUN_TCP_NODELAY",
 		},
 		cli.IntFlag{
-			Name:   "nc",
+			Name:   "tcp-keepalive",
 			Value:  0,
-			Hidden: true,
+			Usage:  "seconds between TCP keepalive probes on the target connections, 0 for the system default",
+			EnvVar: "KCPTUN_TCP_KEEPALIVE",
 		},
 		cli.IntFlag{
-			Name:   "sockbuf",
-			Value:  4194304, // socket buffer size in bytes
-			Hidden: true,
+			Name:   "tcp-linger",
+			Value:  -1,
+			Usage:  "SO_LINGER seconds of the target connections, 0 to reset on close, -1 for the system default",
+			EnvVar: "KCPTUN_TCP_LINGER",
+		},
+		generic.SmuxFrameFlag,
+		generic.SnmpLogFlag,
+		generic.SnmpPeriodFlag,
+		generic.StatsdFlag,
+		generic.StatsdPeriodFlag,
+		cli.StringFlag{
+			Name:   "statsdprefix",
+			Value:  "kcptun.server",
+			Usage:  "prefix of the statsd metric names",
+			EnvVar: "KCPTUN_STATSDPREFIX",
+		},
+		generic.AdminFlag,
+		cli.BoolFlag{
+			Name:   "pprof",
+			Usage:  "start profiling server on :6060",
+			EnvVar: "KCPTUN_PPROF",
+		},
+		cli.BoolFlag{
+			Name:   "echoprobe",
+			Usage:  "answer plaintext probes from 'client ping', this reveals the server to active probing",
+			EnvVar: "KCPTUN_ECHOPROBE",
+		},
+		cli.StringFlag{
+			Name:   "mdns",
+			Value:  "",
+			Usage:  "announce the server on the local network under this name, for clients with --remoteaddr auto to find it, this reveals the server to the network",
+			EnvVar: "KCPTUN_MDNS",
+		},
+		cli.StringFlag{
+			Name:   "decoy",
+			Value:  "none",
+			Usage:  "answer the packets that don't decrypt under the key as another service would: none(drop them), dns(a DNS server refusing the query)",
+			EnvVar: "KCPTUN_DECOY",
+		},
+		cli.BoolFlag{
+			Name:   "multipath",
+			Usage:  "accept clients bonding several paths with --multipath, implies echoprobe",
+			EnvVar: "KCPTUN_MULTIPATH",
+		},
+		cli.StringFlag{
+			Name:   "port-range",
+			Value:  "",
+			Usage:  "hop over the ports in this range with the clients, like 20000-30000, in addition to the listen port",
+			EnvVar: "KCPTUN_PORT_RANGE",
 		},
 		cli.IntFlag{
-			Name:   "keepalive",
-			Value:  10, // nat keepalive interval in seconds
-			Hidden: true,
+			Name:   "hop-interval",
+			Value:  60,
+			Usage:  "seconds between port hops, must match the clients",
+			EnvVar: "KCPTUN_HOP_INTERVAL",
 		},
 		cli.StringFlag{
-			Name:  "snmplog",
-			Value: "",
-			Usage: "collect snmp to file, aware of timeformat in golang, like: ./snmp-20060102.log",
+			Name:   "padding",
+			Value:  "none",
+			Usage:  "pad the replies to padding clients: none, random(random sizes within mtu), bucket(multiples of 128 bytes)",
+			EnvVar: "KCPTUN_PADDING",
+		},
+		generic.RecordsFlag,
+		cli.StringFlag{
+			Name:   "obfs",
+			Value:  "none",
+			Usage:  "disguise the UDP packets: none, scramble(keyed header scrambling), dtls(DTLS 1.2 records), must match the client",
+			EnvVar: "KCPTUN_OBFS",
 		},
 		cli.IntFlag{
-			Name:  "snmpperiod",
-			Value: 60,
-			Usage: "snmp collect period, in seconds",
+			Name:   "chaff",
+			Value:  0,
+			Usage:  "drop the clients' dummy packets and send bursts of them about every N seconds to idle clients, 0 to disable",
+			EnvVar: "KCPTUN_CHAFF",
 		},
 		cli.BoolFlag{
-			Name:  "pprof",
-			Usage: "start profiling server on :6060",
+			Name:   "push",
+			Usage:  "push mtu, mode and windows to the clients, their sndwnd is set to the server's rcvwnd and vice versa",
+			EnvVar: "KCPTUN_PUSH",
+		},
+		generic.LogFlag,
+		generic.QuietFlag,
+		cli.BoolFlag{
+			Name:   "tcp",
+			Usage:  "also accept tcp carriers on the listen address, for clients blocked on UDP",
+			EnvVar: "KCPTUN_TCP",
+		},
+		cli.StringFlag{
+			Name:   "faketcp",
+			Value:  "",
+			Usage:  "also accept faketcp flows(raw TCP segments) on this address, like :443, needs CAP_NET_RAW",
+			EnvVar: "KCPTUN_FAKETCP",
 		},
 		cli.StringFlag{
-			Name:  "log",
-			Value: "",
-			Usage: "specify a log file to output, default goes to stderr",
+			Name:   "quiclisten",
+			Value:  "",
+			Usage:  "also accept QUIC sessions on this UDP address, like :29901, for comparing QUIC with KCP",
+			EnvVar: "KCPTUN_QUICLISTEN",
 		},
 		cli.BoolFlag{
-			Name:  "quiet",
-			Usage: "to suppress the 'stream open/close' messages",
+			Name:   "icmp",
+			Usage:  "also accept ICMP echo tunnels on the listen address, needs CAP_NET_RAW",
+			EnvVar: "KCPTUN_ICMP",
+		},
+		cli.StringFlag{
+			Name:   "dns",
+			Value:  "",
+			Usage:  "also accept DNS tunnels as the authoritative name server of this domain, like t.example.com",
+			EnvVar: "KCPTUN_DNS",
+		},
+		cli.StringFlag{
+			Name:   "dnslisten",
+			Value:  ":53",
+			Usage:  "UDP address of the name server for --dns",
+			EnvVar: "KCPTUN_DNSLISTEN",
+		},
+		cli.StringFlag{
+			Name:   "wslisten",
+			Value:  "",
+			Usage:  "also accept websocket carriers on this address, like :443, for clients blocked on UDP",
+			EnvVar: "KCPTUN_WSLISTEN",
+		},
+		cli.StringFlag{
+			Name:   "wspath",
+			Value:  "/",
+			Usage:  "http path of the websocket endpoint",
+			EnvVar: "KCPTUN_WSPATH",
 		},
 		cli.StringFlag{
-			Name:  "c",
-			Value: "", // when the value is not empty, the config path must exists
-			Usage: "config from json file, which will override the command from shell",
+			Name:   "tlscert",
+			Value:  "",
+			Usage:  "certificate file, serve the websocket endpoint over TLS, and present it with --handshake tls",
+			EnvVar: "KCPTUN_TLSCERT",
 		},
+		generic.TLSKeyFlag,
+		cli.StringFlag{
+			Name:   "auditlog",
+			Value:  "",
+			Usage:  "append a JSON line per closed session and stream to this file, with the remote address, parameters, target, bytes and close reason",
+			EnvVar: "KCPTUN_AUDITLOG",
+		},
+		generic.OTLPFlag,
+		cli.StringFlag{
+			Name:   "webhook",
+			Value:  "",
+			Usage:  "POST JSON events to this URL: up, down, session_established, session_lost, loss, loss_recovered, quota_exceeded, target_down, target_up",
+			EnvVar: "KCPTUN_WEBHOOK",
+		},
+		generic.WebhookLossFlag,
+		cli.StringFlag{
+			Name:   "kvstore",
+			Value:  "",
+			Usage:  "take the target, limits and clients from consul://host:8500/prefix or etcd://host:2379/prefix, as they change",
+			EnvVar: "KCPTUN_KVSTORE",
+		},
+		generic.PcapFlag,
+		generic.PcapPlainFlag,
+		generic.ImpairFlag,
+		generic.SeedFlag,
+		generic.ConfigFlag,
+	}
+	myApp.Commands = []cli.Command{
+		checkCommand,
+		relayCommand,
+		generic.GenKeyCommand,
+		generic.TopCommand,
 	}
 	myApp.Action = func(c *cli.Context) error {
-		config := Config{}
-		config.Listen = c.String("listen")
-		config.Target = c.String("target")
-		config.Key = c.String("key")
-		config.Crypt = c.String("crypt")
-		config.Mode = c.String("mode")
-		config.MTU = c.Int("mtu")
-		config.SndWnd = c.Int("sndwnd")
-		config.RcvWnd = c.Int("rcvwnd")
-		config.DataShard = c.Int("datashard")
-		config.ParityShard = c.Int("parityshard")
-		config.DSCP = c.Int("dscp")
-		config.NoComp = c.Bool("nocomp")
-		config.AckNodelay = c.Bool("acknodelay")
-		config.NoDelay = c.Int("nodelay")
-		config.Interval = c.Int("interval")
-		config.Resend = c.Int("resend")
-		config.NoCongestion = c.Int("nc")
-		config.SockBuf = c.Int("sockbuf")
-		config.KeepAlive = c.Int("keepalive")
-		config.Log = c.String("log")
-		config.SnmpLog = c.String("snmplog")
-		config.SnmpPeriod = c.Int("snmpperiod")
-		config.Pprof = c.Bool("pprof")
-		config.Quiet = c.Bool("quiet")
-
-		if c.String("c") != "" {
-			//Now only support json config file
-			err := parseJSONConfig(&config, c.String("c"))
-			checkError(err)
-		}
+		watchSignals()
+		config := loadConfig(c)
 
 		// log redirect
 		if config.Log != "" {
 			f, err := os.OpenFile(config.Log, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-			checkError(err)
+			if err != nil {
+				return generic.Fatal(generic.ExitBind, err)
+			}
 			defer f.Close()
 			log.SetOutput(f)
 		}
 
-		switch config.Mode {
-		case "normal":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 0, 40, 2, 1
-		case "fast":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 0, 30, 2, 1
-		case "fast2":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 1, 20, 2, 1
-		case "fast3":
-			config.NoDelay, config.Interval, config.Resend, config.NoCongestion = 1, 10, 2, 1
+		log.Println("version:", generic.VERSION)
+		if config.Key == generic.DefaultKey {
+			log.Println("WARNING: running with the public default key, generate one with 'genkey'")
+		}
+		if err := generic.TuneTimers(); err != nil {
+			log.Println("TuneTimers:", err)
 		}
-
-		log.Println("version:", VERSION)
-		pass := pbkdf2.Key([]byte(config.Key), []byte(SALT), 4096, 32, sha1.New)
 		var block kcp.BlockCrypt
-		switch config.Crypt {
-		case "sm4":
-			block, _ = kcp.NewSM4BlockCrypt(pass[:16])
-		case "tea":
-			block, _ = kcp.NewTEABlockCrypt(pass[:16])
-		case "xor":
-			block, _ = kcp.NewSimpleXORBlockCrypt(pass)
-		case "none":
-			block, _ = kcp.NewNoneBlockCrypt(pass)
-		case "aes-128":
-			block, _ = kcp.NewAESBlockCrypt(pass[:16])
-		case "aes-192":
-			block, _ = kcp.NewAESBlockCrypt(pass[:24])
-		case "blowfish":
-			block, _ = kcp.NewBlowfishBlockCrypt(pass)
-		case "twofish":
-			block, _ = kcp.NewTwofishBlockCrypt(pass)
-		case "cast5":
-			block, _ = kcp.NewCast5BlockCrypt(pass[:16])
-		case "3des":
-			block, _ = kcp.NewTripleDESBlockCrypt(pass[:24])
-		case "xtea":
-			block, _ = kcp.NewXTEABlockCrypt(pass[:16])
-		case "salsa20":
-			block, _ = kcp.NewSalsa20BlockCrypt(pass)
-		default:
-			config.Crypt = "aes"
-			block, _ = kcp.NewAESBlockCrypt(pass)
-		}
-
-		lis, err := kcp.ListenWithOptions(config.Listen, block, config.DataShard, config.ParityShard)
-		checkError(err)
-		log.Println("listening on:", lis.Addr())
-		log.Println("target:", config.Target)
+		block, config.Crypt = generic.NewBlockCrypt(config.Key, config.Crypt)
+		if err := generic.CheckDF(config.DF); err != nil {
+			return generic.Fatal(generic.ExitConfig, err)
+		}
+
+		// the first address also serves the carriers and icmp, all the
+		// ports are mapped
+		listens := strings.Split(config.Listen, ",")
+		var ports []int
+		for _, listen := range listens {
+			_, lo, hi, err := generic.SplitListen(listen)
+			if err != nil {
+				return generic.Fatal(generic.ExitConfig, err)
+			}
+			for port := lo; port <= hi; port++ {
+				ports = append(ports, port)
+			}
+		}
+		host, lo, _, _ := generic.SplitListen(listens[0])
+		udpaddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(lo)))
+		if err != nil {
+			return generic.Fatal(generic.ExitConfig, err)
+		}
+		if config.PortRange != "" {
+			if _, _, err := generic.ParsePortRange(config.PortRange); err != nil {
+				return generic.Fatal(generic.ExitConfig, err)
+			}
+		}
+		if err := generic.CheckDecoy(config.Decoy); err != nil {
+			return generic.Fatal(generic.ExitConfig, err)
+		}
+		obfs, err := generic.NewObfuscator(config.Obfs, config.Key)
+		if err != nil {
+			return generic.Fatal(generic.ExitConfig, err)
+		}
+		var pcap *generic.PcapWriter
+		if config.Pcap != "" {
+			if pcap, err = generic.NewPcapWriter(config.Pcap); err != nil {
+				return generic.Fatal(generic.ExitBind, err)
+			}
+			defer pcap.Close()
+		}
+		var impairment *generic.Impairment
+		if config.Impair != "" {
+			if impairment, err = generic.ParseImpairment(config.Impair); err != nil {
+				return generic.Fatal(generic.ExitConfig, err)
+			}
+		}
+		if config.Padding != "" && config.Padding != "none" {
+			if err := generic.CheckPaddingMode(config.Padding); err != nil {
+				return generic.Fatal(generic.ExitConfig, err)
+			}
+		}
+
+		// every address has sockets of its own, their sessions are served
+		// alike, with the same targets, keys and limits
+		var listeners []*kcp.Listener
+		for k, listen := range listens {
+			pconn, network, err := listenPacket(listen, &config)
+			if err != nil {
+				return generic.Fatal(generic.ExitBind, err)
+			}
+			if k == 0 && (config.Introducer || config.Rendezvous != "") {
+				rconn := generic.NewRendezvousConn(pconn, config.Key, config.Introducer)
+				if config.Rendezvous != "" {
+					go func() {
+						log.Println("rendezvous:", rconn.Register(config.Rendezvous, config.PeerID))
+					}()
+				}
+				pconn = rconn
+			}
+			if obfs != nil {
+				pconn = generic.NewObfsConn(pconn, obfs)
+			}
+			if pcap != nil {
+				var plain kcp.BlockCrypt
+				if config.PcapPlain {
+					plain = block
+				}
+				pconn = generic.NewPcapConn(pconn, pcap, plain)
+			}
+			if impairment != nil {
+				pconn = generic.NewImpairConn(pconn, impairment)
+			}
+			if config.Padding != "" && config.Padding != "none" {
+				pconn = generic.NewPadConn(pconn, config.Key, config.Padding, config.MTU, true)
+			}
+			// multipath clients measure their paths with probes
+			if config.EchoProbe || config.Multipath {
+				pconn = generic.NewEchoConn(pconn)
+			}
+			if config.Multipath {
+				pconn = generic.NewBondConn(pconn)
+			}
+			if config.Chaff > 0 {
+				pconn = generic.NewChaffConn(pconn, config.Key, time.Duration(config.Chaff)*time.Second, nil)
+			}
+			// answer the clients' kcpkeepalive pings and fingerprints
+			pconn = generic.NewHeartbeatConn(pconn, config.Key, nil, 0, 0)
+			pconn = generic.NewFingerprintConn(pconn, config.Key, newHello(&config), nil)
+			pconn = generic.NewDecoyConn(pconn, block, config.Decoy)
+			pconn = stats.TimePackets(pconn)
+			lis, err := kcp.ServeConn(block, config.DataShard, config.ParityShard, pconn)
+			if err != nil {
+				return generic.Fatal(generic.ExitBind, err)
+			}
+			if _, lo, hi, _ := generic.SplitListen(listen); hi > lo {
+				log.Println("listening on:", lis.Addr(), network, "ports:", lo, "-", hi)
+			} else {
+				log.Println("listening on:", lis.Addr(), network)
+			}
+			listeners = append(listeners, lis)
+		}
+		lis := listeners[0]
+		log.Println("target:", config.Target, "balance:", config.Balance)
+		if err := checkBalance(config.Balance); err != nil {
+			return generic.Fatal(generic.ExitConfig, err)
+		}
+		log.Println("tun:", config.Tun, "tap:", config.Tap, "tapfilter:", config.TapFilter)
+		log.Println("dial-timeout:", config.DialTimeout, "dial-retries:", config.DialRetries, "dnscache:", config.DNSCache, "resolver:", config.Resolver)
+		if config.Resolver != "" && config.DNSCache <= 0 {
+			return generic.Fatal(generic.ExitConfig, errors.New("resolver: needs dnscache"))
+		}
+		if config.DNSCache > 0 {
+			dnsCache = generic.NewDNSCache(config.Resolver, time.Duration(config.DNSCache)*time.Second)
+		}
+		log.Println("standby:", config.Standby, "healthcheck:", config.HealthCheck, "healthinterval:", config.HealthInterval)
+		if err := checkHealthCheck(config.HealthCheck); err != nil {
+			return generic.Fatal(generic.ExitConfig, err)
+		}
+		log.Println("max-sessions-per-ip:", config.MaxSessionsPerIP, "maxstreams:", config.MaxStreams, "maxsessions:", config.MaxSessions, "max-memory:", config.MaxMemory)
+		if config.MaxMemory > 0 {
+			memory = newMemoryBudget(config.MaxMemory)
+		}
+		log.Println("streamlife:", config.StreamLife, "streamlifewarn:", config.StreamLifeWarn)
+		log.Println("quota:", config.Quota, "quotaperiod:", config.QuotaPeriod, "quotaaction:", config.QuotaAction, "quotastate:", config.QuotaState)
+		if err := checkQuotaMode(config.QuotaAction, config.QuotaPeriod); err != nil {
+			return generic.Fatal(generic.ExitConfig, err)
+		}
+		log.Println("pool:", config.Pool, "poolidle:", config.PoolIdle)
+		log.Println("introducer:", config.Introducer, "rendezvous:", config.Rendezvous, "peer-id:", config.PeerID)
+		log.Println("portmap:", config.PortMap)
 		log.Println("encryption:", config.Crypt)
 		log.Println("nodelay parameters:", config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
 		log.Println("sndwnd:", config.SndWnd, "rcvwnd:", config.RcvWnd)
-		log.Println("compression:", !config.NoComp)
+		log.Println("compression:", !config.NoComp, "streamcomp:", config.StreamComp)
 		log.Println("mtu:", config.MTU)
 		log.Println("datashard:", config.DataShard, "parityshard:", config.ParityShard)
 		log.Println("acknodelay:", config.AckNodelay)
-		log.Println("dscp:", config.DSCP)
+		log.Println("dscp:", config.DSCP, "df:", config.DF, "ttl:", config.TTL)
+		log.Println("fwmark:", config.FWMark)
 		log.Println("sockbuf:", config.SockBuf)
-		log.Println("keepalive:", config.KeepAlive)
+		log.Println("keepalive:", config.KeepAlive, "keepalivetimeout:", config.KeepAliveTimeout)
+		log.Println("handshake:", config.Handshake, "pq:", config.PQ, "noiseclients:", config.NoiseClients, "clients:", config.Clients)
+		log.Println("handshaketimeout:", config.HandshakeTimeout, "idletimeout:", config.IdleTimeout, "clockskew:", config.ClockSkew, "noresume:", config.NoResume)
+		log.Println("smuxframe:", config.SmuxFrame)
+		log.Println("tcp-nodelay:", config.TCPNoDelay, "tcp-keepalive:", config.TCPKeepAlive, "tcp-linger:", config.TCPLinger)
 		log.Println("snmplog:", config.SnmpLog)
 		log.Println("snmpperiod:", config.SnmpPeriod)
+		log.Println("statsd:", config.Statsd, "statsdperiod:", config.StatsdPeriod, "statsdprefix:", config.StatsdPrefix)
+		log.Println("admin:", config.Admin)
 		log.Println("pprof:", config.Pprof)
+		log.Println("otlp:", config.OTLP)
+		log.Println("webhook:", config.Webhook, "webhookloss:", config.WebhookLoss)
+		if err := generic.CheckWebhook(config.Webhook); err != nil {
+			return generic.Fatal(generic.ExitConfig, err)
+		}
+		log.Println("kvstore:", config.KVStore)
+		var kvSrc kvSource
+		if config.KVStore != "" {
+			if kvSrc, err = newKVSource(config.KVStore); err != nil {
+				return generic.Fatal(generic.ExitConfig, err)
+			}
+		}
+		log.Println("auditlog:", config.AuditLog)
+		log.Println("echoprobe:", config.EchoProbe, "decoy:", config.Decoy, "mdns:", config.MDNS)
+		log.Println("multipath:", config.Multipath)
+		log.Println("port-range:", config.PortRange, "hop-interval:", config.HopInterval)
+		log.Println("padding:", config.Padding)
+		log.Println("records:", config.Records)
+		if _, _, err := generic.ParseRecords(config.Records); err != nil {
+			return generic.Fatal(generic.ExitConfig, err)
+		}
+		log.Println("obfs:", config.Obfs)
+		log.Println("chaff:", config.Chaff)
+		log.Println("push:", config.Push)
+		log.Println("pcap:", config.Pcap, "pcapplain:", config.PcapPlain)
+		log.Println("impair:", config.Impair, "seed:", config.Seed)
+		if config.Seed != 0 {
+			generic.SetSeed(config.Seed)
+		}
+		log.Println("tcp:", config.TCP)
+		log.Println("faketcp:", config.FakeTCP)
+		log.Println("quiclisten:", config.QUICListen)
+		log.Println("icmp:", config.ICMP)
+		log.Println("dns:", config.DNS, "dnslisten:", config.DNSListen)
+		log.Println("wslisten:", config.WSListen, "wspath:", config.WSPath, "tls:", config.TLSCert != "")
 		log.Println("quiet:", config.Quiet)
 
-		if err := lis.SetDSCP(config.DSCP); err != nil {
-			log.Println("SetDSCP:", err)
+		go generic.SnmpLogger(config.SnmpLog, config.SnmpPeriod, "DialFailures", func() string {
+			return fmt.Sprint(atomic.LoadUint64(&dialFailures))
+		})
+		if config.Statsd != "" {
+			go generic.StatsdSink(config.Statsd, config.StatsdPrefix, time.Duration(config.StatsdPeriod)*time.Second, stats)
+		}
+		if config.Admin != "" {
+			admin, err := generic.ListenStream(config.Admin)
+			if err != nil {
+				return generic.Fatal(generic.ExitBind, err)
+			}
+			go generic.ServeAdmin(admin, stats)
 		}
-		if err := lis.SetReadBuffer(config.SockBuf); err != nil {
-			log.Println("SetReadBuffer:", err)
+		tracer = generic.NewTracer(config.OTLP, "kcptun-server")
+		webhook = generic.NewWebhook(config.Webhook, "kcptun-server")
+		webhook.WatchLoss(float64(config.WebhookLoss))
+		pass := generic.DeriveKey(config.Key)
+		if config.MaxSessionsPerIP > 0 || kvSrc != nil {
+			// max-sessions-per-ip may come from the store later
+			sourceLimit = newSessionLimit(config.MaxSessionsPerIP)
 		}
-		if err := lis.SetWriteBuffer(config.SockBuf); err != nil {
-			log.Println("SetWriteBuffer:", err)
+		replays = generic.NewReplayGuard(pass, time.Duration(config.ClockSkew)*time.Second)
+		if !config.NoResume {
+			if tokens, err = generic.NewTokenIssuer(24 * time.Hour); err != nil {
+				log.Println("resumption tokens disabled:", err)
+			}
+		}
+		if config.Quota > 0 || config.Clients != "" {
+			// the clients' quotas are set as the file loads
+			if quotas, err = newQuotaBook(&config); err != nil {
+				return generic.Fatal(generic.ExitConfig, err)
+			}
+		}
+		if config.Clients != "" {
+			clients, err = loadClients(config.Clients)
+			if err != nil {
+				return generic.Fatal(generic.ExitConfig, err)
+			}
+		}
+		if kvSrc != nil {
+			dynamic = &dynamicConfig{}
+			go watchKV(kvSrc, &config)
+		}
+		kx, err = newKeyExchange(&config)
+		if err != nil {
+			return generic.Fatal(generic.ExitConfig, err)
+		}
+		if kx.Noise != nil {
+			log.Println("noise public key:", kx.Noise.PublicString(), "pin:", generic.KeyPin(kx.Noise.Public[:]))
+		}
+		if kx.TLS != nil && config.TLSCert != "" {
+			pin, err := generic.TLSPin(kx.TLS)
+			if err != nil {
+				return generic.Fatal(generic.ExitConfig, err)
+			}
+			log.Println("tls certificate pin:", pin)
+		}
+		if config.HealthCheck != "" && config.HealthCheck != "none" && generic.TunnelKind(config.Tun, config.Tap) == "" {
+			health = newHealthChecker(config.HealthCheck, time.Duration(config.HealthInterval)*time.Second, time.Duration(config.DialTimeout)*time.Second)
+			// probed from the start, the clients' targets from their first stream
+			for _, backend := range backends(config.Target) {
+				health.up(backend)
+			}
+			if config.Standby != "" {
+				health.up(config.Standby)
+			}
+		}
+		if config.Pool > 0 && !strings.HasPrefix(config.Target, execPrefix) && generic.TunnelKind(config.Tun, config.Tap) == "" {
+			pool = newTargetPool(config.Pool, time.Duration(config.PoolIdle)*time.Second, time.Duration(config.DialTimeout)*time.Second, generic.NewTCPOptions(config.TCPNoDelay, config.TCPKeepAlive, config.TCPLinger))
+			for _, backend := range backends(config.Target) {
+				pool.warm(generic.SplitNetwork(backend))
+			}
+		}
+		if config.AuditLog != "" {
+			audit, err = generic.OpenAuditLog(config.AuditLog)
+			if err != nil {
+				return generic.Fatal(generic.ExitBind, err)
+			}
+		}
+		if config.Tun != "" {
+			mtu := generic.TunMTU(config.MTU - packetOverhead(&config))
+			dev, name, err := generic.OpenTun(config.Tun, mtu)
+			if err != nil {
+				return generic.Fatal(generic.ExitBind, err)
+			}
+			log.Println("tun:", name, "mtu:", mtu)
+			tunRelay = generic.NewPacketRelay(dev, nil)
+		} else if config.Tap != "" {
+			filter, err := generic.ParseFrameFilter(config.TapFilter)
+			if err != nil {
+				return generic.Fatal(generic.ExitConfig, err)
+			}
+			mtu := generic.TapMTU(config.MTU - packetOverhead(&config))
+			dev, name, err := generic.OpenTap(config.Tap, mtu)
+			if err != nil {
+				return generic.Fatal(generic.ExitBind, err)
+			}
+			log.Println("tap:", name, "mtu:", mtu)
+			tunRelay = generic.NewPacketRelay(dev, filter)
+		}
+		if config.PortMap {
+			go generic.KeepPortsMapped(ports)
 		}
-
-		go snmpLogger(config.SnmpLog, config.SnmpPeriod)
 		if config.Pprof {
 			go http.ListenAndServe(":6060", nil)
 		}
 
-		for {
-			if conn, err := lis.AcceptKCP(); err == nil {
-				log.Println("remote address:", conn.RemoteAddr())
-				conn.SetStreamMode(true)
-				conn.SetWriteDelay(true)
-				conn.SetNoDelay(config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
-				conn.SetMtu(config.MTU)
-				conn.SetWindowSize(config.SndWnd, config.RcvWnd)
-				conn.SetACKNoDelay(config.AckNodelay)
-
-				if config.NoComp {
-					go handleMux(conn, &config)
-				} else {
-					go handleMux(newCompStream(conn), &config)
-				}
-			} else {
-				log.Printf("%+v", err)
+		// tcp and websocket carriers for networks blocking UDP
+		if config.TCP || config.WSListen != "" {
+			carrier := generic.NewCarrierConn(lis.Addr())
+			carrierLis, err := kcp.ServeConn(block, config.DataShard, config.ParityShard, carrier)
+			if err != nil {
+				return generic.Fatal(generic.ExitBind, err)
+			}
+			if config.TCP {
+				go func() {
+					generic.Exit(generic.ExitBind, generic.ListenTCPCarrier(carrier, udpaddr.String()))
+				}()
+			}
+			if config.WSListen != "" {
+				go func() {
+					generic.Exit(generic.ExitBind, generic.ListenWebSocket(carrier, config.WSListen, config.WSPath, config.TLSCert, config.TLSKey))
+				}()
+			}
+			go serve(carrierLis, &config)
+		}
+
+		// ICMP echo tunnels for networks passing nothing but ping
+		if config.ICMP {
+			icmpconn, err := generic.ListenICMP(host)
+			if err != nil {
+				return generic.Fatal(generic.ExitBind, err)
+			}
+			log.Println("icmp: the kernel answers the tunnel's echo requests too, silence it with: sysctl -w net.ipv4.icmp_echo_ignore_all=1")
+			icmplis, err := kcp.ServeConn(block, config.DataShard, config.ParityShard, icmpconn)
+			if err != nil {
+				return generic.Fatal(generic.ExitBind, err)
+			}
+			go serve(icmplis, &config)
+		}
+
+		// DNS tunnels for networks where only the resolver answers
+		if config.DNS != "" {
+			dnsconn, err := generic.ListenDNS(config.DNSListen, config.DNS)
+			if err != nil {
+				return generic.Fatal(generic.ExitBind, err)
+			}
+			dnslis, err := kcp.ServeConn(block, config.DataShard, config.ParityShard, dnsconn)
+			if err != nil {
+				return generic.Fatal(generic.ExitBind, err)
+			}
+			// answers carry less than UDP packets
+			dnsConfig := config
+			if dnsConfig.MTU > generic.DNSDownstreamMTU {
+				dnsConfig.MTU = generic.DNSDownstreamMTU
+			}
+			go serve(dnslis, &dnsConfig)
+		}
+
+		// QUIC in place of KCP, for comparison
+		if config.QUICListen != "" {
+			go func() {
+				generic.Exit(generic.ExitBind, serveQUIC(&config))
+			}()
+		}
+
+		// raw TCP segments for networks policing UDP
+		if config.FakeTCP != "" {
+			fakeconn, err := generic.ListenFakeTCP(config.FakeTCP)
+			if err != nil {
+				return generic.Fatal(generic.ExitBind, err)
+			}
+			log.Println(generic.FakeTCPNote(fakeconn.LocalAddr().(*net.TCPAddr).Port, ""))
+			fakelis, err := kcp.ServeConn(block, config.DataShard, config.ParityShard, fakeconn)
+			if err != nil {
+				return generic.Fatal(generic.ExitBind, err)
+			}
+			go serve(fakelis, &config)
+		}
+
+		if webhook != nil || quotas != nil {
+			go shutdown()
+		}
+		if config.MDNS != "" {
+			if err := generic.AnnounceMDNS(config.MDNS, udpaddr.Port); err != nil {
+				return generic.Fatal(generic.ExitBind, err)
 			}
 		}
+		webhook.Post("up", "listening on "+config.Listen, map[string]interface{}{"listen": config.Listen, "target": config.Target})
+		for _, lis := range listeners[1:] {
+			go serve(lis, &config)
+		}
+		serve(lis, &config)
+		return nil
 	}
-	myApp.Run(os.Args)
+	return myApp
 }
 
-func snmpLogger(path string, interval int) {
-	if path == "" || interval == 0 {
-		return
+// handleSession runs the key exchange of --handshake and checks the
+// client's hello before multiplexing the session
+func handleSession(conn *kcp.UDPSession, config *Config) {
+	span := tracer.Start("session", nil)
+	span.SetAttr("net.peer.addr", conn.RemoteAddr().String())
+	defer span.End()
+	rec := &generic.AuditRecord{
+		Kind:   "session",
+		Opened: time.Now(),
+		Remote: conn.RemoteAddr().String(),
+		Conv:   conn.GetConv(),
 	}
-	ticker := time.NewTicker(time.Duration(interval) * time.Second)
-	defer ticker.Stop()
-	for {
-		select {
-		case <-ticker.C:
-			// split path into dirname and filename
-			logdir, logfile := filepath.Split(path)
-			// only format logfile
-			f, err := os.OpenFile(logdir+time.Now().Format(logfile), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-			if err != nil {
-				log.Println(err)
-				return
+	defer func() {
+		rec.Closed = time.Now()
+		audit.Record(rec)
+	}()
+	hs := tracer.Start("handshake", span)
+	var rconn net.Conn = conn
+	if min, max, _ := generic.ParseRecords(config.Records); min > 0 {
+		// each record goes out as it's written
+		conn.SetWriteDelay(false)
+		rconn = generic.NewRecordConn(conn, min, max)
+	}
+	sconn, err := kx.Run(rconn)
+	// tokens carry the keys and the client of the exchange over
+	var binding *generic.TokenBinding
+	if err == nil {
+		binding = generic.Bind(sconn)
+	}
+	if err == nil && clients != nil {
+		var client clientIdentity
+		if client, err = clients.identify(generic.PeerPin(sconn), conn); err == nil {
+			defer clients.untrack(conn)
+			log.Println(conn.RemoteAddr(), "client:", client.name)
+			rec.Client = client.name
+			span.SetAttr("client", client.name)
+			sconn = generic.NewRateLimitedConn(sconn, client.in, client.out)
+			if client.policy.Target != "" {
+				clientConfig := *config
+				clientConfig.Target = client.policy.Target
+				clientConfig.clientTarget = true
+				config = &clientConfig
 			}
-			w := csv.NewWriter(f)
-			// write header in empty file
-			if stat, err := f.Stat(); err == nil && stat.Size() == 0 {
-				if err := w.Write(append([]string{"Unix"}, kcp.DefaultSnmp.Header()...)); err != nil {
-					log.Println(err)
-				}
+		}
+	}
+	if err == nil {
+		sconn = quotas.conn(sconn, quotaNames(rec.Client))
+	}
+	// past --maxsessions the client is told the server is busy, so it
+	// refuses its connections rather than waiting on a session
+	busy := !acquireSession(config)
+	if !busy {
+		defer releaseSession()
+		// past --max-memory the session gets smaller windows, or none
+		sessConfig, reserved, ok := memory.reserve(config)
+		if !ok {
+			busy = true
+		} else {
+			defer memory.release(reserved)
+			if sessConfig != config {
+				log.Println(conn.RemoteAddr(), "max-memory: shrunk sndwnd", sessConfig.SndWnd, "rcvwnd", sessConfig.RcvWnd, "sockbuf", sessConfig.SockBuf)
+				conn.SetWindowSize(sessConfig.SndWnd, sessConfig.RcvWnd)
+				config = sessConfig
 			}
-			if err := w.Write(append([]string{fmt.Sprint(time.Now().Unix())}, kcp.DefaultSnmp.ToSlice()...)); err != nil {
-				log.Println(err)
+		}
+	}
+	var hconn net.Conn
+	var hello *generic.Hello
+	if err == nil {
+		hconn, hello, err = generic.ServerHello(sconn, newHello(config), time.Duration(config.HandshakeTimeout)*time.Second, tokens, replays, busy, binding)
+	}
+	if err == nil && busy {
+		// a client sending no hello can't be told
+		err = errors.Wrap(generic.ErrServerBusy, "hello")
+	}
+	if busy {
+		stats.Refuse()
+	}
+	hs.SetAttr("hello", hello != nil)
+	hs.SetError(err)
+	hs.End()
+	rec.Params = auditParams(config, hello)
+	if err != nil {
+		span.SetError(err)
+		rec.Reason = "handshake: " + err.Error()
+		log.Println(conn.RemoteAddr(), err)
+		// let the refusal reach the client
+		time.AfterFunc(time.Second, func() { conn.Close() })
+		return
+	}
+	if hello == nil && !config.Quiet {
+		log.Println(conn.RemoteAddr(), "client sent no hello")
+	}
+	if webhook != nil {
+		fields := map[string]interface{}{"remote": rec.Remote, "client": rec.Client, "conv": rec.Conv}
+		webhook.Post("session_established", "session from "+describeClient(rec), fields)
+		defer func() {
+			webhook.Post("session_lost", "session from "+describeClient(rec)+" ended: "+rec.Reason, fields)
+		}()
+	}
+	if hello != nil && hello.Recv != nil {
+		// the client told what its end of an asymmetric link takes, up
+		// to the server's own sndwnd, which the budget may have shrunk
+		conn.SetWindowSize(recvSndWnd(config, hello.Recv), config.RcvWnd)
+		if hello.Recv.Rate > 0 {
+			hconn = generic.NewRateLimitedConn(hconn, nil, generic.NewRateLimiter(hello.Recv.Rate*1000*1000/8))
+		}
+	}
+	if config.NoComp {
+		handleMux(hconn, conn, config, hello, span, rec)
+	} else {
+		handleMux(generic.NewCompStream(hconn), conn, config, hello, span, rec)
+	}
+}
+
+// describeClient names the client of a session record for the webhook
+func describeClient(rec *generic.AuditRecord) string {
+	if rec.Client != "" {
+		return rec.Remote + " (" + rec.Client + ")"
+	}
+	return rec.Remote
+}
+
+// recvSndWnd is the send window for a client that told its receive window
+// in recv, capped at config's sndwnd
+func recvSndWnd(config *Config, recv *generic.RecvParams) int {
+	if recv.RcvWnd <= 0 || recv.RcvWnd > config.SndWnd {
+		return config.SndWnd
+	}
+	return recv.RcvWnd
+}
+
+// auditParams are the parameters of a session for the audit log, the
+// client's hello ones where it sent one
+func auditParams(config *Config, hello *generic.Hello) map[string]interface{} {
+	params := map[string]interface{}{
+		"mtu":       config.MTU,
+		"sndwnd":    config.SndWnd,
+		"rcvwnd":    config.RcvWnd,
+		"nodelay":   config.NoDelay,
+		"interval":  config.Interval,
+		"resend":    config.Resend,
+		"nc":        config.NoCongestion,
+		"handshake": config.Handshake,
+	}
+	if hello == nil {
+		params["hello"] = false
+		return params
+	}
+	params["version"] = hello.Version
+	params["crypt"] = hello.Crypt
+	params["datashard"] = hello.DataShard
+	params["parityshard"] = hello.ParityShard
+	params["nocomp"] = hello.NoComp
+	params["streamcomp"] = hello.StreamComp
+	params["interactive"] = hello.Interactive
+	if hello.Tunnel != "" {
+		params["tunnel"] = hello.Tunnel
+	}
+	if hello.Recv != nil {
+		params["sndwnd"] = recvSndWnd(config, hello.Recv)
+		params["pacing"] = hello.Recv.Rate
+	}
+	return params
+}
+
+// serve accepts KCP sessions from lis and forwards their streams to the target
+func serve(lis *kcp.Listener, config *Config) {
+	overhead := packetOverhead(config)
+	for {
+		if conn, err := lis.AcceptKCP(); err == nil {
+			if !sourceLimit.acquire(conn.RemoteAddr()) {
+				// dropped quietly, a flood would flood the log too
+				stats.Refuse()
+				conn.Close()
+				continue
 			}
-			kcp.DefaultSnmp.Reset()
-			w.Flush()
-			f.Close()
+			log.Println("remote address:", conn.RemoteAddr())
+			conn.SetStreamMode(true)
+			conn.SetWriteDelay(true)
+			conn.SetNoDelay(config.NoDelay, config.Interval, config.Resend, config.NoCongestion)
+			conn.SetMtu(config.MTU - overhead)
+			conn.SetWindowSize(config.SndWnd, config.RcvWnd)
+			conn.SetACKNoDelay(config.AckNodelay)
+			go func() {
+				defer sourceLimit.release(conn.RemoteAddr())
+				handleSession(conn, config)
+			}()
+		} else {
+			log.Printf("%+v", err)
 		}
 	}
 }
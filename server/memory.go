@@ -0,0 +1,93 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+)
+
+// memory shares --max-memory among the sessions, nil without
+var memory *memoryBudget
+
+// memoryMinWnd is the least window, in packets, a session is shrunk to
+// before it's refused
+const memoryMinWnd = 32
+
+// memoryBudget counts the bytes the live sessions may buffer: their KCP
+// send and receive windows, full packets each, and the receive buffer smux
+// shares among their streams. On a 64MB router a few sessions at the
+// default windows take it all, the kernel's OOM killer then ends them all
+// at once. With a budget, the sessions arriving as it runs out get smaller
+// windows, and those which wouldn't fit even at memoryMinWnd are refused
+// as busy.
+type memoryBudget struct {
+	limit int64
+
+	mu   sync.Mutex
+	used int64
+}
+
+func newMemoryBudget(mb int) *memoryBudget {
+	return &memoryBudget{limit: int64(mb) * 1024 * 1024}
+}
+
+// sessionMemory is what a session with these windows and sockbuf buffers
+// at most
+func sessionMemory(sndwnd, rcvwnd, mtu, sockbuf int) int64 {
+	return int64(sndwnd+rcvwnd)*int64(mtu) + int64(sockbuf)
+}
+
+// reserve takes the memory of a session of config, shrinking its windows and
+// sockbuf alike to what's left of the budget. It returns the config the
+// session runs with and the bytes to release, and false when the budget is
+// too low for even the least windows.
+func (b *memoryBudget) reserve(config *Config) (*Config, int64, bool) {
+	if b == nil {
+		return config, 0, true
+	}
+	want := sessionMemory(config.SndWnd, config.RcvWnd, config.MTU, config.SockBuf)
+	least := config.SndWnd
+	if config.RcvWnd < least {
+		least = config.RcvWnd
+	}
+	min := want
+	if least > memoryMinWnd {
+		min = want * memoryMinWnd / int64(least)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	free := b.limit - b.used
+	if free < min {
+		return nil, 0, false
+	}
+	if want <= free {
+		b.used += want
+		return config, want, true
+	}
+	shrunk := *config
+	shrunk.SndWnd = int(int64(config.SndWnd) * free / want)
+	shrunk.RcvWnd = int(int64(config.RcvWnd) * free / want)
+	shrunk.SockBuf = int(int64(config.SockBuf) * free / want)
+	got := sessionMemory(shrunk.SndWnd, shrunk.RcvWnd, shrunk.MTU, shrunk.SockBuf)
+	b.used += got
+	return &shrunk, got, true
+}
+
+// release gives back the memory of a session done
+func (b *memoryBudget) release(n int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+}
+
+// dump describes the budget for the SIGUSR1 snapshot
+func (b *memoryBudget) dump() []string {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return []string{fmt.Sprintf("max-memory: %v of %v bytes reserved", b.used, b.limit)}
+}
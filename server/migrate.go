@@ -0,0 +1,71 @@
+package server
+
+import (
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/generic"
+	"github.com/xtaci/smux"
+)
+
+// migrateKey names a logical stream: the ids are random, and only those of
+// the same client, by its name with --clients, can move a stream over
+type migrateKey struct {
+	client string
+	id     uint64
+}
+
+// migrating are the logical streams of the sessions running with Migrate,
+// for the clients to move them over to new sessions. A new id is reserved
+// with nil until its stream runs.
+var migrating = struct {
+	sync.Mutex
+	m map[migrateKey]*generic.MigrateStream
+}{m: make(map[migrateKey]*generic.MigrateStream)}
+
+// addMigrating records the logical stream id of client, reserved by
+// acceptMigrate, and forgets those done since
+func addMigrating(client string, id uint64, s *generic.MigrateStream) {
+	migrating.Lock()
+	defer migrating.Unlock()
+	for key, s := range migrating.m {
+		if s != nil && s.Done() {
+			delete(migrating.m, key)
+		}
+	}
+	migrating.m[migrateKey{client, id}] = s
+}
+
+// acceptMigrate reads the header of p1, a stream of mux from client over
+// raddr, and moves the logical stream it names over to p1. It returns the
+// id of a new logical stream, reserved for it, and whether p1 opens one.
+func acceptMigrate(mux *smux.Session, client string, raddr net.Addr, p1 io.ReadWriteCloser) (uint64, bool, error) {
+	resume, id, received, err := generic.ReadMigrateHeader(p1)
+	if err != nil {
+		return 0, false, err
+	}
+	key := migrateKey{client, id}
+	migrating.Lock()
+	s, live := migrating.m[key]
+	if !resume && !live {
+		migrating.m[key] = nil
+	}
+	migrating.Unlock()
+	if !resume {
+		if live {
+			return 0, false, errors.Errorf("migrate: stream %x from %v already open", id, raddr)
+		}
+		return id, true, nil
+	}
+	if s == nil || s.Done() {
+		return 0, false, errors.Errorf("migrate: unknown stream %x from %v", id, raddr)
+	}
+	if err := s.Resume(p1, func() bool { return !mux.IsClosed() }, received); err != nil {
+		return 0, false, err
+	}
+	log.Printf("migrate: stream %x moved to %v", id, raddr)
+	return 0, false, nil
+}
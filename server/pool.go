@@ -0,0 +1,189 @@
+package server
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xtaci/kcptun/generic"
+)
+
+// targetPool keeps connections to the targets dialed ahead of the streams,
+// so that a new stream doesn't wait for the target's handshake, e.g. over
+// another slow hop. A nil targetPool pools nothing.
+type targetPool struct {
+	size    int           // connections kept per target
+	idle    time.Duration // recycled after, before the target gives up on them
+	timeout time.Duration // of a dial
+	options *generic.TCPOptions
+
+	mu      sync.Mutex
+	targets map[string][]*pooledConn // by network and address
+	kick    chan struct{}
+}
+
+// pooledConn is a connection waiting in the pool, with the bytes the
+// target sent first, e.g. an SSH banner, read by the health checks
+type pooledConn struct {
+	net.Conn
+	dialed time.Time
+	buf    []byte
+}
+
+func (c *pooledConn) Read(p []byte) (int, error) {
+	if len(c.buf) > 0 {
+		n := copy(p, c.buf)
+		c.buf = c.buf[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// CloseWrite passes a half close on to the target
+func (c *pooledConn) CloseWrite() error {
+	return generic.CloseWrite(c.Conn)
+}
+
+// poolMaxBuffered bounds what a pooled connection may receive before use
+const poolMaxBuffered = 4096
+
+// alive checks that the target didn't close c, keeping what it sent
+func (c *pooledConn) alive() bool {
+	var b [512]byte
+	c.Conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	defer c.Conn.SetReadDeadline(time.Time{})
+	for {
+		n, err := c.Conn.Read(b[:])
+		c.buf = append(c.buf, b[:n]...)
+		if len(c.buf) > poolMaxBuffered {
+			return false
+		}
+		if err != nil {
+			ne, ok := err.(net.Error)
+			return ok && ne.Timeout()
+		}
+	}
+}
+
+// pool keeps --pool connections to the targets, nil without
+var pool *targetPool
+
+func newTargetPool(size int, idle, timeout time.Duration, options *generic.TCPOptions) *targetPool {
+	p := &targetPool{
+		size:    size,
+		idle:    idle,
+		timeout: timeout,
+		options: options,
+		targets: make(map[string][]*pooledConn),
+		kick:    make(chan struct{}, 1),
+	}
+	go p.loop()
+	return p
+}
+
+// poolKey identifies a target
+func poolKey(network, address string) string {
+	return network + ":" + address
+}
+
+// get takes a connection to address, nil if there is none ready. The
+// target is pooled from then on.
+func (p *targetPool) get(network, address string) net.Conn {
+	if p == nil {
+		return nil
+	}
+	key := poolKey(network, address)
+	p.mu.Lock()
+	conns, known := p.targets[key]
+	var conn net.Conn
+	for len(conns) > 0 && conn == nil {
+		c := conns[0]
+		conns = conns[1:]
+		if time.Since(c.dialed) < p.idle && c.alive() {
+			conn = c
+		} else {
+			c.Close()
+		}
+	}
+	p.targets[key] = conns
+	p.mu.Unlock()
+
+	if !known || len(conns) < p.size {
+		p.refill()
+	}
+	return conn
+}
+
+// warm starts pooling connections to address ahead of the first stream
+func (p *targetPool) warm(network, address string) {
+	key := poolKey(network, address)
+	p.mu.Lock()
+	if _, ok := p.targets[key]; !ok {
+		p.targets[key] = nil
+	}
+	p.mu.Unlock()
+	p.refill()
+}
+
+// refill wakes the loop up
+func (p *targetPool) refill() {
+	select {
+	case p.kick <- struct{}{}:
+	default:
+	}
+}
+
+// loop refills the pool every second or when kicked, and recycles the
+// connections closed by the target or idle for too long
+func (p *targetPool) loop() {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-p.kick:
+		}
+		p.mu.Lock()
+		keys := make([]string, 0, len(p.targets))
+		for key, conns := range p.targets {
+			keys = append(keys, key)
+			live := conns[:0]
+			for _, c := range conns {
+				if time.Since(c.dialed) < p.idle && c.alive() {
+					live = append(live, c)
+				} else {
+					c.Close()
+				}
+			}
+			p.targets[key] = live
+		}
+		p.mu.Unlock()
+
+		for _, key := range keys {
+			p.fill(key)
+		}
+	}
+}
+
+// fill dials the connections missing to the target of key
+func (p *targetPool) fill(key string) {
+	p.mu.Lock()
+	missing := p.size - len(p.targets[key])
+	p.mu.Unlock()
+	parts := strings.SplitN(key, ":", 2)
+	for ; missing > 0; missing-- {
+		conn, err := dnsCache.Dial(parts[0], parts[1], p.timeout)
+		if err != nil {
+			log.Println("pool:", err)
+			return
+		}
+		if err := p.options.Apply(conn); err != nil {
+			log.Println("tcp options:", err)
+		}
+		p.mu.Lock()
+		p.targets[key] = append(p.targets[key], &pooledConn{Conn: conn, dialed: time.Now()})
+		p.mu.Unlock()
+	}
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"crypto/hmac"
+	"io"
+	"log"
+	"time"
+
+	quic "github.com/lucas-clemente/quic-go"
+	"github.com/xtaci/kcptun/generic"
+)
+
+// serveQUIC accepts QUIC sessions on config.QUICListen, every stream is
+// forwarded to the target like a smux stream would be
+func serveQUIC(config *Config) error {
+	pass := generic.DeriveKey(config.Key)
+	tlsConfig, err := generic.NewQUICServerTLS(pass)
+	if err != nil {
+		return err
+	}
+	lis, err := quic.ListenAddr(config.QUICListen, tlsConfig, generic.NewQUICConfig(config.SockBuf, config.KeepAlive))
+	if err != nil {
+		return err
+	}
+	log.Println("quic listening on:", lis.Addr())
+
+	token := generic.QUICAuthToken(pass)
+	for {
+		sess, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+		log.Println("remote address:", sess.RemoteAddr())
+		go handleQUICSession(sess, token, config)
+	}
+}
+
+func handleQUICSession(sess quic.Session, token []byte, config *Config) {
+	defer sess.Close(nil)
+	for {
+		p1, err := sess.AcceptStream()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		// every stream opens with the client's auth token
+		auth := make([]byte, generic.QUICAuthSize)
+		p1.SetDeadline(time.Now().Add(10 * time.Second))
+		if _, err := io.ReadFull(p1, auth); err != nil || !hmac.Equal(auth, token) {
+			log.Println("quic: stream auth failed from", sess.RemoteAddr())
+			p1.Close()
+			continue
+		}
+		p1.SetDeadline(time.Time{})
+
+		streamConfig := dynamic.apply(config)
+		target, err := pickTarget(streamConfig, stickyKey("", sess.RemoteAddr()))
+		if err != nil {
+			log.Println(err)
+			p1.Close()
+			continue
+		}
+		go handleStream(p1, target, streamConfig, nil, nil)
+	}
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xtaci/kcptun/generic"
+)
+
+// The transfer of the server, and of each client of --clients with a
+// quota, is metered against its quota over a day or a month. Past it, new
+// streams are refused, or everything slows to quotaTrickle.
+const (
+	quotaStop     = "stop"
+	quotaThrottle = "throttle"
+
+	quotaDay   = "day"
+	quotaMonth = "month"
+
+	// bytes per second past a quota with --quotaaction throttle, enough for
+	// messaging and ssh
+	quotaTrickle = 16 * 1024
+
+	// how often the state is written to --quotastate
+	quotaSaveInterval = time.Minute
+)
+
+// checkQuotaMode validates --quotaaction and --quotaperiod
+func checkQuotaMode(action, period string) error {
+	if action != quotaStop && action != quotaThrottle {
+		return errors.Errorf("quotaaction: unknown action %q, must be stop or throttle", action)
+	}
+	if period != quotaDay && period != quotaMonth {
+		return errors.Errorf("quotaperiod: unknown period %q, must be day or month", period)
+	}
+	return nil
+}
+
+// quotas meters the transfer with --quota or the quotas of --clients, nil
+// without
+var quotas *quotaBook
+
+// quotaState is what --quotastate keeps across restarts
+type quotaState struct {
+	Start time.Time         `json:"start"` // of the period
+	Used  map[string]uint64 `json:"used"`  // bytes by client name, "" for the server
+}
+
+// quotaBook meters the transfer by client name, "" for the whole server
+type quotaBook struct {
+	path   string
+	action string
+	period string
+
+	mu       sync.Mutex
+	state    quotaState
+	limits   map[string]uint64 // bytes by client name
+	trickles map[string]*generic.RateLimiter
+	dirty    bool
+}
+
+// newQuotaBook meters with config's quota, picking up the state of
+// --quotastate where it's of the current period
+func newQuotaBook(config *Config) (*quotaBook, error) {
+	b := &quotaBook{
+		path:     config.QuotaState,
+		action:   config.QuotaAction,
+		period:   config.QuotaPeriod,
+		limits:   make(map[string]uint64),
+		trickles: make(map[string]*generic.RateLimiter),
+	}
+	b.state = quotaState{Start: b.periodStart(time.Now()), Used: make(map[string]uint64)}
+	if config.Quota > 0 {
+		b.limits[""] = gigabytes(config.Quota)
+	}
+	if b.path != "" {
+		data, err := ioutil.ReadFile(b.path)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, errors.Wrap(err, "quotastate")
+		default:
+			var state quotaState
+			if err := json.Unmarshal(data, &state); err != nil {
+				return nil, errors.Wrap(err, "quotastate")
+			}
+			if state.Used != nil && state.Start.Equal(b.state.Start) {
+				b.state = state
+			}
+		}
+	}
+	go b.run()
+	return b, nil
+}
+
+func gigabytes(gb int) uint64 {
+	return uint64(gb) * 1000 * 1000 * 1000
+}
+
+// periodStart returns the start of the period of now, local time
+func (b *quotaBook) periodStart(now time.Time) time.Time {
+	y, m, d := now.Date()
+	if b.period == quotaMonth {
+		d = 1
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+}
+
+// quotaLabel names the quota of client in the log
+func quotaLabel(client string) string {
+	if client == "" {
+		return "server"
+	}
+	return "client " + client
+}
+
+// quotaNames are the quotas a session of client counts against
+func quotaNames(client string) []string {
+	if client == "" {
+		return []string{""}
+	}
+	return []string{"", client}
+}
+
+// setLimit sets the quota of client in GB, 0 for none
+func (b *quotaBook) setLimit(client string, gb int) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if gb > 0 {
+		b.limits[client] = gigabytes(gb)
+	} else {
+		delete(b.limits, client)
+	}
+}
+
+// rollover starts a new period when now is past the current one, called
+// with b.mu held
+func (b *quotaBook) rollover(now time.Time) {
+	if start := b.periodStart(now); !start.Equal(b.state.Start) {
+		b.state = quotaState{Start: start, Used: make(map[string]uint64)}
+		b.dirty = true
+		log.Println("quota: new period from", start.Format("2006-01-02"))
+	}
+}
+
+// add counts n bytes against names
+func (b *quotaBook) add(names []string, n int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, name := range names {
+		used := b.state.Used[name]
+		b.state.Used[name] = used + uint64(n)
+		if limit, ok := b.limits[name]; ok && used < limit && used+uint64(n) >= limit {
+			log.Printf("quota: %v exceeded %v bytes, %v from now on", quotaLabel(name), limit, b.action)
+			webhook.Post("quota_exceeded", fmt.Sprintf("quota of the %v exceeded, %v from now on", quotaLabel(name), b.action),
+				map[string]interface{}{"client": name, "limit_bytes": limit, "action": b.action})
+			go b.save()
+		}
+	}
+	b.dirty = true
+}
+
+// exceeded returns the first of names past its quota, ok false for none
+func (b *quotaBook) exceeded(names []string) (name string, ok bool) {
+	if b == nil {
+		return "", false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, name := range names {
+		if limit, ok := b.limits[name]; ok && b.state.Used[name] >= limit {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// trickle returns the limiter of name past its quota
+func (b *quotaBook) trickle(name string) *generic.RateLimiter {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	l, ok := b.trickles[name]
+	if !ok {
+		l = generic.NewRateLimiter(quotaTrickle)
+		b.trickles[name] = l
+	}
+	return l
+}
+
+// wait slows down the transfer past the quota of names, with throttle
+func (b *quotaBook) wait(names []string, n int) {
+	if b.action != quotaThrottle {
+		return
+	}
+	if name, ok := b.exceeded(names); ok {
+		b.trickle(name).Wait(n)
+	}
+}
+
+// run rolls over the periods and saves the state
+func (b *quotaBook) run() {
+	ticker := time.NewTicker(quotaSaveInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		b.mu.Lock()
+		b.rollover(now)
+		b.mu.Unlock()
+		b.save()
+	}
+}
+
+// save writes the state to --quotastate when it changed
+func (b *quotaBook) save() {
+	if b.path == "" {
+		return
+	}
+	b.mu.Lock()
+	if !b.dirty {
+		b.mu.Unlock()
+		return
+	}
+	data, err := json.Marshal(b.state)
+	b.dirty = false
+	b.mu.Unlock()
+	if err != nil {
+		log.Println("quotastate:", err)
+		return
+	}
+	// replaced whole, a crash mid-write keeps the previous state
+	tmp := b.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		log.Println("quotastate:", err)
+		return
+	}
+	if err := os.Rename(tmp, b.path); err != nil {
+		log.Println("quotastate:", err)
+	}
+}
+
+// dump describes the quotas for the SIGUSR1 snapshot
+func (b *quotaBook) dump() []string {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var lines []string
+	for name, limit := range b.limits {
+		lines = append(lines, fmt.Sprintf("quota %v: %v of %v bytes since %v", quotaLabel(name), b.state.Used[name], limit, b.state.Start.Format("2006-01-02")))
+	}
+	return lines
+}
+
+// quotaConn meters the bytes of a session against its quotas
+type quotaConn struct {
+	net.Conn
+	book  *quotaBook
+	names []string
+}
+
+// conn meters the bytes read from and written to conn against names
+func (b *quotaBook) conn(conn net.Conn, names []string) net.Conn {
+	if b == nil {
+		return conn
+	}
+	return &quotaConn{conn, b, names}
+}
+
+func (c *quotaConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.book.add(c.names, n)
+	c.book.wait(c.names, n)
+	return n, err
+}
+
+func (c *quotaConn) Write(p []byte) (int, error) {
+	c.book.wait(c.names, len(p))
+	n, err := c.Conn.Write(p)
+	c.book.add(c.names, n)
+	return n, err
+}
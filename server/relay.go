@@ -0,0 +1,167 @@
+package server
+
+import (
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"github.com/xtaci/kcptun/generic"
+)
+
+// A relay sits between clients and a server, e.g. in-country in front of a
+// server abroad. It forwards the UDP packets as they are, still encrypted,
+// from a socket of its own per client, so it needs no key and the crypto
+// only terminates at the ends. Relays can be chained.
+var relayCommand = cli.Command{
+	Name:  "relay",
+	Usage: "forward the packets of clients to a next hop server or relay, without decrypting them",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "listen,l",
+			Value:  ":29900",
+			Usage:  "relay listen address",
+			EnvVar: "KCPTUN_RELAY_LISTEN",
+		},
+		cli.StringFlag{
+			Name:   "next,n",
+			Value:  "",
+			Usage:  "address of the next hop, a kcptun server or another relay",
+			EnvVar: "KCPTUN_RELAY_NEXT",
+		},
+		cli.IntFlag{
+			Name:   "timeout",
+			Value:  180,
+			Usage:  "seconds of silence before a client's forwarding socket is released",
+			EnvVar: "KCPTUN_RELAY_TIMEOUT",
+		},
+		cli.IntFlag{
+			Name:   "sockbuf",
+			Value:  4194304,
+			Usage:  "socket buffer size in bytes",
+			EnvVar: "KCPTUN_RELAY_SOCKBUF",
+		},
+	},
+	Action: relay,
+}
+
+// relayPeer is a client and its socket towards the next hop
+type relayPeer struct {
+	addr     net.Addr
+	upstream *net.UDPConn
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+func (p *relayPeer) touch() {
+	p.mu.Lock()
+	p.last = time.Now()
+	p.mu.Unlock()
+}
+
+func (p *relayPeer) idle() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return time.Since(p.last)
+}
+
+func relay(c *cli.Context) error {
+	if c.String("next") == "" {
+		return generic.Fatal(generic.ExitConfig, errors.New("relay: --next is required"))
+	}
+	next, err := net.ResolveUDPAddr("udp", c.String("next"))
+	if err != nil {
+		return generic.Fatal(generic.ExitConfig, errors.Wrap(err, "relay"))
+	}
+	laddr, err := net.ResolveUDPAddr("udp", c.String("listen"))
+	if err != nil {
+		return generic.Fatal(generic.ExitConfig, errors.Wrap(err, "relay"))
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return generic.Fatal(generic.ExitBind, errors.Wrap(err, "relay"))
+	}
+	sockbuf := c.Int("sockbuf")
+	conn.SetReadBuffer(sockbuf)
+	conn.SetWriteBuffer(sockbuf)
+	timeout := time.Duration(c.Int("timeout")) * time.Second
+	log.Println("relaying:", conn.LocalAddr(), "->", next)
+
+	var mu sync.Mutex
+	peers := make(map[string]*relayPeer)
+	// release closes the socket of peer and forgets it, so that its next
+	// packet gets a new one
+	release := func(key string, peer *relayPeer) {
+		mu.Lock()
+		if peers[key] == peer {
+			delete(peers, key)
+		}
+		mu.Unlock()
+		peer.upstream.Close()
+	}
+
+	// release the sockets of silent clients
+	go func() {
+		for range time.Tick(timeout / 4) {
+			mu.Lock()
+			for key, peer := range peers {
+				if peer.idle() > timeout {
+					peer.upstream.Close()
+					delete(peers, key)
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		peer, ok := peers[addr.String()]
+		if !ok {
+			upstream, err := net.DialUDP("udp", nil, next)
+			if err != nil {
+				mu.Unlock()
+				log.Println("relay:", err)
+				continue
+			}
+			upstream.SetReadBuffer(sockbuf)
+			upstream.SetWriteBuffer(sockbuf)
+			peer = &relayPeer{addr: addr, upstream: upstream}
+			peers[addr.String()] = peer
+			log.Println("relay: new client", addr, "via", upstream.LocalAddr())
+			go relayBack(conn, peer, func() { release(addr.String(), peer) })
+		}
+		mu.Unlock()
+		peer.touch()
+		peer.upstream.Write(buf[:n])
+	}
+}
+
+// relayBack forwards the next hop's packets to the peer until its socket is
+// released, or fails and is released with release
+func relayBack(conn *net.UDPConn, peer *relayPeer, release func()) {
+	buf := make([]byte, 65536)
+	for {
+		n, err := peer.upstream.Read(buf)
+		if err != nil {
+			// the next hop restarting answers with port unreachable for
+			// a while, the socket still works
+			if strings.Contains(err.Error(), "refused") {
+				continue
+			}
+			release()
+			return
+		}
+		peer.touch()
+		conn.WriteTo(buf[:n], peer.addr)
+	}
+}
@@ -1,29 +1,48 @@
 // +build linux darwin freebsd
 
-package main
+package server
 
 import (
 	"log"
 	"os"
 	"os/signal"
+	"sync/atomic"
 	"syscall"
 
 	kcp "github.com/xtaci/kcp-go"
 )
 
-func init() {
+// watchSignals handles the signals of the server once it runs, not as the
+// combined binary starts: the client and the server take SIGHUP apart
+func watchSignals() {
 	go sigHandler()
 }
 
 func sigHandler() {
 	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, syscall.SIGUSR1)
+	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGHUP)
 	signal.Ignore(syscall.SIGPIPE)
 
 	for {
 		switch <-ch {
 		case syscall.SIGUSR1:
 			log.Printf("KCP SNMP:%+v", kcp.DefaultSnmp.Copy())
+			log.Println("dial failures:", atomic.LoadUint64(&dialFailures))
+			for _, line := range stats.Dump() {
+				log.Println(line)
+			}
+			for _, line := range quotas.dump() {
+				log.Println(line)
+			}
+			for _, line := range memory.dump() {
+				log.Println(line)
+			}
+		case syscall.SIGHUP:
+			if clients != nil {
+				if err := clients.reload(); err != nil {
+					log.Println(err, "keeping the clients loaded")
+				}
+			}
 		}
 	}
 }
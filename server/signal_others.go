@@ -0,0 +1,5 @@
+// +build !linux,!darwin,!freebsd
+
+package server
+
+func watchSignals() {}
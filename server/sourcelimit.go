@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net"
+	"sync"
+)
+
+// sourceLimit caps the live sessions of each source address with
+// --max-sessions-per-ip, nil without
+var sourceLimit *sessionLimit
+
+// sessionLimit counts the live sessions of each source IP
+type sessionLimit struct {
+	mu       sync.Mutex
+	max      int // 0 for unlimited
+	sessions map[string]int
+}
+
+func newSessionLimit(max int) *sessionLimit {
+	return &sessionLimit{max: max, sessions: make(map[string]int)}
+}
+
+// sourceIP is the IP of addr, the whole address where it has none
+func sourceIP(addr net.Addr) string {
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
+
+// acquire counts a new session from addr, unless its source is at the limit
+func (l *sessionLimit) acquire(addr net.Addr) bool {
+	if l == nil {
+		return true
+	}
+	ip := sourceIP(addr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.max > 0 && l.sessions[ip] >= l.max {
+		return false
+	}
+	l.sessions[ip]++
+	return true
+}
+
+// setMax changes the limit of the sessions to come, 0 for unlimited
+func (l *sessionLimit) setMax(max int) {
+	l.mu.Lock()
+	l.max = max
+	l.mu.Unlock()
+}
+
+// release uncounts a session from addr once it's over
+func (l *sessionLimit) release(addr net.Addr) {
+	if l == nil {
+		return
+	}
+	ip := sourceIP(addr)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.sessions[ip]--; l.sessions[ip] <= 0 {
+		delete(l.sessions, ip)
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// reasonMaxLife is the audit reason of the streams closed by --streamlife
+const reasonMaxLife = "max lifetime"
+
+// limitLife closes stream, named desc in the log, once it lived
+// --streamlife seconds, with a warning --streamlifewarn seconds ahead. The
+// returned stop cancels it, and tells whether the stream was closed for its
+// age.
+func limitLife(stream io.Closer, desc string, config *Config) (stop func() bool) {
+	if config.StreamLife <= 0 {
+		return func() bool { return false }
+	}
+	life := time.Duration(config.StreamLife) * time.Second
+	warn := time.Duration(config.StreamLifeWarn) * time.Second
+	if warn > life {
+		warn = life
+	}
+	var expired int32
+	var warning *time.Timer
+	if warn > 0 {
+		warning = time.AfterFunc(life-warn, func() {
+			log.Println(desc, "reaches its maximum lifetime of", life, "in", warn)
+		})
+	}
+	closing := time.AfterFunc(life, func() {
+		atomic.StoreInt32(&expired, 1)
+		log.Println(desc, "closed at its maximum lifetime of", life)
+		stream.Close()
+	})
+	return func() bool {
+		if warning != nil {
+			warning.Stop()
+		}
+		closing.Stop()
+		return atomic.LoadInt32(&expired) == 1
+	}
+}